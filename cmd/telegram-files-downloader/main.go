@@ -0,0 +1,9 @@
+// Command telegram-files-downloader is a Telegram bot that downloads the files
+// sent to it, see the README.
+package main
+
+import "github.com/clisboa/telegram-files-downloader/downloader"
+
+func main() {
+	downloader.Main()
+}
@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// chatWhitelist skips updates from chats not in the configured list. Unlike
+// middleware.Whitelist, which matches the sender, it matches the chat, so
+// group chats can be whitelisted too. An empty list allows every chat.
+func chatWhitelist(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		chats := botCfgFor(c).ChatIDs
+		if len(chats) == 0 {
+			return next(c)
+		}
+		if c.Chat() == nil {
+			return nil
+		}
+		if _, ok := cfg().channel(c.Chat().ID); ok {
+			return next(c)
+		}
+		for _, id := range chats {
+			if id == c.Chat().ID {
+				return next(c)
+			}
+		}
+		if m := c.Message(); cfg().ApprovalChatID != 0 && m != nil && m.Document != nil &&
+			(m.LastEdit == 0 || !sameFile(c, &m.Document.File)) {
+			return requestApproval(c)
+		}
+		debugf("Ignoring update from chat %d", c.Chat().ID)
+		return nil
+	}
+}
+
+type userList struct {
+	ids       map[int64]bool
+	usernames map[string]bool
+}
+
+func parseUserList(s string) userList {
+	l := userList{ids: map[int64]bool{}, usernames: map[string]bool{}}
+	for _, u := range strings.Split(s, ",") {
+		u = strings.TrimSpace(u)
+		if u == "" {
+			continue
+		}
+		if id, err := strconv.ParseInt(u, 10, 64); err == nil {
+			l.ids[id] = true
+			continue
+		}
+		l.usernames[strings.ToLower(strings.TrimPrefix(u, "@"))] = true
+	}
+	return l
+}
+
+func (l userList) Empty() bool {
+	return len(l.ids) == 0 && len(l.usernames) == 0
+}
+
+func (l userList) String() string {
+	items := make([]string, 0, len(l.ids)+len(l.usernames))
+	for id := range l.ids {
+		items = append(items, strconv.FormatInt(id, 10))
+	}
+	for name := range l.usernames {
+		items = append(items, "@"+name)
+	}
+	sort.Strings(items)
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+func (l userList) Contains(u *tele.User) bool {
+	if u == nil {
+		return false
+	}
+	return l.ids[u.ID] || (u.Username != "" && l.usernames[strings.ToLower(u.Username)])
+}
+
+// userWhitelist skips updates from senders not in the configured list,
+// regardless of which (whitelisted) chat they were sent in. An empty list
+// allows every user.
+func userWhitelist(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		users := cfg().WhitelistedUsers
+		// Channel posts have no sender, the channel list decides about them.
+		if !users.Empty() && !users.Contains(c.Sender()) && !isChannelPost(c) {
+			if c.Sender() != nil {
+				debugf("Ignoring update from user %d (@%s)",
+					c.Sender().ID, c.Sender().Username)
+			}
+			return nil
+		}
+		return next(c)
+	}
+}
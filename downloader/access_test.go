@@ -0,0 +1,91 @@
+package downloader
+
+import (
+	"testing"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The whitelists let through the listed users in the listed chats only.
+func TestWhitelists(t *testing.T) {
+	tests := []struct {
+		name   string
+		users  string
+		chats  []int64
+		sender *tele.User
+		chat   int64
+		want   bool
+	}{
+		{name: "no whitelist", sender: testUser, chat: testChat, want: true},
+		{name: "user ID", users: "7", sender: testUser, chat: testChat, want: true},
+		{name: "username", users: "@Tester", sender: testUser, chat: testChat, want: true},
+		{name: "other user", users: "8,@someone", sender: testUser, chat: testChat},
+		{name: "chat", chats: []int64{testChat}, sender: testUser, chat: testChat, want: true},
+		{name: "other chat", chats: []int64{testChat}, sender: testUser, chat: testChat + 1},
+		{name: "user in other chat", users: "7", chats: []int64{testChat}, sender: testUser, chat: testChat + 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) {
+				c.WhitelistedUsers, c.WhitelistedChatIDs = parseUserList(tt.users), tt.chats
+				c.ApprovalChatID = 0
+			})
+			called := false
+			handler := userWhitelist(chatWhitelist(func(tele.Context) error {
+				called = true
+				return nil
+			}))
+			msg := newMessage()
+			msg.Sender, msg.Chat = tt.sender, &tele.Chat{ID: tt.chat, Type: tele.ChatGroup}
+			msg.Text = "/stats"
+			if err := handler(fakebot.New().Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			if called != tt.want {
+				t.Errorf("handled %v, want %v", called, tt.want)
+			}
+		})
+	}
+}
+
+// Commands need the permission of their role.
+func TestRoles(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles roles
+		perm  permission
+		want  bool
+	}{
+		{name: "no roles", perm: permAdmin, want: true},
+		{name: "admin", roles: roles{admins: parseUserList("7")}, perm: permAdmin, want: true},
+		{name: "admin uploads", roles: roles{admins: parseUserList("@tester")}, perm: permUpload, want: true},
+		{name: "uploader", roles: roles{uploaders: parseUserList("7")}, perm: permUpload, want: true},
+		{name: "uploader as admin", roles: roles{uploaders: parseUserList("7")}, perm: permAdmin},
+		{name: "viewer", roles: roles{viewers: parseUserList("7")}, perm: permView, want: true},
+		{name: "viewer uploads", roles: roles{viewers: parseUserList("7")}, perm: permUpload},
+		{name: "no role", roles: roles{admins: parseUserList("8")}, perm: permView},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) { c.Roles = tt.roles })
+			called := false
+			handler := requirePermission(tt.perm)(func(tele.Context) error {
+				called = true
+				return nil
+			})
+			b := fakebot.New()
+			msg := newMessage()
+			msg.Text = "/command"
+			if err := handler(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			if called != tt.want {
+				t.Errorf("handled %v, want %v", called, tt.want)
+			}
+			if !tt.want {
+				waitEvent(t, b, "reply", "Permission denied")
+			}
+		})
+	}
+}
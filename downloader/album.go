@@ -0,0 +1,100 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The items of every album (media group) sent to a whitelisted chat are
+// recorded in the state file by "<chat ID>:<media group ID>", so replying
+// /get to any of them downloads the whole album. Telegram only tells which
+// group a message belongs to, not what else is in it.
+const albumsBucket = "albums"
+
+type albumItem struct {
+	MessageID int    `json:"message_id"`
+	FileID    string `json:"file_id"`
+	UniqueID  string `json:"unique_id"`
+	Size      int64  `json:"size"`
+	Name      string `json:"name"`
+}
+
+func recordAlbumItem(m *tele.Message) {
+	if m.AlbumID == "" {
+		return
+	}
+	_, f, name := channelMedia(m)
+	if f == nil {
+		return
+	}
+	var items []albumItem
+	err := storage.Modify(albumsBucket, fmt.Sprintf("%d:%s", m.Chat.ID, m.AlbumID), &items, func() error {
+		// An edit can replace the file of an item.
+		item := albumItem{MessageID: m.ID, FileID: f.FileID, UniqueID: f.UniqueID, Size: f.FileSize, Name: name}
+		if i := slices.IndexFunc(items, func(i albumItem) bool { return i.MessageID == m.ID }); i >= 0 {
+			items[i] = item
+		} else {
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("Albums: %s", err.Error())
+	}
+}
+
+// handleOnMedia is for the attachments other than documents, downloaded
+// under a name made from the message ID unless they have one. Like documents,
+// the items of albums are also recorded for /get.
+func handleOnMedia(c tele.Context) error {
+	m := c.Message()
+	recordAlbumItem(m)
+	kind, f, name := channelMedia(m)
+	if f == nil {
+		log.Printf("Ignoring an attachment of an unknown type from %s", senderName(c.Sender()))
+		return nil
+	}
+	return requirePermission(permUpload)(maintenanceGuard(func(c tele.Context) error {
+		log.Printf("Downloading a %s from %s as %s", kind, senderName(c.Sender()), name)
+		return enqueueFile(c, f, name)
+	}))(c)
+}
+
+func handleGet(c tele.Context) error {
+	m := c.Message().ReplyTo
+	if m == nil {
+		return c.Reply(tr("Reply /get to a file or to an item of an album"))
+	}
+	var items []albumItem
+	if m.AlbumID != "" {
+		if _, err := storage.Get(albumsBucket, fmt.Sprintf("%d:%s", c.Chat().ID, m.AlbumID), &items); err != nil {
+			return err
+		}
+	}
+	if len(items) == 0 {
+		_, f, name := channelMedia(m)
+		if f == nil {
+			return c.Reply(tr("That message has no file"))
+		}
+		items = []albumItem{{MessageID: m.ID, FileID: f.FileID, UniqueID: f.UniqueID, Size: f.FileSize,
+			Name: name}}
+	}
+	slices.SortFunc(items, func(a, b albumItem) int { return a.MessageID - b.MessageID })
+
+	log.Printf("Get %d files for %s", len(items), senderName(c.Sender()))
+	for _, i := range items {
+		// Each file replies to its own message and counts for the user of /get.
+		ic := tele.NewContext(c.Bot(), tele.Update{Message: &tele.Message{ID: i.MessageID, Chat: c.Chat(),
+			Sender: c.Sender(), AlbumID: m.AlbumID}})
+		doc := &tele.Document{File: tele.File{FileID: i.FileID, UniqueID: i.UniqueID, FileSize: i.Size},
+			FileName: i.Name}
+		if err := enqueueDocument(ic, doc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package downloader
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"sync/atomic"
+	"time"
+)
+
+// The HTTP API lets other automation see and control downloads. Every
+// request needs "Authorization: Bearer <TELEGRAM_API_TOKEN>".
+
+type apiJob struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	Sender   string     `json:"sender"`
+	ChatID   int64      `json:"chat_id"`
+	State    jobState   `json:"state"`             // see jobState
+	Outcome  jobOutcome `json:"outcome,omitempty"` // done, failed, cancelled or skipped
+	Written  int64      `json:"written"`           // so far, or in all once finished
+	Result   string     `json:"result,omitempty"`
+	Thumb    bool       `json:"thumbnail"`
+	SHA256   string     `json:"sha256,omitempty"`
+	Enqueued time.Time  `json:"enqueued"`
+	StartAt  *time.Time `json:"start_at,omitempty"` // of a scheduled download
+	Finished *time.Time `json:"finished,omitempty"`
+	// When the job entered each of the states it went through.
+	States map[jobState]time.Time `json:"states"`
+}
+
+type apiStats struct {
+	Uptime     string            `json:"uptime"`
+	SinceReset string            `json:"since_reset"`
+	Ok         uint64            `json:"ok"`
+	Failed     uint64            `json:"failed"`
+	Pending    int64             `json:"pending"`
+	Queued     int64             `json:"queued"`
+	Active     int64             `json:"active"`
+	Paused     bool              `json:"paused"`
+	Failures   map[string]uint32 `json:"failures"`
+	Jobs       map[jobState]int  `json:"jobs"` // unfinished jobs by state
+	// Totals by outcome, rolling windows, per chat and per file type.
+	Stats statsSnapshot `json:"stats"`
+}
+
+func (j *job) apiJob() apiJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	a := apiJob{ID: j.id, Name: j.name, Path: j.path, Size: j.file.FileSize,
+		Sender: senderName(j.c.Sender()), ChatID: j.c.Chat().ID, State: j.state, Result: j.result,
+		Thumb: j.thumbnail() != nil, Enqueued: j.enqueued, States: maps.Clone(j.since)}
+	switch {
+	case j.state.final():
+		a.Outcome = j.outcome
+		a.SHA256 = j.sha256
+		a.Written = j.written
+		finished := j.finished
+		a.Finished = &finished
+	case j.progress != nil:
+		a.Written = j.progress.Written()
+	}
+	if !j.startAt.IsZero() && j.state == stateQueued {
+		startAt := j.startAt
+		a.StartAt = &startAt
+	}
+	return a
+}
+
+// listJobs returns the running (finished=false) or finished jobs, oldest first.
+func listJobs(finished bool) []apiJob {
+	jobs.Lock()
+	list := make([]*job, 0, len(jobs.m))
+	for _, j := range jobs.m {
+		list = append(list, j)
+	}
+	jobs.Unlock()
+
+	out := []apiJob{}
+	for _, j := range list {
+		if a := j.apiJob(); a.State.final() == finished {
+			out = append(out, a)
+		}
+	}
+	slices.SortFunc(out, func(a, b apiJob) int { return a.Enqueued.Compare(b.Enqueued) })
+	return out
+}
+
+func startAPI(addr string) *http.Server {
+	startThroughputSampler()
+	log.Println("API listening on:", addr)
+	return serveHTTP("api", addr, apiAuth(apiHandler()))
+}
+
+// serveHTTP serves handler on addr in the background and returns the server
+// for the Engine to shut down. Its requests end with rootContext, so that
+// event streams don't hold up the shutdown.
+func serveHTTP(name, addr string, handler http.Handler) *http.Server {
+	srv := &http.Server{Addr: addr, Handler: handler,
+		BaseContext: func(net.Listener) context.Context { return rootContext() }}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			errorf("%s: %s", name, err.Error())
+		}
+	}()
+	return srv
+}
+
+// apiHandler serves the API without authentication, shared with the dashboard.
+func apiHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/jobs", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, listJobs(false))
+	})
+	mux.HandleFunc("GET /api/history", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, listJobs(true))
+	})
+	mux.HandleFunc("GET /api/jobs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if j := apiLookup(w, r); j != nil {
+			writeJSON(w, http.StatusOK, j.apiJob())
+		}
+	})
+	mux.HandleFunc("POST /api/jobs/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if j := apiLookup(w, r); j != nil {
+			apiResult(w, j.Cancel("API"))
+		}
+	})
+	mux.HandleFunc("POST /api/jobs/{id}/retry", func(w http.ResponseWriter, r *http.Request) {
+		if j := apiLookup(w, r); j != nil {
+			apiResult(w, j.Retry("API"))
+		}
+	})
+	mux.HandleFunc("POST /api/pause", func(w http.ResponseWriter, r *http.Request) {
+		setPaused(true)
+		apiResult(w, nil)
+	})
+	mux.HandleFunc("POST /api/resume", func(w http.ResponseWriter, r *http.Request) {
+		setPaused(false)
+		apiResult(w, nil)
+	})
+	mux.HandleFunc("GET /api/stats", func(w http.ResponseWriter, r *http.Request) {
+		snap := snapshotStats()
+		s := apiStats{
+			Uptime:     time.Since(snap.Started).Round(time.Second).String(),
+			SinceReset: time.Since(snap.Reset).Round(time.Second).String(),
+			Ok:         snap.Total.Done,
+			Failed:     snap.Total.Failed,
+			Pending:    snap.Pending,
+			Queued:     snap.Queued,
+			Active:     snap.Active,
+			Paused:     isPaused(),
+			Failures:   map[string]uint32{},
+			Jobs:       map[jobState]int{},
+			Stats:      snap,
+		}
+		for _, j := range listJobs(false) {
+			s.Jobs[j.State]++
+		}
+		for kind := failureKind(0); kind < failureKinds; kind++ {
+			if n := atomic.LoadUint32(&failureCounts[kind]); n > 0 {
+				s.Failures[kind.String()] = n
+			}
+		}
+		writeJSON(w, http.StatusOK, s)
+	})
+	mux.HandleFunc("GET /api/throughput", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, throughputSamples())
+	})
+	mux.HandleFunc("GET /api/disk", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, diskUsage())
+	})
+	mux.HandleFunc("GET /api/jobs/{id}/thumbnail", func(w http.ResponseWriter, r *http.Request) {
+		if j := apiLookup(w, r); j != nil {
+			serveThumbnail(w, j)
+		}
+	})
+	mux.HandleFunc("GET /api/events", serveEvents)
+	return mux
+}
+
+// serveEvents streams job events as server-sent events until the client
+// goes away, e.g. curl -N -H "Authorization: Bearer $TOKEN" .../api/events
+func serveEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events, stop := subscribeEvents(r.Context())
+	defer stop()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(30 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				errorf("api: %s", err.Error())
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := cfg().APIToken
+		got := r.Header.Get("Authorization")
+		if token == "" || subtle.ConstantTimeCompare([]byte(got), []byte("Bearer "+token)) != 1 {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiLookup(w http.ResponseWriter, r *http.Request) *job {
+	jobs.Lock()
+	j, ok := jobs.m[r.PathValue("id")]
+	jobs.Unlock()
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "no such job"})
+		return nil
+	}
+	return j
+}
+
+func apiResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, map[string]string{"result": "ok"})
+	case errors.Is(err, errNotDownloading), errors.Is(err, errStillRunning), errors.Is(err, errMaintenance),
+		errors.Is(err, errOverQuota):
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, errRateLimited):
+		writeJSON(w, http.StatusTooManyRequests, map[string]string{"error": err.Error()})
+	default:
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		errorf("api: %s", err.Error())
+	}
+}
@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The API answers only requests with TELEGRAM_API_TOKEN, and none without
+// one configured.
+func TestAPIAuth(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		want   int
+	}{
+		{name: "token", token: "secret", header: "Bearer secret", want: http.StatusOK},
+		{name: "missing token", token: "secret", want: http.StatusUnauthorized},
+		{name: "wrong token", token: "secret", header: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "token without Bearer", token: "secret", header: "secret", want: http.StatusUnauthorized},
+		{name: "no token configured", header: "Bearer ", want: http.StatusUnauthorized},
+		{name: "no token at all", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) { c.APIToken = tt.token })
+			handler := apiAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest(http.MethodGet, "/api/jobs", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// POST /api/jobs/{id}/retry goes through the checks of a new download, and
+// starts one download however many retries arrive at once.
+func TestAPIRetry(t *testing.T) {
+	b := fakebot.New()
+	f := b.AddFile([]byte("retry"))
+	b.FailFile(f.FileID, errors.New("connection reset"))
+	msg := newMessage()
+	msg.Document = &tele.Document{File: *f, FileName: "retry.bin"}
+	wait := finished(t, "retry.bin")
+	if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+		t.Fatal(err)
+	}
+	id := wait().Job.ID
+	retry := func() int {
+		w := httptest.NewRecorder()
+		apiHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/api/jobs/"+id+"/retry", nil))
+		return w.Code
+	}
+
+	maintenance.Store(true)
+	code := retry()
+	maintenance.Store(false)
+	if code != http.StatusConflict {
+		t.Errorf("retry in maintenance: %d, want %d", code, http.StatusConflict)
+	}
+	withCfg(t, func(c *Cfg) { c.RateLimits = []rateLimit{{Bytes: 1, Window: time.Hour}} })
+	if code := retry(); code != http.StatusTooManyRequests {
+		t.Errorf("rate limited retry: %d, want %d", code, http.StatusTooManyRequests)
+	}
+	withCfg(t, func(c *Cfg) { c.RateLimits = nil })
+
+	wait = finished(t, "retry.bin")
+	codes := make([]int, 5)
+	var wg sync.WaitGroup
+	for i := range codes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes[i] = retry()
+		}()
+	}
+	wg.Wait()
+	ok := 0
+	for _, code := range codes {
+		if code == http.StatusOK {
+			ok++
+		}
+	}
+	if ok != 1 {
+		t.Errorf("concurrent retries answered %v, want one success", codes)
+	}
+	wait()
+}
@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+const approvalTimeout = 24 * time.Hour
+
+// approvalCooldown is how long a chat waits after its last approval request
+// before it can send the admin chat another one.
+const approvalCooldown = 10 * time.Minute
+
+type pendingApproval struct {
+	c       tele.Context
+	created time.Time
+}
+
+var approvals = struct {
+	sync.Mutex
+	next int
+	m    map[string]pendingApproval
+	// The time of the last request of each chat.
+	last map[int64]time.Time
+}{m: make(map[string]pendingApproval), last: make(map[int64]time.Time)}
+
+var (
+	btnApprove = tele.Btn{Unique: "approve"}
+	btnReject  = tele.Btn{Unique: "reject"}
+)
+
+func senderName(u *tele.User) string {
+	if u == nil {
+		return "unknown"
+	}
+	if u.Username != "" {
+		return fmt.Sprintf("@%s (%d)", u.Username, u.ID)
+	}
+	return fmt.Sprintf("%s %s (%d)", u.FirstName, u.LastName, u.ID)
+}
+
+// requestApproval asks the admin chat whether a document sent from a
+// non-whitelisted chat may be downloaded. A chat has at most one request
+// waiting, and sends the next one approvalCooldown after the last.
+func requestApproval(c tele.Context) error {
+	doc := c.Message().Document
+
+	approvals.Lock()
+	for id, p := range approvals.m {
+		if time.Since(p.created) > approvalTimeout {
+			delete(approvals.m, id)
+		}
+	}
+	for chat, t := range approvals.last {
+		if time.Since(t) > approvalCooldown {
+			delete(approvals.last, chat)
+		}
+	}
+	if _, ok := approvals.last[c.Chat().ID]; ok || pendingIn(c.Chat().ID) {
+		approvals.Unlock()
+		debugf("Ignoring document from chat %d: an approval request was sent less than %s ago",
+			c.Chat().ID, approvalCooldown)
+		return nil
+	}
+	approvals.last[c.Chat().ID] = time.Now()
+	approvals.next++
+	id := strconv.Itoa(approvals.next)
+	approvals.m[id] = pendingApproval{c: c, created: time.Now()}
+	approvals.Unlock()
+
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data(tr("Approve"), btnApprove.Unique, id),
+		markup.Data(tr("Reject"), btnReject.Unique, id),
+	))
+	msg := tr("User %s in chat %d wants to send file %s (%s). Approve?",
+		senderName(c.Sender()), c.Chat().ID, doc.FileName,
+		units.Format(doc.FileSize))
+	if _, err := apiOf(c).Send(tele.ChatID(cfg().ApprovalChatID), msg, markup); err != nil {
+		errorf("Approval request failed: %s", err.Error())
+		return err
+	}
+	log.Println(msg)
+	return c.Reply(tr("Waiting for admin approval"))
+}
+
+// pendingIn reports whether a request of the chat is waiting, with approvals
+// locked.
+func pendingIn(chatID int64) bool {
+	for _, p := range approvals.m {
+		if p.c.Chat().ID == chatID {
+			return true
+		}
+	}
+	return false
+}
+
+func takeApproval(c tele.Context) (pendingApproval, bool) {
+	approvals.Lock()
+	defer approvals.Unlock()
+	p, ok := approvals.m[c.Data()]
+	delete(approvals.m, c.Data())
+	if ok && time.Since(p.created) > approvalTimeout {
+		return p, false
+	}
+	return p, ok
+}
+
+func handleApprove(c tele.Context) error {
+	p, ok := takeApproval(c)
+	if !ok {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Request expired")})
+	}
+	log.Printf("Approved by %s: %s", senderName(c.Sender()), p.c.Message().Document.FileName)
+	c.Edit(c.Message().Text + "\n" + tr("Approved by %s", senderName(c.Sender())))
+	p.c.Reply(tr("Approved"))
+	if err := approvedDocument(p.c); err != nil {
+		return err
+	}
+	return c.Respond()
+}
+
+func handleReject(c tele.Context) error {
+	p, ok := takeApproval(c)
+	if !ok {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Request expired")})
+	}
+	log.Printf("Rejected by %s: %s", senderName(c.Sender()), p.c.Message().Document.FileName)
+	c.Edit(c.Message().Text + "\n" + tr("Rejected by %s", senderName(c.Sender())))
+	p.c.Reply(tr("Rejected"))
+	return c.Respond()
+}
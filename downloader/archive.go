@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+// backfillBucket records the messages whose files were archived by /backfill
+// or import, keyed by "<chat ID>:<message ID>", so they are stored only once.
+const backfillBucket = "backfill"
+
+// archiveMessage stores the file of a message in dir unless the message was
+// archived before or a file with the same name and size is already there. A
+// different file with the same name is stored as <message ID>_<name>. write
+// fills the temporary file; archiveMessage returns whether it stored the file.
+func archiveMessage(chatID int64, msgID int, fname string, size int64, dir string,
+	write func(tmp string) error) (bool, error) {
+	key := fmt.Sprintf("%d:%d", chatID, msgID)
+	fname = safeFilename(fname)
+	var stored string
+	if found, err := storage.Get(backfillBucket, key, &stored); err != nil || found {
+		return false, err
+	}
+
+	fpath := filepath.Join(dir, fname)
+	if fi, err := os.Stat(fpath); err == nil {
+		if fi.Size() == size {
+			return false, storage.Put(backfillBucket, key, fname)
+		}
+		fname = fmt.Sprintf("%d_%s", msgID, fname)
+		fpath = filepath.Join(dir, fname)
+	}
+
+	tmp := stagingPath(fpath, fmt.Sprintf("%d_%d", chatID, msgID))
+	trackPartial(tmp)
+	if err := write(tmp); err != nil {
+		os.Remove(tmp)
+		return false, err
+	}
+	if err := moveFile(tmp, fpath); err != nil {
+		return false, err
+	}
+	log.Printf("Archived %s (%s)", fname, units.Format(size))
+	return true, storage.Put(backfillBucket, key, fname)
+}
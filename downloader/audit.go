@@ -0,0 +1,106 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+const auditBucket = "audit"
+
+type auditEntry struct {
+	Time    time.Time
+	UserID  int64
+	User    string
+	ChatID  int64
+	Command string
+	Outcome string
+}
+
+func auditAction(c tele.Context) string {
+	if cb := c.Callback(); cb != nil {
+		return "button:" + strings.TrimPrefix(cb.Data, "\f")
+	}
+	if m := c.Message(); m != nil && strings.HasPrefix(m.Text, "/") {
+		return m.Text
+	}
+	return ""
+}
+
+// auditMiddleware records every command and button press with its outcome.
+func auditMiddleware(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		action := auditAction(c)
+		if action == "" {
+			return next(c)
+		}
+		err := next(c)
+		outcome := "ok"
+		if denied, _ := c.Get("denied").(bool); denied {
+			outcome = "denied"
+		} else if err != nil {
+			outcome = "error: " + err.Error()
+		}
+		entry := auditEntry{
+			Time:    time.Now(),
+			ChatID:  c.Chat().ID,
+			Command: action,
+			Outcome: outcome,
+		}
+		// Channel posts have no sender, the channel is the actor.
+		if u := c.Sender(); u != nil {
+			entry.UserID, entry.User = u.ID, u.Username
+		} else {
+			entry.UserID, entry.User = c.Chat().ID, c.Chat().Username
+		}
+		if err := storage.Append(auditBucket, entry); err != nil {
+			errorf("Audit: %s", err.Error())
+		}
+		return err
+	}
+}
+
+// maxAuditText keeps the /audit reply under Telegram's limit of 4096
+// characters, with room for the title.
+const maxAuditText = 4000
+
+var errAuditFull = errors.New("audit reply full")
+
+func handleAudit(c tele.Context) error {
+	n := 20
+	if args := c.Args(); len(args) > 0 {
+		if v, err := strconv.Atoi(args[0]); err == nil && v > 0 {
+			n = v
+		}
+	}
+	msg, shown := "", 0
+	err := storage.Last(auditBucket, n, func(_ string, data []byte) error {
+		var e auditEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		line := fmt.Sprintf("%s %d(@%s) chat %d: %s -> %s\n",
+			inZone(e.Time).Format(time.RFC3339), e.UserID, e.User, e.ChatID, e.Command, e.Outcome)
+		if utf8.RuneCountInString(msg)+utf8.RuneCountInString(line) > maxAuditText {
+			return errAuditFull
+		}
+		msg += line
+		shown++
+		return nil
+	})
+	if err != nil && !errors.Is(err, errAuditFull) {
+		return err
+	}
+	title := tr("Audit log:")
+	if errors.Is(err, errAuditFull) {
+		title = tr("Audit log (the last %d entries that fit in a message):", shown)
+	}
+	return replyPre(c, title, msg)
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Channel posts have no sender, the channel is recorded instead.
+func TestAuditChannelPost(t *testing.T) {
+	b := fakebot.New()
+	post := &tele.Message{ID: int(lastMessageID.Add(1)), Text: "/audit-channel-post",
+		Chat: &tele.Chat{ID: -1001, Type: tele.ChatChannel, Username: "archive"}}
+	handler := auditMiddleware(func(tele.Context) error { return nil })
+	if err := handler(b.Context(tele.Update{ChannelPost: post})); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := newMessage()
+	msg.Text, msg.Payload = "/audit 1", "1"
+	if err := handleAudit(b.Context(tele.Update{Message: msg})); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, b, "reply", "-1001(@archive) chat -1001: /audit-channel-post")
+}
+
+// However many entries are asked for, the reply fits in a message.
+func TestAuditLimit(t *testing.T) {
+	b := fakebot.New()
+	handler := auditMiddleware(func(tele.Context) error { return nil })
+	for range 100 {
+		msg := newMessage()
+		msg.Text = "/audit-limit " + strings.Repeat("x", 50)
+		if err := handler(b.Context(tele.Update{Message: msg})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := newMessage()
+	msg.Text, msg.Payload = "/audit 500", "500"
+	if err := handleAudit(b.Context(tele.Update{Message: msg})); err != nil {
+		t.Fatal(err)
+	}
+	e := waitEvent(t, b, "reply", "entries that fit in a message")
+	text := html.UnescapeString(regexp.MustCompile(`<[^>]*>`).ReplaceAllString(e.Text, ""))
+	if n := utf8.RuneCountInString(text); n > 4096 {
+		t.Errorf("reply of %d characters, Telegram's limit is 4096", n)
+	}
+}
@@ -0,0 +1,72 @@
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"github.com/prometheus/client_golang/prometheus"
+	tele "gopkg.in/telebot.v4"
+)
+
+// New downloads are turned down rather than queued without bounds when
+// TELEGRAM_MAX_QUEUE downloads are already queued or in progress, or when the
+// file would leave less than TELEGRAM_MIN_FREE_SPACE on the destination.
+// Retries, resumed and requeued downloads are work already accepted and
+// aren't checked.
+var enqueuesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telegram_enqueues_rejected_total",
+	Help: "New downloads turned down, by reason (queue or disk).",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(enqueuesRejected)
+	for _, s := range jobStates {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "telegram_queue_depth",
+			Help:        "Unfinished downloads by state.",
+			ConstLabels: prometheus.Labels{"state": string(s)},
+		}, func() float64 { return float64(jobsInState(s)) }))
+	}
+}
+
+// overloadMessage returns a user-facing message if a new download of size
+// bytes to dest should be turned down.
+func overloadMessage(dest string, size int64) string {
+	if limit := cfg().MaxQueue; limit > 0 {
+		if pending := pendingDownloads(); pending >= int64(limit) {
+			enqueuesRejected.WithLabelValues("queue").Inc()
+			return tr("Queue full (%d downloads), try again later.", pending)
+		}
+	}
+	if keep := cfg().MinFreeSpace; keep > 0 {
+		_, free, err := diskSpace(dest)
+		if err != nil {
+			// The download reports it if the destination is really broken.
+			errorf("Disk space of %s: %s", dest, err.Error())
+			return ""
+		}
+		if int64(free)-size < keep {
+			enqueuesRejected.WithLabelValues("disk").Inc()
+			return tr("Disk almost full (%s free, keeping %s), try again later.",
+				units.Format(int64(free)), units.Format(keep))
+		}
+	}
+	return ""
+}
+
+// checkFreeSpace fails if size bytes don't fit next to path. Platforms
+// without disk usage pass.
+func checkFreeSpace(path string, size int64) error {
+	_, free, err := diskSpace(filepath.Dir(path))
+	if err != nil || int64(free) >= size {
+		return nil
+	}
+	return fmt.Errorf("%w: %s needed, %s free", syscall.ENOSPC, units.Format(size), units.Format(int64(free)))
+}
+
+// overloaded is overloadMessage for the destination of a file sent to c.
+func overloaded(c tele.Context, fname string, size int64) string {
+	return overloadMessage(destinationFor(c, fname), size)
+}
@@ -0,0 +1,283 @@
+package downloader
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"github.com/klauspost/compress/zstd"
+	tele "gopkg.in/telebot.v4"
+)
+
+// /backup streams the destination, or a folder in it, into a tar.zst split in
+// parts that fit the upload limit of the Bot API and sends them one by one to
+// TELEGRAM_BACKUP_CHATID, followed by a manifest with the checksums and how to
+// restore. Only one part is on disk at a time, in TELEGRAM_STAGING_DIR or the
+// system temporary folder. The state file and partial downloads are left out.
+const backupPartSize = 45 << 20 // with room below the 50 MB upload limit
+
+var backup struct {
+	sync.Mutex
+	cancel context.CancelFunc
+}
+
+func handleBackup(c tele.Context) error {
+	if cfg().BackupChatID == 0 {
+		return c.Reply(tr("Backups need TELEGRAM_BACKUP_CHATID"))
+	}
+	args := c.Args()
+	if len(args) > 1 {
+		return c.Reply(tr("Usage: /backup [folder|stop]"))
+	}
+
+	backup.Lock()
+	defer backup.Unlock()
+	if len(args) == 1 && args[0] == "stop" {
+		if backup.cancel == nil {
+			return c.Reply(tr("No backup is running"))
+		}
+		backup.cancel()
+		return nil
+	}
+	if backup.cancel != nil {
+		return c.Reply(tr("A backup is already running, stop it with /backup stop"))
+	}
+	dir := botCfgFor(c).Dest
+	if len(args) == 1 {
+		dir = filepath.Join(dir, safePath(args[0]))
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return c.Reply(tr("No folder %s", dir))
+	}
+	ctx, cancel := context.WithCancel(rootContext())
+	backup.cancel = cancel
+
+	logEverywhere(c, "Backing up %s to chat %d", dir, cfg().BackupChatID)
+	go func() {
+		defer reportPanic(c, map[string]string{"backup": dir})
+		m, err := runBackup(ctx, apiOf(c), tele.ChatID(cfg().BackupChatID), dir)
+		backup.Lock()
+		backup.cancel = nil
+		backup.Unlock()
+		cancel()
+		switch {
+		case errors.Is(err, context.Canceled):
+			notifyChat(c, kindSummary, "Backup of %s stopped after %d parts", dir, len(m.parts))
+		case err != nil:
+			reportError(c, err, map[string]string{"stage": "backup"})
+			notifyChat(c, kindError, "Backup of %s failed: %s", dir, err.Error())
+		default:
+			notifyChat(c, kindSummary, "Backup of %s finished: %d files (%s) in %d parts (%s)", dir, m.files,
+				units.Format(m.size), len(m.parts), units.Format(m.archived))
+		}
+	}()
+	return nil
+}
+
+type backupPart struct {
+	name string
+	size int64
+	sum  string
+}
+
+type backupManifest struct {
+	name     string // of the archive
+	files    int
+	size     int64 // of the files
+	archived int64
+	sum      string
+	parts    []backupPart
+}
+
+func runBackup(ctx context.Context, b botAPI, chat tele.Recipient, dir string) (*backupManifest, error) {
+	started := time.Now()
+	m := &backupManifest{name: fmt.Sprintf("%s-%s.tar.zst", filepath.Base(dir), inZone(started).Format("20060102-150405"))}
+	parts := &partWriter{ctx: ctx, b: b, chat: chat, m: m, total: sha256.New()}
+	zw, err := zstd.NewWriter(parts)
+	if err != nil {
+		return m, err
+	}
+	tw := tar.NewWriter(zw)
+
+	skip := map[string]bool{cfg().StatePath: true, pidPath(): true}
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if skip[path] || filepath.Ext(path) == ".tmp" || !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil || rel == "." {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		if d.IsDir() {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := streamCopy(tw, io.LimitReader(ctxReader{ctx, f}, hdr.Size))
+		if err == nil && n < hdr.Size {
+			err = fmt.Errorf("%s shrank while it was archived", rel)
+		}
+		m.files++
+		m.size += n
+		return err
+	})
+	if err == nil {
+		err = tw.Close()
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = parts.Close()
+	}
+	if err != nil {
+		parts.abort()
+		return m, err
+	}
+	m.sum = hex.EncodeToString(parts.total.Sum(nil))
+	log.Printf("Backup of %s: %d files (%s) in %d parts (%s), %s", dir, m.files, units.Format(m.size),
+		len(m.parts), units.Format(m.archived), time.Since(started).Round(time.Second))
+	return m, sendManifest(ctx, b, chat, dir, m)
+}
+
+// partWriter cuts the archive in backupPartSize parts and sends each as it's
+// complete.
+type partWriter struct {
+	ctx   context.Context
+	b     botAPI
+	chat  tele.Recipient
+	m     *backupManifest
+	total hash.Hash
+
+	f    *os.File
+	size int64
+	sum  hash.Hash
+}
+
+func (w *partWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.f == nil {
+			dir := cfg().StagingDir
+			if dir == "" {
+				dir = os.TempDir()
+			}
+			f, err := os.CreateTemp(dir, ".backup-*.tmp")
+			if err != nil {
+				return written, err
+			}
+			trackPartial(f.Name())
+			w.f, w.size, w.sum = f, 0, sha256.New()
+		}
+		chunk := p[:min(int64(len(p)), backupPartSize-w.size)]
+		n, err := io.MultiWriter(w.f, w.sum, w.total).Write(chunk)
+		written += n
+		w.size += int64(n)
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+		if w.size == backupPartSize {
+			if err := w.send(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *partWriter) send() error {
+	path := w.f.Name()
+	defer forgetPartial(path)
+	defer os.Remove(path)
+	defer func() { w.f = nil }()
+	if err := w.f.Close(); err != nil {
+		return err
+	}
+	part := backupPart{fmt.Sprintf("%s.%03d", w.m.name, len(w.m.parts)+1), w.size, hex.EncodeToString(w.sum.Sum(nil))}
+	if err := sendDocument(w.ctx, w.b, w.chat, path, part.name); err != nil {
+		return fmt.Errorf("sending %s: %w", part.name, err)
+	}
+	log.Printf("Backup: sent %s (%s)", part.name, units.Format(part.size))
+	w.m.parts = append(w.m.parts, part)
+	w.m.archived += part.size
+	return nil
+}
+
+// Close sends the last part.
+func (w *partWriter) Close() error {
+	if w.f == nil {
+		return nil
+	}
+	return w.send()
+}
+
+func (w *partWriter) abort() {
+	if w.f != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		forgetPartial(w.f.Name())
+	}
+}
+
+func sendManifest(ctx context.Context, b botAPI, chat tele.Recipient, dir string, m *backupManifest) error {
+	var s strings.Builder
+	fmt.Fprintf(&s, "Backup of %s, %s\n", dir, localNow().Format(time.RFC3339))
+	fmt.Fprintf(&s, "%d files, %s, archived in %s\n", m.files, units.Format(m.size), units.Format(m.archived))
+	fmt.Fprintf(&s, "SHA-256 of the archive: %s\n\nParts, to check with sha256sum -c:\n", m.sum)
+	for _, p := range m.parts {
+		fmt.Fprintf(&s, "%s  %s\n", p.sum, p.name)
+	}
+	fmt.Fprintf(&s, "\nTo restore, download the parts and run:\n  cat %s.* | zstd -d | tar -x\n", m.name)
+
+	f, err := os.CreateTemp("", ".backup-manifest-*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(s.String()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return sendDocument(ctx, b, chat, f.Name(), strings.TrimSuffix(m.name, ".tar.zst")+".manifest.txt")
+}
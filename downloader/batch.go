@@ -0,0 +1,220 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Files sent by the same user in the same chat less than
+// TELEGRAM_BATCH_WINDOW apart form a batch with one status message and one
+// summary, instead of a reply for each file.
+type batch struct {
+	id     string
+	status *statusMessage
+
+	mu      sync.Mutex
+	jobs    []*job
+	last    time.Time
+	closed  bool
+	summary string
+}
+
+var batches = struct {
+	sync.Mutex
+	next int
+	open map[string]*batch // by chat and sender
+	m    map[string]*batch // by ID, for the buttons
+}{open: make(map[string]*batch), m: make(map[string]*batch)}
+
+var btnBatchRetry = tele.Btn{Unique: "batchretry"}
+
+// joinBatch creates the status message of j and adds j to the open batch of
+// its chat and sender, or starts one. Only the first job of a batch shows its
+// own message, until a second one joins and the batch message replaces it.
+// The messages are made while the locks are held, so a second job can't join
+// before the first one's message exists, but only sent, edited or deleted
+// once they are released.
+func joinBatch(j *job, text string, markup *tele.ReplyMarkup) {
+	window := cfg().BatchWindow
+	if window <= 0 || isChannelPost(j.c) {
+		j.status = newStatusMessage(j.c, text, markup, isChannelPost(j.c))
+		return
+	}
+	key := fmt.Sprintf("%d:%d", j.c.Chat().ID, j.c.Sender().ID)
+
+	var send []func()
+	defer func() {
+		for _, fn := range send {
+			fn()
+		}
+	}()
+	batches.Lock()
+	defer batches.Unlock()
+	for id, b := range batches.m {
+		b.mu.Lock()
+		if b.closed && time.Since(b.last) > jobRetention {
+			delete(batches.m, id)
+		}
+		b.mu.Unlock()
+	}
+	b := batches.open[key]
+	if b != nil {
+		b.mu.Lock()
+		if b.closed || time.Since(b.last) > window {
+			b.mu.Unlock()
+			b = nil
+		}
+	}
+	if b == nil {
+		batches.next++
+		b = &batch{id: strconv.Itoa(batches.next), jobs: []*job{j}, last: time.Now()}
+		batches.open[key] = b
+		batches.m[b.id] = b
+		j.batch = b
+		j.status = &statusMessage{c: j.c, last: text, markup: markup}
+		send = append(send, j.status.showNew)
+		return
+	}
+	defer b.mu.Unlock()
+	b.jobs = append(b.jobs, j)
+	b.last = time.Now()
+	j.batch = b
+	j.status = &statusMessage{c: j.c, last: text, markup: markup, hidden: true}
+	status := b.status
+	if len(b.jobs) == 2 {
+		first := b.jobs[0]
+		log.Printf("Batch %s started by %s", b.id, senderName(first.c.Sender()))
+		status = &statusMessage{c: first.c, last: b.textLocked()}
+		b.status = status
+		send = append(send, func() {
+			first.status.Hide()
+			if cfg().Notify >= notifySummary {
+				status.Show(kindSummary)
+			}
+		})
+	} else {
+		text := b.textLocked()
+		send = append(send, func() { status.Update(text) })
+	}
+	time.AfterFunc(window, b.check)
+}
+
+// grouped reports whether the batch has more than one job, which means it
+// reports for them.
+func (b *batch) grouped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.jobs) > 1
+}
+
+// jobFinished updates the counts and closes the batch when it's complete.
+func (b *batch) jobFinished() {
+	b.mu.Lock()
+	if b.status != nil {
+		b.status.Update(b.textLocked())
+	}
+	b.mu.Unlock()
+	b.check()
+}
+
+// check closes the batch once no more files can join and all are finished,
+// and sends the summary.
+func (b *batch) check() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || time.Since(b.last) < cfg().BatchWindow {
+		return
+	}
+	counts := b.countsLocked()
+	if counts[""] > 0 {
+		return
+	}
+	b.closed = true
+	if b.status == nil {
+		return
+	}
+
+	text := b.textLocked()
+	var failed bool
+	for _, j := range b.jobs {
+		j.mu.Lock()
+		if j.outcome == jobFailed || j.outcome == jobCancelled {
+			failed = true
+			text += "\n" + j.text
+		}
+		j.mu.Unlock()
+	}
+	log.Printf("Batch %s finished: %d of %d downloaded", b.id, counts[jobDone], len(b.jobs))
+	if failed {
+		markup := &tele.ReplyMarkup{}
+		markup.Inline(markup.Row(markup.Data(tr("Retry failed"), btnBatchRetry.Unique, b.id)))
+		b.status.SetButtons(markup)
+	}
+	b.summary = text
+	b.status.Update(text)
+	switch {
+	case failed && cfg().Notify >= notifyErrors:
+		b.status.Show(kindError)
+	case cfg().Notify >= notifySummary:
+		b.status.Show(kindSummary)
+	}
+}
+
+// countsLocked counts the jobs by outcome, "" for the unfinished ones.
+func (b *batch) countsLocked() map[jobOutcome]int {
+	counts := map[jobOutcome]int{}
+	for _, j := range b.jobs {
+		j.mu.Lock()
+		outcome := j.outcome
+		if j.finished.IsZero() {
+			outcome = ""
+		}
+		j.mu.Unlock()
+		counts[outcome]++
+	}
+	return counts
+}
+
+func (b *batch) textLocked() string {
+	counts := b.countsLocked()
+	if b.closed {
+		return trHTML("Batch finished: %d/%d downloaded, %d failed, %d cancelled", counts[jobDone],
+			len(b.jobs), counts[jobFailed], counts[jobCancelled])
+	}
+	return trHTML("Batch: %d/%d downloaded, %d failed", counts[jobDone], len(b.jobs), counts[jobFailed])
+}
+
+func handleBatchRetry(c tele.Context) error {
+	batches.Lock()
+	b, ok := batches.m[c.Data()]
+	batches.Unlock()
+	if !ok {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Expired")})
+	}
+	b.mu.Lock()
+	list := append([]*job(nil), b.jobs...)
+	summary := b.summary
+	b.mu.Unlock()
+	if list[0].c.Sender().ID != c.Sender().ID && cfg().Roles.permissionsOf(c.Sender())&permAdmin == 0 {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Only the sender or an admin can do this")})
+	}
+
+	by := senderName(c.Sender())
+	var n int
+	for _, j := range list {
+		j.mu.Lock()
+		retry := j.outcome == jobFailed || j.outcome == jobCancelled
+		j.mu.Unlock()
+		if retry && j.Retry(by) == nil {
+			n++
+		}
+	}
+	b.status.SetButtons(nil)
+	b.status.Update(summary + "\n" + trHTML("Retried by %s", by))
+	return c.Respond(&tele.CallbackResponse{Text: tr("Retrying %d files", n)})
+}
@@ -0,0 +1,71 @@
+package downloader
+
+import (
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Files the media managers pick up from their blackhole/watch folders.
+var blackholeExts = []string{".torrent", ".nzb", ".mkv", ".mp4", ".avi", ".m4v", ".mov", ".wmv", ".ts"}
+
+// parseBlackholes parses "tv=/watch/sonarr,movies=/watch/radarr" into a map
+// from hashtag (without #) to folder.
+func parseBlackholes(s string) (map[string]string, error) {
+	m := map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		tag, dir, ok := strings.Cut(item, "=")
+		tag = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(tag), "#"))
+		if !ok || tag == "" || strings.TrimSpace(dir) == "" {
+			return nil, fmt.Errorf("expected <hashtag>=<folder>, got %q", item)
+		}
+		m[tag] = strings.TrimSpace(dir)
+	}
+	return m, nil
+}
+
+// hashtags returns the hashtags of a caption, lowercase and without #.
+func hashtags(caption string) []string {
+	var tags []string
+	for _, w := range strings.Fields(caption) {
+		if !strings.HasPrefix(w, "#") {
+			continue
+		}
+		if tag := strings.ToLower(strings.TrimRight(w[1:], ".,;:!?")); tag != "" && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// destinationFor is the folder a file goes to: the folder of the channel's
+// archiving profile, the watch folder of the first caption hashtag with a
+// TELEGRAM_BLACKHOLES entry for torrents, NZBs and videos, with
+// TELEGRAM_TAG_FOLDERS a subfolder of the destination named after the first
+// caption hashtag, or the bot's destination otherwise.
+func destinationFor(c tele.Context, fname string) string {
+	if ch, ok := cfg().channel(c.Chat().ID); ok {
+		return ch.dir(botCfgFor(c).Dest)
+	}
+	if holes := cfg().Blackholes; len(holes) > 0 && c.Message() != nil &&
+		slices.Contains(blackholeExts, strings.ToLower(filepath.Ext(fname))) {
+		for _, tag := range hashtags(c.Message().Caption) {
+			if dir, ok := holes[tag]; ok {
+				return dir
+			}
+		}
+	}
+	if cfg().TagFolders && c.Message() != nil {
+		if tags := hashtags(c.Message().Caption); len(tags) > 0 {
+			return filepath.Join(botCfgFor(c).Dest, safeFilename(tags[0]))
+		}
+	}
+	return botCfgFor(c).Dest
+}
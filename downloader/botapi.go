@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// botAPI is the part of the Bot API the handlers and downloads use for
+// messages and files. Everything goes through apiOf, so any tele.API works,
+// including the fake in internal/fakebot, and the download logic can run
+// without Telegram.
+type botAPI interface {
+	Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error)
+	Reply(to *tele.Message, what interface{}, opts ...interface{}) (*tele.Message, error)
+	Edit(msg tele.Editable, what interface{}, opts ...interface{}) (*tele.Message, error)
+	Delete(msg tele.Editable) error
+	File(file *tele.File) (io.ReadCloser, error)
+}
+
+var _ botAPI = (*tele.Bot)(nil)
+
+func apiOf(c tele.Context) botAPI {
+	return c.Bot()
+}
+
+// uploadMaxSize is the upload limit of the Bot API.
+const uploadMaxSize = 50 << 20
+
+// Files the bot sends itself, such as the outbox and backups, are tried this
+// many times, waiting a minute longer after every failure.
+const sendAttempts = 3
+
+// sendDocument uploads the file at path to chat as name.
+func sendDocument(ctx context.Context, b botAPI, chat tele.Recipient, path, name string) error {
+	for attempt := 1; ; attempt++ {
+		_, err := b.Send(chat, &tele.Document{File: tele.FromDisk(path), FileName: name})
+		if err == nil || attempt == sendAttempts {
+			return err
+		}
+		warnf("Sending %s failed, trying again: %s", name, err.Error())
+		if !sleepContext(ctx, time.Duration(attempt)*time.Minute) {
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// channelCfg is an archiving profile for a channel listed in
+// TELEGRAM_CHANNELS, configured with TELEGRAM_CHANNEL_<NAME>_ID, _DEST,
+// _TYPES and _NAME. Every matching post is downloaded without replying in
+// the channel.
+type channelCfg struct {
+	Name     string
+	ChatID   int64
+	Dest     string // relative to the bot destination unless absolute
+	Types    []string
+	Template string
+}
+
+var channelMediaTypes = []string{"document", "video", "audio", "animation", "voice", "photo", "video_note",
+	"sticker"}
+
+const defaultChannelTemplate = "{name}"
+
+func parseChannels() ([]channelCfg, []error) {
+	var channels []channelCfg
+	var problems []error
+	for _, name := range strings.Split(getenv("TELEGRAM_CHANNELS"), ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "TELEGRAM_CHANNEL_" + name + "_"
+		ch := channelCfg{Name: strings.ToLower(name), Dest: getenv(prefix + "DEST"),
+			Types: []string{"document"}, Template: defaultChannelTemplate}
+
+		var err error
+		if v := getenv(prefix + "ID"); v == "" {
+			problems = append(problems, errors.New(prefix+"ID is not set"))
+		} else if ch.ChatID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			problems = append(problems, fmt.Errorf("%sID is not a valid number: err=%s", prefix, err.Error()))
+		}
+		if ch.Dest != "" && !filepath.IsAbs(ch.Dest) && !filepath.IsLocal(ch.Dest) {
+			problems = append(problems, fmt.Errorf("%sDEST must stay inside the destination: %q", prefix, ch.Dest))
+		}
+		if v := getenv(prefix + "TYPES"); v != "" {
+			ch.Types = nil
+			for _, t := range strings.Split(v, ",") {
+				t = strings.ToLower(strings.TrimSpace(t))
+				if !slices.Contains(channelMediaTypes, t) {
+					problems = append(problems, fmt.Errorf("%sTYPES has an unknown type %q (want %s)", prefix, t,
+						strings.Join(channelMediaTypes, ", ")))
+				}
+				ch.Types = append(ch.Types, t)
+			}
+		}
+		if v := getenv(prefix + "NAME"); v != "" {
+			ch.Template = v
+			if err := checkChannelTemplate(v); err != nil {
+				problems = append(problems, fmt.Errorf("%sNAME is not valid: err=%s", prefix, err.Error()))
+			}
+		}
+		channels = append(channels, ch)
+	}
+	return channels, problems
+}
+
+func describeChannels(channels []channelCfg) string {
+	items := make([]string, 0, len(channels))
+	for _, ch := range channels {
+		items = append(items, fmt.Sprintf("%s(id=%d dest=%s types=%s name=%s)", ch.Name, ch.ChatID, ch.Dest,
+			strings.Join(ch.Types, ","), ch.Template))
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
+
+func (c *Cfg) channel(chatID int64) (channelCfg, bool) {
+	for _, ch := range c.Channels {
+		if ch.ChatID == chatID {
+			return ch, true
+		}
+	}
+	return channelCfg{}, false
+}
+
+func (ch channelCfg) dir(botDest string) string {
+	if filepath.IsAbs(ch.Dest) {
+		return ch.Dest
+	}
+	return filepath.Join(botDest, ch.Dest)
+}
+
+// The placeholders of a naming template.
+func channelTemplateReplacer(m *tele.Message, ch channelCfg, kind, name string) *strings.Replacer {
+	ext := filepath.Ext(name)
+	return strings.NewReplacer(
+		"{name}", name,
+		"{base}", strings.TrimSuffix(name, ext),
+		"{ext}", ext,
+		"{id}", strconv.Itoa(m.ID),
+		"{date}", inZone(m.Time()).Format("2006-01-02"),
+		"{channel}", ch.Name,
+		"{type}", kind,
+	)
+}
+
+func checkChannelTemplate(t string) error {
+	sample := channelTemplateReplacer(&tele.Message{ID: 1}, channelCfg{Name: "news"}, "document", "file.pdf")
+	name := sample.Replace(t)
+	if strings.Contains(name, "{") {
+		return fmt.Errorf("unknown placeholder in %q (want {name}, {base}, {ext}, {id}, {date}, {channel} or {type})", t)
+	}
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("%q must be a relative path", t)
+	}
+	return nil
+}
+
+// channelMedia returns the kind, file and name of the media in a post.
+// Photos, voice and video messages and stickers have no name, so one is made
+// from the message ID.
+func channelMedia(m *tele.Message) (string, *tele.File, string) {
+	switch {
+	case m.Document != nil:
+		return "document", &m.Document.File, mediaName(m, "document", m.Document.FileName, m.Document.MIME)
+	case m.Video != nil:
+		return "video", &m.Video.File, mediaName(m, "video", m.Video.FileName, m.Video.MIME)
+	case m.Audio != nil:
+		return "audio", &m.Audio.File, mediaName(m, "audio", m.Audio.FileName, m.Audio.MIME)
+	case m.Animation != nil:
+		return "animation", &m.Animation.File, mediaName(m, "animation", m.Animation.FileName, m.Animation.MIME)
+	case m.Voice != nil:
+		return "voice", &m.Voice.File, mediaName(m, "voice", "", "audio/ogg")
+	case m.Photo != nil:
+		return "photo", &m.Photo.File, mediaName(m, "photo", "", "image/jpeg")
+	case m.VideoNote != nil:
+		return "video_note", &m.VideoNote.File, mediaName(m, "video_note", "", "video/mp4")
+	case m.Sticker != nil:
+		return "sticker", &m.Sticker.File, mediaName(m, "sticker", "", stickerMIME(m.Sticker))
+	}
+	return "", nil, ""
+}
+
+// Extensions for the common media types, mime.ExtensionsByType picks the
+// alphabetically first one (".jfif" for JPEG).
+var mediaExts = map[string]string{
+	"image/jpeg": ".jpg",
+	"video/mp4":  ".mp4",
+	"audio/mpeg": ".mp3",
+	"audio/ogg":  ".ogg",
+	"image/webp": ".webp",
+	"video/webm": ".webm",
+
+	"application/x-tgsticker": ".tgs",
+}
+
+func stickerMIME(s *tele.Sticker) string {
+	switch {
+	case s.Animated:
+		return "application/x-tgsticker"
+	case s.Video:
+		return "video/webm"
+	}
+	return "image/webp"
+}
+
+func mediaName(m *tele.Message, kind, name, mimeType string) string {
+	if name != "" {
+		return safeFilename(name)
+	}
+	name = fmt.Sprintf("%s_%d", kind, m.ID)
+	if ext, ok := mediaExts[mimeType]; ok {
+		name += ext
+	} else if exts, _ := mime.ExtensionsByType(mimeType); len(exts) > 0 {
+		name += exts[0]
+	}
+	return name
+}
+
+// channelContext stands the channel in for the sender its posts don't have,
+// so jobs, batches and the usage counters work as for other chats.
+type channelContext struct {
+	tele.Context
+}
+
+func (c channelContext) Sender() *tele.User {
+	return &tele.User{ID: c.Chat().ID, FirstName: c.Chat().Title, Username: c.Chat().Username}
+}
+
+// isChannelPost reports whether c is a channel post, which never gets replies.
+func isChannelPost(c tele.Context) bool {
+	return c.Chat() != nil && c.Chat().Type == tele.ChatChannel
+}
+
+func handleChannelPost(c tele.Context) error {
+	ch, ok := cfg().channel(c.Chat().ID)
+	if !ok {
+		return nil
+	}
+	kind, f, name := channelMedia(c.Message())
+	if f == nil || !slices.Contains(ch.Types, kind) {
+		return nil
+	}
+	fname := filepath.FromSlash(channelTemplateReplacer(c.Message(), ch, kind, name).Replace(ch.Template))
+	// There's nobody to tell in a channel, so posts during maintenance wait
+	// among the failed downloads for the next retry.
+	if maintenance.Load() {
+		if holdChannelPost(c, f, fname) {
+			log.Printf("Channel %s: maintenance, held for later: %s", ch.Name, name)
+		} else {
+			log.Printf("Channel %s: maintenance, skipped: %s", ch.Name, name)
+		}
+		return nil
+	}
+	if maxSizeMessage(f.FileSize) != "" {
+		log.Printf("Channel %s: too large, skipped: %s", ch.Name, name)
+		return nil
+	}
+	if overloaded(c, name, f.FileSize) != "" {
+		log.Printf("Channel %s: overloaded, skipped: %s", ch.Name, name)
+		return nil
+	}
+
+	log.Printf("Channel %s: archiving %s", ch.Name, fname)
+	go downloadFile(handlerContext(c), channelContext{c}, f, fname, time.Now())
+	return nil
+}
+
+// holdChannelPost records a post that came during maintenance for the
+// retries, which start it once maintenance is off. It reports false when
+// the retries are off.
+func holdChannelPost(c tele.Context, f *tele.File, fname string) bool {
+	if cfg().RetryAttempts <= 0 {
+		return false
+	}
+	cc := channelContext{c}
+	fd := failedDownload{savedDownload: savedDownload{Bot: botCfgFor(c).Name, ChatID: c.Chat().ID,
+		ChatType: c.Chat().Type, MessageID: c.Message().ID, Caption: c.Message().Caption, Sender: *cc.Sender(),
+		FileID: f.FileID, UniqueID: f.UniqueID, Size: f.FileSize, Name: fname, URL: f.FileURL},
+		Error: "maintenance", Failed: time.Now()}
+	if err := storage.Put(failedBucket, failedKey(c), fd); err != nil {
+		errorf("Channel: %s", err.Error())
+		return false
+	}
+	return true
+}
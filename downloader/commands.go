@@ -0,0 +1,168 @@
+package downloader
+
+import (
+	"slices"
+	"sync"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// command is an entry of the command registry, which drives the handlers,
+// /help and Telegram's command menu. Commands with a permission are only
+// available to (and listed for) the users that have it.
+type command struct {
+	text, args, desc string
+	perm             permission
+	handler          tele.HandlerFunc
+	middleware       []tele.MiddlewareFunc
+}
+
+// Filled in init because handleHelp reads it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{text: "help", desc: "show this help", handler: handleHelp},
+		{text: "stats", desc: "print statistics", perm: permView, handler: handleStats},
+		{text: "statsreset", desc: "reset download counters", perm: permAdmin, handler: handleStatsReset,
+			middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "get", desc: "reply to a file or album item to download it, or the whole album", perm: permUpload,
+			handler: handleGet, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "grab", args: "<message link>", desc: "download the file of a linked message", perm: permUpload,
+			handler: handleGrab, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "schedule", args: "<time>", desc: "reply to a file to download it later, e.g. at 02:00 or in 2h",
+			perm: permUpload, handler: handleSchedule, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "mirror", args: "<url> [folder] [sha256:<checksum>]", desc: "download a URL into the destination",
+			perm: permAdmin, handler: handleMirror, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "redownload", args: "[history id]", desc: "download a file from the history again", perm: permAdmin,
+			handler: handleRedownload, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "queue", desc: "list the downloads of this chat by state", perm: permView, handler: handleQueue},
+		{text: "tagged", args: "<tag>", desc: "list the downloads with a caption hashtag", perm: permView,
+			handler: handleTagged},
+		{text: "job", args: "<job id>", desc: "show the details of a download: timeline, transfer, retries, last error",
+			perm: permView, handler: handleJob},
+		{text: "status", args: "<job id>", desc: "the same as /job", perm: permView, handler: handleJob},
+		{text: "speedtest", desc: "measure the download speed from Telegram and the disk speed (reply to use a file)",
+			perm: permAdmin, handler: handleSpeedtest},
+		{text: "prune", args: "[all]", desc: "remove partial downloads left by crashes and failures", perm: permAdmin,
+			handler: handlePrune, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "sendto", args: "<chat> <file>", desc: "send a file of the destination to another chat", perm: permAdmin,
+			handler: handleSendTo},
+		{text: "galleryupdate", desc: "update the index.html gallery of every folder", perm: permAdmin,
+			handler: handleGalleryUpdate},
+		{text: "backup", args: "[folder|stop]", desc: "send an archive of the destination to the backup chat",
+			perm: permAdmin, handler: handleBackup, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "cancelall", desc: "cancel all downloads in this chat", perm: permAdmin, handler: handleCancelAll,
+			middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "quota", desc: "show your usage", handler: handleQuota},
+		{text: "audit", args: "[n]", desc: "show the last n audit log entries", perm: permAdmin, handler: handleAudit},
+		{text: "maintenance", args: "on|off", desc: "refuse new downloads while on", perm: permAdmin,
+			handler: handleMaintenance},
+		{text: "reload", desc: "reload the config file", perm: permAdmin, handler: handleReload},
+		{text: "config", desc: "show the effective configuration", perm: permAdmin, handler: handleConfig},
+		{text: "set", args: "<name> [value]", desc: "change a setting at runtime", perm: permAdmin,
+			handler: handleSet, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+		{text: "backfill", args: "[@chat|chat id|stop]", desc: "download the past files of a chat", perm: permAdmin,
+			handler: handleBackfill, middleware: []tele.MiddlewareFunc{maintenanceGuard}},
+	}
+}
+
+func handleCommands(b *tele.Bot) {
+	for _, cmd := range commands {
+		var m []tele.MiddlewareFunc
+		if cmd.perm != 0 {
+			m = append(m, requirePermission(cmd.perm))
+		}
+		b.Handle("/"+cmd.text, cmd.handler, append(m, cmd.middleware...)...)
+	}
+}
+
+func handleHelp(c tele.Context) error {
+	p := cfg().Roles.permissionsOf(c.Sender())
+	msg := tr("This is a bot for downloading attachments.") + "\n"
+	msg += tr("Chat ID: %d\nCommands:", c.Chat().ID) + "\n"
+	for _, cmd := range commands {
+		if p&cmd.perm != cmd.perm {
+			continue
+		}
+		usage := "/" + cmd.text
+		if cmd.args != "" {
+			usage += " " + cmd.args
+		}
+		msg += usage + " - " + tr(cmd.desc) + "\n"
+	}
+	return c.Send(msg)
+}
+
+var runningBots struct {
+	sync.Mutex
+	bots []*tele.Bot
+	// Scopes registered by the last registerCommands, so users that lost
+	// their role get the default menu back.
+	scopes map[*tele.Bot][]tele.CommandScope
+}
+
+func commandsFor(p permission) []tele.Command {
+	var cmds []tele.Command
+	for _, cmd := range commands {
+		if p&cmd.perm == cmd.perm {
+			cmds = append(cmds, tele.Command{Text: cmd.text, Description: tr(cmd.desc)})
+		}
+	}
+	return cmds
+}
+
+// registerCommands sets the command menu of every bot: the default scope
+// gets what users without a role may do, users with a role get their own
+// menu in the private chat and in each whitelisted chat. Users given by
+// @username can't be scoped and see the default menu.
+func registerCommands() {
+	runningBots.Lock()
+	defer runningBots.Unlock()
+	if runningBots.scopes == nil {
+		runningBots.scopes = map[*tele.Bot][]tele.CommandScope{}
+	}
+
+	c := cfg()
+	var ids []int64
+	for _, l := range []userList{c.Roles.admins, c.Roles.uploaders, c.Roles.viewers} {
+		for id := range l.ids {
+			if !slices.Contains(ids, id) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	for _, b := range runningBots.bots {
+		set := func(cmds []tele.Command, scope tele.CommandScope) {
+			if err := b.SetCommands(cmds, scope); err != nil {
+				errorf("Registering commands failed: %s", err.Error())
+			}
+		}
+		set(commandsFor(c.Roles.permissionsOf(&tele.User{})), tele.CommandScope{Type: tele.CommandScopeDefault})
+
+		var scopes []tele.CommandScope
+		if !c.Roles.Empty() {
+			chats := botCfgOf(b).ChatIDs
+			for _, id := range ids {
+				cmds := commandsFor(c.Roles.permissionsOf(&tele.User{ID: id}))
+				scope := tele.CommandScope{Type: tele.CommandScopeChat, ChatID: id}
+				set(cmds, scope)
+				scopes = append(scopes, scope)
+				for _, chat := range chats {
+					scope := tele.CommandScope{Type: tele.CommandScopeChatMember, ChatID: chat, UserID: id}
+					set(cmds, scope)
+					scopes = append(scopes, scope)
+				}
+			}
+		}
+		for _, old := range runningBots.scopes[b] {
+			if !slices.Contains(scopes, old) {
+				if err := b.DeleteCommands(old); err != nil {
+					errorf("Removing commands failed: %s", err.Error())
+				}
+			}
+		}
+		runningBots.scopes[b] = scopes
+	}
+}
@@ -0,0 +1,160 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// With TELEGRAM_MAX_CONCURRENT set, transfers wait for one of a limited number
+// of slots. The limit starts at TELEGRAM_MIN_CONCURRENT and is tuned every
+// concurrencyInterval: it is halved on a Telegram flood error (429), drops by
+// one when more than a fifth of the transfers failed or when the last
+// increase didn't raise the throughput, and grows by one while every slot is
+// taken. After an increase that didn't pay off it holds for a while.
+const (
+	concurrencyInterval = 10 * time.Second
+	concurrencyHold     = 6 // intervals
+)
+
+var concurrency = struct {
+	sync.Mutex
+	limit   int
+	running int
+	freed   chan struct{} // closed when a slot frees or the limit grows
+
+	ok, failed, flooded int
+	lastBytes           int64
+	lastRate            float64
+	increased           bool
+	hold                int
+}{freed: make(chan struct{})}
+
+func startConcurrency() {
+	concurrency.Lock()
+	concurrency.limit = cfg().MinConcurrent
+	concurrency.lastBytes = atomic.LoadInt64(&bytesTransferred)
+	concurrency.Unlock()
+	go func() {
+		for sleepContext(rootContext(), concurrencyInterval) {
+			tuneConcurrency()
+		}
+	}()
+}
+
+// acquireSlot waits for a free transfer slot.
+func acquireSlot(ctx context.Context) error {
+	for {
+		concurrency.Lock()
+		if cfg().MaxConcurrent <= 0 || concurrency.running < concurrency.limit {
+			concurrency.running++
+			concurrency.Unlock()
+			return nil
+		}
+		freed := concurrency.freed
+		concurrency.Unlock()
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// releaseSlot frees the slot of a transfer that ended with err.
+func releaseSlot(err error) {
+	concurrency.Lock()
+	defer concurrency.Unlock()
+	concurrency.running--
+	switch {
+	case err == nil:
+		concurrency.ok++
+	case errors.Is(err, context.Canceled):
+	case isFlood(err):
+		concurrency.flooded++
+	default:
+		concurrency.failed++
+	}
+	wakeSlots()
+}
+
+// wakeSlots lets the waiting transfers check again. concurrency must be
+// locked.
+func wakeSlots() {
+	close(concurrency.freed)
+	concurrency.freed = make(chan struct{})
+}
+
+// noteFlood counts a flood wait that was handled without failing the request.
+func noteFlood() {
+	concurrency.Lock()
+	concurrency.flooded++
+	concurrency.Unlock()
+}
+
+func isFlood(err error) bool {
+	var floodErr tele.FloodError
+	return errors.As(err, &floodErr) || strings.Contains(err.Error(), "got 429")
+}
+
+func tuneConcurrency() {
+	lo, hi := cfg().MinConcurrent, cfg().MaxConcurrent
+	concurrency.Lock()
+	defer concurrency.Unlock()
+	c := &concurrency
+
+	bytes := atomic.LoadInt64(&bytesTransferred)
+	rate := float64(bytes-c.lastBytes) / concurrencyInterval.Seconds()
+	c.lastBytes = bytes
+	old := c.limit
+	total := c.ok + c.failed + c.flooded
+	reason := ""
+	switch {
+	case hi <= 0:
+	case c.flooded > 0:
+		c.limit /= 2
+		reason = "flood errors"
+	case total > 0 && c.failed*5 > total:
+		c.limit--
+		reason = "errors"
+	case c.increased && rate < c.lastRate*1.05:
+		c.limit--
+		c.hold = concurrencyHold
+		reason = "no throughput gain"
+	case c.hold > 0:
+		c.hold--
+	case c.running >= c.limit:
+		c.limit++
+		reason = "all slots busy"
+	}
+	if hi > 0 {
+		c.limit = min(max(c.limit, lo), hi)
+	}
+	c.increased = c.limit > old
+	if c.limit != old {
+		log.Printf("Concurrent downloads: %d → %d (%s, %s/s)", old, c.limit, reason, units.Format(int64(rate)))
+	}
+	if c.increased {
+		wakeSlots()
+	}
+	c.lastRate = rate
+	c.ok, c.failed, c.flooded = 0, 0, 0
+}
+
+// concurrencyReport is the /stats line, empty without a limit.
+func concurrencyReport() string {
+	if cfg().MaxConcurrent <= 0 {
+		return ""
+	}
+	concurrency.Lock()
+	defer concurrency.Unlock()
+	return tr("Transfers: %d running, limit %d (%d-%d)", concurrency.running, concurrency.limit,
+		cfg().MinConcurrent, cfg().MaxConcurrent)
+}
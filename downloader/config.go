@@ -0,0 +1,1278 @@
+package downloader
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/mail"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/config"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+type Cfg struct {
+	InitialWorkingDir  string
+	TelegramToken      string
+	WhitelistedChatIDs []int64
+	ExtraBots          []botCfg
+	Channels           []channelCfg
+	WhitelistedUsers   userList
+	Roles              roles
+	ApprovalChatID     int64
+	AdminChatID        int64
+	RetryAttempts      int
+	RetryInterval      time.Duration
+	MinConcurrent      int
+	MaxConcurrent      int
+	MaxQueue           int
+	MinFreeSpace       int64
+	Preallocate        bool
+	RateLimits         []rateLimit
+	UserQuota          int64
+	ChatQuota          int64
+	MaxFileSize        int64
+	MemoryLimit        int64
+	DryRun             bool
+	Dedup              bool
+	PollTimeout        time.Duration
+	HTTPTimeout        time.Duration
+	HTTPKeepAlive      time.Duration
+	HTTPIdleConns      int
+	HTTP2              bool
+	ProgressInterval   time.Duration
+	BatchWindow        time.Duration
+	NotifyDebounce     time.Duration
+	Notify             notifyLevel
+	LogLevel           logLevel
+	Silent             silentCfg
+	Reactions          bool
+	Locale             string
+	Timezone           *time.Location
+	Catalog            map[string]string
+	AllowedUpdates     []string
+	DropPending        bool
+	CatchUpWindow      time.Duration
+	StatePath          string
+	StagingDir         string
+	MaxNameBytes       int
+	UnicodeForm        string
+	ASCIINames         bool
+	OutboxDir          string
+	OutboxChatID       int64
+	BackupChatID       int64
+	PodcastDir         string
+	PodcastURL         string
+	Takeover           bool
+	DrainTimeout       time.Duration
+	ConfirmTimeout     time.Duration
+	PprofPort          string
+	MetricsAddr        string
+	APIAddr            string
+	APIToken           string
+	WebAddr            string
+	GRPCAddr           string
+	GRPCCert           string
+	GRPCKey            string
+	GRPCClientCA       string
+	WebUser            string
+	WebPassword        string
+	SentryDSN          string
+	ErrorWebhook       string
+	Webhooks           []string
+	WebhookSecret      string
+	DiscordWebhooks    []string
+	SlackWebhooks      []string
+	MQTTBroker         string
+	MQTTUser           string
+	MQTTPassword       string
+	MQTTTopic          string
+	Blackholes         map[string]string
+	ChatNames          map[string]int64
+	TagFolders         bool
+	GalleryInterval    time.Duration
+	WriteLimits        map[string]int64
+	SMTPAddr           string
+	SMTPUser           string
+	SMTPPassword       string
+	SMTPFrom           string
+	EmailTo            []string
+	EmailEvents        []string
+	EmailSummaryAt     string
+	Plugins            []string
+	MTProtoAppID       int
+	MTProtoAppHash     string
+	MTProtoSession     string
+	NextcloudURL       string
+	NextcloudUser      string
+	NextcloudPassword  string
+	NextcloudDir       string
+	NextcloudShare     bool
+	NextcloudChunkSize int64
+	InstanceName       string
+}
+
+var currentCfg atomic.Pointer[Cfg]
+
+// cfg returns the current configuration; it is replaced as a whole on reload.
+func cfg() *Cfg {
+	return currentCfg.Load()
+}
+
+var currentSources atomic.Pointer[config.Sources]
+
+// sources are the values of the settings from flags, the environment, the
+// config file and /set, read by getenv.
+func sources() *config.Sources {
+	return currentSources.Load()
+}
+
+var settings = []config.Setting{
+	{Name: "CONFIG", Desc: "path of the YAML config file"},
+	{Name: "ENV_FILE", Desc: "path of the .env file (default: ./.env if present)"},
+	{Name: "ENV_PREFIX", Desc: "prefix of environment variables instead of TELEGRAM_"},
+	{Name: "DEST", Desc: "destination directory for downloads"},
+	{Name: "TOKEN", Desc: "bot token", Secret: true},
+	{Name: "TOKEN_FILE", Desc: "file containing the bot token"},
+	{Name: "CHATID", Desc: "comma-separated whitelisted chat IDs"},
+	{Name: "BOTS", Desc: "names of additional bots, configured with BOT_<NAME>_TOKEN, _DEST, _CHATID"},
+	{Name: "CHANNELS", Desc: "names of channels to archive, configured with CHANNEL_<NAME>_ID, _DEST, _TYPES, _NAME", Runtime: true},
+	{Name: "POLL_TIMEOUT", Desc: "long polling timeout (default 10s)"},
+	{Name: "HTTP_TIMEOUT", Desc: "Telegram connection, TLS and response timeout, on top of the polling timeout (default 30s)"},
+	{Name: "HTTP_KEEPALIVE", Desc: "how long idle Telegram connections are kept for reuse (default 90s)"},
+	{Name: "HTTP_IDLE_CONNS", Desc: "idle Telegram connections kept for reuse (default 32)"},
+	{Name: "HTTP2", Desc: "use HTTP/2 with Telegram (default true)"},
+	{Name: "ALLOWED_UPDATES", Desc: "comma-separated update types to receive (default: all)"},
+	{Name: "DROP_PENDING", Desc: "skip updates that queued up while the bot was down (true/false)"},
+	{Name: "CATCHUP_WINDOW", Desc: "skip messages sent longer ago than this while the bot was down (default 24h, 0 = none)", Runtime: true},
+	{Name: "USERS", Desc: "comma-separated whitelisted user IDs/@usernames", Runtime: true},
+	{Name: "ADMINS", Desc: "users with the admin role", Runtime: true},
+	{Name: "UPLOADERS", Desc: "users with the uploader role", Runtime: true},
+	{Name: "VIEWERS", Desc: "users with the viewer role", Runtime: true},
+	{Name: "APPROVAL_CHATID", Desc: "admin chat for approving non-whitelisted senders", Runtime: true},
+	{Name: "ADMIN_CHATID", Desc: "chat for reports such as given up downloads (default APPROVAL_CHATID)", Runtime: true},
+	{Name: "RETRY_ATTEMPTS", Desc: "automatic retries of failed downloads (default 5, 0 = off)", Runtime: true},
+	{Name: "RETRY_INTERVAL", Desc: "how often failed downloads are retried (default 1h, 0 = only at startup)", Runtime: true},
+	{Name: "MIN_CONCURRENT", Desc: "fewest parallel transfers the adaptive limit goes down to (default 1)", Runtime: true},
+	{Name: "MAX_CONCURRENT", Desc: "most parallel transfers, tuned between the bounds by throughput and errors (default 0 = no limit)", Runtime: true, Alias: "workers"},
+	{Name: "MAX_QUEUE", Desc: "most downloads queued or in progress before new ones are turned down (default 0 = no limit)", Runtime: true},
+	{Name: "MIN_FREE_SPACE", Desc: "free space to keep on the destination, new downloads are turned down below it, e.g. 10GB", Runtime: true},
+	{Name: "PREALLOCATE", Desc: "reserve the space of a file before downloading it (default true)", Runtime: true},
+	{Name: "USER_MAX_FILES_PER_HOUR", Desc: "per-user file rate limit", Runtime: true},
+	{Name: "USER_MAX_BYTES_PER_HOUR", Desc: "per-user size rate limit, e.g. 500MB", Runtime: true},
+	{Name: "USER_MAX_FILES_PER_DAY", Desc: "per-user file rate limit", Runtime: true},
+	{Name: "USER_MAX_BYTES_PER_DAY", Desc: "per-user size rate limit, e.g. 5GB", Runtime: true},
+	{Name: "DRY_RUN", Desc: "go through all checks but don't download (true/false)", Runtime: true},
+	{Name: "DEDUP", Desc: "skip files that were downloaded before (default true)", Runtime: true},
+	{Name: "MAX_SIZE", Desc: "largest accepted file, e.g. 2GB", Runtime: true},
+	{Name: "MEMORY_LIMIT", Desc: "soft memory limit of the process, e.g. 256MB (default: none)"},
+	{Name: "USER_QUOTA", Desc: "total size cap per user, e.g. 50GB", Runtime: true},
+	{Name: "CHAT_QUOTA", Desc: "total size cap per chat, e.g. 200GB", Runtime: true},
+	{Name: "STATE", Desc: "path of the state file"},
+	{Name: "WRITE_LIMITS", Desc: "write throughput caps per folder, e.g. /mnt/hdd=40MB for 40 MB/s", Runtime: true},
+	{Name: "MAX_NAME_BYTES", Desc: "longest file name in bytes, e.g. 143 for eCryptfs (default 255)", Runtime: true},
+	{Name: "UNICODE_FORM", Desc: "Unicode normalization of file names: nfc, nfd (for macOS) or none (default nfc)", Runtime: true},
+	{Name: "ASCII_NAMES", Desc: "transliterate file names to ASCII (true/false)", Runtime: true},
+	{Name: "STAGING_DIR", Desc: "directory for the partial downloads, e.g. on a faster disk (default: next to the file)", Runtime: true},
+	{Name: "OUTBOX_DIR", Desc: "folder whose new files are sent to OUTBOX_CHATID"},
+	{Name: "OUTBOX_CHATID", Desc: "chat the files of OUTBOX_DIR are sent to"},
+	{Name: "BACKUP_CHATID", Desc: "chat /backup sends the archive parts to", Runtime: true},
+	{Name: "PODCAST_DIR", Desc: "folder whose audio files are listed in a podcast feed.xml, relative to DEST or absolute", Runtime: true},
+	{Name: "PODCAST_URL", Desc: "URL PODCAST_DIR is served at, for the enclosures of the feed", Runtime: true},
+	{Name: "TAKEOVER", Desc: "if another instance has the state file, ask it to hand over and wait instead of exiting (true/false)"},
+	{Name: "DRAIN_TIMEOUT", Desc: "how long running downloads may finish before a handover (default 2m)", Runtime: true},
+	{Name: "CONFIRM_TIMEOUT", Desc: "expiry of confirmation buttons, e.g. 1m", Runtime: true},
+	{Name: "NOTIFY_DEBOUNCE", Desc: "hold chat notices this long and send them as one message (default 0 = off)", Runtime: true},
+	{Name: "BATCH_WINDOW", Desc: "files from one user less than this apart share one status message (default 5s, 0 = off)", Runtime: true},
+	{Name: "PROGRESS_INTERVAL", Desc: "how often the status message is edited while downloading (default 5s, 0 = never)", Runtime: true},
+	{Name: "NOTIFY", Desc: "chat notifications about downloads: silent, errors, summary or verbose (default)", Runtime: true},
+	{Name: "SILENT", Desc: "message kinds sent without notification sound: all, status, errors, summary", Runtime: true},
+	{Name: "SILENT_CHATID", Desc: "limit TELEGRAM_SILENT to these chats", Runtime: true},
+	{Name: "REACTIONS", Desc: "react to sent files instead of replying (true/false)", Runtime: true},
+	{Name: "TIMEZONE", Desc: "time zone of dates in folder names, schedules and replies, e.g. Europe/Lisbon (default TZ)", Runtime: true},
+	{Name: "LOCALE", Desc: "language of the bot replies, e.g. pt (default en)", Runtime: true},
+	{Name: "LOCALE_DIR", Desc: "directory with additional <locale>.yaml message catalogs"},
+	{Name: "LOG_FILE", Desc: "also append the log to this file"},
+	{Name: "LOG_LEVEL", Desc: "least important log messages kept: debug, info (default), warn or error", Runtime: true},
+	{Name: "SENTRY_DSN", Desc: "Sentry DSN", Secret: true},
+	{Name: "SENTRY_DSN_FILE", Desc: "file containing the Sentry DSN"},
+	{Name: "ERROR_WEBHOOK", Desc: "URL receiving error reports as JSON", Runtime: true},
+	{Name: "WEBHOOKS", Desc: "comma-separated URLs receiving finished and failed downloads as JSON", Runtime: true},
+	{Name: "WEBHOOK_SECRET", Desc: "HMAC-SHA256 key for signing webhook payloads", Secret: true},
+	{Name: "WEBHOOK_SECRET_FILE", Desc: "file containing the webhook secret"},
+	{Name: "DISCORD_WEBHOOKS", Desc: "comma-separated Discord webhook URLs mirroring finished and failed notices", Runtime: true},
+	{Name: "SLACK_WEBHOOKS", Desc: "comma-separated Slack webhook URLs mirroring finished and failed notices", Runtime: true},
+	{Name: "BLACKHOLES", Desc: "watch folders by caption hashtag for torrents, NZBs and videos, e.g. tv=/watch/sonarr", Runtime: true},
+	{Name: "TAG_FOLDERS", Desc: "put files in a subfolder named after the first caption hashtag (true/false)", Runtime: true},
+	{Name: "GALLERY_INTERVAL", Desc: "how often the index.html gallery of every folder is updated (default 0 = only with /galleryupdate)", Runtime: true},
+	{Name: "CHAT_NAMES", Desc: "chat names for /sendto, e.g. family=-1001234567890", Runtime: true},
+	{Name: "SMTP_ADDR", Desc: "SMTP server for email notifications, e.g. smtp.example.com:587", Runtime: true},
+	{Name: "SMTP_USER", Desc: "SMTP user name", Runtime: true},
+	{Name: "SMTP_PASSWORD", Desc: "SMTP password", Secret: true},
+	{Name: "SMTP_PASSWORD_FILE", Desc: "file containing the SMTP password"},
+	{Name: "SMTP_FROM", Desc: "sender address of email notifications", Runtime: true},
+	{Name: "EMAIL_TO", Desc: "comma-separated addresses receiving email notifications", Runtime: true},
+	{Name: "EMAIL_EVENTS", Desc: "emails to send: failed, summary (default both)", Runtime: true},
+	{Name: "EMAIL_SUMMARY_AT", Desc: "local time of the daily summary email (default 08:00)", Runtime: true},
+	{Name: "PLUGINS", Desc: "comma-separated commands run for the filter, filename, enqueue and complete hooks"},
+	{Name: "MTPROTO_APP_ID", Desc: "api_id from my.telegram.org, enables /backfill with a user account", Runtime: true},
+	{Name: "MTPROTO_APP_HASH", Desc: "api_hash from my.telegram.org", Secret: true},
+	{Name: "MTPROTO_APP_HASH_FILE", Desc: "file containing the MTProto api_hash"},
+	{Name: "MTPROTO_SESSION", Desc: "MTProto session file (default <dest>/.telegram-files-downloader.session)", Runtime: true},
+	{Name: "NEXTCLOUD_URL", Desc: "Nextcloud server to copy finished downloads to, e.g. https://cloud.example.com", Runtime: true},
+	{Name: "NEXTCLOUD_USER", Desc: "Nextcloud user name", Runtime: true},
+	{Name: "NEXTCLOUD_PASSWORD", Desc: "Nextcloud app password", Secret: true},
+	{Name: "NEXTCLOUD_PASSWORD_FILE", Desc: "file containing the Nextcloud app password"},
+	{Name: "NEXTCLOUD_DIR", Desc: "Nextcloud folder for uploads (default /)", Runtime: true},
+	{Name: "NEXTCLOUD_SHARE", Desc: "reply with a public share link to uploaded files (true/false)", Runtime: true},
+	{Name: "NEXTCLOUD_CHUNK_SIZE", Desc: "Nextcloud upload chunk size, at least 5MB (default 10MB)", Runtime: true},
+	{Name: "MQTT_BROKER", Desc: "MQTT broker for job events, e.g. tcp://localhost:1883"},
+	{Name: "MQTT_USER", Desc: "MQTT user name"},
+	{Name: "MQTT_PASSWORD", Desc: "MQTT password", Secret: true},
+	{Name: "MQTT_PASSWORD_FILE", Desc: "file containing the MQTT password"},
+	{Name: "MQTT_TOPIC", Desc: "topic prefix for job events (default telegram-files-downloader)", Runtime: true},
+	{Name: "INSTANCE", Desc: "instance name used in error reports"},
+	{Name: "METRICS_ADDR", Desc: "listen address for Prometheus metrics, e.g. :9090"},
+	{Name: "PPROF_PORT", Desc: "localhost port for net/http/pprof"},
+	{Name: "API_ADDR", Desc: "listen address for the HTTP API, e.g. :8080"},
+	{Name: "API_TOKEN", Desc: "bearer token for the HTTP API", Secret: true},
+	{Name: "API_TOKEN_FILE", Desc: "file containing the HTTP API token"},
+	{Name: "GRPC_ADDR", Desc: "listen address for the gRPC API, e.g. :9443"},
+	{Name: "GRPC_CERT", Desc: "TLS certificate of the gRPC API"},
+	{Name: "GRPC_KEY", Desc: "TLS key of the gRPC API"},
+	{Name: "GRPC_CLIENT_CA", Desc: "CA for client certificates (mTLS) of the gRPC API"},
+	{Name: "WEB_ADDR", Desc: "listen address for the web dashboard, e.g. :8081"},
+	{Name: "WEB_USER", Desc: "basic auth user of the web dashboard", Runtime: true},
+	{Name: "WEB_PASSWORD", Desc: "basic auth password of the web dashboard", Secret: true},
+	{Name: "WEB_PASSWORD_FILE", Desc: "file containing the web dashboard password"},
+}
+
+// describeCfg lists the effective value of every setting, with secrets
+// redacted.
+func describeCfg(c *Cfg) string {
+	limits := map[string]string{}
+	for _, l := range c.RateLimits {
+		w := "HOUR"
+		if l.Window != time.Hour {
+			w = "DAY"
+		}
+		limits["USER_MAX_FILES_PER_"+w] = strconv.Itoa(l.Files)
+		limits["USER_MAX_BYTES_PER_"+w] = units.Format(l.Bytes)
+	}
+	redact := func(v string) string {
+		if v == "" {
+			return ""
+		}
+		return "<redacted>"
+	}
+	values := map[string]string{
+		"CONFIG":                  getenv("TELEGRAM_CONFIG"),
+		"ENV_FILE":                getenv("TELEGRAM_ENV_FILE"),
+		"ENV_PREFIX":              sources().EnvPrefix(),
+		"DEST":                    c.InitialWorkingDir,
+		"TOKEN":                   redact(c.TelegramToken),
+		"TOKEN_FILE":              getenv("TELEGRAM_TOKEN_FILE"),
+		"CHATID":                  fmt.Sprint(c.WhitelistedChatIDs),
+		"BOTS":                    describeBots(c.ExtraBots),
+		"CHANNELS":                describeChannels(c.Channels),
+		"POLL_TIMEOUT":            c.PollTimeout.String(),
+		"HTTP_TIMEOUT":            c.HTTPTimeout.String(),
+		"HTTP_KEEPALIVE":          c.HTTPKeepAlive.String(),
+		"HTTP_IDLE_CONNS":         strconv.Itoa(c.HTTPIdleConns),
+		"HTTP2":                   strconv.FormatBool(c.HTTP2),
+		"ALLOWED_UPDATES":         fmt.Sprint(c.AllowedUpdates),
+		"DROP_PENDING":            strconv.FormatBool(c.DropPending),
+		"CATCHUP_WINDOW":          c.CatchUpWindow.String(),
+		"USERS":                   c.WhitelistedUsers.String(),
+		"ADMINS":                  c.Roles.admins.String(),
+		"UPLOADERS":               c.Roles.uploaders.String(),
+		"VIEWERS":                 c.Roles.viewers.String(),
+		"APPROVAL_CHATID":         strconv.FormatInt(c.ApprovalChatID, 10),
+		"ADMIN_CHATID":            strconv.FormatInt(c.AdminChatID, 10),
+		"RETRY_ATTEMPTS":          strconv.Itoa(c.RetryAttempts),
+		"RETRY_INTERVAL":          c.RetryInterval.String(),
+		"MIN_CONCURRENT":          strconv.Itoa(c.MinConcurrent),
+		"MAX_CONCURRENT":          strconv.Itoa(c.MaxConcurrent),
+		"MAX_QUEUE":               strconv.Itoa(c.MaxQueue),
+		"MIN_FREE_SPACE":          units.Format(c.MinFreeSpace),
+		"PREALLOCATE":             strconv.FormatBool(c.Preallocate),
+		"DRY_RUN":                 strconv.FormatBool(c.DryRun),
+		"DEDUP":                   strconv.FormatBool(c.Dedup),
+		"MAX_SIZE":                units.Format(c.MaxFileSize),
+		"MEMORY_LIMIT":            units.Format(c.MemoryLimit),
+		"USER_QUOTA":              units.Format(c.UserQuota),
+		"CHAT_QUOTA":              units.Format(c.ChatQuota),
+		"STATE":                   c.StatePath,
+		"MAX_NAME_BYTES":          strconv.Itoa(c.MaxNameBytes),
+		"UNICODE_FORM":            c.UnicodeForm,
+		"ASCII_NAMES":             strconv.FormatBool(c.ASCIINames),
+		"STAGING_DIR":             c.StagingDir,
+		"OUTBOX_DIR":              c.OutboxDir,
+		"OUTBOX_CHATID":           strconv.FormatInt(c.OutboxChatID, 10),
+		"BACKUP_CHATID":           strconv.FormatInt(c.BackupChatID, 10),
+		"PODCAST_DIR":             c.PodcastDir,
+		"PODCAST_URL":             c.PodcastURL,
+		"WRITE_LIMITS":            fmt.Sprint(c.WriteLimits),
+		"TAKEOVER":                strconv.FormatBool(c.Takeover),
+		"DRAIN_TIMEOUT":           c.DrainTimeout.String(),
+		"CONFIRM_TIMEOUT":         c.ConfirmTimeout.String(),
+		"PROGRESS_INTERVAL":       c.ProgressInterval.String(),
+		"BATCH_WINDOW":            c.BatchWindow.String(),
+		"NOTIFY_DEBOUNCE":         c.NotifyDebounce.String(),
+		"NOTIFY":                  c.Notify.String(),
+		"SILENT":                  c.Silent.String(),
+		"SILENT_CHATID":           fmt.Sprint(c.Silent.chats),
+		"REACTIONS":               strconv.FormatBool(c.Reactions),
+		"TIMEZONE":                c.Timezone.String(),
+		"LOCALE":                  c.Locale,
+		"LOCALE_DIR":              getenv("TELEGRAM_LOCALE_DIR"),
+		"LOG_FILE":                getenv("TELEGRAM_LOG_FILE"),
+		"LOG_LEVEL":               c.LogLevel.String(),
+		"SENTRY_DSN":              redact(c.SentryDSN),
+		"SENTRY_DSN_FILE":         getenv("TELEGRAM_SENTRY_DSN_FILE"),
+		"ERROR_WEBHOOK":           redact(c.ErrorWebhook),
+		"WEBHOOKS":                redact(strings.Join(c.Webhooks, ",")),
+		"WEBHOOK_SECRET":          redact(c.WebhookSecret),
+		"WEBHOOK_SECRET_FILE":     getenv("TELEGRAM_WEBHOOK_SECRET_FILE"),
+		"DISCORD_WEBHOOKS":        redact(strings.Join(c.DiscordWebhooks, ",")),
+		"SLACK_WEBHOOKS":          redact(strings.Join(c.SlackWebhooks, ",")),
+		"BLACKHOLES":              fmt.Sprint(c.Blackholes),
+		"TAG_FOLDERS":             strconv.FormatBool(c.TagFolders),
+		"GALLERY_INTERVAL":        c.GalleryInterval.String(),
+		"CHAT_NAMES":              fmt.Sprint(c.ChatNames),
+		"SMTP_ADDR":               c.SMTPAddr,
+		"SMTP_USER":               c.SMTPUser,
+		"SMTP_PASSWORD":           redact(c.SMTPPassword),
+		"SMTP_PASSWORD_FILE":      getenv("TELEGRAM_SMTP_PASSWORD_FILE"),
+		"SMTP_FROM":               c.SMTPFrom,
+		"EMAIL_TO":                strings.Join(c.EmailTo, ","),
+		"PLUGINS":                 strings.Join(c.Plugins, ","),
+		"EMAIL_EVENTS":            strings.Join(c.EmailEvents, ","),
+		"EMAIL_SUMMARY_AT":        c.EmailSummaryAt,
+		"MTPROTO_APP_ID":          strconv.Itoa(c.MTProtoAppID),
+		"MTPROTO_APP_HASH":        redact(c.MTProtoAppHash),
+		"MTPROTO_APP_HASH_FILE":   getenv("TELEGRAM_MTPROTO_APP_HASH_FILE"),
+		"MTPROTO_SESSION":         c.MTProtoSession,
+		"NEXTCLOUD_URL":           c.NextcloudURL,
+		"NEXTCLOUD_USER":          c.NextcloudUser,
+		"NEXTCLOUD_PASSWORD":      redact(c.NextcloudPassword),
+		"NEXTCLOUD_PASSWORD_FILE": getenv("TELEGRAM_NEXTCLOUD_PASSWORD_FILE"),
+		"NEXTCLOUD_DIR":           c.NextcloudDir,
+		"NEXTCLOUD_SHARE":         strconv.FormatBool(c.NextcloudShare),
+		"NEXTCLOUD_CHUNK_SIZE":    units.Format(c.NextcloudChunkSize),
+		"MQTT_BROKER":             c.MQTTBroker,
+		"MQTT_USER":               c.MQTTUser,
+		"MQTT_PASSWORD":           redact(c.MQTTPassword),
+		"MQTT_PASSWORD_FILE":      getenv("TELEGRAM_MQTT_PASSWORD_FILE"),
+		"MQTT_TOPIC":              c.MQTTTopic,
+		"INSTANCE":                c.InstanceName,
+		"METRICS_ADDR":            c.MetricsAddr,
+		"API_ADDR":                c.APIAddr,
+		"API_TOKEN":               redact(c.APIToken),
+		"API_TOKEN_FILE":          getenv("TELEGRAM_API_TOKEN_FILE"),
+		"GRPC_ADDR":               c.GRPCAddr,
+		"GRPC_CERT":               c.GRPCCert,
+		"GRPC_KEY":                c.GRPCKey,
+		"GRPC_CLIENT_CA":          c.GRPCClientCA,
+		"WEB_ADDR":                c.WebAddr,
+		"WEB_USER":                c.WebUser,
+		"WEB_PASSWORD":            redact(c.WebPassword),
+		"WEB_PASSWORD_FILE":       getenv("TELEGRAM_WEB_PASSWORD_FILE"),
+		"PPROF_PORT":              c.PprofPort,
+	}
+	for k, v := range limits {
+		values[k] = v
+	}
+
+	out := ""
+	for _, s := range settings {
+		v, ok := values[s.Name]
+		if !ok {
+			v = "0"
+		}
+		out += fmt.Sprintf("%s = %s (%s)\n", strings.ToLower(s.Name), v,
+			sources().Source("TELEGRAM_"+s.Name))
+	}
+	return out
+}
+
+// getenv returns the setting from /set, flags, the environment or the config
+// file.
+func getenv(name string) string {
+	return sources().Get(name)
+}
+
+// initCfg is loadCfg for the subcommands, which exit if the configuration is
+// invalid.
+func initCfg(args []string) {
+	if err := loadCfg(args); errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// loadCfg reads the settings from args (program name first, then flags), the
+// environment and the config file, and makes them the configuration. If it
+// fails, the configuration stays as it was.
+func loadCfg(args []string) error {
+	src := config.New()
+	if err := src.ParseFlags(args, settings); err != nil {
+		return err
+	}
+	if err := src.LoadEnv(); err != nil {
+		return err
+	}
+	if path := src.Get("TELEGRAM_CONFIG"); path != "" {
+		if err := src.LoadFile(path); err != nil {
+			return err
+		}
+	}
+	prev := currentSources.Swap(src)
+	c, err := buildCfg()
+	if err != nil {
+		currentSources.Store(prev)
+		return fmt.Errorf("Invalid configuration:\n%s", err.Error())
+	}
+	out := log.Writer()
+	if path := getenv("TELEGRAM_LOG_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			currentSources.Store(prev)
+			return fmt.Errorf("TELEGRAM_LOG_FILE can't be opened: err=%s", err.Error())
+		}
+		out = io.MultiWriter(os.Stderr, f)
+	}
+	setLogOutput(out)
+	log.Println("Working directory:", c.InitialWorkingDir)
+	currentCfg.Store(c)
+	return nil
+}
+
+// reloadCfg re-reads the config file and swaps in the new configuration. If
+// the file or the configuration is invalid, the file read before stays.
+func reloadCfg() error {
+	src := sources()
+	if path := getenv("TELEGRAM_CONFIG"); path != "" {
+		src = src.Clone()
+		if err := src.LoadFile(path); err != nil {
+			return err
+		}
+	}
+	return applySources(src)
+}
+
+// rebuildCfg applies a change of the current sources, such as a runtime
+// setting, without reading the config file again.
+func rebuildCfg() error {
+	return applySources(sources())
+}
+
+// applySources makes src and the configuration built from it the current
+// ones, or leaves both as they were if it's invalid. Settings that are only
+// used at startup (destination, token, state file, listeners, error
+// reporting) keep their old values.
+func applySources(src *config.Sources) error {
+	prev := currentSources.Swap(src)
+	c, err := buildCfg()
+	if err != nil {
+		currentSources.Store(prev)
+		return err
+	}
+	old := cfg()
+	if c.InitialWorkingDir != old.InitialWorkingDir || c.StatePath != old.StatePath ||
+		c.MetricsAddr != old.MetricsAddr || c.PprofPort != old.PprofPort || c.APIAddr != old.APIAddr ||
+		c.WebAddr != old.WebAddr || c.GRPCAddr != old.GRPCAddr ||
+		c.MQTTBroker != old.MQTTBroker {
+		log.Println("Reload: destination, state and listener changes need a restart")
+	}
+	c.InitialWorkingDir = old.InitialWorkingDir
+	c.TelegramToken = old.TelegramToken
+	// Bots can't be added or removed without a restart.
+	extra := make([]botCfg, 0, len(old.ExtraBots))
+	for _, ob := range old.ExtraBots {
+		for _, nb := range c.ExtraBots {
+			if nb.Name == ob.Name {
+				ob.ChatIDs = nb.ChatIDs
+			}
+		}
+		extra = append(extra, ob)
+	}
+	c.ExtraBots = extra
+	c.StatePath = old.StatePath
+	c.MetricsAddr = old.MetricsAddr
+	c.APIAddr = old.APIAddr
+	c.WebAddr = old.WebAddr
+	c.GRPCAddr = old.GRPCAddr
+	c.PprofPort = old.PprofPort
+	c.GRPCCert = old.GRPCCert
+	c.GRPCKey = old.GRPCKey
+	c.GRPCClientCA = old.GRPCClientCA
+	c.SentryDSN = old.SentryDSN
+	// The listeners keep running, so they still need their credentials.
+	if problems := validateListeners(c); len(problems) > 0 {
+		currentSources.Store(prev)
+		return errors.Join(problems...)
+	}
+	currentCfg.Store(c)
+	log.Println("Configuration reloaded")
+	go registerCommands()
+	return nil
+}
+
+// validateListeners checks that every listener has its credentials.
+func validateListeners(c *Cfg) []error {
+	var problems []error
+	if c.APIAddr != "" && c.APIToken == "" {
+		problems = append(problems, errors.New("TELEGRAM_API_TOKEN is required with TELEGRAM_API_ADDR"))
+	}
+	problems = append(problems, validateGRPC(c)...)
+	if c.WebAddr != "" && (c.WebUser == "" || c.WebPassword == "") {
+		problems = append(problems, errors.New("TELEGRAM_WEB_USER and TELEGRAM_WEB_PASSWORD are required with TELEGRAM_WEB_ADDR"))
+	}
+	return problems
+}
+
+func buildCfg() (*Cfg, error) {
+	cfg := &Cfg{}
+	var problems []error
+	cfg.InitialWorkingDir = getenv("TELEGRAM_DEST")
+	if cfg.InitialWorkingDir == "" {
+		problems = append(problems, errors.New("TELEGRAM_DEST is not set"))
+	} else if abs, err := filepath.Abs(cfg.InitialWorkingDir); err == nil {
+		// Only absolute paths may exceed MAX_PATH on Windows.
+		cfg.InitialWorkingDir = abs
+	}
+
+	var err error
+	cfg.TelegramToken, err = secretEnv("TELEGRAM_TOKEN")
+	if err != nil {
+		problems = append(problems, err)
+	} else if cfg.TelegramToken == "" {
+		problems = append(problems, errors.New("TELEGRAM_TOKEN is not set"))
+	}
+
+	cfg.WhitelistedChatIDs, err = parseChatIDs("TELEGRAM_CHATID", getenv("TELEGRAM_CHATID"))
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	extra, extraProblems := parseExtraBots()
+	cfg.ExtraBots = extra
+	problems = append(problems, extraProblems...)
+	channels, channelProblems := parseChannels()
+	cfg.Channels = channels
+	problems = append(problems, channelProblems...)
+
+	cfg.PollTimeout = 10 * time.Second
+	if v := getenv("TELEGRAM_POLL_TIMEOUT"); v != "" {
+		cfg.PollTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_POLL_TIMEOUT is not a valid duration: err=%s",
+				err.Error()))
+		} else if cfg.PollTimeout < time.Second {
+			problems = append(problems, errors.New("TELEGRAM_POLL_TIMEOUT must be at least 1s"))
+		}
+	}
+	cfg.HTTPTimeout = 30 * time.Second
+	if v := getenv("TELEGRAM_HTTP_TIMEOUT"); v != "" {
+		cfg.HTTPTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_HTTP_TIMEOUT is not a valid duration: err=%s",
+				err.Error()))
+		} else if cfg.HTTPTimeout < time.Second {
+			problems = append(problems, errors.New("TELEGRAM_HTTP_TIMEOUT must be at least 1s"))
+		}
+	}
+	cfg.HTTPKeepAlive = 90 * time.Second
+	if v := getenv("TELEGRAM_HTTP_KEEPALIVE"); v != "" {
+		cfg.HTTPKeepAlive, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_HTTP_KEEPALIVE is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.HTTPIdleConns = 32
+	if v := getenv("TELEGRAM_HTTP_IDLE_CONNS"); v != "" {
+		cfg.HTTPIdleConns, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_HTTP_IDLE_CONNS is not a valid number: err=%s",
+				err.Error()))
+		} else if cfg.HTTPIdleConns < 1 {
+			problems = append(problems, errors.New("TELEGRAM_HTTP_IDLE_CONNS must be at least 1"))
+		}
+	}
+	cfg.HTTP2 = true
+	if v := getenv("TELEGRAM_HTTP2"); v != "" {
+		cfg.HTTP2, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_HTTP2 is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	for _, u := range strings.Split(getenv("TELEGRAM_ALLOWED_UPDATES"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.AllowedUpdates = append(cfg.AllowedUpdates, u)
+		}
+	}
+	if v := getenv("TELEGRAM_DROP_PENDING"); v != "" {
+		cfg.DropPending, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_DROP_PENDING is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.CatchUpWindow = 24 * time.Hour
+	if v := getenv("TELEGRAM_CATCHUP_WINDOW"); v != "" {
+		cfg.CatchUpWindow, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_CATCHUP_WINDOW is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+
+	cfg.BatchWindow = 5 * time.Second
+	if v := getenv("TELEGRAM_BATCH_WINDOW"); v != "" {
+		cfg.BatchWindow, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_BATCH_WINDOW is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+	if v := getenv("TELEGRAM_NOTIFY_DEBOUNCE"); v != "" {
+		cfg.NotifyDebounce, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NOTIFY_DEBOUNCE is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.ProgressInterval = 5 * time.Second
+	if v := getenv("TELEGRAM_PROGRESS_INTERVAL"); v != "" {
+		cfg.ProgressInterval, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_PROGRESS_INTERVAL is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+
+	cfg.Notify = notifyVerbose
+	cfg.LogLevel = logInfo
+	if v := getenv("TELEGRAM_LOG_LEVEL"); v != "" {
+		cfg.LogLevel, err = parseLogLevel(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_LOG_LEVEL is not a valid level: err=%s", err.Error()))
+		}
+	}
+
+	if v := getenv("TELEGRAM_NOTIFY"); v != "" {
+		cfg.Notify, err = parseNotifyLevel(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NOTIFY is not a valid level: err=%s", err.Error()))
+		}
+	}
+
+	cfg.Silent.kinds, err = parseSilentKinds(getenv("TELEGRAM_SILENT"))
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TELEGRAM_SILENT is not valid: err=%s", err.Error()))
+	}
+	cfg.Silent.chats, err = parseChatIDs("TELEGRAM_SILENT_CHATID", getenv("TELEGRAM_SILENT_CHATID"))
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	if v := getenv("TELEGRAM_REACTIONS"); v != "" {
+		cfg.Reactions, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_REACTIONS is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+
+	cfg.Timezone = time.Local
+	if v := getenv("TELEGRAM_TIMEZONE"); v != "" {
+		cfg.Timezone, err = time.LoadLocation(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_TIMEZONE is not a valid time zone: err=%s",
+				err.Error()))
+			cfg.Timezone = time.Local
+		}
+	}
+
+	cfg.Locale = defaultLocale
+	if v := getenv("TELEGRAM_LOCALE"); v != "" {
+		cfg.Locale = strings.ToLower(v)
+	}
+	cfg.Catalog, err = loadCatalog(cfg.Locale, getenv("TELEGRAM_LOCALE_DIR"))
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TELEGRAM_LOCALE is not valid: err=%s", err.Error()))
+	}
+
+	cfg.WhitelistedUsers = parseUserList(getenv("TELEGRAM_USERS"))
+	cfg.Roles = roles{
+		admins:    parseUserList(getenv("TELEGRAM_ADMINS")),
+		uploaders: parseUserList(getenv("TELEGRAM_UPLOADERS")),
+		viewers:   parseUserList(getenv("TELEGRAM_VIEWERS")),
+	}
+
+	if approvalChat := getenv("TELEGRAM_APPROVAL_CHATID"); approvalChat != "" {
+		cfg.ApprovalChatID, err = strconv.ParseInt(approvalChat, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_APPROVAL_CHATID is not a valid number: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.AdminChatID = cfg.ApprovalChatID
+	if adminChat := getenv("TELEGRAM_ADMIN_CHATID"); adminChat != "" {
+		cfg.AdminChatID, err = strconv.ParseInt(adminChat, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_ADMIN_CHATID is not a valid number: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.RetryAttempts = 5
+	if v := getenv("TELEGRAM_RETRY_ATTEMPTS"); v != "" {
+		cfg.RetryAttempts, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_RETRY_ATTEMPTS is not a valid number: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.RetryInterval = time.Hour
+	if v := getenv("TELEGRAM_RETRY_INTERVAL"); v != "" {
+		cfg.RetryInterval, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_RETRY_INTERVAL is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.MinConcurrent = 1
+	if v := getenv("TELEGRAM_MIN_CONCURRENT"); v != "" {
+		cfg.MinConcurrent, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MIN_CONCURRENT is not a valid number: err=%s",
+				err.Error()))
+		} else if cfg.MinConcurrent < 1 {
+			problems = append(problems, errors.New("TELEGRAM_MIN_CONCURRENT must be at least 1"))
+		}
+	}
+	if v := getenv("TELEGRAM_MAX_CONCURRENT"); v != "" {
+		cfg.MaxConcurrent, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MAX_CONCURRENT is not a valid number: err=%s",
+				err.Error()))
+		} else if cfg.MaxConcurrent != 0 && cfg.MaxConcurrent < cfg.MinConcurrent {
+			problems = append(problems, errors.New("TELEGRAM_MAX_CONCURRENT must not be below TELEGRAM_MIN_CONCURRENT"))
+		}
+	}
+	if v := getenv("TELEGRAM_MAX_QUEUE"); v != "" {
+		cfg.MaxQueue, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MAX_QUEUE is not a valid number: err=%s",
+				err.Error()))
+		} else if cfg.MaxQueue < 0 {
+			problems = append(problems, errors.New("TELEGRAM_MAX_QUEUE must not be negative"))
+		}
+	}
+	if v := getenv("TELEGRAM_MIN_FREE_SPACE"); v != "" {
+		cfg.MinFreeSpace, err = units.Parse(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MIN_FREE_SPACE is not a valid size: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.Preallocate = true
+	if v := getenv("TELEGRAM_PREALLOCATE"); v != "" {
+		cfg.Preallocate, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_PREALLOCATE is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+
+	for _, w := range []struct {
+		name   string
+		window time.Duration
+	}{{"HOUR", time.Hour}, {"DAY", 24 * time.Hour}} {
+		l := rateLimit{Window: w.window}
+		if v := getenv("TELEGRAM_USER_MAX_FILES_PER_" + w.name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("TELEGRAM_USER_MAX_FILES_PER_%s is not a valid number: err=%s",
+					w.name, err.Error()))
+			}
+			l.Files = n
+		}
+		if v := getenv("TELEGRAM_USER_MAX_BYTES_PER_" + w.name); v != "" {
+			n, err := units.Parse(v)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("TELEGRAM_USER_MAX_BYTES_PER_%s is not a valid size: err=%s",
+					w.name, err.Error()))
+			}
+			l.Bytes = n
+		}
+		if l.Files > 0 || l.Bytes > 0 {
+			cfg.RateLimits = append(cfg.RateLimits, l)
+		}
+	}
+
+	if v := getenv("TELEGRAM_DRY_RUN"); v != "" {
+		cfg.DryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_DRY_RUN is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.Dedup = true
+	if v := getenv("TELEGRAM_DEDUP"); v != "" {
+		cfg.Dedup, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_DEDUP is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+
+	if v := getenv("TELEGRAM_MAX_SIZE"); v != "" {
+		cfg.MaxFileSize, err = units.Parse(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MAX_SIZE is not a valid size: err=%s",
+				err.Error()))
+		}
+	}
+
+	if v := getenv("TELEGRAM_MEMORY_LIMIT"); v != "" {
+		cfg.MemoryLimit, err = units.Parse(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MEMORY_LIMIT is not a valid size: err=%s",
+				err.Error()))
+		}
+	}
+
+	if v := getenv("TELEGRAM_USER_QUOTA"); v != "" {
+		cfg.UserQuota, err = units.Parse(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_USER_QUOTA is not a valid size: err=%s",
+				err.Error()))
+		}
+	}
+	if v := getenv("TELEGRAM_CHAT_QUOTA"); v != "" {
+		cfg.ChatQuota, err = units.Parse(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_CHAT_QUOTA is not a valid size: err=%s",
+				err.Error()))
+		}
+	}
+
+	cfg.StatePath = getenv("TELEGRAM_STATE")
+	if cfg.StatePath == "" {
+		cfg.StatePath = filepath.Join(cfg.InitialWorkingDir, ".telegram-files-downloader.db")
+	}
+	cfg.MaxNameBytes = defaultMaxNameBytes
+	if v := getenv("TELEGRAM_MAX_NAME_BYTES"); v != "" {
+		cfg.MaxNameBytes, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MAX_NAME_BYTES is not a valid number: err=%s",
+				err.Error()))
+		} else if cfg.MaxNameBytes < minNameBytes {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MAX_NAME_BYTES must be at least %d", minNameBytes))
+		}
+	}
+	cfg.UnicodeForm = "nfc"
+	if v := strings.ToLower(getenv("TELEGRAM_UNICODE_FORM")); v != "" {
+		cfg.UnicodeForm = v
+		if !slices.Contains(unicodeForms, v) {
+			problems = append(problems, fmt.Errorf("TELEGRAM_UNICODE_FORM is not valid: %q, expected one of %s", v,
+				strings.Join(unicodeForms, ", ")))
+		}
+	}
+	if v := getenv("TELEGRAM_ASCII_NAMES"); v != "" {
+		cfg.ASCIINames, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_ASCII_NAMES is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.StagingDir = getenv("TELEGRAM_STAGING_DIR")
+	cfg.OutboxDir = getenv("TELEGRAM_OUTBOX_DIR")
+	if v := getenv("TELEGRAM_OUTBOX_CHATID"); v != "" {
+		cfg.OutboxChatID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_OUTBOX_CHATID is not a valid number: err=%s",
+				err.Error()))
+		}
+	}
+	if v := getenv("TELEGRAM_BACKUP_CHATID"); v != "" {
+		cfg.BackupChatID, err = strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_BACKUP_CHATID is not a valid number: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.PodcastDir = getenv("TELEGRAM_PODCAST_DIR")
+	cfg.PodcastURL = getenv("TELEGRAM_PODCAST_URL")
+	if v := getenv("TELEGRAM_TAKEOVER"); v != "" {
+		cfg.Takeover, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_TAKEOVER is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.DrainTimeout = 2 * time.Minute
+	if v := getenv("TELEGRAM_DRAIN_TIMEOUT"); v != "" {
+		cfg.DrainTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_DRAIN_TIMEOUT is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+
+	cfg.ConfirmTimeout = time.Minute
+	if v := getenv("TELEGRAM_CONFIRM_TIMEOUT"); v != "" {
+		cfg.ConfirmTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_CONFIRM_TIMEOUT is not a valid duration: err=%s",
+				err.Error()))
+		} else if cfg.ConfirmTimeout <= 0 {
+			problems = append(problems, errors.New("TELEGRAM_CONFIRM_TIMEOUT must be positive"))
+		}
+
+	}
+
+	cfg.SentryDSN, err = secretEnv("TELEGRAM_SENTRY_DSN")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	cfg.ErrorWebhook = getenv("TELEGRAM_ERROR_WEBHOOK")
+	for _, u := range strings.Split(getenv("TELEGRAM_WEBHOOKS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.Webhooks = append(cfg.Webhooks, u)
+		}
+	}
+	cfg.WebhookSecret, err = secretEnv("TELEGRAM_WEBHOOK_SECRET")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	for _, u := range strings.Split(getenv("TELEGRAM_DISCORD_WEBHOOKS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.DiscordWebhooks = append(cfg.DiscordWebhooks, u)
+		}
+	}
+	for _, u := range strings.Split(getenv("TELEGRAM_SLACK_WEBHOOKS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			cfg.SlackWebhooks = append(cfg.SlackWebhooks, u)
+		}
+	}
+
+	cfg.Blackholes, err = parseBlackholes(getenv("TELEGRAM_BLACKHOLES"))
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TELEGRAM_BLACKHOLES is not valid: err=%s", err.Error()))
+	}
+	if v := getenv("TELEGRAM_TAG_FOLDERS"); v != "" {
+		cfg.TagFolders, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_TAG_FOLDERS is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	if v := getenv("TELEGRAM_GALLERY_INTERVAL"); v != "" {
+		cfg.GalleryInterval, err = time.ParseDuration(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_GALLERY_INTERVAL is not a valid duration: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.ChatNames, err = parseChatNames(getenv("TELEGRAM_CHAT_NAMES"))
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TELEGRAM_CHAT_NAMES is not valid: err=%s", err.Error()))
+	}
+	cfg.WriteLimits, err = parseWriteLimits(getenv("TELEGRAM_WRITE_LIMITS"))
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TELEGRAM_WRITE_LIMITS is not valid: err=%s", err.Error()))
+	}
+
+	cfg.SMTPAddr = getenv("TELEGRAM_SMTP_ADDR")
+	if cfg.SMTPAddr != "" {
+		if _, _, err := net.SplitHostPort(cfg.SMTPAddr); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_SMTP_ADDR is not valid: err=%s", err.Error()))
+		}
+	}
+	cfg.SMTPUser = getenv("TELEGRAM_SMTP_USER")
+	cfg.SMTPPassword, err = secretEnv("TELEGRAM_SMTP_PASSWORD")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	cfg.SMTPFrom = getenv("TELEGRAM_SMTP_FROM")
+	for _, a := range strings.Split(getenv("TELEGRAM_EMAIL_TO"), ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			addr, err := mail.ParseAddress(a)
+			if err != nil {
+				problems = append(problems, fmt.Errorf("TELEGRAM_EMAIL_TO has an invalid address: %q", a))
+				continue
+			}
+			cfg.EmailTo = append(cfg.EmailTo, addr.Address)
+		}
+	}
+	if cfg.SMTPAddr != "" && len(cfg.EmailTo) > 0 {
+		if _, err := mail.ParseAddress(cfg.SMTPFrom); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_SMTP_FROM is not a valid address: %q", cfg.SMTPFrom))
+		}
+	}
+	cfg.EmailEvents, err = parseEmailEvents(getenv("TELEGRAM_EMAIL_EVENTS"))
+	if err != nil {
+		problems = append(problems, fmt.Errorf("TELEGRAM_EMAIL_EVENTS is not valid: err=%s", err.Error()))
+	}
+	cfg.EmailSummaryAt = defaultEmailSummaryAt
+	if v := getenv("TELEGRAM_EMAIL_SUMMARY_AT"); v != "" {
+		if _, err := time.Parse("15:04", v); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_EMAIL_SUMMARY_AT is not a valid time (HH:MM): %q", v))
+		}
+		cfg.EmailSummaryAt = v
+	}
+	for _, p := range strings.Split(getenv("TELEGRAM_PLUGINS"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			if _, err := exec.LookPath(p); err != nil {
+				problems = append(problems, fmt.Errorf("TELEGRAM_PLUGINS is not valid: err=%s", err.Error()))
+			}
+			cfg.Plugins = append(cfg.Plugins, p)
+		}
+	}
+
+	if v := getenv("TELEGRAM_MTPROTO_APP_ID"); v != "" {
+		cfg.MTProtoAppID, err = strconv.Atoi(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_MTPROTO_APP_ID is not a number: err=%s", err.Error()))
+		}
+	}
+	cfg.MTProtoAppHash, err = secretEnv("TELEGRAM_MTPROTO_APP_HASH")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if cfg.MTProtoAppID != 0 && cfg.MTProtoAppHash == "" {
+		problems = append(problems, fmt.Errorf("TELEGRAM_MTPROTO_APP_HASH is required with TELEGRAM_MTPROTO_APP_ID"))
+	}
+	cfg.MTProtoSession = getenv("TELEGRAM_MTPROTO_SESSION")
+	if cfg.MTProtoSession == "" {
+		cfg.MTProtoSession = filepath.Join(cfg.InitialWorkingDir, ".telegram-files-downloader.session")
+	}
+
+	cfg.NextcloudURL = getenv("TELEGRAM_NEXTCLOUD_URL")
+	if cfg.NextcloudURL != "" {
+		if u, err := url.Parse(cfg.NextcloudURL); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NEXTCLOUD_URL is not a valid URL: %q", cfg.NextcloudURL))
+		}
+		cfg.NextcloudUser = getenv("TELEGRAM_NEXTCLOUD_USER")
+		if cfg.NextcloudUser == "" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NEXTCLOUD_USER is required with TELEGRAM_NEXTCLOUD_URL"))
+		}
+	}
+	cfg.NextcloudPassword, err = secretEnv("TELEGRAM_NEXTCLOUD_PASSWORD")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	cfg.NextcloudDir = getenv("TELEGRAM_NEXTCLOUD_DIR")
+	if v := getenv("TELEGRAM_NEXTCLOUD_SHARE"); v != "" {
+		cfg.NextcloudShare, err = strconv.ParseBool(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NEXTCLOUD_SHARE is not a valid boolean: err=%s",
+				err.Error()))
+		}
+	}
+	cfg.NextcloudChunkSize = defaultNextcloudChunkSize
+	if v := getenv("TELEGRAM_NEXTCLOUD_CHUNK_SIZE"); v != "" {
+		cfg.NextcloudChunkSize, err = units.Parse(v)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NEXTCLOUD_CHUNK_SIZE is not a valid size: err=%s",
+				err.Error()))
+		} else if cfg.NextcloudChunkSize < 5<<20 {
+			problems = append(problems, fmt.Errorf("TELEGRAM_NEXTCLOUD_CHUNK_SIZE must be at least 5MB"))
+		}
+	}
+
+	cfg.MQTTBroker = getenv("TELEGRAM_MQTT_BROKER")
+	cfg.MQTTUser = getenv("TELEGRAM_MQTT_USER")
+	cfg.MQTTPassword, err = secretEnv("TELEGRAM_MQTT_PASSWORD")
+	if err != nil {
+		problems = append(problems, err)
+	}
+	cfg.MQTTTopic = strings.TrimRight(getenv("TELEGRAM_MQTT_TOPIC"), "/")
+	if cfg.MQTTTopic == "" {
+		cfg.MQTTTopic = serviceName
+	}
+	cfg.InstanceName = instanceName()
+
+	cfg.MetricsAddr = getenv("TELEGRAM_METRICS_ADDR")
+
+	cfg.APIAddr = getenv("TELEGRAM_API_ADDR")
+	cfg.APIToken, err = secretEnv("TELEGRAM_API_TOKEN")
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	cfg.GRPCAddr = getenv("TELEGRAM_GRPC_ADDR")
+	cfg.GRPCCert = getenv("TELEGRAM_GRPC_CERT")
+	cfg.GRPCKey = getenv("TELEGRAM_GRPC_KEY")
+	cfg.GRPCClientCA = getenv("TELEGRAM_GRPC_CLIENT_CA")
+
+	cfg.WebAddr = getenv("TELEGRAM_WEB_ADDR")
+	cfg.WebUser = getenv("TELEGRAM_WEB_USER")
+	cfg.WebPassword, err = secretEnv("TELEGRAM_WEB_PASSWORD")
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	cfg.PprofPort = getenv("TELEGRAM_PPROF_PORT")
+	if cfg.PprofPort != "" {
+		if _, err := strconv.ParseUint(cfg.PprofPort, 10, 16); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_PPROF_PORT is not a valid port: err=%s",
+				err.Error()))
+		}
+	}
+
+	problems = append(problems, validateListeners(cfg)...)
+	problems = append(problems, validateCfg(cfg)...)
+	if len(problems) > 0 {
+		return nil, errors.Join(problems...)
+	}
+	return cfg, nil
+}
+
+// validateCfg checks the parsed configuration against the environment, so
+// that problems show up at startup instead of in the middle of a download.
+func validateCfg(cfg *Cfg) []error {
+	var problems []error
+
+	known := map[string]bool{}
+	for _, s := range settings {
+		known["TELEGRAM_"+s.Name] = true
+	}
+	for _, name := range sources().FileNames() {
+		if !known[name] && !strings.HasPrefix(name, "TELEGRAM_BOT_") && !strings.HasPrefix(name, "TELEGRAM_CHANNEL_") {
+			problems = append(problems, fmt.Errorf("config file: unknown setting %q",
+				strings.ToLower(strings.TrimPrefix(name, "TELEGRAM_"))))
+		}
+	}
+
+	if cfg.InitialWorkingDir != "" {
+		if err := probeWritable(cfg.InitialWorkingDir); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_DEST is not usable: err=%s", err.Error()))
+		}
+	}
+	for tag, dir := range cfg.Blackholes {
+		if err := probeWritable(dir); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_BLACKHOLES folder for #%s is not usable: err=%s",
+				tag, err.Error()))
+		}
+	}
+	if cfg.StagingDir != "" {
+		if err := probeWritable(cfg.StagingDir); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_STAGING_DIR is not usable: err=%s", err.Error()))
+		}
+	}
+	if cfg.OutboxDir != "" {
+		if fi, err := os.Stat(cfg.OutboxDir); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_OUTBOX_DIR is not usable: err=%s", err.Error()))
+		} else if !fi.IsDir() {
+			problems = append(problems, errors.New("TELEGRAM_OUTBOX_DIR is not a directory"))
+		}
+		if cfg.OutboxChatID == 0 {
+			problems = append(problems, errors.New("TELEGRAM_OUTBOX_DIR needs TELEGRAM_OUTBOX_CHATID"))
+		}
+	}
+	if cfg.PodcastDir != "" {
+		if u, err := url.Parse(cfg.PodcastURL); cfg.PodcastURL == "" {
+			problems = append(problems, errors.New("TELEGRAM_PODCAST_DIR needs TELEGRAM_PODCAST_URL"))
+		} else if err != nil || u.Scheme != "http" && u.Scheme != "https" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_PODCAST_URL is not an http or https URL: %q",
+				cfg.PodcastURL))
+		}
+	}
+	if dir := filepath.Dir(cfg.StatePath); cfg.StatePath != "" && dir != cfg.InitialWorkingDir {
+		if err := probeWritable(dir); err != nil {
+			problems = append(problems, fmt.Errorf("TELEGRAM_STATE is not usable: err=%s", err.Error()))
+		}
+	}
+	for _, l := range cfg.RateLimits {
+		if l.Files < 0 {
+			problems = append(problems, fmt.Errorf("rate limit per %s must not be negative", l.Window))
+		}
+	}
+	if cfg.ApprovalChatID != 0 && len(cfg.WhitelistedChatIDs) > 0 {
+		found := false
+		for _, id := range cfg.WhitelistedChatIDs {
+			found = found || id == cfg.ApprovalChatID
+		}
+		if !found {
+			problems = append(problems, errors.New("TELEGRAM_APPROVAL_CHATID must be one of TELEGRAM_CHATID"))
+		}
+	}
+	if cfg.ErrorWebhook != "" {
+		if u, err := url.Parse(cfg.ErrorWebhook); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_ERROR_WEBHOOK is not a valid URL: %q", cfg.ErrorWebhook))
+		}
+	}
+	for _, w := range cfg.Webhooks {
+		if u, err := url.Parse(w); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_WEBHOOKS has an invalid URL: %q", w))
+		}
+	}
+	for _, w := range cfg.DiscordWebhooks {
+		if u, err := url.Parse(w); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_DISCORD_WEBHOOKS has an invalid URL: %q", w))
+		}
+	}
+	for _, w := range cfg.SlackWebhooks {
+		if u, err := url.Parse(w); err != nil || u.Host == "" {
+			problems = append(problems, fmt.Errorf("TELEGRAM_SLACK_WEBHOOKS has an invalid URL: %q", w))
+		}
+	}
+	return problems
+}
+
+// probeWritable checks that dir is an existing directory by creating and
+// removing a temporary file in it.
+func probeWritable(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	f, err := os.CreateTemp(dir, ".write-probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// secretEnv reads a secret from the file named by <name>_FILE (e.g. a docker
+// secret under /run/secrets) or, failing that, from <name> itself; both
+// can come from the environment or the config file.
+// The variables are removed from the environment so child processes don't inherit
+// them; this does not hide the values from `docker inspect` or
+// /proc/<pid>/environ, which is what the _FILE variant is for.
+func secretEnv(name string) (string, error) {
+	envName := sources().EnvPrefix() + strings.TrimPrefix(name, "TELEGRAM_")
+	defer os.Unsetenv(envName)
+	defer os.Unsetenv(envName + "_FILE")
+
+	if path := getenv(name + "_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("%s_FILE can't be read: err=%s", name, err.Error())
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return getenv(name), nil
+}
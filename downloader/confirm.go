@@ -0,0 +1,98 @@
+package downloader
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+type confirmation struct {
+	userID int64
+	answer chan bool
+}
+
+var confirmations = struct {
+	sync.Mutex
+	next int
+	m    map[string]confirmation
+}{m: make(map[string]confirmation)}
+
+var (
+	btnConfirm = tele.Btn{Unique: "confirm"}
+	btnCancel  = tele.Btn{Unique: "cancel"}
+)
+
+// askConfirmation shows Confirm/Cancel buttons with the question and blocks
+// until the requesting user answers or cfg().ConfirmTimeout expires, which
+// counts as a "no". Nobody is asked in channels, so existing files are kept.
+func askConfirmation(c tele.Context, question string) bool {
+	if isChannelPost(c) {
+		return false
+	}
+	confirmations.Lock()
+	confirmations.next++
+	id := strconv.Itoa(confirmations.next)
+	answer := make(chan bool, 1)
+	confirmations.m[id] = confirmation{userID: c.Sender().ID, answer: answer}
+	confirmations.Unlock()
+
+	defer func() {
+		confirmations.Lock()
+		delete(confirmations.m, id)
+		confirmations.Unlock()
+	}()
+
+	markup := &tele.ReplyMarkup{}
+	markup.Inline(markup.Row(
+		markup.Data(tr("Confirm"), btnConfirm.Unique, id),
+		markup.Data(tr("Cancel"), btnCancel.Unique, id),
+	))
+	msg, err := apiOf(c).Reply(c.Message(), question, markup)
+	if err != nil {
+		errorf("Confirmation: %s", err.Error())
+		return false
+	}
+
+	select {
+	case ok := <-answer:
+		return ok
+	case <-handlerContext(c).Done():
+		return false
+	case <-time.After(cfg().ConfirmTimeout):
+		apiOf(c).Edit(msg, question+"\n"+tr("Expired, nothing was changed."))
+		return false
+	}
+}
+
+func answerConfirmation(c tele.Context, ok bool) error {
+	confirmations.Lock()
+	conf, found := confirmations.m[c.Data()]
+	confirmations.Unlock()
+	if !found {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Expired")})
+	}
+	if conf.userID != c.Sender().ID {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Only the requester can answer")})
+	}
+
+	select {
+	case conf.answer <- ok:
+	default:
+	}
+	result := tr("Cancelled.")
+	if ok {
+		result = tr("Confirmed.")
+	}
+	c.Edit(c.Message().Text + "\n" + result)
+	return c.Respond()
+}
+
+func handleConfirm(c tele.Context) error {
+	return answerConfirmation(c, true)
+}
+
+func handleCancel(c tele.Context) error {
+	return answerConfirmation(c, false)
+}
@@ -0,0 +1,177 @@
+package downloader
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+//go:embed web/index.html
+var dashboardHTML []byte
+
+// startDashboard serves the web dashboard and, for its scripts, the API
+// under /api/, both behind basic auth.
+func startDashboard(addr string) *http.Server {
+	startThroughputSampler()
+	log.Println("Dashboard listening on:", addr)
+	return serveHTTP("dashboard", addr, dashboardHandler())
+}
+
+func dashboardHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write(dashboardHTML)
+	})
+	mux.Handle("/api/", apiHandler())
+	return basicAuth(sameOrigin(mux))
+}
+
+func basicAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, password, ok := r.BasicAuth()
+		wantUser, wantPassword := cfg().WebUser, cfg().WebPassword
+		if !ok || wantUser == "" || wantPassword == "" ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(wantUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(wantPassword)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="telegram-files-downloader"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sameOrigin refuses the requests that change something, unless they come
+// from the dashboard's own scripts: browsers resend the basic auth
+// credentials with the form posts of any other site. The scripts send
+// X-Requested-With, which a cross-site form can't set, and their Origin,
+// or Referer, is the dashboard's host.
+func sameOrigin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		from := r.Header.Get("Origin")
+		if from == "" {
+			from = r.Header.Get("Referer")
+		}
+		u, err := url.Parse(from)
+		if r.Header.Get("X-Requested-With") == "" || (from != "" && (err != nil || u.Host != r.Host)) {
+			http.Error(w, "cross-origin request refused", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+const (
+	throughputInterval   = 10 * time.Second
+	maxThroughputSamples = 360 // one hour
+)
+
+type throughputSample struct {
+	Time        time.Time `json:"time"`
+	BytesPerSec int64     `json:"bytes_per_sec"`
+}
+
+var throughput = struct {
+	sync.Mutex
+	samples []throughputSample
+}{}
+
+var samplerOnce sync.Once
+
+func startThroughputSampler() {
+	samplerOnce.Do(func() { go sampleThroughput() })
+}
+
+func sampleThroughput() {
+	last := atomic.LoadInt64(&bytesTransferred)
+	t := time.NewTicker(throughputInterval)
+	defer t.Stop()
+	for {
+		var now time.Time
+		select {
+		case now = <-t.C:
+		case <-rootContext().Done():
+			return
+		}
+		total := atomic.LoadInt64(&bytesTransferred)
+		s := throughputSample{Time: now, BytesPerSec: (total - last) / int64(throughputInterval/time.Second)}
+		last = total
+		throughput.Lock()
+		throughput.samples = append(throughput.samples, s)
+		if len(throughput.samples) > maxThroughputSamples {
+			throughput.samples = throughput.samples[1:]
+		}
+		throughput.Unlock()
+	}
+}
+
+func throughputSamples() []throughputSample {
+	throughput.Lock()
+	defer throughput.Unlock()
+	return append([]throughputSample{}, throughput.samples...)
+}
+
+// thumbnail is Telegram's preview image of the sent file, if it has one.
+func (j *job) thumbnail() *tele.Photo {
+	msg := j.c.Message()
+	switch {
+	case msg == nil:
+		return nil
+	case msg.Document != nil:
+		return msg.Document.Thumbnail
+	case msg.Video != nil:
+		return msg.Video.Thumbnail
+	}
+	return nil
+}
+
+func serveThumbnail(w http.ResponseWriter, j *job) {
+	thumb := j.thumbnail()
+	if thumb == nil {
+		http.NotFound(w, nil)
+		return
+	}
+	r, err := apiOf(j.c).File(&thumb.File)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer r.Close()
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=86400")
+	io.Copy(w, r)
+}
+
+type diskInfo struct {
+	Bot   string `json:"bot,omitempty"`
+	Path  string `json:"path"`
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+	Error string `json:"error,omitempty"`
+}
+
+func diskUsage() []diskInfo {
+	var out []diskInfo
+	for _, bc := range cfg().bots() {
+		d := diskInfo{Bot: bc.Name, Path: bc.Dest}
+		var err error
+		if d.Total, d.Free, err = diskSpace(bc.Dest); err != nil {
+			d.Error = err.Error()
+		}
+		out = append(out, d)
+	}
+	return out
+}
@@ -0,0 +1,49 @@
+package downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Only the dashboard's own scripts can change something: a form posted
+// from another site carries the basic auth credentials too.
+func TestDashboardSameOrigin(t *testing.T) {
+	withCfg(t, func(c *Cfg) { c.WebUser, c.WebPassword = "admin", "secret" })
+	tests := []struct {
+		name   string
+		method string
+		header map[string]string
+		want   int
+	}{
+		{name: "read", method: http.MethodGet, want: http.StatusOK},
+		{name: "dashboard", method: http.MethodPost, want: http.StatusOK,
+			header: map[string]string{"X-Requested-With": "fetch", "Origin": "http://dashboard.test"}},
+		{name: "no origin", method: http.MethodPost, want: http.StatusOK,
+			header: map[string]string{"X-Requested-With": "fetch"}},
+		{name: "cross-origin", method: http.MethodPost, want: http.StatusForbidden,
+			header: map[string]string{"X-Requested-With": "fetch", "Origin": "https://evil.example"}},
+		{name: "cross-site referer", method: http.MethodPost, want: http.StatusForbidden,
+			header: map[string]string{"X-Requested-With": "fetch", "Referer": "https://evil.example/page"}},
+		{name: "form", method: http.MethodPost, want: http.StatusForbidden,
+			header: map[string]string{"Origin": "http://dashboard.test"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := "/api/resume"
+			if tt.method == http.MethodGet {
+				path = "/api/stats"
+			}
+			req := httptest.NewRequest(tt.method, "http://dashboard.test"+path, nil)
+			req.SetBasicAuth("admin", "secret")
+			for k, v := range tt.header {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			dashboardHandler().ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"os"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+)
+
+// The dedup index in the state file maps the Telegram file unique ID and the
+// SHA-256 of every downloaded file to where it was stored, so a file that is
+// forwarded again is skipped, even after restarts. Entries whose file was
+// deleted since are ignored.
+
+const dedupBucket = "dedup"
+
+type dedupEntry struct {
+	Path string    `json:"path"`
+	Size int64     `json:"size"`
+	Time time.Time `json:"time"`
+}
+
+// duplicateOf returns the stored copy of the file with the given index key,
+// "id:<unique ID>" or "sha256:<hash>".
+func duplicateOf(key string) (string, bool) {
+	if !cfg().Dedup {
+		return "", false
+	}
+	var e dedupEntry
+	found, err := storage.Get(dedupBucket, key, &e)
+	if err != nil {
+		errorf("Dedup: %s", err.Error())
+		return "", false
+	}
+	if !found {
+		return "", false
+	}
+	if fi, err := os.Stat(e.Path); err != nil || fi.Size() != e.Size {
+		if err := storage.Delete(dedupBucket, key); err != nil {
+			errorf("Dedup: %s", err.Error())
+		}
+		return "", false
+	}
+	return e.Path, true
+}
+
+func rememberFile(uniqueID, sum, path string, size int64) {
+	e := dedupEntry{Path: path, Size: size, Time: time.Now()}
+	for _, key := range []string{"id:" + uniqueID, "sha256:" + sum} {
+		if err := storage.Put(dedupBucket, key, e); err != nil {
+			errorf("Dedup: %s", err.Error())
+		}
+	}
+}
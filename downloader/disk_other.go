@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !windows
+
+package downloader
+
+import "errors"
+
+func diskSpace(path string) (total, free uint64, err error) {
+	return 0, 0, errors.New("disk usage is not supported on this platform")
+}
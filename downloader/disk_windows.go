@@ -0,0 +1,14 @@
+package downloader
+
+import "golang.org/x/sys/windows"
+
+func diskSpace(path string) (total, free uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := windows.GetDiskFreeSpaceEx(p, &free, &total, nil); err != nil {
+		return 0, 0, err
+	}
+	return total, free, nil
+}
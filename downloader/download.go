@@ -0,0 +1,507 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	tele "gopkg.in/telebot.v4"
+)
+
+var errorOutside = errors.New("outside initial working dir")
+
+var errSizeMismatch = errors.New("the file has the wrong size")
+
+func handleStats(c tele.Context) error {
+	s := snapshotStats()
+	msg := tr("Uptime: %s\nSince reset: %s\nDownloads : %d/%d (pending: %d)",
+		time.Since(s.Started), time.Since(s.Reset), s.Total.Done, s.Total.Done+s.Total.Failed, s.Pending)
+	msg += "\n" + tr("Queued: %d, downloading: %d", s.Queued, s.Active)
+	msg += "\n" + tr("Downloaded: %s, cancelled: %d, skipped: %d",
+		units.Format(int64(s.Total.Bytes)), s.Total.Cancelled, s.Total.Skipped)
+	msg += "\n" + tr("Last hour: %s\nLast 24 hours: %s", s.LastHour, s.LastDay)
+	if len(s.ByChat) > 1 {
+		msg += "\n" + tr("Per chat:") + tallyReport(s.ByChat, func(a, b int64) bool { return a < b })
+	}
+	if len(s.ByType) > 1 {
+		msg += "\n" + tr("Per type:") + tallyReport(s.ByType, func(a, b string) bool { return a < b })
+	}
+	if failures := failuresReport(); failures != "" {
+		msg += "\n" + tr("Failures:") + failures
+	}
+	if isPaused() {
+		msg += "\n" + tr("Downloads are paused")
+	}
+	msg += "\n" + tr("Queue wait: %s\nDownload time: %s", &queueWindow, &downloadWindow)
+	msg += "\n" + tr("Time: %s", localNow().Format("2006-01-02 15:04 MST"))
+	msg += "\n" + memoryReport()
+	if floods := floodReport(); floods != "" {
+		msg += "\n" + floods
+	}
+	if transfers := concurrencyReport(); transfers != "" {
+		msg += "\n" + transfers
+	}
+	if active := activeDownloadsReport(); active != "" {
+		msg += "\n" + tr("Active:") + active
+	}
+	log.Println(msg)
+	return replyPre(c, tr("Stats:"), msg)
+}
+
+func handleStatsReset(c tele.Context) error {
+	if !askConfirmation(c, tr("Reset all download counters?")) {
+		return nil
+	}
+
+	prev := counters.Reset()
+	now := localNow()
+	if err := archiveStats(prev, now); err != nil {
+		errorf("Stats archive: %s", err.Error())
+	}
+	queueWindow.Reset()
+	downloadWindow.Reset()
+	resetFailureCounts()
+	logEverywhere(c, "Stats reset. Previous window: %s - %s, downloads: %d/%d",
+		inZone(prev.Reset).Format(time.RFC3339), now.Format(time.RFC3339), prev.Total.Done, prev.Total.Done+prev.Total.Failed)
+	return nil
+}
+
+func logEverywhere(c tele.Context, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	c.Reply(tr(format, args...))
+}
+
+func downloadFile(ctx context.Context, c tele.Context, f *tele.File, fname string, enqueued time.Time) {
+	ctx, span := tracer.Start(ctx, "download job",
+		trace.WithAttributes(attribute.String("file.name", fname)))
+	defer span.End()
+	defer reportPanic(c, map[string]string{"file": fname})
+
+	counters.AddPending(c.Chat().ID, 1)
+	sdNotifyStatus()
+	job := downloadFileInternal(ctx, c, f, fname, enqueued)
+	pending := counters.AddPending(c.Chat().ID, -1)
+	sdNotifyStatus()
+	// The counts are of the chat. A batch sends its own summary, also when
+	// its last file is the chat's last one, and there's none while stopping.
+	if cfg().Notify < notifySummary || job.batch != nil && job.batch.grouped() || rootContext().Err() != nil {
+		return
+	}
+	if pending == 0 {
+		notifyChat(c, kindSummary, "All downloads finished")
+	} else if pending%5 == 0 {
+		notifyChat(c, kindSummary, "Done. Pending downloads: %d", pending)
+	}
+}
+
+func downloadFileInternal(ctx context.Context, c tele.Context, f *tele.File, fname string, enqueued time.Time) *job {
+	fname = safePath(fname)
+	hooks := allHooks()
+	if name := resolveFilename(hooks, fileInfo(c, f, fname)); name != fname {
+		name = safePath(name)
+		log.Printf("Hooks: %s renamed to %s", fname, name)
+		fname = name
+	}
+	fpath := filepath.Join(destinationFor(c, fname), fname)
+	if dir, ok := pairedDir(c, fname); ok {
+		fpath = filepath.Join(dir, filepath.Base(fname))
+	}
+	job := newJob(c, f, fname, fpath, enqueued)
+	tmp := job.tmpPath()
+	job.hooks = hooks
+	trace.SpanFromContext(ctx).SetAttributes(attribute.String("job.id", job.id))
+	jobCreated(ctx, job)
+
+	if err := filterFile(hooks, job.fileInfo()); err != nil {
+		job.finish(jobSkipped, "Skipped: %s (%s)", code(fname), err.Error())
+		return job
+	}
+	if filepath.Dir(fpath) != botCfgFor(c).Dest {
+		if err := os.MkdirAll(filepath.Dir(fpath), 0o755); err != nil {
+			downloadFailed(c, job, "Download", fname, err)
+			return job
+		}
+	}
+	for _, h := range hooks {
+		if h.OnEnqueue != nil {
+			h.OnEnqueue(job.fileInfo())
+		}
+	}
+
+	if dup, ok := duplicateOf("id:" + f.UniqueID); ok {
+		job.finish(jobSkipped, "Skipped: %s (already downloaded to %s)", code(fname), code(dup))
+		return job
+	}
+	if cfg().DryRun {
+		format := "Dry run: would download %s (%s) to %s"
+		if _, err := os.Stat(fpath); err == nil {
+			format = "Dry run: would download %s (%s) to %s, asking before overwriting the existing file"
+		}
+		job.finish(jobSkipped, format, code(fname), units.Format(f.FileSize), code(fpath))
+		return job
+	}
+
+	// The enqueue span is the wait in the queue, until a download slot is
+	// taken. Ending it again on the way out does nothing.
+	_, enqueue := tracer.Start(ctx, "enqueue", trace.WithTimestamp(enqueued))
+	defer enqueue.End()
+	jobCtx := job.start(ctx)
+	if err := job.waitForStart(jobCtx); err != nil {
+		job.cancelled()
+		return job
+	}
+	if err := waitWhilePaused(jobCtx); err != nil {
+		job.cancelled()
+		return job
+	}
+	if err := acquireSlot(jobCtx); err != nil {
+		job.cancelled()
+		return job
+	}
+	enqueue.End()
+
+	started := time.Now()
+
+	_, span := tracer.Start(ctx, "download",
+		trace.WithAttributes(attribute.Int64("file.size", f.FileSize)))
+	progress := newProgressWriter(fname, f.FileSize)
+	job.setProgress(progress)
+	stop := make(chan struct{})
+	go job.follow(progress, stop)
+	hash := sha256.New()
+	err := downloadTo(jobCtx, apiOf(c), f, tmp, progress, hash)
+	releaseSlot(err)
+	close(stop)
+	progress.Close()
+	if errors.Is(err, context.Canceled) {
+		span.End()
+		os.Remove(tmp)
+		job.cancelled()
+		return job
+	}
+	if err != nil {
+		spanError(span, err)
+		span.End()
+		downloadFailed(c, job, "Download", fname, err)
+		return job
+	}
+	span.End()
+	job.setState(stateVerifying)
+
+	if err := checkSize(tmp, f.FileSize); err != nil {
+		os.Remove(tmp)
+		downloadFailed(c, job, "Verify", fname, err)
+		return job
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+	if want := urlChecksum(f); want != "" && want != sum {
+		os.Remove(tmp)
+		downloadFailed(c, job, "Verify", fname, fmt.Errorf("the SHA-256 is %s, expected %s", sum, want))
+		return job
+	}
+	if dup, ok := duplicateOf("sha256:" + sum); ok {
+		os.Remove(tmp)
+		job.finish(jobSkipped, "Skipped: %s (same content as %s)", code(fname), code(dup))
+		return job
+	}
+	if _, err := os.Stat(fpath); err == nil {
+		if !askConfirmation(c, tr("%s already exists. Overwrite?", fname)) {
+			os.Remove(tmp)
+			if jobCtx.Err() != nil {
+				job.cancelled()
+			} else {
+				job.finish(jobSkipped, "Skipped: %s (kept existing file)", code(fname))
+			}
+			return job
+		}
+	}
+	if jobCtx.Err() != nil {
+		os.Remove(tmp)
+		job.cancelled()
+		return job
+	}
+
+	job.setState(stateProcessing)
+	_, span = tracer.Start(ctx, "rename")
+	if err := moveFile(tmp, fpath); err != nil {
+		spanError(span, err)
+		span.End()
+		downloadFailed(c, job, "Rename", fname, err)
+		return job
+	}
+	span.End()
+	var link string
+	if cfg().NextcloudURL != "" {
+		_, uploadSpan := tracer.Start(ctx, "nextcloud")
+		defer uploadSpan.End()
+		link, err = nextcloudUpload(jobCtx, fpath, fname)
+		if err != nil {
+			spanError(uploadSpan, err)
+			downloadFailed(c, job, "Upload", fname, err)
+			return job
+		}
+	}
+	addUsage(c.Sender().ID, c.Chat().ID, progress.Written())
+	duration := time.Since(started)
+	job.setHash(sum)
+	rememberFile(f.UniqueID, sum, fpath, progress.Written())
+	if pair := pairedFile(fpath); pair != "" {
+		job.finish(jobDone, "Done ✅ %s (%s, %s)\nRAW+JPEG pair with %s", code(fname),
+			units.Format(progress.Written()), duration.Round(time.Second/10), code(pair))
+	} else {
+		job.finish(jobDone, "Done ✅ %s (%s, %s)", code(fname), units.Format(progress.Written()),
+			duration.Round(time.Second/10))
+	}
+	if link != "" {
+		notifyChat(c, kindSummary, "Shared %s: %s", fname, link)
+	}
+	return job
+}
+
+func downloadFailed(c tele.Context, job *job, stage, fname string, err error) {
+	kind := countFailure(err)
+	job.finish(jobFailed, "Failed ❌ %s (job %s)\nError: %s (%s): %s", code(fname), job.id, stage, kind,
+		err.Error())
+	reportError(c, err, map[string]string{
+		"stage": strings.ToLower(stage), "reason": kind.String(), "file": fname, "job": job.id})
+	recordFailure(c, job, err)
+}
+
+// Transfers stream through one fixed-size buffer each, so a download takes
+// about copyBufferSize of memory whatever the size of the file.
+const copyBufferSize = 64 << 10
+
+var copyBuffers = sync.Pool{New: func() interface{} {
+	b := make([]byte, copyBufferSize)
+	return &b
+}}
+
+// streamCopy copies src to dst through a pooled buffer. dst is wrapped so
+// that io.CopyBuffer can't hand the copy over to os.File.ReadFrom and its own
+// buffers.
+func streamCopy(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+}
+
+// downloadTo writes the file to path, the bytes going through progress and
+// hash. A URL resumes from what a previous attempt left at path, which then
+// goes through hash first and counts as already written.
+func downloadTo(ctx context.Context, b botAPI, f *tele.File, path string, progress *progressWriter,
+	hash io.Writer) error {
+	var reader io.ReadCloser
+	var offset int64
+	var err error
+	if f.FileURL != "" {
+		reader, offset, err = openURL(ctx, f.FileURL, path)
+	} else {
+		reader, err = b.File(f)
+	}
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	trackPartial(path)
+	if offset > 0 {
+		return resumeTo(ctx, reader, path, progress, hash)
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if cfg().Preallocate && f.FileSize > 0 {
+		if err := preallocate(out, f.FileSize); err != nil {
+			out.Close()
+			os.Remove(path)
+			return fmt.Errorf("preallocating %s: %w", units.Format(f.FileSize), err)
+		}
+	}
+
+	if _, err := streamCopy(throttled(ctx, path, out), io.TeeReader(ctxReader{ctx, reader},
+		io.MultiWriter(progress, hash))); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// checkSize fails a download that isn't the size Telegram reported, such as
+// one cut short by a dropped connection that still ended like a complete one.
+// The failure is retried like any other. A size of 0 is unknown.
+func checkSize(path string, want int64) error {
+	fi, err := os.Stat(path)
+	if err != nil || want <= 0 || fi.Size() == want {
+		return err
+	}
+	return fmt.Errorf("%w: %s on disk, %s expected", errSizeMismatch, units.Format(fi.Size()), units.Format(want))
+}
+
+func handleOnDocument(c tele.Context) error {
+	recordAlbumItem(c.Message())
+	return enqueueDocument(c, c.Message().Document)
+}
+
+// onDocument is handleOnDocument behind the checks of new uploads, the
+// OnDocument handler.
+func onDocument(c tele.Context) error {
+	return requirePermission(permUpload)(maintenanceGuard(handleOnDocument))(c)
+}
+
+// approvedDocument is onDocument for a document an admin approved: the
+// approval grants the upload permission for it, as the sender of a chat that
+// isn't whitelisted has no role. The user whitelist still applies.
+func approvedDocument(c tele.Context) error {
+	return userWhitelist(maintenanceGuard(handleOnDocument))(c)
+}
+
+// enqueueDocument checks the limits and starts downloading doc, replying to
+// the message of c.
+func enqueueDocument(c tele.Context, doc *tele.Document) error {
+	fname := safeFilename(doc.FileName)
+	if doc.FileName == "" {
+		log.Printf("Document without filename: %s", doc.UniqueID)
+		fname = doc.UniqueID
+	}
+	return enqueueFile(c, doc.MediaFile(), fname)
+}
+
+// The reasons admitDownload turns a download down.
+var (
+	errMaintenance = errors.New("maintenance in progress")
+	errOverQuota   = errors.New("over quota")
+	errRateLimited = errors.New("rate limited")
+)
+
+// refusal is an error of admitDownload: a user-facing message that wraps its
+// reason.
+type refusal struct {
+	reason error
+	msg    string
+}
+
+func (r *refusal) Error() string { return r.msg }
+func (r *refusal) Unwrap() error { return r.reason }
+
+// admitDownload is the gate of every new download, from a message, a retry
+// or the gRPC API: maintenance, the quotas and the rate limit of the sender
+// and the chat of c. The size of an admitted file is reserved until
+// releaseQuota.
+func admitDownload(c tele.Context, fname string, size int64) error {
+	userID, chatID := c.Sender().ID, c.Chat().ID
+	if maintenance.Load() {
+		log.Printf("Maintenance, turned down from %s: %s", senderName(c.Sender()), fname)
+		return &refusal{errMaintenance, refuseInMaintenance(chatID)}
+	}
+	if msg := reserveQuota(userID, chatID, size); msg != "" {
+		log.Printf("Over quota %s: %s", senderName(c.Sender()), fname)
+		return &refusal{errOverQuota, msg}
+	}
+	if msg := allowEnqueue(userID, size); msg != "" {
+		releaseQuota(userID, chatID, size)
+		log.Printf("Rate limited %s: %s", senderName(c.Sender()), fname)
+		return &refusal{errRateLimited, msg}
+	}
+	return nil
+}
+
+// enqueueFile is enqueueDocument for a file and a path in the destination.
+func enqueueFile(c tele.Context, f *tele.File, fname string) error {
+	ctx, span := tracer.Start(handlerContext(c), "handle document")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("file.name", fname),
+		attribute.Int64("chat.id", c.Chat().ID))
+
+	if msg := maxSizeMessage(f.FileSize); msg != "" {
+		log.Printf("Too large from %s: %s", senderName(c.Sender()), fname)
+		return c.Reply(msg)
+	}
+	if msg := overloaded(c, fname, f.FileSize); msg != "" {
+		log.Printf("Overloaded, turned down from %s: %s", senderName(c.Sender()), fname)
+		return c.Reply(msg)
+	}
+	if err := admitDownload(c, fname, f.FileSize); err != nil {
+		return c.Reply(err.Error())
+	}
+
+	go func() {
+		defer releaseQuota(c.Sender().ID, c.Chat().ID, f.FileSize)
+		downloadFile(ctx, c, f, fname, time.Now())
+	}()
+	return nil
+}
+
+func newBot(bc botCfg) (*tele.Bot, error) {
+	pref := tele.Settings{
+		Token:  bc.Token,
+		Poller: newPoller(bc),
+		Client: telegramClient(),
+	}
+
+	b, err := tele.NewBot(pref)
+	if err != nil {
+		return nil, err
+	}
+	if bc.Name != "" {
+		log.Printf("Bot %s: @%s, destination: %s", bc.Name, b.Me.Username, bc.Dest)
+	}
+	if cfg().DropPending {
+		// deleteWebhook also works for polling bots and is the only way to
+		// discard the backlog without fetching it.
+		if _, err := b.Raw("deleteWebhook", map[string]bool{"drop_pending_updates": true}); err != nil {
+			errorf("Dropping pending updates failed: %s", err.Error())
+		} else {
+			log.Println("Dropped pending updates")
+		}
+	}
+
+	b.Use(recoverMiddleware)
+
+	// The user whitelist comes first, so that only allowed users can ask for
+	// an approval.
+	b.Use(userWhitelist, chatWhitelist)
+	if len(bc.ChatIDs) != 0 {
+		log.Printf("Whitelisted chat IDs: %v", bc.ChatIDs)
+		if cfg().ApprovalChatID != 0 {
+			log.Printf("Approval requests go to chat: %d", cfg().ApprovalChatID)
+		}
+	}
+	if !cfg().WhitelistedUsers.Empty() {
+		log.Printf("User whitelist enabled")
+	}
+	if !cfg().Roles.Empty() {
+		log.Printf("Role-based access control enabled")
+	}
+	b.Use(auditMiddleware)
+
+	handleCommands(b)
+
+	b.Handle(tele.OnDocument, onDocument)
+	b.Handle(tele.OnMedia, handleOnMedia)
+	b.Handle(tele.OnChannelPost, handleChannelPost)
+	b.Handle(tele.OnEdited, handleEdited)
+	b.Handle(tele.OnEditedChannelPost, handleEditedChannelPost)
+	b.Handle(&btnApprove, handleApprove, requirePermission(permAdmin))
+	b.Handle(&btnReject, handleReject, requirePermission(permAdmin))
+	b.Handle(&btnConfirm, handleConfirm)
+	b.Handle(&btnCancel, handleCancel)
+	b.Handle(&btnJobCancel, handleJobCancel)
+	b.Handle(&btnJobRetry, handleJobRetry, maintenanceGuard)
+	b.Handle(&btnJobInfo, handleJobInfo)
+	b.Handle(&btnBatchRetry, handleBatchRetry, maintenanceGuard)
+	return b, nil
+}
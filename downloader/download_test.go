@@ -0,0 +1,253 @@
+package downloader
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	tele "gopkg.in/telebot.v4"
+)
+
+func TestHandleOnDocument(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string // of the document
+		data     string
+		fail     error // of the download
+		maxSize  int64
+		want     jobOutcome
+		wantName string // in the destination
+		wantText string // of the bot's reply or the final status
+	}{
+		{name: "saved", fileName: "report.pdf", data: "report", want: jobDone, wantName: "report.pdf",
+			wantText: "Done"},
+		{name: "unsafe name", fileName: "../../etc/passwd", data: "passwd", want: jobDone,
+			wantName: ".._.._etc_passwd", wantText: "Done"},
+		{name: "no name", data: "no name", want: jobDone, wantText: "Done"},
+		{name: "failed", fileName: "broken.zip", data: "broken", fail: errors.New("connection reset"),
+			want: jobFailed, wantText: "connection reset"},
+		{name: "too large", fileName: "big.iso", data: "too large", maxSize: 4, wantText: "File too large"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) { c.MaxFileSize = tt.maxSize })
+			b := fakebot.New()
+			f := b.AddFile([]byte(tt.data))
+			if tt.fail != nil {
+				b.FailFile(f.FileID, tt.fail)
+			}
+			msg := newMessage()
+			msg.Document = &tele.Document{File: *f, FileName: tt.fileName}
+			name := safeFilename(tt.fileName)
+			if tt.fileName == "" {
+				name = f.UniqueID
+			}
+			if tt.wantName == "" && tt.want == jobDone {
+				tt.wantName = name
+			}
+			wait := finished(t, name)
+
+			if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				waitEvent(t, b, "reply", tt.wantText)
+				if _, err := os.Stat(filepath.Join(cfg().InitialWorkingDir, name)); !os.IsNotExist(err) {
+					t.Errorf("%s was downloaded: %v", name, err)
+				}
+				return
+			}
+			e := wait()
+			if e.Job.Outcome != tt.want {
+				t.Fatalf("outcome %q, want %q: %s", e.Job.Outcome, tt.want, e.Job.Result)
+			}
+			if !strings.Contains(e.Job.Result, tt.wantText) {
+				t.Errorf("result %q, want %q in it", e.Job.Result, tt.wantText)
+			}
+			if tt.wantName == "" {
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(cfg().InitialWorkingDir, tt.wantName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.data {
+				t.Errorf("%s has %q, want %q", tt.wantName, data, tt.data)
+			}
+		})
+	}
+}
+
+// An existing file is only overwritten once the requester confirms; as in
+// /statsreset the question expires after TELEGRAM_CONFIRM_TIMEOUT.
+func TestExistingFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		button *tele.Btn // pressed, nil to let it expire
+		want   jobOutcome
+		kept   bool // the existing file
+	}{
+		{name: "confirmed", button: &btnConfirm, want: jobDone},
+		{name: "cancelled", button: &btnCancel, want: jobSkipped, kept: true},
+		{name: "expired", want: jobSkipped, kept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) { c.ConfirmTimeout = 200 * time.Millisecond })
+			name := "existing-" + tt.name + ".txt"
+			path := filepath.Join(cfg().InitialWorkingDir, name)
+			if err := os.WriteFile(path, []byte("old"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			b := fakebot.New()
+			f := b.AddFile([]byte("new " + tt.name))
+			msg := newMessage()
+			msg.Document = &tele.Document{File: *f, FileName: name}
+			wait := finished(t, name)
+
+			if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			question := name + " already exists"
+			if tt.button != nil {
+				handler := handleCancel
+				if tt.button == &btnConfirm {
+					handler = handleConfirm
+				}
+				answer(t, b, question, *tt.button, handler)
+			} else {
+				waitEvent(t, b, "edit", "Expired")
+			}
+			if e := wait(); e.Job.Outcome != tt.want {
+				t.Fatalf("outcome %q, want %q: %s", e.Job.Outcome, tt.want, e.Job.Result)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := "new " + tt.name
+			if tt.kept {
+				want = "old"
+			}
+			if string(data) != want {
+				t.Errorf("%s has %q, want %q", name, data, want)
+			}
+			if matches, _ := filepath.Glob(path + ".*.tmp"); len(matches) > 0 {
+				t.Errorf("partial files left: %v", matches)
+			}
+		})
+	}
+}
+
+// An edited message had the file it was saved with, not another one.
+func TestSameFile(t *testing.T) {
+	b := fakebot.New()
+	f := b.AddFile([]byte("edited"))
+	other := b.AddFile([]byte("replaced"))
+	msg := newMessage()
+	msg.Document = &tele.Document{File: *f, FileName: "edited.txt"}
+	wait := finished(t, "edited.txt")
+	if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+		t.Fatal(err)
+	}
+	if e := wait(); e.Job.Outcome != jobDone {
+		t.Fatalf("outcome %q: %s", e.Job.Outcome, e.Job.Result)
+	}
+
+	tests := []struct {
+		name string
+		msg  *tele.Message
+		file *tele.File
+		want bool
+	}{
+		{name: "same file", msg: msg, file: f, want: true},
+		{name: "other file", msg: msg, file: other},
+		{name: "other message", msg: newMessage(), file: f},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameFile(b.Context(tele.Update{EditedMessage: tt.msg}), tt.file); got != tt.want {
+				t.Errorf("sameFile = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// A job only moves along jobTransitions, and stateCounts follows it.
+func TestJobTransition(t *testing.T) {
+	done, failed, cancelled, skipped := jobState(jobDone), jobState(jobFailed), jobState(jobCancelled),
+		jobState(jobSkipped)
+	tests := []struct {
+		from, to jobState
+		want     bool
+	}{
+		{from: stateQueued, to: stateDownloading, want: true},
+		{from: stateQueued, to: cancelled, want: true},
+		{from: stateQueued, to: skipped, want: true},
+		{from: stateQueued, to: stateVerifying},
+		{from: stateQueued, to: done},
+		{from: stateDownloading, to: stateVerifying, want: true},
+		{from: stateDownloading, to: failed, want: true},
+		{from: stateDownloading, to: skipped},
+		{from: stateDownloading, to: stateQueued},
+		{from: stateVerifying, to: stateProcessing, want: true},
+		{from: stateVerifying, to: skipped, want: true},
+		{from: stateVerifying, to: done},
+		{from: stateProcessing, to: done, want: true},
+		{from: stateProcessing, to: failed, want: true},
+		{from: stateProcessing, to: cancelled},
+		{from: done, to: failed},
+		{from: cancelled, to: stateQueued},
+	}
+	// count is the number of jobs in s, zero for the outcomes, which aren't
+	// counted.
+	count := func(s jobState) int64 {
+		if n := stateCounts[s]; n != nil {
+			return n.Load()
+		}
+		return 0
+	}
+	add := func(s jobState, delta int64) {
+		if n := stateCounts[s]; n != nil {
+			n.Add(delta)
+		}
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.from)+"→"+string(tt.to), func(t *testing.T) {
+			j := &job{id: "transition", state: tt.from, since: map[jobState]time.Time{}}
+			add(tt.from, 1) // as newJob counts a queued job
+			from, to := count(tt.from), count(tt.to)
+
+			j.mu.Lock()
+			got := j.transition(tt.to)
+			j.mu.Unlock()
+			wantFrom, wantTo, wantState := from, to, tt.from
+			if tt.want {
+				defer add(tt.to, -1)
+				wantState, wantFrom = tt.to, from-1
+				if !tt.to.final() {
+					wantTo++
+				}
+			} else {
+				defer add(tt.from, -1)
+			}
+			if got != tt.want {
+				t.Errorf("transition = %v, want %v", got, tt.want)
+			}
+			if j.state != wantState {
+				t.Errorf("state %s, want %s", j.state, wantState)
+			}
+			if tt.want && j.since[tt.to].IsZero() {
+				t.Errorf("no time for %s", tt.to)
+			}
+			if count(tt.from) != wantFrom || count(tt.to) != wantTo {
+				t.Errorf("%d jobs %s and %d %s, want %d and %d", count(tt.from), tt.from, count(tt.to), tt.to,
+					wantFrom, wantTo)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package downloader
+
+import (
+	"log"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Editing a message can attach a file to it or replace its file with another.
+// The new file is downloaded like one just sent, but only when the file
+// changed: most edits are of the caption only, and those leave the message
+// with the file it had. The file was already seen when a job of the same
+// message has it, in memory, in the history or among the failed downloads.
+// A download of the file it replaced goes on.
+
+// sameFile tells whether the message of c had f before the edit.
+func sameFile(c tele.Context, f *tele.File) bool {
+	key := failedKey(c)
+	jobs.Lock()
+	for _, j := range jobs.m {
+		if j.c.Message() != nil && failedKey(j.c) == key && j.file.UniqueID == f.UniqueID {
+			jobs.Unlock()
+			return true
+		}
+	}
+	jobs.Unlock()
+
+	found, err := storage.Get(historyFilesBucket, historyFileKey(c, f), new(string))
+	if err != nil {
+		errorf("Edited: %s", err.Error())
+	}
+	if found {
+		return true
+	}
+	var fd failedDownload
+	found, err = storage.Get(failedBucket, key, &fd)
+	if err != nil {
+		errorf("Edited: %s", err.Error())
+	}
+	return found && fd.UniqueID == f.UniqueID
+}
+
+// editedFile is the file an edit brought and its name, nil if it's not a new
+// one.
+func editedFile(c tele.Context) (*tele.File, string) {
+	_, f, name := channelMedia(c.Message())
+	if f == nil || sameFile(c, f) {
+		return nil, ""
+	}
+	return f, name
+}
+
+func handleEdited(c tele.Context) error {
+	m := c.Message()
+	recordAlbumItem(m)
+	f, name := editedFile(c)
+	if f == nil {
+		return nil
+	}
+	// The checks come only now, so edits of text messages go unanswered.
+	return requirePermission(permUpload)(maintenanceGuard(func(c tele.Context) error {
+		log.Printf("Edited message %d from %s has a new file: %s", m.ID, senderName(c.Sender()), name)
+		if m.Document != nil {
+			return enqueueDocument(c, m.Document)
+		}
+		return enqueueFile(c, f, name)
+	}))(c)
+}
+
+func handleEditedChannelPost(c tele.Context) error {
+	if f, _ := editedFile(c); f == nil {
+		return nil
+	}
+	return handleChannelPost(c)
+}
@@ -0,0 +1,141 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+// Email events: a mail for every failed download and a daily summary, for
+// admins that don't watch the chats themselves.
+const (
+	emailFailed  = "failed"
+	emailSummary = "summary"
+)
+
+const defaultEmailSummaryAt = "08:00"
+
+func parseEmailEvents(s string) ([]string, error) {
+	if s == "" {
+		return []string{emailFailed, emailSummary}, nil
+	}
+	var events []string
+	for _, e := range strings.Split(s, ",") {
+		switch e = strings.TrimSpace(e); e {
+		case emailFailed, emailSummary:
+			events = append(events, e)
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown event %q (want failed or summary)", e)
+		}
+	}
+	return events, nil
+}
+
+// startEmail mails failed downloads and the daily summary. Like webhooks,
+// the recipients can change on reload, so both always run.
+func startEmail() {
+	events, _ := subscribeEvents(rootContext())
+	go func() {
+		for e := range events {
+			if e.Type != eventFailed || !emailEnabled(emailFailed) {
+				continue
+			}
+			go sendEmail(fmt.Sprintf("Download failed: %s", e.Job.Name),
+				fmt.Sprintf("Job: %s\nFile: %s\nPath: %s\nSize: %s\nChat: %d\nSender: %s\n\n%s\n",
+					e.Job.ID, e.Job.Name, e.Job.Path, units.Format(e.Job.Size), e.Job.ChatID, e.Job.Sender,
+					e.Job.Result))
+		}
+	}()
+	go func() {
+		for {
+			if !sleepContext(rootContext(), time.Until(nextSummary(localNow(), cfg().EmailSummaryAt))) {
+				return
+			}
+			if emailEnabled(emailSummary) {
+				sendEmail("Daily summary", dailySummary())
+			}
+		}
+	}()
+}
+
+func emailEnabled(event string) bool {
+	return cfg().SMTPAddr != "" && len(cfg().EmailTo) > 0 && slices.Contains(cfg().EmailEvents, event)
+}
+
+// nextSummary returns the next time of day at (HH:MM, in the zone of now)
+// after now.
+func nextSummary(now time.Time, at string) time.Time {
+	t, err := time.Parse("15:04", at)
+	if err != nil {
+		t, _ = time.Parse("15:04", defaultEmailSummaryAt)
+	}
+	next := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// dailySummary lists the downloads finished in the last 24 hours.
+func dailySummary() string {
+	since := time.Now().Add(-24 * time.Hour)
+	var b strings.Builder
+	counts := map[jobOutcome]int{}
+	var lines []string
+	for _, j := range listJobs(true) {
+		if j.Finished == nil || j.Finished.Before(since) {
+			continue
+		}
+		counts[j.Outcome]++
+		lines = append(lines, fmt.Sprintf("%s %s: %s", inZone(*j.Finished).Format("15:04"), j.Outcome, j.Result))
+	}
+	fmt.Fprintf(&b, "Last 24 hours: %d done, %d failed, %d cancelled, %d skipped\n",
+		counts[jobDone], counts[jobFailed], counts[jobCancelled], counts[jobSkipped])
+	total := counters.Total()
+	fmt.Fprintf(&b, "Since start: %d ok (%s), %d failed, %d pending\n",
+		total.Done, units.Format(int64(total.Bytes)), total.Failed, pendingDownloads())
+	if isPaused() {
+		b.WriteString("Downloads are paused\n")
+	}
+	if len(lines) > 0 {
+		b.WriteString("\n" + strings.Join(lines, "\n") + "\n")
+	}
+	return b.String()
+}
+
+func sendEmail(subject, body string) {
+	c := cfg()
+	subject = fmt.Sprintf("[%s] %s", c.InstanceName, subject)
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.SMTPFrom)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.EmailTo, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if c.SMTPUser != "" {
+		host, _, _ := net.SplitHostPort(c.SMTPAddr)
+		auth = smtp.PlainAuth("", c.SMTPUser, c.SMTPPassword, host)
+	}
+	from := c.SMTPFrom
+	if addr, err := mail.ParseAddress(from); err == nil {
+		from = addr.Address
+	}
+	if err := smtp.SendMail(c.SMTPAddr, auth, from, c.EmailTo, msg.Bytes()); err != nil {
+		errorf("Email: %s", err.Error())
+		return
+	}
+	log.Printf("Email sent: %s", subject)
+}
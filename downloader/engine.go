@@ -0,0 +1,260 @@
+// Package downloader is the Telegram files downloader: bots that save the
+// files sent to them, with the commands, limits and integrations described in
+// the README. Main is the command; other programs can embed an Engine.
+package downloader
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/stats"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"google.golang.org/grpc"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Engine runs the configured bots and the services around them. The
+// configuration, the counters and the state file are process-wide, so there
+// is at most one Engine per process lifetime: one that was stopped can't be
+// replaced by a new one, as Stop ends the background workers for good.
+type Engine struct {
+	bots []*tele.Bot
+
+	mu      sync.Mutex
+	cleanup []func()
+	// The listeners, shut down by close before the cleanup.
+	servers    []*http.Server
+	grpcServer *grpc.Server
+}
+
+var errEngineExists = errors.New("an Engine was already created in this process")
+
+var engineCreated atomic.Bool
+
+// New loads the configuration from args (program name first, then flags), the
+// environment and the config file, opens the state file, starts the enabled
+// listeners and integrations and connects the bots. It fails if the
+// configuration is invalid, with flag.ErrHelp for -h, or if another Engine
+// was created before, even if it was stopped since.
+func New(args []string) (*Engine, error) {
+	if !engineCreated.CompareAndSwap(false, true) {
+		return nil, errEngineExists
+	}
+	e, err := newEngine(args)
+	if err != nil {
+		engineCreated.Store(false)
+		return nil, err
+	}
+	return e, nil
+}
+
+// newEngine does the steps that can fail first, undoing them if one does.
+func newEngine(args []string) (*Engine, error) {
+	if err := loadCfg(args); err != nil {
+		return nil, err
+	}
+	counters = stats.New()
+	e := &Engine{}
+	if limit := cfg().MemoryLimit; limit > 0 {
+		debug.SetMemoryLimit(limit)
+		log.Printf("Memory limit: %s", units.Format(limit))
+	}
+
+	if err := openState(); err != nil {
+		return nil, err
+	}
+	e.cleanup = append(e.cleanup, storage.Close, removePID, saveOffsets)
+	loadMaintenance()
+	loadRuntimeSettings()
+
+	if err := initErrorReporting(); err != nil {
+		e.close()
+		return nil, err
+	}
+	e.cleanup = append(e.cleanup, flushErrorReporting)
+	for _, bc := range cfg().bots() {
+		b, err := newBot(bc)
+		if err != nil {
+			e.close()
+			return nil, err
+		}
+		e.bots = append(e.bots, b)
+	}
+	if cfg().GRPCAddr != "" {
+		s, err := startGRPC(cfg().GRPCAddr)
+		if err != nil {
+			e.close()
+			return nil, err
+		}
+		e.grpcServer = s
+	}
+
+	if cfg().MetricsAddr != "" {
+		e.servers = append(e.servers, startMetrics(cfg().MetricsAddr))
+	}
+	if cfg().PprofPort != "" {
+		e.servers = append(e.servers, startPprof(cfg().PprofPort))
+	}
+	if cfg().APIAddr != "" {
+		e.servers = append(e.servers, startAPI(cfg().APIAddr))
+	}
+	if cfg().WebAddr != "" {
+		e.servers = append(e.servers, startDashboard(cfg().WebAddr))
+	}
+
+	startWebhooks()
+	startEmail()
+	startMirrors()
+	if cfg().MQTTBroker != "" {
+		startMQTT()
+	}
+
+	shutdownTracing := initTracing()
+	e.cleanup = append(e.cleanup, func() { shutdownTracing(context.Background()) })
+
+	runningBots.bots = e.bots
+	registerCommands()
+	startConcurrency()
+	if cfg().OutboxDir != "" {
+		startOutbox(e.bots[0])
+	}
+	recoverAtStart(e.bots[0])
+	startRetries()
+	startGallery()
+	startPodcast()
+	return e, nil
+}
+
+// Bots returns the bots, the first one configured with TELEGRAM_TOKEN, e.g.
+// to register additional handlers before Start.
+func (e *Engine) Bots() []*tele.Bot {
+	return e.bots
+}
+
+const shutdownTimeout = 10 * time.Second
+
+// Start handles updates until Stop is called, then flushes the error reports
+// and closes the state file.
+func (e *Engine) Start() {
+	startWatchdog()
+	sdNotify("READY=1")
+	sdNotifyStatus()
+
+	var wg sync.WaitGroup
+	for _, b := range e.bots {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.Start()
+		}()
+	}
+	wg.Wait()
+	// The cancelled downloads still clean up and record their outcome.
+	for deadline := time.Now().Add(shutdownTimeout); pendingDownloads() > 0 &&
+		time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	e.close()
+}
+
+// close shuts the listeners down, letting the requests in flight finish for
+// up to shutdownTimeout, then runs the cleanup, the last step first.
+func (e *Engine) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, srv := range e.servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			srv.Close()
+		}
+	}
+	e.servers = nil
+	if e.grpcServer != nil {
+		e.grpcServer.GracefulStop()
+		e.grpcServer = nil
+	}
+	for i := len(e.cleanup) - 1; i >= 0; i-- {
+		e.cleanup[i]()
+	}
+	e.cleanup = nil
+}
+
+// Stop cancels the downloads in progress and the background workers, and
+// stops polling. The unfinished downloads are resumed by the next start.
+func (e *Engine) Stop() {
+	saveHandover()
+	stopLifecycle()
+	for _, b := range e.bots {
+		b.Stop()
+	}
+}
+
+// Drain hands over to the next process: queued downloads are held, the
+// running ones get TELEGRAM_DRAIN_TIMEOUT to finish, then it stops like Stop.
+func (e *Engine) Drain() {
+	log.Printf("Draining, waiting up to %s for %d downloads", cfg().DrainTimeout, activeJobs())
+	setPaused(true)
+	for deadline := time.Now().Add(cfg().DrainTimeout); activeJobs() > 0 && time.Now().Before(deadline); {
+		time.Sleep(100 * time.Millisecond)
+	}
+	e.Stop()
+}
+
+// Main runs the command: the subcommands mtproto-login and import <dir>, or
+// the bots, as a Windows service when started by the service manager.
+func Main() {
+	// Subcommands come first, the flags follow them.
+	args := os.Args
+	switch {
+	case len(args) > 1 && args[1] == "mtproto-login":
+		initCfg(append(args[:1:1], args[2:]...))
+		mtprotoLogin()
+		return
+	case len(args) > 2 && args[1] == "import":
+		initCfg(append(args[:1:1], args[3:]...))
+		importExport(args[2])
+		return
+	}
+
+	if runService(args) {
+		return
+	}
+	e, err := New(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatal(err)
+	}
+	handleSIGHUP()
+	// SIGINT and SIGTERM cancel the downloads, removing the partial files,
+	// and close the state file before exiting.
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		log.Printf("%s received, shutting down", <-stop)
+		e.Stop()
+	}()
+	// The drain signal comes from a new instance with TELEGRAM_TAKEOVER.
+	if drainSignal != nil {
+		drain := make(chan os.Signal, 1)
+		signal.Notify(drain, drainSignal)
+		go func() {
+			log.Printf("%s received, handing over", <-drain)
+			e.Drain()
+		}()
+	}
+	e.Start()
+}
@@ -0,0 +1,275 @@
+package downloader
+
+import (
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// fakeTelegram answers the Bot API calls the Engine makes itself: getMe
+// when connecting, getUpdates while polling, and true for the rest, such as
+// setMyCommands. Other hosts, such as the servers of /mirror tests, are
+// reached for real.
+type fakeTelegram struct{}
+
+func (fakeTelegram) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != botAPIHost {
+		return http.DefaultTransport.RoundTrip(req)
+	}
+	var body string
+	switch filepath.Base(req.URL.Path) {
+	case "getMe":
+		body = `{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"Test","username":"test_bot"}}`
+	case "getUpdates":
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+		body = `{"ok":true,"result":[]}`
+	default:
+		body = `{"ok":true,"result":true}`
+	}
+	return &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Type": {"application/json"}},
+		Body: io.NopCloser(strings.NewReader(body)), Request: req}, nil
+}
+
+// newTestEngine builds the Engine of the tests, with the destination and
+// the state file in dir, connected to fakeTelegram.
+func newTestEngine(dir string) (*Engine, error) {
+	dest := filepath.Join(dir, "dest")
+	if err := os.Mkdir(dest, 0o755); err != nil {
+		return nil, err
+	}
+	os.Setenv("TELEGRAM_TOKEN", "1:test")
+	os.Setenv("TELEGRAM_DEST", dest)
+	os.Setenv("TELEGRAM_STATE", filepath.Join(dir, "state.db"))
+	os.Setenv("TELEGRAM_ENV_FILE", os.DevNull)
+	telegramClient = func() *http.Client { return &http.Client{Transport: fakeTelegram{}} }
+	return New([]string{"downloader.test"})
+}
+
+func TestEngine(t *testing.T) {
+	bots := engine.Bots()
+	if len(bots) != 1 || bots[0].Me.Username != "test_bot" {
+		t.Fatalf("bots %v, want test_bot", bots)
+	}
+	if got := filepath.Base(cfg().InitialWorkingDir); got != "dest" {
+		t.Errorf("destination %s, want dest", cfg().InitialWorkingDir)
+	}
+	if _, err := New([]string{"downloader.test"}); !errors.Is(err, errEngineExists) {
+		t.Errorf("second New: %v, want %v", err, errEngineExists)
+	}
+}
+
+// close shuts the listeners down, so their addresses can be used again, e.g.
+// by the next Engine after New failed.
+func TestEngineCloseServers(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	e := &Engine{servers: []*http.Server{startMetrics(addr)}}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		resp, err := http.Get("http://" + addr + "/metrics")
+		if err == nil {
+			resp.Body.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+	}
+	e.close()
+	lis, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatalf("%s still in use after close: %v", addr, err)
+	}
+	lis.Close()
+}
+
+// A configuration that can't be loaded is an error, and the one in use
+// stays.
+func TestLoadCfg(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{name: "help", args: []string{"-h"}, wantErr: flag.ErrHelp.Error()},
+		{name: "unknown flag", args: []string{"-no-such-flag"}, wantErr: "no-such-flag"},
+		{name: "no token", env: map[string]string{"TELEGRAM_TOKEN": ""}, wantErr: "TELEGRAM_TOKEN"},
+		{name: "missing destination", args: []string{"-dest", filepath.Join(t.TempDir(), "missing")},
+			wantErr: "TELEGRAM_DEST"},
+		{name: "invalid value", args: []string{"-max-size", "lots"}, wantErr: "TELEGRAM_MAX_SIZE"},
+		{name: "gRPC token in plaintext", args: []string{"-grpc-addr", ":9443"},
+			env: map[string]string{"TELEGRAM_API_TOKEN": "secret"}, wantErr: "TELEGRAM_GRPC_CERT"},
+		{name: "missing config file", args: []string{"-config", filepath.Join(t.TempDir(), "config.yaml")},
+			wantErr: "Config file can't be read"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TELEGRAM_TOKEN", "1:test")
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			prev, dest := cfg(), getenv("TELEGRAM_DEST")
+			err := loadCfg(append([]string{"downloader.test"}, tt.args...))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("loadCfg: %v, want %q", err, tt.wantErr)
+			}
+			if cfg() != prev || getenv("TELEGRAM_DEST") != dest {
+				t.Errorf("the configuration changed")
+			}
+		})
+	}
+}
+
+// A config file that fails the reload is dropped: the next runtime setting
+// still builds on the file that was valid.
+func TestReloadInvalidFile(t *testing.T) {
+	prevCfg, prevSources := cfg(), sources()
+	t.Cleanup(func() {
+		currentSources.Store(prevSources)
+		currentCfg.Store(prevCfg)
+	})
+	t.Setenv("TELEGRAM_TOKEN", "1:test")
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("max_size: 1MB\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCfg([]string{"downloader.test", "-config", path}); err != nil {
+		t.Fatal(err)
+	}
+	want := cfg().MaxFileSize
+
+	if err := os.WriteFile(path, []byte("max_size: lots\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadCfg(); err == nil {
+		t.Fatal("reload of an invalid file succeeded")
+	}
+	undo := sources().Set("TELEGRAM_LOG_LEVEL", "debug")
+	defer undo()
+	if err := rebuildCfg(); err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg().MaxFileSize; got != want {
+		t.Errorf("max size %d after a runtime setting, want %d of the valid file", got, want)
+	}
+}
+
+// A download is saved for the next process once it's queued and dropped when
+// it finishes, unless a stop interrupted it: then the next start resumes it.
+func TestHandover(t *testing.T) {
+	tests := []struct {
+		name     string
+		stopped  bool // by saveHandover and the cancel of the stop
+		wantKept bool
+	}{
+		{name: "finished"},
+		{name: "stopped", stopped: true, wantKept: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setPaused(true)
+			t.Cleanup(func() { setPaused(false) })
+			b := fakebot.New()
+			f := b.AddFile([]byte("handover " + tt.name))
+			name := "handover-" + tt.name + ".bin"
+			msg := newMessage()
+			msg.Document = &tele.Document{File: *f, FileName: name}
+			wait := finished(t, name)
+			if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			j := queuedJob(t, name, "")
+			if !handedOver(t, j.id) {
+				t.Fatalf("job %s not saved once queued", j.id)
+			}
+
+			if tt.stopped {
+				saveHandover()
+				cancelJob(t, j)
+			} else {
+				setPaused(false)
+			}
+			if e := wait(); e.Job.Outcome == jobFailed {
+				t.Fatalf("failed: %s", e.Job.Result)
+			}
+			if kept := handedOver(t, j.id); kept != tt.wantKept {
+				t.Fatalf("job %s kept %v, want %v", j.id, kept, tt.wantKept)
+			}
+			if !tt.stopped {
+				return
+			}
+
+			wait = finished(t, name)
+			if n := resumeHandover(); n != 1 {
+				t.Fatalf("%d downloads resumed, want 1", n)
+			}
+			resumed := queuedJob(t, name, j.id)
+			if handedOver(t, j.id) || !handedOver(t, resumed.id) {
+				t.Errorf("job %s still saved or %s not saved", j.id, resumed.id)
+			}
+			cancelJob(t, resumed)
+			wait()
+			if handedOver(t, resumed.id) {
+				t.Errorf("cancelled job %s still saved", resumed.id)
+			}
+		})
+	}
+}
+
+// queuedJob waits for the unfinished job of name other than job except.
+func queuedJob(t *testing.T, name, except string) *job {
+	t.Helper()
+	for timeout := time.Now().Add(10 * time.Second); time.Now().Before(timeout); {
+		jobs.Lock()
+		for _, j := range jobs.m {
+			if j.name == name && j.id != except && !j.apiJob().State.final() {
+				jobs.Unlock()
+				return j
+			}
+		}
+		jobs.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s wasn't queued", name)
+	return nil
+}
+
+// cancelJob cancels j once it can be.
+func cancelJob(t *testing.T, j *job) {
+	t.Helper()
+	for timeout := time.Now().Add(10 * time.Second); j.Cancel("test") != nil; {
+		if time.Now().After(timeout) {
+			t.Fatalf("job %s can't be cancelled", j.id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func handedOver(t *testing.T, id string) bool {
+	t.Helper()
+	found, err := storage.Get(handoverBucket, id, &savedDownload{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return found
+}
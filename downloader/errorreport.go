@@ -0,0 +1,116 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"time"
+
+	"github.com/getsentry/sentry-go"
+	tele "gopkg.in/telebot.v4"
+)
+
+var errorWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func initErrorReporting() error {
+	if cfg().SentryDSN != "" {
+		err := sentry.Init(sentry.ClientOptions{
+			Dsn:        cfg().SentryDSN,
+			ServerName: cfg().InstanceName,
+		})
+		if err != nil {
+			return fmt.Errorf("Sentry init failed: err=%s", err.Error())
+		}
+		log.Println("Sentry error reporting enabled")
+	}
+	if cfg().ErrorWebhook != "" {
+		log.Println("Error webhook enabled:", cfg().ErrorWebhook)
+	}
+	return nil
+}
+
+func flushErrorReporting() {
+	if cfg().SentryDSN != "" {
+		sentry.Flush(5 * time.Second)
+	}
+}
+
+// reportError forwards an error with its context to Sentry and/or the
+// generic error webhook. Both are optional and reporting never blocks the
+// caller on failures.
+func reportError(c tele.Context, err error, extra map[string]string) {
+	if extra == nil {
+		extra = map[string]string{}
+	}
+	if c != nil && c.Chat() != nil {
+		extra["chat_id"] = strconv.FormatInt(c.Chat().ID, 10)
+	}
+	if c != nil && c.Sender() != nil {
+		extra["user"] = c.Sender().Username
+	}
+
+	if cfg().SentryDSN != "" {
+		sentry.WithScope(func(scope *sentry.Scope) {
+			scope.SetTags(extra)
+			sentry.CaptureException(err)
+		})
+	}
+	if cfg().ErrorWebhook != "" {
+		go postErrorWebhook(err.Error(), extra)
+	}
+}
+
+func postErrorWebhook(msg string, extra map[string]string) {
+	body, _ := json.Marshal(map[string]interface{}{
+		"instance": cfg().InstanceName,
+		"time":     time.Now().UTC().Format(time.RFC3339),
+		"error":    msg,
+		"context":  extra,
+	})
+	resp, err := errorWebhookClient.Post(cfg().ErrorWebhook, "application/json",
+		bytes.NewReader(body))
+	if err != nil {
+		errorf("Error webhook: %s", err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		errorf("Error webhook: unexpected status %s", resp.Status)
+	}
+}
+
+// reportPanic is deferred at the top of goroutines; it reports and swallows
+// the panic so that one bad download can't take the whole bot down.
+func reportPanic(c tele.Context, extra map[string]string) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	err := fmt.Errorf("panic: %v", r)
+	errorf("%s\n%s", err.Error(), debug.Stack())
+	if extra == nil {
+		extra = map[string]string{}
+	}
+	extra["stack"] = string(debug.Stack())
+	reportError(c, err, extra)
+}
+
+func recoverMiddleware(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		defer reportPanic(c, map[string]string{"handler": c.Text()})
+		return next(c)
+	}
+}
+
+func instanceName() string {
+	if name := getenv("TELEGRAM_INSTANCE"); name != "" {
+		return name
+	}
+	host, _ := os.Hostname()
+	return host
+}
@@ -0,0 +1,148 @@
+package downloader
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// jobEventType is a step in the life of a download: queued, started,
+// progress (every TELEGRAM_PROGRESS_INTERVAL), then one of the outcomes.
+type jobEventType string
+
+const (
+	eventQueued    jobEventType = "queued"
+	eventStarted   jobEventType = "started"
+	eventProgress  jobEventType = "progress"
+	eventDone                   = jobEventType(jobDone)
+	eventFailed                 = jobEventType(jobFailed)
+	eventCancelled              = jobEventType(jobCancelled)
+	eventSkipped                = jobEventType(jobSkipped)
+)
+
+type jobEvent struct {
+	Type jobEventType `json:"type"`
+	Time time.Time    `json:"time"`
+	Job  apiJob       `json:"job"`
+	job  *job
+}
+
+func (t jobEventType) finished() bool {
+	return t == eventDone || t == eventFailed || t == eventCancelled || t == eventSkipped
+}
+
+// The download engine only publishes events; the chat messages, metrics,
+// history and retries are listeners. They are registered in init and run
+// synchronously in the download's goroutine, in registration order, so they
+// see every event. Subscribers (webhooks, email, MQTT, the APIs) get the
+// events through a channel instead.
+var eventListeners []func(jobEvent)
+
+func listenEvents(fn func(jobEvent)) {
+	eventListeners = append(eventListeners, fn)
+}
+
+// Subscribers get events through a channel fed from a queue of their own, so
+// a subscriber that doesn't keep up never blocks the downloads. Once
+// subscriberBuffer events wait, it loses the new progress and queued events,
+// counted in the log, but not the outcomes: webhooks, email and MQTT see
+// every finished download. Only a subscriber that stopped reading, with
+// subscriberLimit events waiting, loses the outcomes too.
+const (
+	subscriberBuffer = 64
+	subscriberLimit  = 16 * subscriberBuffer
+)
+
+type subscriber struct {
+	mu      sync.Mutex
+	queue   []jobEvent
+	dropped int
+	wake    chan struct{}
+	done    chan struct{}
+	out     chan jobEvent
+}
+
+var eventSubscribers = struct {
+	sync.Mutex
+	m map[*subscriber]struct{}
+}{m: make(map[*subscriber]struct{})}
+
+func publishEvent(typ jobEventType, j *job) {
+	e := jobEvent{Type: typ, Time: time.Now(), Job: j.apiJob(), job: j}
+	for _, fn := range eventListeners {
+		fn(e)
+	}
+
+	eventSubscribers.Lock()
+	defer eventSubscribers.Unlock()
+	for s := range eventSubscribers.m {
+		s.push(e)
+	}
+}
+
+func (s *subscriber) push(e jobEvent) {
+	s.mu.Lock()
+	if len(s.queue) >= subscriberLimit || len(s.queue) >= subscriberBuffer && !e.Type.finished() {
+		s.dropped++
+		dropped := s.dropped
+		s.mu.Unlock()
+		if dropped == 1 || dropped%100 == 0 {
+			log.Printf("Events: a subscriber is behind, %d events dropped so far", dropped)
+		}
+		return
+	}
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// pump hands the queued events over to the subscriber until it's done, then
+// closes its channel.
+func (s *subscriber) pump() {
+	defer close(s.out)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.wake:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		select {
+		case s.out <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// subscribeEvents returns a channel of job events and the function that
+// ends the subscription. It also ends with ctx; either way the channel is
+// closed.
+func subscribeEvents(ctx context.Context) (<-chan jobEvent, func()) {
+	s := &subscriber{wake: make(chan struct{}, 1), done: make(chan struct{}), out: make(chan jobEvent)}
+	eventSubscribers.Lock()
+	eventSubscribers.m[s] = struct{}{}
+	eventSubscribers.Unlock()
+	go s.pump()
+	stop := func() {
+		eventSubscribers.Lock()
+		defer eventSubscribers.Unlock()
+		if _, ok := eventSubscribers.m[s]; ok {
+			delete(eventSubscribers.m, s)
+			close(s.done)
+		}
+	}
+	context.AfterFunc(ctx, stop)
+	return s.out, stop
+}
@@ -0,0 +1,30 @@
+package downloader
+
+import "testing"
+
+// A subscriber that never reads keeps at most subscriberLimit events, the
+// outcomes first.
+func TestSubscriberBehind(t *testing.T) {
+	tests := []struct {
+		name string
+		typ  jobEventType
+		want int // events queued
+	}{
+		{name: "progress", typ: eventProgress, want: subscriberBuffer},
+		{name: "outcomes", typ: eventDone, want: subscriberLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &subscriber{wake: make(chan struct{}, 1), done: make(chan struct{}), out: make(chan jobEvent)}
+			for range 2 * subscriberLimit {
+				s.push(jobEvent{Type: tt.typ})
+			}
+			if len(s.queue) != tt.want {
+				t.Errorf("%d events queued, want %d", len(s.queue), tt.want)
+			}
+			if want := 2*subscriberLimit - tt.want; s.dropped != want {
+				t.Errorf("%d events dropped, want %d", s.dropped, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+	tele "gopkg.in/telebot.v4"
+)
+
+type failureKind int
+
+const (
+	failureOther failureKind = iota
+	failureTelegram
+	failureTimeout
+	failureDiskFull
+	failurePermission
+	failurePath
+	failureKinds
+)
+
+var failureNames = [failureKinds]string{
+	failureOther:      "other",
+	failureTelegram:   "telegram api",
+	failureTimeout:    "network timeout",
+	failureDiskFull:   "disk full",
+	failurePermission: "permission denied",
+	failurePath:       "path violation",
+}
+
+func (k failureKind) String() string {
+	return failureNames[k]
+}
+
+var failureCounts [failureKinds]uint32
+
+var failuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "telegram_download_failures_total",
+	Help: "Failed downloads by reason.",
+}, []string{"reason"})
+
+func init() {
+	prometheus.MustRegister(failuresTotal)
+}
+
+func classifyError(err error) failureKind {
+	var tgErr *tele.Error
+	var floodErr tele.FloodError
+	var groupErr tele.GroupError
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errorOutside):
+		return failurePath
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return failureDiskFull
+	case errors.Is(err, fs.ErrPermission):
+		return failurePermission
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return failureTimeout
+	case errors.As(err, &tgErr), errors.As(err, &floodErr), errors.As(err, &groupErr),
+		strings.HasPrefix(err.Error(), "telebot: expected status"):
+		return failureTelegram
+	}
+	return failureOther
+}
+
+func countFailure(err error) failureKind {
+	kind := classifyError(err)
+	atomic.AddUint32(&failureCounts[kind], 1)
+	failuresTotal.WithLabelValues(kind.String()).Inc()
+	return kind
+}
+
+func resetFailureCounts() {
+	for i := range failureCounts {
+		atomic.StoreUint32(&failureCounts[i], 0)
+	}
+}
+
+func failuresReport() string {
+	s := ""
+	for kind := failureKind(0); kind < failureKinds; kind++ {
+		if n := atomic.LoadUint32(&failureCounts[kind]); n > 0 {
+			s += fmt.Sprintf("\n%s: %d", kind, n)
+		}
+	}
+	return s
+}
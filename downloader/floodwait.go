@@ -0,0 +1,170 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Telegram answers 429 with a retry_after when a bot sends too much. Every
+// Bot API request goes through floodTransport, so this is handled in one
+// place for the messages, the file downloads and the polling alike: the bot
+// is paused until retry_after has passed, its other requests wait for that
+// too, and the request is sent again, up to floodAttempts times. Only
+// uploads, whose body can't be sent twice, still fail with the flood error,
+// and those are retried like any other failure without counting as an
+// attempt. /stats shows a pause in progress.
+const (
+	floodAttempts    = 5
+	floodDefaultWait = 5 * time.Second
+)
+
+var floods = struct {
+	sync.Mutex
+	until  map[string]time.Time // by bot token
+	count  int
+	waited time.Duration
+}{until: map[string]time.Time{}}
+
+type floodTransport struct {
+	base http.RoundTripper
+}
+
+func (t floodTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token := botToken(req.URL)
+	if token == "" {
+		return t.base.RoundTrip(req)
+	}
+	for attempt := 1; ; attempt++ {
+		if err := waitFlood(req, token); err != nil {
+			return nil, err
+		}
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests {
+			return resp, err
+		}
+		wait := retryAfter(resp)
+		method := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		flooded(token, wait, method)
+		if attempt == floodAttempts || req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+		req = req.Clone(req.Context())
+		if req.Body != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// botAPIHost is the host of the Bot API, the only one whose requests carry a
+// bot token.
+var botAPIHost = strings.TrimPrefix(tele.DefaultApiURL, "https://")
+
+// botToken is the token in the path of a Bot API request, "" for other URLs
+// such as those of /mirror.
+func botToken(u *url.URL) string {
+	if u.Host != botAPIHost {
+		return ""
+	}
+	path := strings.TrimPrefix(u.Path, "/file")
+	if !strings.HasPrefix(path, "/bot") {
+		return ""
+	}
+	token, _, _ := strings.Cut(path[len("/bot"):], "/")
+	return token
+}
+
+// retryAfter reads the wait out of a 429 answer, leaving the body for
+// telebot to turn into its FloodError.
+func retryAfter(resp *http.Response) time.Duration {
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	var answer struct {
+		Parameters struct {
+			RetryAfter int `json:"retry_after"`
+		} `json:"parameters"`
+	}
+	if json.Unmarshal(data, &answer) == nil && answer.Parameters.RetryAfter > 0 {
+		return time.Duration(answer.Parameters.RetryAfter) * time.Second
+	}
+	if s, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return floodDefaultWait
+}
+
+func flooded(token string, wait time.Duration, method string) {
+	floods.Lock()
+	until := time.Now().Add(wait)
+	if until.After(floods.until[token]) {
+		floods.until[token] = until
+	}
+	floods.count++
+	floods.waited += wait
+	floods.Unlock()
+	noteFlood()
+	log.Printf("Flood wait: %s for bot %s after %s", wait, botName(token), method)
+}
+
+// waitFlood holds a request of the bot while it's paused.
+func waitFlood(req *http.Request, token string) error {
+	floods.Lock()
+	wait := time.Until(floods.until[token])
+	floods.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	t := time.NewTimer(wait)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-req.Context().Done():
+		return req.Context().Err()
+	case <-rootContext().Done():
+		return rootContext().Err()
+	}
+}
+
+// botName names a bot in the log without its token.
+func botName(token string) string {
+	for i, bc := range cfg().bots() {
+		if bc.Token == token {
+			if bc.Name != "" {
+				return bc.Name
+			}
+			return fmt.Sprintf("#%d", i+1)
+		}
+	}
+	return "?"
+}
+
+// floodReport is the /stats line, empty if there was no flood wait.
+func floodReport() string {
+	floods.Lock()
+	defer floods.Unlock()
+	if floods.count == 0 {
+		return ""
+	}
+	msg := tr("Flood waits: %d, %s in total", floods.count, floods.waited.Round(time.Second))
+	for token, until := range floods.until {
+		if left := time.Until(until); left > 0 {
+			msg += "\n" + tr("Paused by Telegram: bot %s for %s more", botName(token), left.Round(time.Second))
+		}
+	}
+	return msg
+}
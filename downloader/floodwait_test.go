@@ -0,0 +1,28 @@
+package downloader
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestBotToken(t *testing.T) {
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{url: "https://api.telegram.org/bot1:abc/getUpdates", want: "1:abc"},
+		{url: "https://api.telegram.org/file/bot1:abc/documents/file_1.pdf", want: "1:abc"},
+		{url: "https://api.telegram.org/other"},
+		{url: "https://github.com/bottlerocket-os/bottlerocket/releases"},
+		{url: "https://example.com/file/bot1:abc/documents/file_1.pdf"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := botToken(u); got != tt.want {
+			t.Errorf("botToken(%s) = %q, want %q", tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package downloader
+
+import (
+	"fmt"
+	"html"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Replies that use Telegram's HTML parse mode must escape everything that
+// isn't markup, otherwise <, > and & in file names break the message.
+
+// code is shown monospaced by trHTML, e.g. file names.
+type code string
+
+var esc = html.EscapeString
+
+// trHTML is tr for HTML replies: the message and its arguments are escaped,
+// code arguments are wrapped in <code>.
+func trHTML(format string, args ...interface{}) string {
+	if t, ok := cfg().Catalog[format]; ok {
+		format = t
+	}
+	format = esc(format)
+	escaped := make([]interface{}, len(args))
+	for i, a := range args {
+		switch a := a.(type) {
+		case code:
+			escaped[i] = "<code>" + esc(string(a)) + "</code>"
+		case string:
+			escaped[i] = esc(a)
+		case error:
+			escaped[i] = esc(a.Error())
+		case fmt.Stringer:
+			escaped[i] = esc(a.String())
+		default:
+			escaped[i] = a
+		}
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, escaped...)
+}
+
+// replyPre sends a listing as a preformatted block, so columns line up and
+// nothing in it is taken as markup.
+func replyPre(c tele.Context, title, text string) error {
+	return c.Reply("<b>"+esc(title)+"</b>\n<pre>"+esc(text)+"</pre>", tele.ModeHTML)
+}
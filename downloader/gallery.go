@@ -0,0 +1,370 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The gallery is a static index.html in every folder of the destinations,
+// with the subfolders, a thumbnail of every JPEG, PNG and GIF and the caption
+// the file came with, so the archive can be browsed with any browser from a
+// file share or a plain web server. The thumbnails are in a .thumbs folder
+// next to the pictures and only made again when the picture changes. It's
+// updated on every TELEGRAM_GALLERY_INTERVAL and with /galleryupdate. An
+// index.html that isn't one of these pages, e.g. a downloaded one, is left
+// alone and listed as a file of its folder, whose page is gallery.html then.
+const (
+	galleryIndex  = "index.html"
+	galleryAlt    = "gallery.html"
+	galleryMarker = `<meta name="generator" content="telegram-files-downloader gallery">`
+	thumbsDir     = ".thumbs"
+	thumbSize     = 240
+)
+
+var galleryExts = []string{".jpg", ".jpeg", ".png", ".gif"}
+
+var galleryMu sync.Mutex
+
+type galleryItem struct {
+	Name, Link, Thumb, Caption, Size, Time string
+}
+
+type galleryPage struct {
+	Title   string
+	Parent  string // link, "" at the top
+	Folders []galleryItem
+	Files   []galleryItem
+}
+
+var galleryTemplate = template.Must(template.New("gallery").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+` + galleryMarker + `
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 1em; }
+.grid { display: flex; flex-wrap: wrap; gap: 1em; }
+figure { margin: 0; width: 240px; }
+figure img { max-width: 240px; max-height: 240px; }
+figcaption { font-size: small; overflow-wrap: anywhere; }
+.meta { color: gray; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+{{if .Parent}}<p><a href="{{.Parent}}">⬆ ..</a></p>{{end}}
+{{if .Folders}}<ul>{{range .Folders}}<li><a href="{{.Link}}">📁 {{.Name}}</a></li>{{end}}</ul>{{end}}
+<div class="grid">
+{{range .Files}}<figure>
+{{if .Thumb}}<a href="{{.Link}}"><img src="{{.Thumb}}" alt="{{.Name}}" loading="lazy"></a>{{end}}
+<figcaption><a href="{{.Link}}">{{.Name}}</a>{{if .Caption}}<br>{{.Caption}}{{end}}
+<br><span class="meta">{{.Size}}, {{.Time}}</span></figcaption>
+</figure>
+{{end}}</div>
+</body>
+</html>
+`))
+
+// startGallery updates the gallery on every TELEGRAM_GALLERY_INTERVAL, which
+// can change on reload.
+func startGallery() {
+	go func() {
+		ctx := rootContext()
+		for {
+			interval := cfg().GalleryInterval
+			if interval <= 0 {
+				interval = time.Minute
+			}
+			if !sleepContext(ctx, interval) {
+				return
+			}
+			if cfg().GalleryInterval > 0 {
+				if _, _, err := updateGalleries(ctx); err != nil {
+					errorf("Gallery: %s", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// updateGalleries writes the pages of every destination and returns how many
+// pages and thumbnails it wrote.
+func updateGalleries(ctx context.Context) (int, int, error) {
+	galleryMu.Lock()
+	defer galleryMu.Unlock()
+	captions, err := galleryCaptions()
+	if err != nil {
+		return 0, 0, err
+	}
+	var pages, thumbs int
+	seen := map[string]bool{}
+	for _, bc := range cfg().bots() {
+		if seen[bc.Dest] {
+			continue
+		}
+		seen[bc.Dest] = true
+		err := filepath.WalkDir(bc.Dest, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if path != bc.Dest && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			n, written, err := writeGallery(bc.Dest, path, captions)
+			if err != nil {
+				errorf("Gallery: %s: %s", path, err.Error())
+				return nil
+			}
+			if written {
+				pages++
+			}
+			thumbs += n
+			return nil
+		})
+		if err != nil {
+			return pages, thumbs, err
+		}
+	}
+	log.Printf("Gallery: wrote %d pages, made %d thumbnails", pages, thumbs)
+	return pages, thumbs, nil
+}
+
+// galleryCaptions maps the paths of the downloads in the history to their
+// captions, the last download of a path winning.
+func galleryCaptions() (map[string]string, error) {
+	captions := map[string]string{}
+	err := storage.ForEach(historyBucket, func(_ string, data []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.Caption != "" {
+			captions[e.Path] = e.Caption
+		} else {
+			delete(captions, e.Path)
+		}
+		return nil
+	})
+	return captions, err
+}
+
+// ownPage tells whether the file name in dir is missing or a gallery page,
+// which may be written.
+func ownPage(dir, name string) bool {
+	f, err := os.Open(filepath.Join(dir, name))
+	if err != nil {
+		return errors.Is(err, fs.ErrNotExist)
+	}
+	defer f.Close()
+	head := make([]byte, 1024)
+	n, _ := io.ReadFull(f, head)
+	return bytes.Contains(head[:n], []byte(galleryMarker))
+}
+
+// galleryPageName is the name of the page of dir, "" if both names are taken
+// by files of its own.
+func galleryPageName(dir string) string {
+	for _, name := range []string{galleryIndex, galleryAlt} {
+		if ownPage(dir, name) {
+			return name
+		}
+	}
+	return ""
+}
+
+// galleryLink is the link to the folder at path: its page or, if it can't
+// have one, the folder itself.
+func galleryLink(link, path string) string {
+	return link + galleryPageName(path)
+}
+
+// writeGallery writes the page of dir and returns how many thumbnails it made
+// and whether it wrote the page. Thumbnails of pictures that are gone are
+// removed.
+func writeGallery(dest, dir string, captions map[string]string) (int, bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, false, err
+	}
+	title := filepath.Base(dest)
+	if rel, err := filepath.Rel(dest, dir); err == nil && rel != "." {
+		title = filepath.ToSlash(rel)
+	}
+	page := galleryPage{Title: title}
+	if dir != dest {
+		page.Parent = galleryLink("../", filepath.Dir(dir))
+	}
+	pageName := galleryPageName(dir)
+	thumbs := map[string]bool{}
+	made := 0
+	for _, e := range entries {
+		name := e.Name()
+		if strings.HasPrefix(name, ".") || name == pageName || filepath.Ext(name) == ".tmp" {
+			continue
+		}
+		if e.IsDir() {
+			page.Folders = append(page.Folders, galleryItem{Name: name,
+				Link: galleryLink(url.PathEscape(name)+"/", filepath.Join(dir, name))})
+			continue
+		}
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		item := galleryItem{Name: name, Link: url.PathEscape(name), Caption: captions[path],
+			Size: units.Format(fi.Size()), Time: inZone(fi.ModTime()).Format("2006-01-02 15:04")}
+		if slices.Contains(galleryExts, strings.ToLower(filepath.Ext(name))) {
+			thumb := name + ".jpg"
+			thumbs[thumb] = true
+			ok, err := makeThumb(path, filepath.Join(dir, thumbsDir, thumb), fi.ModTime())
+			switch {
+			case err != nil:
+				errorf("Gallery: thumbnail of %s: %s", path, err.Error())
+			case ok:
+				made++
+				fallthrough
+			default:
+				item.Thumb = thumbsDir + "/" + url.PathEscape(thumb)
+			}
+		}
+		page.Files = append(page.Files, item)
+	}
+
+	if old, err := os.ReadDir(filepath.Join(dir, thumbsDir)); err == nil {
+		for _, e := range old {
+			if !thumbs[e.Name()] {
+				os.Remove(filepath.Join(dir, thumbsDir, e.Name()))
+			}
+		}
+	}
+	if pageName == "" {
+		log.Printf("Gallery: %s has an %s and a %s of its own, no page written", dir, galleryIndex, galleryAlt)
+		return made, false, nil
+	}
+	var buf bytes.Buffer
+	if err := galleryTemplate.Execute(&buf, page); err != nil {
+		return made, false, err
+	}
+	if pageName == galleryIndex && ownPage(dir, galleryAlt) {
+		// The index.html of its own is gone.
+		os.Remove(filepath.Join(dir, galleryAlt))
+	}
+	return made, true, writeAtomic(filepath.Join(dir, pageName), buf.Bytes())
+}
+
+// makeThumb writes the thumbnail of the picture at path unless it's there
+// already and newer than the picture, and tells whether it did.
+func makeThumb(path, thumb string, modTime time.Time) (bool, error) {
+	if fi, err := os.Stat(thumb); err == nil && !fi.ModTime().Before(modTime) {
+		return false, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	img, _, err := image.Decode(f)
+	f.Close()
+	if err != nil {
+		return false, err
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(img, thumbSize), &jpeg.Options{Quality: 80}); err != nil {
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(thumb), 0o755); err != nil {
+		return false, err
+	}
+	return true, writeAtomic(thumb, buf.Bytes())
+}
+
+// scaleDown fits img in a size×size square, averaging the pixels each one of
+// the thumbnail covers.
+func scaleDown(img image.Image, size int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= size && h <= size {
+		return img
+	}
+	tw, th := size, h*size/w
+	if h > w {
+		tw, th = w*size/h, size
+	}
+	tw, th = max(tw, 1), max(th, 1)
+	out := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := range th {
+		y0, y1 := b.Min.Y+y*h/th, b.Min.Y+max((y+1)*h/th, y*h/th+1)
+		for x := range tw {
+			x0, x1 := b.Min.X+x*w/tw, b.Min.X+max((x+1)*w/tw, x*w/tw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			i := out.PixOffset(x, y)
+			out.Pix[i], out.Pix[i+1], out.Pix[i+2], out.Pix[i+3] =
+				uint8(r/n>>8), uint8(g/n>>8), uint8(bl/n>>8), uint8(a/n>>8)
+		}
+	}
+	return out
+}
+
+// writeAtomic replaces the file at path with data, so a browser never gets
+// half of it.
+func writeAtomic(path string, data []byte) error {
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".part")
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	if err := renameFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func handleGalleryUpdate(c tele.Context) error {
+	if !galleryMu.TryLock() {
+		return c.Reply(tr("The gallery is being updated already"))
+	}
+	galleryMu.Unlock()
+	go func() {
+		defer reportPanic(c, map[string]string{"stage": "gallery"})
+		pages, thumbs, err := updateGalleries(rootContext())
+		if err != nil {
+			reportError(c, err, map[string]string{"stage": "gallery"})
+			notifyChat(c, kindError, "Updating the gallery failed: %s", err.Error())
+			return
+		}
+		notifyChat(c, kindSummary, "Gallery updated: %d pages, %d new thumbnails", pages, thumbs)
+	}()
+	return c.Reply(tr("Updating the gallery"))
+}
@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// parseMessageLink turns a message link into the message it points to:
+// t.me/c/<chat>/<message> for private chats, t.me/<username>/<message> for
+// public ones, with an optional topic between the chat and the message.
+func parseMessageLink(b tele.API, link string) (*tele.StoredMessage, error) {
+	if !strings.Contains(link, "://") {
+		link = "https://" + link
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		return nil, err
+	}
+	if host := strings.TrimPrefix(u.Host, "www."); host != "t.me" && host != "telegram.me" {
+		return nil, errors.New("not a t.me link")
+	}
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	private := len(parts) > 0 && parts[0] == "c"
+	if private {
+		parts = parts[1:]
+	}
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, errors.New("expected t.me/c/<chat>/<message> or t.me/<username>/<message>")
+	}
+	msgID := parts[len(parts)-1]
+	if _, err := strconv.Atoi(msgID); err != nil {
+		return nil, errors.New("message ID is not a number")
+	}
+
+	if private {
+		id, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return nil, errors.New("chat ID is not a number")
+		}
+		return &tele.StoredMessage{MessageID: msgID, ChatID: -1000000000000 - id}, nil
+	}
+	chat, err := b.ChatByUsername("@" + parts[0])
+	if err != nil {
+		return nil, err
+	}
+	return &tele.StoredMessage{MessageID: msgID, ChatID: chat.ID}, nil
+}
+
+// grabAllowed tells whether the user of c may grab from the chat: this one or
+// another one whitelisted for the bot, and any chat for admins.
+func grabAllowed(c tele.Context, chatID int64) bool {
+	if chatID == c.Chat().ID || cfg().Roles.permissionsOf(c.Sender())&permAdmin == permAdmin {
+		return true
+	}
+	if chatID == cfg().ApprovalChatID || chatID == cfg().AdminChatID {
+		return false
+	}
+	return slices.Contains(botCfgFor(c).ChatIDs, chatID)
+}
+
+// handleGrab downloads the file of a linked message. The Bot API can't read
+// messages directly, so the message is forwarded here and the copy deleted;
+// that only works in chats the bot is a member of.
+func handleGrab(c tele.Context) error {
+	if len(c.Args()) != 1 {
+		return c.Reply(tr("Usage: /grab <message link>"))
+	}
+	src, err := parseMessageLink(c.Bot(), c.Args()[0])
+	if err != nil {
+		return c.Reply(tr("Not a message link: %s", err.Error()))
+	}
+	if !grabAllowed(c, src.ChatID) {
+		log.Printf("Grab %s by %s: chat not allowed", c.Args()[0], senderName(c.Sender()))
+		return c.Reply(tr("You can't grab from that chat"))
+	}
+	msg, err := c.Bot().Forward(c.Chat(), src, tele.Silent)
+	if err != nil {
+		errorf("Grab %s: %s", c.Args()[0], err.Error())
+		return c.Reply(tr("Can't fetch that message, is the bot a member of its chat? %s", err.Error()))
+	}
+	if err := apiOf(c).Delete(msg); err != nil {
+		errorf("Grab: deleting the forwarded copy: %s", err.Error())
+	}
+
+	_, f, name := channelMedia(msg)
+	if f == nil {
+		return c.Reply(tr("That message has no file"))
+	}
+	log.Printf("Grab %s by %s", c.Args()[0], senderName(c.Sender()))
+	return enqueueFile(c, f, name)
+}
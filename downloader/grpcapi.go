@@ -0,0 +1,303 @@
+package downloader
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/grpcapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The gRPC service is described by hand, see package grpcapi for its
+// messages and its client. The answers are the apiJob and jobEvent of the HTTP
+// API, which have the JSON of grpcapi.Job and grpcapi.Event.
+
+// listJobsResponse is grpcapi.ListJobsResponse.
+type listJobsResponse struct {
+	Jobs []apiJob `json:"jobs"`
+}
+
+// jobCreatedKey carries a channel through the download context that gets
+// the job as soon as it exists, so Enqueue can return it.
+type jobCreatedKey struct{}
+
+func jobCreated(ctx context.Context, j *job) {
+	if created, ok := ctx.Value(jobCreatedKey{}).(chan *job); ok {
+		created <- j
+	}
+}
+
+func grpcEnqueue(ctx context.Context, req *grpcapi.EnqueueRequest) (interface{}, error) {
+	var b *tele.Bot
+	for _, rb := range runningBots.bots {
+		if botCfgOf(rb).Name == req.Bot {
+			b = rb
+		}
+	}
+	if b == nil {
+		return nil, status.Errorf(codes.NotFound, "no bot named %q", req.Bot)
+	}
+	if chats := botCfgOf(b).ChatIDs; len(chats) > 0 && !slices.Contains(chats, req.ChatID) {
+		return nil, status.Errorf(codes.PermissionDenied, "chat %d is not whitelisted", req.ChatID)
+	}
+	name := filepath.Base(req.Name)
+	if req.FileID == "" || name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, status.Error(codes.InvalidArgument, "file_id and name are required")
+	}
+	if msg := maxSizeMessage(req.Size); msg != "" {
+		return nil, status.Error(codes.FailedPrecondition, msg)
+	}
+	if msg := overloadMessage(botCfgOf(b).Dest, req.Size); msg != "" {
+		return nil, status.Error(codes.ResourceExhausted, msg)
+	}
+
+	doc := &tele.Document{File: tele.File{FileID: req.FileID, FileSize: req.Size}, FileName: name}
+	c := b.NewContext(tele.Update{Message: &tele.Message{
+		Chat: &tele.Chat{ID: req.ChatID}, Sender: b.Me, Document: doc}})
+	if err := admitDownload(c, name, req.Size); err != nil {
+		if errors.Is(err, errMaintenance) {
+			return nil, status.Error(codes.Unavailable, err.Error())
+		}
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	created := make(chan *job, 1)
+	dctx, cancel := context.WithCancel(context.WithValue(handlerContext(c), jobCreatedKey{}, created))
+	log.Printf("Enqueued over gRPC: %s", name)
+	go func() {
+		defer cancel()
+		defer releaseQuota(c.Sender().ID, req.ChatID, req.Size)
+		downloadFile(dctx, c, doc.MediaFile(), name, time.Now())
+	}()
+	select {
+	case j := <-created:
+		a := j.apiJob()
+		return &a, nil
+	case <-ctx.Done():
+		// The client gave up before getting the job, so it's cancelled
+		// rather than left running unknown to the client.
+		cancel()
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+}
+
+func grpcCancel(ctx context.Context, req *grpcapi.JobRequest) (interface{}, error) {
+	j, err := grpcJob(req.ID)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.Cancel("gRPC"); err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+	a := j.apiJob()
+	return &a, nil
+}
+
+func grpcListJobs(ctx context.Context, req *grpcapi.ListJobsRequest) (interface{}, error) {
+	return &listJobsResponse{Jobs: listJobs(req.Finished)}, nil
+}
+
+func grpcStreamEvents(srv interface{}, stream grpc.ServerStream) error {
+	if err := stream.RecvMsg(&grpcapi.StreamEventsRequest{}); err != nil {
+		return err
+	}
+	events, stop := subscribeEvents(stream.Context())
+	defer stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-rootContext().Done():
+			return nil
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := stream.SendMsg(&e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func grpcJob(id string) (*job, error) {
+	jobs.Lock()
+	j, ok := jobs.m[id]
+	jobs.Unlock()
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no job %q", id)
+	}
+	return j, nil
+}
+
+func unaryMethod[Req any](name string, fn func(context.Context, *Req) (interface{}, error)) grpc.MethodDesc {
+	return grpc.MethodDesc{
+		MethodName: name,
+		Handler: func(srv interface{}, ctx context.Context, dec func(interface{}) error,
+			interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+			req := new(Req)
+			if err := dec(req); err != nil {
+				return nil, err
+			}
+			if interceptor == nil {
+				return fn(ctx, req)
+			}
+			info := &grpc.UnaryServerInfo{Server: srv, FullMethod: "/" + grpcapi.ServiceName + "/" + name}
+			return interceptor(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+				return fn(ctx, req.(*Req))
+			})
+		},
+	}
+}
+
+var grpcServiceDesc = grpc.ServiceDesc{
+	ServiceName: grpcapi.ServiceName,
+	HandlerType: (*interface{})(nil),
+	Methods: []grpc.MethodDesc{
+		unaryMethod("Enqueue", grpcEnqueue),
+		unaryMethod("Cancel", grpcCancel),
+		unaryMethod("ListJobs", grpcListJobs),
+	},
+	Streams: []grpc.StreamDesc{
+		{StreamName: "StreamEvents", Handler: grpcStreamEvents, ServerStreams: true},
+	},
+}
+
+// grpcAuthorized checks the bearer token when TELEGRAM_API_TOKEN is set.
+// Without one only clients with a certificate verified by the TLS layer get
+// through.
+func grpcAuthorized(ctx context.Context) error {
+	token := cfg().APIToken
+	if token == "" {
+		if p, ok := peer.FromContext(ctx); ok {
+			if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.VerifiedChains) > 0 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "unauthorized")
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get("authorization") {
+		if subtle.ConstantTimeCompare([]byte(v), []byte("Bearer "+token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "unauthorized")
+}
+
+func grpcTLS(c *Cfg) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(c.GRPCCert, c.GRPCKey)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.GRPCClientCA != "" {
+		pem, err := os.ReadFile(c.GRPCClientCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates in " + c.GRPCClientCA)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(conf), nil
+}
+
+func startGRPC(addr string) (*grpc.Server, error) {
+	var opts []grpc.ServerOption
+	if cfg().GRPCCert != "" {
+		creds, err := grpcTLS(cfg())
+		if err != nil {
+			return nil, fmt.Errorf("gRPC TLS is not valid: err=%s", err.Error())
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	opts = append(opts,
+		grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+			handler grpc.UnaryHandler) (interface{}, error) {
+			if err := grpcAuthorized(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo,
+			handler grpc.StreamHandler) error {
+			if err := grpcAuthorized(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}))
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("gRPC can't listen: err=%s", err.Error())
+	}
+	s := grpc.NewServer(opts...)
+	s.RegisterService(&grpcServiceDesc, struct{}{})
+	log.Println("gRPC listening on:", addr)
+	go func() {
+		if err := s.Serve(lis); err != nil {
+			errorf("grpc: %s", err.Error())
+		}
+	}()
+	return s, nil
+}
+
+func validateGRPC(c *Cfg) []error {
+	var problems []error
+	if c.GRPCAddr == "" {
+		return nil
+	}
+	if (c.GRPCCert == "") != (c.GRPCKey == "") {
+		problems = append(problems, errors.New("TELEGRAM_GRPC_CERT and TELEGRAM_GRPC_KEY must be set together"))
+	}
+	if c.GRPCClientCA != "" && c.GRPCCert == "" {
+		problems = append(problems, errors.New("TELEGRAM_GRPC_CLIENT_CA needs TELEGRAM_GRPC_CERT"))
+	}
+	if c.GRPCClientCA == "" && c.APIToken == "" {
+		problems = append(problems, fmt.Errorf("TELEGRAM_GRPC_ADDR needs TELEGRAM_GRPC_CLIENT_CA or TELEGRAM_API_TOKEN"))
+	}
+	// Without TLS the token would cross the network in plaintext.
+	if c.APIToken != "" && c.GRPCCert == "" && !loopback(c.GRPCAddr) {
+		problems = append(problems, fmt.Errorf(
+			"TELEGRAM_GRPC_ADDR %q is not a loopback address, the token needs TELEGRAM_GRPC_CERT", c.GRPCAddr))
+	}
+	if c.GRPCCert != "" && len(problems) == 0 {
+		if _, err := grpcTLS(c); err != nil {
+			problems = append(problems, fmt.Errorf("gRPC TLS is not valid: err=%s", err.Error()))
+		}
+	}
+	return problems
+}
+
+// loopback reports whether addr only listens on the loopback interface.
+func loopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
@@ -0,0 +1,92 @@
+package downloader
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/grpcapi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// grpcClient is a client of grpcServiceDesc served in memory.
+func grpcClient(t *testing.T) *grpcapi.Client {
+	lis := bufconn.Listen(1 << 20)
+	s := grpc.NewServer()
+	s.RegisterService(&grpcServiceDesc, struct{}{})
+	go s.Serve(lis)
+	t.Cleanup(s.Stop)
+	conn, err := grpc.NewClient("passthrough:///bufconn", grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return grpcapi.NewClient(conn)
+}
+
+// The client of package grpcapi talks to the service of grpcServiceDesc.
+func TestGRPCClient(t *testing.T) {
+	client := grpcClient(t)
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+
+	events, err := client.StreamEvents(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stream is subscribed once the server has the request.
+	time.Sleep(100 * time.Millisecond)
+	j, err := client.Enqueue(ctx, &grpcapi.EnqueueRequest{ChatID: testChat, FileID: "grpc-file", Name: "grpc.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if j.ID == "" || j.Name != "grpc.bin" || j.ChatID != testChat {
+		t.Errorf("enqueued %+v, want a job of grpc.bin in chat %d", j, testChat)
+	}
+	for {
+		e, err := events.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Job.ID == j.ID && e.Job.Outcome != "" {
+			break
+		}
+	}
+	finished, err := client.ListJobs(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, f := range finished {
+		found = found || f.ID == j.ID
+	}
+	if !found {
+		t.Errorf("job %s not in the finished jobs %+v", j.ID, finished)
+	}
+	if _, err := client.Cancel(ctx, "no-such-job"); status.Code(err) != codes.NotFound {
+		t.Errorf("cancel of an unknown job: %v, want NotFound", err)
+	}
+}
+
+// Enqueue goes through the checks of a new download.
+func TestGRPCEnqueueRefused(t *testing.T) {
+	client := grpcClient(t)
+	req := &grpcapi.EnqueueRequest{ChatID: testChat, FileID: "grpc-refused", Name: "refused.bin", Size: 10}
+
+	maintenance.Store(true)
+	_, err := client.Enqueue(t.Context(), req)
+	maintenance.Store(false)
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("enqueue in maintenance: %v, want Unavailable", err)
+	}
+	withCfg(t, func(c *Cfg) { c.ChatQuota = 5 })
+	if _, err := client.Enqueue(t.Context(), req); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("enqueue over quota: %v, want ResourceExhausted", err)
+	}
+}
@@ -0,0 +1,208 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// A restart hands the unfinished downloads over to the next process: they are
+// saved in the state file as they are queued, marked when the engine stops
+// and started again, with one notice per chat, when it starts. As they're
+// saved before they start, a crash or a kill doesn't lose them either. The
+// update offset is saved at shutdown too, see saveOffsets. With
+// TELEGRAM_TAKEOVER the new process asks the running one to drain
+// (drainSignal) and opens the state file as soon as it exits.
+const handoverBucket = "handover"
+
+func pidPath() string {
+	return cfg().StatePath + ".pid"
+}
+
+// openState opens the state file, taking it over from the running instance
+// with TELEGRAM_TAKEOVER.
+func openState() error {
+	path := cfg().StatePath
+	takeover := cfg().Takeover && drainSignal != nil
+	timeout := 5 * time.Second
+	if takeover {
+		timeout = time.Second
+	}
+	err := storage.OpenWait(path, timeout)
+	if errors.Is(err, storage.ErrLocked) && takeover {
+		if err = askHandover(); err == nil {
+			err = storage.OpenWait(path, cfg().DrainTimeout+shutdownTimeout+time.Minute)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to open state file %s: err=%s", path, err.Error())
+	}
+	writePID()
+	return nil
+}
+
+func askHandover() error {
+	data, err := os.ReadFile(pidPath())
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return fmt.Errorf("%s is not valid: err=%s", pidPath(), err.Error())
+	}
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	log.Printf("State file in use by process %d, asking it to hand over", pid)
+	return p.Signal(drainSignal)
+}
+
+func writePID() {
+	if err := os.WriteFile(pidPath(), []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644); err != nil {
+		errorf("PID file: %s", err.Error())
+	}
+}
+
+// removePID runs before the state file is closed, so the next process
+// never finds the PID of this one.
+func removePID() {
+	if data, err := os.ReadFile(pidPath()); err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(pidPath())
+	}
+}
+
+// activeJobs counts the jobs past the queue and not finished yet.
+func activeJobs() int {
+	n := 0
+	for _, a := range listJobs(false) {
+		if a.State != stateQueued {
+			n++
+		}
+	}
+	return n
+}
+
+// saveHandover saves the unfinished jobs for the next start and marks them,
+// so they show as interrupted rather than cancelled.
+func saveHandover() {
+	jobs.Lock()
+	list := make([]*job, 0, len(jobs.m))
+	for _, j := range jobs.m {
+		list = append(list, j)
+	}
+	jobs.Unlock()
+
+	n := 0
+	for _, j := range list {
+		j.mu.Lock()
+		final := j.state.final()
+		if !final {
+			j.handedOver = true
+		}
+		j.mu.Unlock()
+		if final || j.c.Message() == nil {
+			continue
+		}
+		if err := storage.Put(handoverBucket, j.id, saveDownload(j)); err != nil {
+			errorf("Handover: %s", err.Error())
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		log.Printf("Handing over %d downloads", n)
+	}
+}
+
+func init() {
+	// A job that finished, even on its own after the stop, isn't resumed; one
+	// cancelled by the stop is.
+	listenEvents(func(e jobEvent) {
+		if e.job.c.Message() == nil {
+			return
+		}
+		if e.Type == eventQueued {
+			if err := storage.Put(handoverBucket, e.job.id, saveDownload(e.job)); err != nil {
+				errorf("Handover: %s", err.Error())
+			}
+			return
+		}
+		if !e.Type.finished() {
+			return
+		}
+		e.job.mu.Lock()
+		handedOver := e.job.handedOver
+		e.job.mu.Unlock()
+		if handedOver && e.Type == eventCancelled {
+			return
+		}
+		if err := storage.Delete(handoverBucket, e.job.id); err != nil {
+			errorf("Handover: %s", err.Error())
+		}
+	})
+}
+
+// resumeHandover starts the downloads handed over by the previous process and
+// returns how many. Those that are also failed downloads are left to the
+// retries.
+func resumeHandover() int {
+	type handedOver struct {
+		key string
+		s   savedDownload
+	}
+	var list []handedOver
+	err := storage.ForEach(handoverBucket, func(key string, data []byte) error {
+		var s savedDownload
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		list = append(list, handedOver{key, s})
+		return nil
+	})
+	if err != nil {
+		errorf("Handover: %s", err.Error())
+		return 0
+	}
+
+	type resumed struct {
+		c    tele.Context
+		file *tele.File
+		name string
+	}
+	chats := map[int64][]resumed{}
+	for _, h := range list {
+		if err := storage.Delete(handoverBucket, h.key); err != nil {
+			errorf("Handover: %s", err.Error())
+			continue
+		}
+		b := h.s.bot()
+		if b == nil {
+			log.Printf("Handover: the bot that received %s is no longer configured", h.s.Name)
+			continue
+		}
+		c, file := h.s.restore(b)
+		if found, _ := storage.Get(failedBucket, failedKey(c), &failedDownload{}); found {
+			continue
+		}
+		log.Printf("Resuming %s (job %s)", h.s.Name, h.s.JobID)
+		chats[h.s.ChatID] = append(chats[h.s.ChatID], resumed{c, file, h.s.Name})
+	}
+	n := 0
+	for _, list := range chats {
+		notifyChat(list[0].c, kindSummary, "Restarted, resumed %d downloads", len(list))
+		for _, r := range list {
+			go downloadFile(handlerContext(r.c), r.c, r.file, r.name, time.Now())
+		}
+		n += len(list)
+	}
+	return n
+}
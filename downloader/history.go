@@ -0,0 +1,203 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/stats"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// savedDownload is what's needed to download a file again later: the
+// Telegram file ID and the message it came with.
+type savedDownload struct {
+	JobID     string        `json:"job_id,omitempty"`
+	Bot       string        `json:"bot,omitempty"`
+	ChatID    int64         `json:"chat_id"`
+	ChatType  tele.ChatType `json:"chat_type"`
+	MessageID int           `json:"message_id"`
+	Caption   string        `json:"caption,omitempty"`
+	Sender    tele.User     `json:"sender"`
+	FileID    string        `json:"file_id"`
+	UniqueID  string        `json:"unique_id"`
+	Size      int64         `json:"size"`
+	Name      string        `json:"name"`
+	URL       string        `json:"url,omitempty"` // of /mirror
+}
+
+func saveDownload(j *job) savedDownload {
+	c := j.c
+	return savedDownload{JobID: j.id, Bot: botCfgFor(c).Name, ChatID: c.Chat().ID, ChatType: c.Chat().Type,
+		MessageID: c.Message().ID, Caption: c.Message().Caption, Sender: *c.Sender(),
+		FileID: j.file.FileID, UniqueID: j.file.UniqueID, Size: j.file.FileSize, Name: j.name,
+		URL: j.file.FileURL}
+}
+
+// bot returns the running bot that received the file, nil if it's no longer
+// configured.
+func (s savedDownload) bot() *tele.Bot {
+	runningBots.Lock()
+	defer runningBots.Unlock()
+	for _, b := range runningBots.bots {
+		if botCfgOf(b).Name == s.Bot {
+			return b
+		}
+	}
+	return nil
+}
+
+// restore rebuilds the context of the original message, so the download
+// replies there and goes to the same destination.
+func (s savedDownload) restore(b *tele.Bot) (tele.Context, *tele.File) {
+	sender := s.Sender
+	var c tele.Context = b.NewContext(tele.Update{Message: &tele.Message{
+		ID:      s.MessageID,
+		Chat:    &tele.Chat{ID: s.ChatID, Type: s.ChatType},
+		Sender:  &sender,
+		Caption: s.Caption,
+	}})
+	if isChannelPost(c) {
+		c = channelContext{c}
+	}
+	return c, &tele.File{FileID: s.FileID, UniqueID: s.UniqueID, FileSize: s.Size, FileURL: s.URL}
+}
+
+// The download history keeps every finished download under a sequence
+// number, the ID /redownload takes.
+const historyBucket = "history"
+
+type historyEntry struct {
+	savedDownload
+	Path string    `json:"path"`
+	Hash string    `json:"sha256"`
+	Time time.Time `json:"time"`
+	Tags []string  `json:"tags,omitempty"` // hashtags of the caption
+}
+
+func init() {
+	listenEvents(func(e jobEvent) {
+		if e.Type == eventDone {
+			recordHistory(e.job, e.Job.SHA256)
+		}
+	})
+}
+
+// The path of every file in the history is also kept by historyFileKey, so
+// that an edited message finds whether it had the file with a single lookup.
+const historyFilesBucket = "historyfiles"
+
+func historyFileKey(c tele.Context, f *tele.File) string {
+	return failedKey(c) + ":" + f.UniqueID
+}
+
+func recordHistory(j *job, sum string) {
+	if j.c.Message() == nil {
+		return
+	}
+	e := historyEntry{savedDownload: saveDownload(j), Path: j.path, Hash: sum, Time: time.Now(),
+		Tags: hashtags(j.c.Message().Caption)}
+	if err := storage.Append(historyBucket, e); err != nil {
+		errorf("History: %s", err.Error())
+	}
+	if err := storage.Put(historyFilesBucket, historyFileKey(j.c, j.file), j.path); err != nil {
+		errorf("History: %s", err.Error())
+	}
+}
+
+// Each /statsreset appends the counters it zeroes, so the earlier measurement
+// windows are kept next to the download history.
+const statsHistoryBucket = "statshistory"
+
+// statsWindow is the counters from Reset until the /statsreset that ended it.
+type statsWindow struct {
+	stats.Snapshot
+	Until time.Time `json:"until"`
+}
+
+func archiveStats(prev stats.Snapshot, until time.Time) error {
+	return storage.Append(statsHistoryBucket, statsWindow{Snapshot: prev, Until: until})
+}
+
+func handleRedownload(c tele.Context) error {
+	args := c.Args()
+	if len(args) == 0 {
+		msg := ""
+		err := storage.Last(historyBucket, 10, func(key string, data []byte) error {
+			var e historyEntry
+			if err := json.Unmarshal(data, &e); err != nil {
+				return err
+			}
+			id, _ := strconv.ParseUint(key, 10, 64)
+			msg += fmt.Sprintf("%d %s %s (%s, job %s)\n", id, inZone(e.Time).Format(time.RFC3339), e.Path,
+				units.Format(e.Size), e.JobID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return replyPre(c, tr("Usage: /redownload <history id>. Last downloads:"), msg)
+	}
+	id, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil || len(args) > 1 {
+		return c.Reply(tr("Usage: /redownload <history id>"))
+	}
+
+	var e historyEntry
+	if found, err := storage.Get(historyBucket, fmt.Sprintf("%020d", id), &e); err != nil {
+		return err
+	} else if !found {
+		return c.Reply(tr("No download with history ID %d", id))
+	}
+	b := e.bot()
+	if b == nil {
+		return c.Reply(tr("The bot that received %s is no longer configured", e.Name))
+	}
+	ctx, file := e.restore(b)
+	log.Printf("Re-downloading %s for %s", e.Name, senderName(c.Sender()))
+	go downloadFile(handlerContext(ctx), ctx, file, e.Name, time.Now())
+	return c.Reply(tr("Downloading %s again", e.Name))
+}
+
+// storedJob finds a job that is no longer in memory: its history entry and
+// history ID if it was downloaded, else its failed download.
+func storedJob(id string) (*historyEntry, uint64, *failedDownload, error) {
+	var found *historyEntry
+	var seq uint64
+	err := storage.ForEach(historyBucket, func(key string, data []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.JobID == id {
+			found = &e
+			seq, _ = strconv.ParseUint(key, 10, 64)
+		}
+		return nil
+	})
+	if err != nil || found != nil {
+		return found, seq, nil, err
+	}
+	fd, err := failedJob(func(fd failedDownload) bool { return fd.JobID == id })
+	return nil, 0, fd, err
+}
+
+// failedJob is the first failed download that match accepts, nil if none.
+func failedJob(match func(failedDownload) bool) (*failedDownload, error) {
+	var found *failedDownload
+	err := storage.ForEach(failedBucket, func(_ string, data []byte) error {
+		var fd failedDownload
+		if err := json.Unmarshal(data, &fd); err != nil {
+			return err
+		}
+		if found == nil && match(fd) {
+			found = &fd
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,187 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// FileInfo describes a file for the hooks.
+type FileInfo struct {
+	Name     string `json:"name"` // relative to the destination
+	Path     string `json:"path,omitempty"`
+	Size     int64  `json:"size"`
+	ChatID   int64  `json:"chat_id"`
+	SenderID int64  `json:"sender_id"`
+	Sender   string `json:"sender"`
+	Caption  string `json:"caption,omitempty"`
+	// Set for OnComplete.
+	Outcome string `json:"outcome,omitempty"` // done, failed, cancelled or skipped
+	Result  string `json:"result,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// Hooks are extension points around every download; unset ones are skipped.
+// They run in the download's goroutine, so they should return quickly.
+type Hooks struct {
+	// Filter returns a non-nil error to skip the file, the error is the
+	// reason shown in the status message.
+	Filter func(FileInfo) error
+	// FilenameResolver returns the name to store the file under, relative
+	// to the destination, or "" to keep it.
+	FilenameResolver func(FileInfo) string
+	OnEnqueue        func(FileInfo)
+	OnComplete       func(FileInfo)
+}
+
+var registeredHooks struct {
+	sync.RWMutex
+	list []Hooks
+}
+
+// AddHooks registers hooks for all downloads from now on, in addition to the
+// plugins of TELEGRAM_PLUGINS.
+func AddHooks(h Hooks) {
+	registeredHooks.Lock()
+	registeredHooks.list = append(registeredHooks.list, h)
+	registeredHooks.Unlock()
+}
+
+func allHooks() []Hooks {
+	registeredHooks.RLock()
+	list := append([]Hooks(nil), registeredHooks.list...)
+	registeredHooks.RUnlock()
+	for _, cmd := range cfg().Plugins {
+		list = append(list, execPlugin(cmd))
+	}
+	return list
+}
+
+func fileInfo(c tele.Context, f *tele.File, fname string) FileInfo {
+	info := FileInfo{Name: fname, Size: f.FileSize, ChatID: c.Chat().ID, SenderID: c.Sender().ID,
+		Sender: senderName(c.Sender())}
+	if c.Message() != nil {
+		info.Caption = c.Message().Caption
+	}
+	return info
+}
+
+// resolveFilename lets the hooks rename the file, in registration order.
+func resolveFilename(hooks []Hooks, info FileInfo) string {
+	for _, h := range hooks {
+		if h.FilenameResolver == nil {
+			continue
+		}
+		name := h.FilenameResolver(info)
+		if name == "" {
+			continue
+		}
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			log.Printf("Hooks: ignoring file name %q, it must be a relative path", name)
+			continue
+		}
+		info.Name = filepath.FromSlash(name)
+	}
+	return info.Name
+}
+
+func filterFile(hooks []Hooks, info FileInfo) error {
+	for _, h := range hooks {
+		if h.Filter == nil {
+			continue
+		}
+		if err := h.Filter(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func init() {
+	listenEvents(func(e jobEvent) {
+		if !e.Type.finished() {
+			return
+		}
+		for _, h := range e.job.hooks {
+			if h.OnComplete != nil {
+				h.OnComplete(e.job.fileInfo())
+			}
+		}
+	})
+}
+
+func (j *job) fileInfo() FileInfo {
+	info := fileInfo(j.c, j.file, j.name)
+	info.Path = j.path
+	j.mu.Lock()
+	info.Outcome, info.Result, info.SHA256 = string(j.outcome), j.result, j.sha256
+	j.mu.Unlock()
+	return info
+}
+
+// Plugins of TELEGRAM_PLUGINS are commands run for every hook with the hook
+// name as their argument and the FileInfo as JSON on stdin. For "filter" a
+// non-zero exit skips the file with the output as the reason, for
+// "filename" the output is the new name. "enqueue" and "complete" are only
+// notifications.
+const pluginTimeout = 10 * time.Second
+
+func execPlugin(command string) Hooks {
+	run := func(hook string, info FileInfo) (string, error) {
+		input, err := json.Marshal(info)
+		if err != nil {
+			return "", err
+		}
+		ctx, cancel := context.WithTimeout(rootContext(), pluginTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, command, hook)
+		cmd.Stdin = bytes.NewReader(input)
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	return Hooks{
+		Filter: func(info FileInfo) error {
+			out, err := run("filter", info)
+			var exitErr *exec.ExitError
+			switch {
+			case errors.As(err, &exitErr):
+				if out == "" {
+					out = fmt.Sprintf("rejected by %s", filepath.Base(command))
+				}
+				return errors.New(out)
+			case err != nil:
+				// A broken plugin doesn't block downloads.
+				errorf("Plugin %s: %s", command, err.Error())
+			}
+			return nil
+		},
+		FilenameResolver: func(info FileInfo) string {
+			out, err := run("filename", info)
+			if err != nil {
+				errorf("Plugin %s: %s", command, err.Error())
+				return ""
+			}
+			return out
+		},
+		OnEnqueue: func(info FileInfo) {
+			if _, err := run("enqueue", info); err != nil {
+				errorf("Plugin %s: %s", command, err.Error())
+			}
+		},
+		OnComplete: func(info FileInfo) {
+			if _, err := run("complete", info); err != nil {
+				errorf("Plugin %s: %s", command, err.Error())
+			}
+		},
+	}
+}
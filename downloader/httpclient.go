@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// All the bots share one client for the Bot API and the file downloads, so
+// connections are reused between them. Its timeouts are per phase rather
+// than for the whole request: telebot's default of one minute for the
+// request, body included, cuts off downloads that take longer. A download
+// whose body stalls is left to its cancellation. Flood waits are handled in
+// its transport (see floodwait.go).
+var telegramClient = sync.OnceValue(func() *http.Client {
+	c := cfg()
+	dialer := &net.Dialer{Timeout: c.HTTPTimeout, KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DialContext:       dialer.DialContext,
+		ForceAttemptHTTP2: c.HTTP2,
+		// Without HTTP/2 every concurrent download needs its own connection.
+		MaxIdleConns:        c.HTTPIdleConns,
+		MaxIdleConnsPerHost: c.HTTPIdleConns,
+		IdleConnTimeout:     c.HTTPKeepAlive,
+		TLSHandshakeTimeout: c.HTTPTimeout,
+		// getUpdates only answers after the long polling timeout.
+		ResponseHeaderTimeout: c.PollTimeout + c.HTTPTimeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	if !c.HTTP2 {
+		// A non-nil empty map turns HTTP/2 off.
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return &http.Client{Transport: floodTransport{transport}}
+})
@@ -0,0 +1,156 @@
+package downloader
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+// "telegram-files-downloader import <dir>" copies the files of a Telegram
+// Desktop export (JSON format) into the destination, with the same
+// bookkeeping as /backfill so neither stores a message twice.
+
+type exportChat struct {
+	Name     string          `json:"name"`
+	Type     string          `json:"type"`
+	ID       int64           `json:"id"`
+	Messages []exportMessage `json:"messages"`
+}
+
+type exportMessage struct {
+	ID       int    `json:"id"`
+	Type     string `json:"type"`
+	File     string `json:"file"`
+	FileName string `json:"file_name"`
+	Photo    string `json:"photo"`
+}
+
+// A single chat export is one exportChat, a full account export lists them.
+type exportResult struct {
+	exportChat
+	Chats struct {
+		List []exportChat `json:"list"`
+	} `json:"chats"`
+	LeftChats struct {
+		List []exportChat `json:"list"`
+	} `json:"left_chats"`
+}
+
+// chatID returns the chat ID the Bot API uses for an exported chat.
+func (c exportChat) chatID() int64 {
+	switch c.Type {
+	case "public_channel", "private_channel", "public_supergroup", "private_supergroup":
+		return -1000000000000 - c.ID
+	case "private_group":
+		return -c.ID
+	}
+	return c.ID
+}
+
+func importExport(dir string) {
+	data, err := os.ReadFile(filepath.Join(dir, "result.json"))
+	if err != nil {
+		log.Fatalf("Import: %s (export the chat history as JSON)", err.Error())
+	}
+	var result exportResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		log.Fatalf("Import: result.json is not valid: err=%s", err.Error())
+	}
+	chats := append(result.Chats.List, result.LeftChats.List...)
+	if result.Messages != nil {
+		chats = append(chats, result.exportChat)
+	}
+
+	storage.Open(cfg().StatePath)
+	defer storage.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	dest := cfg().InitialWorkingDir
+	var total backfillCounts
+	for _, chat := range chats {
+		n, err := importChat(ctx, dir, dest, chat)
+		log.Printf("Imported %q: %d copied (%s), %d skipped, %d failed", chat.Name, n.ok,
+			units.Format(n.bytes), n.skipped, n.failed)
+		total.ok, total.skipped, total.failed = total.ok+n.ok, total.skipped+n.skipped, total.failed+n.failed
+		total.bytes += n.bytes
+		if err != nil {
+			errorf("Import stopped: %s", err.Error())
+			break
+		}
+	}
+	log.Printf("Import into %s finished: %d copied (%s), %d skipped, %d failed", dest, total.ok,
+		units.Format(total.bytes), total.skipped, total.failed)
+}
+
+func importChat(ctx context.Context, dir, dest string, chat exportChat) (backfillCounts, error) {
+	var n backfillCounts
+	for _, m := range chat.Messages {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		rel := m.File
+		if rel == "" {
+			rel = m.Photo
+		}
+		if m.Type != "message" || rel == "" {
+			continue
+		}
+		// Files left out of the export are replaced by a note in parentheses.
+		if strings.HasPrefix(rel, "(") || !filepath.IsLocal(filepath.FromSlash(rel)) {
+			n.skipped++
+			continue
+		}
+		src := filepath.Join(dir, filepath.FromSlash(rel))
+		fi, err := os.Stat(src)
+		if err != nil {
+			errorf("Import: %s", err.Error())
+			n.failed++
+			continue
+		}
+		fname := filepath.Base(m.FileName)
+		if m.FileName == "" || fname == "." || fname == "/" {
+			fname = filepath.Base(src)
+		}
+
+		saved, err := archiveMessage(chat.chatID(), m.ID, fname, fi.Size(), dest, func(tmp string) error {
+			return copyFile(src, tmp)
+		})
+		switch {
+		case err != nil:
+			errorf("Import of message %d in %q failed: %s", m.ID, chat.Name, err.Error())
+			n.failed++
+		case saved:
+			n.ok++
+			n.bytes += fi.Size()
+		default:
+			n.skipped++
+		}
+	}
+	return n, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := streamCopy(throttled(rootContext(), dst, out), in); err != nil {
+		return fmt.Errorf("copying %s: %w", src, err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,442 @@
+package downloader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// How long finished jobs stay around for the Retry and Info buttons.
+const jobRetention = 24 * time.Hour
+
+// job is a single download, reachable from the buttons of its status message.
+// Its ID is in the logs, the status message, the history, events, metric
+// exemplars, traces and error reports, and /job and the API take it.
+type job struct {
+	id     string
+	c      tele.Context
+	file   *tele.File
+	name   string
+	path   string
+	status *statusMessage
+	batch  *batch
+	hooks  []Hooks
+
+	mu       sync.Mutex
+	cancel   context.CancelFunc
+	progress *progressWriter
+	written  int64 // by the finished transfer
+	outcome  jobOutcome
+	sha256   string
+	enqueued time.Time
+	startAt  time.Time // with /schedule
+	state    jobState
+	since    map[jobState]time.Time
+	// Saved for the next process, see saveHandover.
+	handedOver bool
+	result     string
+	text       string // result as shown in the status message
+	finished   time.Time
+	retried    bool // by Retry, which only the first call does
+}
+
+var jobs = struct {
+	sync.Mutex
+	m map[string]*job
+}{m: make(map[string]*job)}
+
+var (
+	btnJobCancel = tele.Btn{Unique: "jobcancel"}
+	btnJobRetry  = tele.Btn{Unique: "jobretry"}
+	btnJobInfo   = tele.Btn{Unique: "jobinfo"}
+)
+
+func newJob(c tele.Context, f *tele.File, name, path string, enqueued time.Time) *job {
+	jobs.Lock()
+	for id, j := range jobs.m {
+		if !j.finished.IsZero() && time.Since(j.finished) > jobRetention {
+			delete(jobs.m, id)
+		}
+	}
+	j := &job{id: newJobID(), c: c, file: f, name: name, path: path, enqueued: enqueued,
+		state: stateQueued, since: map[jobState]time.Time{stateQueued: time.Now()}}
+	jobs.m[j.id] = j
+	jobs.Unlock()
+	stateCounts[stateQueued].Add(1)
+
+	j.logf("Enqueued: %s", name)
+	joinBatch(j, trHTML("Enqueued: %s", code(name)), j.buttons(withCancel))
+	publishEvent(eventQueued, j)
+	return j
+}
+
+// tmpPath is where the job downloads to until the file is complete. That of
+// a URL is the same for every attempt, so they can resume.
+func (j *job) tmpPath() string {
+	if j.file.FileURL != "" {
+		return stagingPath(j.path, urlKey(j.file.FileURL))
+	}
+	return stagingPath(j.path, j.id)
+}
+
+// newJobID returns a random ID, unique among the jobs in memory. Its 64 bits
+// keep it from repeating in the history too, where /retry, /redownload and
+// the API look jobs up by ID. jobs must be locked.
+func newJobID() string {
+	for {
+		var b [8]byte
+		rand.Read(b[:])
+		id := hex.EncodeToString(b[:])
+		if _, ok := jobs.m[id]; !ok {
+			return id
+		}
+	}
+}
+
+func (j *job) logf(format string, args ...interface{}) {
+	log.Printf("Job %s: %s", j.id, fmt.Sprintf(format, args...))
+}
+
+// react replaces the bot's reaction on the sent file when TELEGRAM_REACTIONS
+// is on. Telegram only accepts its own set of reaction emoji.
+func (j *job) react(emoji string) {
+	if !cfg().Reactions || isChannelPost(j.c) {
+		return
+	}
+	r := tele.Reactions{Reactions: []tele.Reaction{{Type: tele.ReactionTypeEmoji, Emoji: emoji}}}
+	if err := j.c.Bot().React(j.c.Chat(), j.c.Message(), r); err != nil {
+		errorf("Reaction: %s", err.Error())
+	}
+}
+
+type jobButtons uint8
+
+const (
+	withCancel jobButtons = 1 << iota
+	withRetry
+)
+
+func (j *job) buttons(which jobButtons) *tele.ReplyMarkup {
+	markup := &tele.ReplyMarkup{}
+	var row []tele.Btn
+	if which&withCancel != 0 {
+		row = append(row, markup.Data(tr("Cancel"), btnJobCancel.Unique, j.id))
+	}
+	if which&withRetry != 0 {
+		row = append(row, markup.Data(tr("Retry"), btnJobRetry.Unique, j.id))
+	}
+	row = append(row, markup.Data(tr("Info"), btnJobInfo.Unique, j.id))
+	markup.Inline(markup.Row(row...))
+	return markup
+}
+
+// start makes the job cancellable and returns the context for the transfer.
+func (j *job) start(ctx context.Context) context.Context {
+	ctx, cancel := context.WithCancel(ctx)
+	j.mu.Lock()
+	j.cancel = cancel
+	j.mu.Unlock()
+	return ctx
+}
+
+func (j *job) setHash(sum string) {
+	j.mu.Lock()
+	j.sha256 = sum
+	j.mu.Unlock()
+}
+
+func (j *job) setProgress(progress *progressWriter) {
+	j.mu.Lock()
+	j.progress = progress
+	ok := j.transition(stateDownloading)
+	j.mu.Unlock()
+	if ok {
+		publishEvent(eventStarted, j)
+	}
+}
+
+// follow publishes a progress event every cfg().ProgressInterval until stop
+// is closed.
+func (j *job) follow(p *progressWriter, stop chan struct{}) {
+	if cfg().ProgressInterval <= 0 {
+		return
+	}
+	t := time.NewTicker(cfg().ProgressInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+			publishEvent(eventProgress, j)
+		}
+	}
+}
+
+// Pausing holds jobs before their transfer starts; running transfers go on.
+var paused = struct {
+	sync.Mutex
+	on     bool
+	resume chan struct{}
+}{resume: make(chan struct{})}
+
+func setPaused(on bool) {
+	paused.Lock()
+	defer paused.Unlock()
+	if on == paused.on {
+		return
+	}
+	paused.on = on
+	if on {
+		log.Println("Downloads paused")
+		paused.resume = make(chan struct{})
+	} else {
+		log.Println("Downloads resumed")
+		close(paused.resume)
+	}
+}
+
+func isPaused() bool {
+	paused.Lock()
+	defer paused.Unlock()
+	return paused.on
+}
+
+func waitWhilePaused(ctx context.Context) error {
+	paused.Lock()
+	on, resume := paused.on, paused.resume
+	paused.Unlock()
+	if !on {
+		return nil
+	}
+	select {
+	case <-resume:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+type jobOutcome string
+
+const (
+	jobDone      jobOutcome = "done"
+	jobFailed    jobOutcome = "failed"
+	jobCancelled jobOutcome = "cancelled"
+	jobSkipped   jobOutcome = "skipped"
+)
+
+// finish records the outcome and the final status message text.
+func (j *job) finish(outcome jobOutcome, format string, args ...interface{}) {
+	j.mu.Lock()
+	if !j.transition(jobState(outcome)) {
+		j.mu.Unlock()
+		return
+	}
+	if j.cancel != nil {
+		j.cancel()
+	}
+	j.cancel = nil
+	if j.progress != nil {
+		j.written = j.progress.Written()
+	}
+	j.progress = nil
+	j.logf(format, args...)
+	j.outcome = outcome
+	j.result = tr(format, args...)
+	j.text = trHTML(format, args...)
+	j.finished = j.since[j.state]
+	j.mu.Unlock()
+	publishEvent(jobEventType(outcome), j)
+}
+
+// cancelled finishes a job whose context was cancelled.
+func (j *job) cancelled() {
+	j.mu.Lock()
+	handedOver := j.handedOver
+	j.mu.Unlock()
+	if handedOver {
+		j.finish(jobCancelled, "Interrupted by a restart, will resume: %s", code(j.name))
+		return
+	}
+	j.finish(jobCancelled, "Cancelled ⏹ %s", code(j.name))
+}
+
+func init() {
+	listenEvents(presentJob)
+}
+
+// presentJob shows the events of a job in its chat: the status message, the
+// reactions and the batch counts. Failed and cancelled jobs get a Retry
+// button.
+func presentJob(e jobEvent) {
+	j := e.job
+	switch e.Type {
+	case eventQueued:
+		j.react("👀")
+	case eventProgress:
+		j.mu.Lock()
+		p := j.progress
+		j.mu.Unlock()
+		if p != nil && cfg().Notify >= notifyVerbose {
+			j.status.Update(trHTML("Downloading %s", code(p.name)) + "\n" + esc(p.Bar()))
+		}
+	case eventDone, eventFailed, eventCancelled, eventSkipped:
+		which := jobButtons(0)
+		if e.Type == eventFailed || e.Type == eventCancelled {
+			which = withRetry
+		}
+		j.mu.Lock()
+		text := j.text
+		j.mu.Unlock()
+		j.status.SetButtons(j.buttons(which))
+		j.status.Update(text)
+		switch {
+		case e.Type == eventDone:
+			j.react("👍")
+		case e.Type == eventFailed:
+			j.react("👎")
+			if cfg().Notify >= notifyErrors {
+				j.status.Show(kindError)
+			}
+		}
+		if j.batch != nil {
+			j.batch.jobFinished()
+		}
+	}
+}
+
+func (j *job) info() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	state := tr("enqueued")
+	if j.progress != nil {
+		state = j.progress.String()
+	} else if j.result != "" {
+		state = j.result
+	}
+	return tr("Job %s\n%s\nFolder: %s\nSize: %s\nFrom: %s\n%s", j.id, j.name,
+		filepath.Dir(j.path), units.Format(j.file.FileSize),
+		senderName(j.c.Sender()), state)
+}
+
+// jobFor finds the job of a button press. Only the sender of the file or an
+// admin may control it.
+func jobFor(c tele.Context) (*job, error) {
+	jobs.Lock()
+	j, ok := jobs.m[c.Data()]
+	jobs.Unlock()
+	if !ok {
+		return nil, c.Respond(&tele.CallbackResponse{Text: tr("Expired")})
+	}
+	if j.c.Sender().ID != c.Sender().ID &&
+		cfg().Roles.permissionsOf(c.Sender())&permAdmin == 0 {
+		return nil, c.Respond(&tele.CallbackResponse{Text: tr("Only the sender or an admin can do this")})
+	}
+	return j, nil
+}
+
+var (
+	errNotDownloading = errors.New("not downloading")
+	errStillRunning   = errors.New("still running")
+)
+
+// Cancel stops the download, by is only used for the log.
+func (j *job) Cancel(by string) error {
+	j.mu.Lock()
+	cancel := j.cancel
+	j.mu.Unlock()
+	if cancel == nil {
+		return errNotDownloading
+	}
+	j.logf("Cancelled by %s: %s", by, j.name)
+	cancel()
+	return nil
+}
+
+// Retry starts a finished job again as a new job, through the checks of
+// admitDownload. A job is retried once, later calls get errStillRunning.
+func (j *job) Retry(by string) error {
+	j.mu.Lock()
+	if j.finished.IsZero() || j.retried {
+		j.mu.Unlock()
+		return errStillRunning
+	}
+	j.retried = true
+	j.mu.Unlock()
+	if err := admitDownload(j.c, j.name, j.file.FileSize); err != nil {
+		j.mu.Lock()
+		j.retried = false
+		j.mu.Unlock()
+		return err
+	}
+
+	jobs.Lock()
+	delete(jobs.m, j.id)
+	jobs.Unlock()
+	j.logf("Retry by %s: %s", by, j.name)
+	j.status.SetButtons(nil)
+	j.status.Update(j.text + "\n" + trHTML("Retried by %s", by))
+	go func() {
+		defer releaseQuota(j.c.Sender().ID, j.c.Chat().ID, j.file.FileSize)
+		downloadFile(handlerContext(j.c), j.c, j.file, j.name, time.Now())
+	}()
+	return nil
+}
+
+func handleJobCancel(c tele.Context) error {
+	j, err := jobFor(c)
+	if j == nil {
+		return err
+	}
+	if err := j.Cancel(senderName(c.Sender())); err != nil {
+		return c.Respond(&tele.CallbackResponse{Text: tr("Not downloading")})
+	}
+	return c.Respond(&tele.CallbackResponse{Text: tr("Cancelling")})
+}
+
+func handleJobRetry(c tele.Context) error {
+	j, err := jobFor(c)
+	if j == nil {
+		return err
+	}
+	if err := j.Retry(senderName(c.Sender())); err != nil {
+		var r *refusal
+		if errors.As(err, &r) {
+			return c.Respond(&tele.CallbackResponse{Text: r.msg, ShowAlert: true})
+		}
+		return c.Respond(&tele.CallbackResponse{Text: tr("Still running")})
+	}
+	return c.Respond()
+}
+
+func handleJobInfo(c tele.Context) error {
+	j, err := jobFor(c)
+	if j == nil {
+		return err
+	}
+	return c.Respond(&tele.CallbackResponse{Text: j.info(), ShowAlert: true})
+}
+
+// ctxReader stops a transfer as soon as its context is cancelled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,102 @@
+package downloader
+
+import (
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// jobState is where a job is in its life: queued → downloading → verifying
+// (size, checksum, duplicate and overwrite checks) → processing (rename and
+// upload), then one of the outcomes. A job can end from any state but
+// processing, which only fails or succeeds.
+type jobState string
+
+const (
+	stateQueued      jobState = "queued"
+	stateDownloading jobState = "downloading"
+	stateVerifying   jobState = "verifying"
+	stateProcessing  jobState = "processing"
+)
+
+var jobTransitions = map[jobState][]jobState{
+	stateQueued:      {stateDownloading, jobState(jobFailed), jobState(jobCancelled), jobState(jobSkipped)},
+	stateDownloading: {stateVerifying, jobState(jobFailed), jobState(jobCancelled)},
+	stateVerifying:   {stateProcessing, jobState(jobFailed), jobState(jobCancelled), jobState(jobSkipped)},
+	stateProcessing:  {jobState(jobDone), jobState(jobFailed)},
+}
+
+// The unfinished states in the order of /queue.
+var jobStates = []jobState{stateQueued, stateDownloading, stateVerifying, stateProcessing}
+
+// stateCounts counts the jobs in each unfinished state, kept up to date by
+// transition: queued ones wait for a pause to end or a transfer slot,
+// downloading ones transfer.
+var stateCounts = map[jobState]*atomic.Int64{
+	stateQueued: {}, stateDownloading: {}, stateVerifying: {}, stateProcessing: {},
+}
+
+func jobsInState(s jobState) int64 {
+	return stateCounts[s].Load()
+}
+
+func (s jobState) final() bool {
+	_, ok := jobTransitions[s]
+	return !ok
+}
+
+// transition moves the job to state s, recording when. Invalid transitions
+// are logged and ignored. j.mu must be held.
+func (j *job) transition(s jobState) bool {
+	if !slices.Contains(jobTransitions[j.state], s) {
+		j.logf("Invalid state transition %s → %s", j.state, s)
+		return false
+	}
+	stateCounts[j.state].Add(-1)
+	if n := stateCounts[s]; n != nil {
+		n.Add(1)
+	}
+	j.state = s
+	j.since[s] = time.Now()
+	return true
+}
+
+func (j *job) setState(s jobState) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.transition(s)
+}
+
+// handleQueue lists the unfinished jobs of the chat by state, oldest first,
+// with how long they have been in it.
+func handleQueue(c tele.Context) error {
+	byState := map[jobState][]apiJob{}
+	for _, a := range listJobs(false) {
+		if a.ChatID == c.Chat().ID {
+			byState[a.State] = append(byState[a.State], a)
+		}
+	}
+
+	msg := ""
+	for _, s := range jobStates {
+		list := byState[s]
+		if len(list) == 0 {
+			continue
+		}
+		msg += fmt.Sprintf("%s: %d\n", s, len(list))
+		for _, a := range list {
+			msg += fmt.Sprintf("  %s %s (%s)", a.ID, a.Name, time.Since(a.States[s]).Round(time.Second))
+			if a.StartAt != nil {
+				msg += " " + tr("starts at %s", inZone(*a.StartAt).Format("Mon 15:04"))
+			}
+			msg += "\n"
+		}
+	}
+	if msg == "" {
+		return c.Reply(tr("Nothing queued or downloading in this chat"))
+	}
+	return replyPre(c, tr("Queue:"), msg)
+}
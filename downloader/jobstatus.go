@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleJob, also /status, shows everything known about a job: its state
+// timeline, transfer, destination, retries and last error while it's in
+// memory (for jobRetention after it finished), and what the history or the
+// failed downloads kept about it after that. Only admins see the jobs of
+// other chats.
+func handleJob(c tele.Context) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return c.Reply(tr("Usage: /job <job id>"))
+	}
+	id := strings.ToLower(args[0])
+	allChats := cfg().Roles.permissionsOf(c.Sender())&permAdmin == permAdmin
+	jobs.Lock()
+	j, ok := jobs.m[id]
+	jobs.Unlock()
+	if ok && (allChats || j.c.Chat().ID == c.Chat().ID) {
+		return replyPre(c, tr("Job %s:", id), j.statusReport())
+	}
+
+	e, seq, fd, err := storedJob(id)
+	if e != nil && !allChats && e.ChatID != c.Chat().ID {
+		e = nil
+	}
+	if fd != nil && !allChats && fd.ChatID != c.Chat().ID {
+		fd = nil
+	}
+	switch {
+	case err != nil:
+		return err
+	case e != nil:
+		msg := tr("Name: %s\nState: %s at %s\nSize: %s\nDestination: %s\nSHA-256: %s\nHistory ID: %d",
+			e.Name, jobDone, inZone(e.Time).Format(time.RFC3339), units.Format(e.Size), e.Path, e.Hash, seq)
+		return replyPre(c, tr("Job %s:", id), msg)
+	case fd != nil:
+		msg := tr("Name: %s\nState: %s at %s\nSize: %s\nRetries: %d\nLast error: %s",
+			fd.Name, jobFailed, inZone(fd.Failed).Format(time.RFC3339), units.Format(fd.Size), fd.Attempts, fd.Error)
+		return replyPre(c, tr("Job %s:", id), msg)
+	}
+	return c.Reply(tr("No job %s", id))
+}
+
+func (j *job) statusReport() string {
+	j.mu.Lock()
+	state, result, path, startAt := j.state, j.result, j.path, j.startAt
+	since := maps.Clone(j.since)
+	written := j.written
+	if j.progress != nil {
+		written = j.progress.Written()
+	}
+	j.mu.Unlock()
+	timeline := slices.SortedFunc(maps.Keys(since), func(a, b jobState) int { return since[a].Compare(since[b]) })
+
+	msg := tr("Name: %s\nState: %s for %s\nSender: %s\nDestination: %s", j.name, state,
+		time.Since(since[state]).Round(time.Second), senderName(j.c.Sender()), path)
+	if state == stateQueued && !startAt.IsZero() {
+		msg += "\n" + tr("Starts at: %s", inZone(startAt).Format(time.DateTime))
+	}
+	msg += "\n" + tr("Timeline:")
+	for i, s := range timeline {
+		msg += fmt.Sprintf("\n  %-11s %s", s, inZone(since[s]).Format(time.TimeOnly))
+		if i > 0 {
+			msg += fmt.Sprintf(" (+%s)", since[s].Sub(since[timeline[i-1]]).Round(time.Millisecond))
+		}
+	}
+
+	if started, ok := since[stateDownloading]; ok {
+		msg += "\n" + tr("Bytes: %s of %s", units.Format(written), units.Format(j.file.FileSize))
+		end, ok := since[stateVerifying]
+		if state == stateDownloading {
+			end, ok = time.Now(), true
+		}
+		if ok {
+			msg += "\n" + tr("Speed: %s", speed(written, end.Sub(started)))
+		}
+	} else {
+		msg += "\n" + tr("Size: %s", units.Format(j.file.FileSize))
+	}
+
+	var fd failedDownload
+	if j.c.Message() != nil {
+		if found, _ := storage.Get(failedBucket, failedKey(j.c), &fd); found {
+			msg += "\n" + tr("Retries: %d", fd.Attempts)
+		}
+	}
+	switch {
+	case fd.Error != "":
+		msg += "\n" + tr("Last error: %s", fd.Error)
+	case state == jobState(jobFailed):
+		msg += "\n" + tr("Last error: %s", result)
+	case state.final():
+		msg += "\n" + result
+	}
+	return msg
+}
@@ -0,0 +1,112 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Every download and background worker runs with a context derived from the
+// engine's, which Stop cancels. Downloads go through a child context per
+// chat, so /cancelall stops all the downloads of a chat at once.
+var lifecycle = struct {
+	sync.Mutex
+	ctx    context.Context
+	cancel context.CancelFunc
+	chats  map[int64]chatLifecycle
+}{chats: make(map[int64]chatLifecycle)}
+
+type chatLifecycle struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func init() {
+	lifecycle.ctx, lifecycle.cancel = context.WithCancel(context.Background())
+}
+
+func rootContext() context.Context {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	return lifecycle.ctx
+}
+
+func stopLifecycle() {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	lifecycle.cancel()
+}
+
+func chatContext(chatID int64) context.Context {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	cl, ok := lifecycle.chats[chatID]
+	if !ok || cl.ctx.Err() != nil {
+		cl.ctx, cl.cancel = context.WithCancel(lifecycle.ctx)
+		lifecycle.chats[chatID] = cl
+	}
+	return cl.ctx
+}
+
+// handlerContext is the context for the work a handler starts.
+func handlerContext(c tele.Context) context.Context {
+	if c.Chat() == nil {
+		return rootContext()
+	}
+	return chatContext(c.Chat().ID)
+}
+
+// cancelChat cancels everything running for a chat; the next download gets a
+// new context.
+func cancelChat(chatID int64) {
+	lifecycle.Lock()
+	defer lifecycle.Unlock()
+	if cl, ok := lifecycle.chats[chatID]; ok {
+		cl.cancel()
+		delete(lifecycle.chats, chatID)
+	}
+}
+
+// sleepContext waits for d and reports whether ctx is still alive.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// handleCancelAll cancels the downloads of the chat once the sender confirms.
+func handleCancelAll(c tele.Context) error {
+	n := runningIn(c.Chat().ID)
+	if n == 0 {
+		return c.Reply(tr("No downloads in this chat"))
+	}
+	if !askConfirmation(c, tr("Cancel %d downloads in this chat?", n)) {
+		return nil
+	}
+	n = runningIn(c.Chat().ID)
+	cancelChat(c.Chat().ID)
+	logEverywhere(c, "Cancelled %d downloads in this chat", n)
+	return nil
+}
+
+// runningIn counts the unfinished downloads of a chat.
+func runningIn(chatID int64) int {
+	var n int
+	jobs.Lock()
+	defer jobs.Unlock()
+	for _, j := range jobs.m {
+		j.mu.Lock()
+		if j.c.Chat().ID == chatID && j.finished.IsZero() {
+			n++
+		}
+		j.mu.Unlock()
+	}
+	return n
+}
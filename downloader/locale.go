@@ -0,0 +1,55 @@
+package downloader
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Message catalogs map the English format strings used in the code to their
+// translation. English needs no catalog.
+//
+//go:embed locales/*.yaml
+var builtinLocales embed.FS
+
+const defaultLocale = "en"
+
+// loadCatalog returns the catalog of locale, from dir if it has one and the
+// built-in one otherwise.
+func loadCatalog(locale, dir string) (map[string]string, error) {
+	if locale == defaultLocale {
+		return nil, nil
+	}
+	file := locale + ".yaml"
+	var data []byte
+	var err error
+	if dir != "" {
+		data, err = os.ReadFile(filepath.Join(dir, file))
+	}
+	if dir == "" || os.IsNotExist(err) {
+		data, err = builtinLocales.ReadFile("locales/" + file)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no message catalog for locale %q", locale)
+	}
+	catalog := map[string]string{}
+	if err := yaml.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("message catalog %s is invalid: err=%s", file, err.Error())
+	}
+	return catalog, nil
+}
+
+// tr translates a user-facing message to the configured locale and formats
+// it. Messages missing from the catalog stay in English.
+func tr(format string, args ...interface{}) string {
+	if t, ok := cfg().Catalog[format]; ok {
+		format = t
+	}
+	if len(args) == 0 {
+		return format
+	}
+	return fmt.Sprintf(format, args...)
+}
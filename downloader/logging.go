@@ -0,0 +1,85 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// logLevel is TELEGRAM_LOG_LEVEL, the least important messages that are
+// logged. A message has its level as a prefix, which logDebug, logWarn and
+// logError add; log.Printf logs at info.
+type logLevel uint8
+
+const (
+	logDebug logLevel = iota
+	logInfo
+	logWarn
+	logError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string {
+	return logLevelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, expected one of %s", s, strings.Join(logLevelNames, ", "))
+}
+
+func (l logLevel) prefix() string {
+	return strings.ToUpper(l.String()) + " "
+}
+
+func logAt(l logLevel, format string, args ...interface{}) {
+	log.Output(3, l.prefix()+fmt.Sprintf(format, args...))
+}
+
+func debugf(format string, args ...interface{}) { logAt(logDebug, format, args...) }
+func warnf(format string, args ...interface{})  { logAt(logWarn, format, args...) }
+func errorf(format string, args ...interface{}) { logAt(logError, format, args...) }
+
+// levelWriter is the output of the log. It drops the messages below the
+// level and adds the date and time, which the logger leaves out so that the
+// messages start with their level.
+type levelWriter struct {
+	w io.Writer
+}
+
+func (lw levelWriter) Write(p []byte) (int, error) {
+	level := logInfo
+	for _, l := range []logLevel{logDebug, logWarn, logError} {
+		if bytes.HasPrefix(p, []byte(l.prefix())) {
+			level = l
+		}
+	}
+	min := logInfo
+	if c := cfg(); c != nil {
+		min = c.LogLevel
+	}
+	if level < min {
+		return len(p), nil
+	}
+	if _, err := lw.w.Write(append(time.Now().AppendFormat(nil, "2006/01/02 15:04:05 "), p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// setLogOutput sends the log to w through levelWriter.
+func setLogOutput(w io.Writer) {
+	if lw, ok := w.(levelWriter); ok {
+		w = lw.w
+	}
+	log.SetFlags(0)
+	log.SetOutput(levelWriter{w})
+}
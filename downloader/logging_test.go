@@ -0,0 +1,27 @@
+package downloader
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+// Messages below TELEGRAM_LOG_LEVEL are dropped, the others keep their level.
+func TestLogLevel(t *testing.T) {
+	withCfg(t, func(c *Cfg) { c.LogLevel = logWarn })
+	prev, flags := log.Writer(), log.Flags()
+	t.Cleanup(func() { log.SetOutput(prev); log.SetFlags(flags) })
+	var buf bytes.Buffer
+	setLogOutput(&buf)
+
+	debugf("debug %d", 1)
+	log.Printf("info %d", 2)
+	warnf("warn %d", 3)
+	errorf("error %d", 4)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], " WARN warn 3") || !strings.HasSuffix(lines[1], " ERROR error 4") {
+		t.Errorf("log %q, want only the warning and the error", lines)
+	}
+}
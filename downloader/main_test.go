@@ -0,0 +1,142 @@
+package downloader
+
+import (
+	"flag"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The tests run the handlers against internal/fakebot, in the Engine built
+// by newTestEngine with the destination and the state file in a temporary
+// directory.
+var engine *Engine
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	dir, err := os.MkdirTemp("", "downloader")
+	if err != nil {
+		log.Fatal(err)
+	}
+	engine, err = newTestEngine(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		engine.Start()
+		close(done)
+	}()
+
+	code := m.Run()
+	engine.Stop()
+	<-done
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+const testChat = 100
+
+var testUser = &tele.User{ID: 7, Username: "tester"}
+
+var lastMessageID atomic.Int32
+
+// newMessage is a message of testUser in testChat, with an ID of its own.
+func newMessage() *tele.Message {
+	return &tele.Message{ID: int(lastMessageID.Add(1)), Chat: &tele.Chat{ID: testChat, Type: tele.ChatPrivate},
+		Sender: testUser, Unixtime: time.Now().Unix()}
+}
+
+// commandHandler is the handler of /text with its middleware, as
+// handleCommands registers it.
+func commandHandler(t *testing.T, text string) tele.HandlerFunc {
+	t.Helper()
+	for _, cmd := range commands {
+		if cmd.text != text {
+			continue
+		}
+		m := cmd.middleware
+		if cmd.perm != 0 {
+			m = append([]tele.MiddlewareFunc{requirePermission(cmd.perm)}, m...)
+		}
+		h := cmd.handler
+		for i := len(m) - 1; i >= 0; i-- {
+			h = m[i](h)
+		}
+		return h
+	}
+	t.Fatalf("no /%s command", text)
+	return nil
+}
+
+// withCfg changes the configuration until the end of the test.
+func withCfg(t *testing.T, change func(c *Cfg)) {
+	prev := cfg()
+	c := *prev
+	change(&c)
+	currentCfg.Store(&c)
+	t.Cleanup(func() { currentCfg.Store(prev) })
+}
+
+// finished subscribes to the job events and returns the function that waits
+// for the outcome of the download of name.
+func finished(t *testing.T, name string) func() jobEvent {
+	events, stop := subscribeEvents(t.Context())
+	t.Cleanup(stop)
+	return func() jobEvent {
+		timeout := time.After(10 * time.Second)
+		for {
+			select {
+			case e := <-events:
+				if e.Type.finished() && e.Job.Name == name {
+					return e
+				}
+			case <-timeout:
+				t.Fatalf("%s didn't finish", name)
+			}
+		}
+	}
+}
+
+// waitEvent waits for what the bot did to include a message with text.
+func waitEvent(t *testing.T, b *fakebot.Bot, action, text string) fakebot.Event {
+	timeout := time.Now().Add(10 * time.Second)
+	for time.Now().Before(timeout) {
+		for _, e := range b.Events() {
+			if e.Action == action && strings.Contains(e.Text, text) {
+				return e
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("no %s with %q in %+v", action, text, b.Events())
+	return fakebot.Event{}
+}
+
+// answer presses the button of the confirmation with the question, as
+// testUser.
+func answer(t *testing.T, b *fakebot.Bot, question string, btn tele.Btn, handler tele.HandlerFunc) {
+	t.Helper()
+	e := waitEvent(t, b, "reply", question)
+	for _, button := range e.Buttons {
+		if button.Unique == btn.Unique {
+			msg := &tele.Message{ID: e.ID, Chat: &tele.Chat{ID: e.ChatID}, Text: e.Text}
+			c := b.Context(tele.Update{Callback: &tele.Callback{Sender: testUser, Message: msg, Data: button.Data}})
+			if err := handler(c); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+	t.Fatalf("no %s button in %+v", btn.Unique, e)
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+const settingsBucket = "settings"
+
+var maintenance atomic.Bool
+
+// Chats that were turned away during maintenance, told when it ends.
+var maintenanceChats = struct {
+	sync.Mutex
+	m map[int64]bool
+}{m: make(map[int64]bool)}
+
+func loadMaintenance() {
+	var on bool
+	if _, err := storage.Get(settingsBucket, "maintenance", &on); err != nil {
+		errorf("Maintenance: %s", err.Error())
+	}
+	maintenance.Store(on)
+	if on {
+		log.Println("Maintenance mode is on")
+	}
+}
+
+// maintenanceGuard refuses the wrapped handler while maintenance is on.
+func maintenanceGuard(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		if !maintenance.Load() {
+			return next(c)
+		}
+		return c.Reply(refuseInMaintenance(c.Chat().ID))
+	}
+}
+
+// refuseInMaintenance notes the chat to tell when maintenance ends and
+// returns the refusal.
+func refuseInMaintenance(chatID int64) string {
+	maintenanceChats.Lock()
+	maintenanceChats.m[chatID] = true
+	maintenanceChats.Unlock()
+	return tr("Maintenance in progress, please try again later. I'll let you know when I'm back.")
+}
+
+func handleMaintenance(c tele.Context) error {
+	args := c.Args()
+	if len(args) != 1 || (args[0] != "on" && args[0] != "off") {
+		state := "off"
+		if maintenance.Load() {
+			state = "on"
+		}
+		return c.Reply(tr("Usage: /maintenance on|off (currently %s)", state))
+	}
+
+	on := args[0] == "on"
+	maintenance.Store(on)
+	if err := storage.Put(settingsBucket, "maintenance", on); err != nil {
+		errorf("Maintenance: %s", err.Error())
+	}
+	if on {
+		logEverywhere(c, "Maintenance mode on: new downloads and destructive commands are refused")
+		return nil
+	}
+
+	logEverywhere(c, "Maintenance mode off")
+	go retryFailures()
+	maintenanceChats.Lock()
+	chats := maintenanceChats.m
+	maintenanceChats.m = make(map[int64]bool)
+	maintenanceChats.Unlock()
+	for _, id := range botCfgFor(c).ChatIDs {
+		chats[id] = true
+	}
+	delete(chats, c.Chat().ID)
+	for id := range chats {
+		if _, err := apiOf(c).Send(tele.ChatID(id), tr("I'm back, downloads are accepted again.")); err != nil {
+			errorf("Maintenance: notify %d: %s", id, err.Error())
+		}
+	}
+	return nil
+}
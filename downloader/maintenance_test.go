@@ -0,0 +1,75 @@
+package downloader
+
+import (
+	"testing"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Maintenance mode refuses the commands that delete or change something.
+func TestMaintenanceRefuses(t *testing.T) {
+	maintenance.Store(true)
+	t.Cleanup(func() { maintenance.Store(false) })
+	for _, text := range []string{"prune", "backup", "cancelall", "set"} {
+		t.Run(text, func(t *testing.T) {
+			b := fakebot.New()
+			msg := newMessage()
+			msg.Text = "/" + text
+			if err := commandHandler(t, text)(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			events := b.Events()
+			if len(events) != 1 {
+				t.Fatalf("events %+v, want only the refusal", events)
+			}
+			waitEvent(t, b, "reply", "Maintenance in progress")
+		})
+	}
+}
+
+// A channel post during maintenance waits among the failed downloads, to be
+// retried once maintenance is off.
+func TestMaintenanceChannelPost(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int // TELEGRAM_RETRY_ATTEMPTS
+		want     bool
+	}{
+		{name: "held", attempts: 5, want: true},
+		{name: "no retries", attempts: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) {
+				c.RetryAttempts = tt.attempts
+				c.Channels = []channelCfg{{Name: "archive", ChatID: -1002, Types: []string{"document"},
+					Template: defaultChannelTemplate}}
+			})
+			maintenance.Store(true)
+			t.Cleanup(func() { maintenance.Store(false) })
+			b := fakebot.New()
+			f := b.AddFile([]byte("channel post " + tt.name))
+			post := &tele.Message{ID: int(lastMessageID.Add(1)), Chat: &tele.Chat{ID: -1002, Type: tele.ChatChannel},
+				Document: &tele.Document{File: *f, FileName: "post.pdf"}}
+			c := b.Context(tele.Update{ChannelPost: post})
+			t.Cleanup(func() { storage.Delete(failedBucket, failedKey(c)) })
+
+			if err := handleChannelPost(c); err != nil {
+				t.Fatal(err)
+			}
+			var fd failedDownload
+			found, err := storage.Get(failedBucket, failedKey(c), &fd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != tt.want {
+				t.Fatalf("held %v, want %v", found, tt.want)
+			}
+			if found && (fd.Name != "post.pdf" || fd.FileID != f.FileID || fd.Attempts != 0) {
+				t.Errorf("held %+v, want post.pdf with no attempts", fd)
+			}
+		})
+	}
+}
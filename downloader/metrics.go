@@ -0,0 +1,173 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/stats"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queueLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "telegram_download_queue_seconds",
+		Help:    "Time from enqueue until the download starts.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 4, 10),
+	})
+	downloadDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "telegram_download_duration_seconds",
+		Help:    "Time from download start until the file is in place.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 3, 10),
+	})
+	// By outcome, for the life of the process: unlike the /stats tallies,
+	// /statsreset doesn't touch them.
+	downloadCounters = map[jobOutcome]prometheus.Counter{
+		jobDone: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "telegram_downloads_ok_total",
+			Help: "Successful downloads.",
+		}),
+		jobFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "telegram_downloads_failed_total",
+			Help: "Failed downloads.",
+		}),
+		jobCancelled: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "telegram_downloads_cancelled_total",
+			Help: "Cancelled downloads.",
+		}),
+		jobSkipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "telegram_downloads_skipped_total",
+			Help: "Skipped downloads (filtered, duplicates, dry run).",
+		}),
+	}
+	downloadedBytes = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "telegram_downloaded_bytes_total",
+		Help: "Size of the successful downloads.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(queueLatency, downloadDuration)
+	for _, c := range downloadCounters {
+		prometheus.MustRegister(c)
+	}
+	prometheus.MustRegister(downloadedBytes,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "telegram_downloads_pending",
+			Help: "Downloads enqueued or in progress.",
+		}, func() float64 { return float64(pendingDownloads()) }),
+	)
+}
+
+func startMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	log.Println("Metrics listening on:", addr)
+	return serveHTTP("metrics", addr, mux)
+}
+
+// durationWindow keeps the most recent samples for percentile reporting
+// in /stats; Prometheus gets the full histograms.
+type durationWindow struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+const durationWindowSize = 1000
+
+var (
+	queueWindow    durationWindow
+	downloadWindow durationWindow
+)
+
+func (w *durationWindow) Add(d time.Duration) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.samples) < durationWindowSize {
+		w.samples = append(w.samples, d)
+		return
+	}
+	w.samples[w.next] = d
+	w.next = (w.next + 1) % durationWindowSize
+}
+
+func (w *durationWindow) Reset() {
+	w.mu.Lock()
+	w.samples = nil
+	w.next = 0
+	w.mu.Unlock()
+}
+
+func (w *durationWindow) String() string {
+	w.mu.Lock()
+	sorted := append([]time.Duration(nil), w.samples...)
+	w.mu.Unlock()
+	if len(sorted) == 0 {
+		return "n/a"
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	p := func(q float64) time.Duration {
+		return sorted[int(q*float64(len(sorted)-1))].Round(time.Millisecond)
+	}
+	return fmt.Sprintf("p50 %s, p90 %s, p99 %s", p(0.5), p(0.9), p(0.99))
+}
+
+func init() {
+	listenEvents(countJob)
+}
+
+// countJob keeps the download counters and latency metrics.
+func countJob(e jobEvent) {
+	j := e.job
+	j.mu.Lock()
+	enqueued, started := j.enqueued, j.since[stateDownloading]
+	j.mu.Unlock()
+	switch e.Type {
+	case eventStarted:
+		if !enqueued.IsZero() {
+			observeQueueLatency(j.id, started.Sub(enqueued))
+		}
+	case eventDone:
+		observeDownloadDuration(j.id, e.Time.Sub(started))
+	}
+	if e.Type.finished() {
+		downloadCounters[jobOutcome(e.Type)].Inc()
+		if e.Type == eventDone {
+			downloadedBytes.Add(float64(e.Job.Written))
+		}
+		counters.Record(e.Job.ChatID, j.fileType(), stats.Outcome(e.Type), e.Job.Written, e.Time)
+	}
+}
+
+// The job ID goes into the exemplar of the observation, shown by the
+// OpenMetrics format.
+func observeQueueLatency(jobID string, d time.Duration) {
+	queueLatency.(prometheus.ExemplarObserver).ObserveWithExemplar(d.Seconds(), prometheus.Labels{"job_id": jobID})
+	queueWindow.Add(d)
+}
+
+func observeDownloadDuration(jobID string, d time.Duration) {
+	downloadDuration.(prometheus.ExemplarObserver).ObserveWithExemplar(d.Seconds(), prometheus.Labels{"job_id": jobID})
+	downloadWindow.Add(d)
+}
+
+// memoryReport is the memory taken from the OS, and the limit when
+// TELEGRAM_MEMORY_LIMIT or GOMEMLIMIT sets one.
+func memoryReport() string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		return tr("Memory: %s (limit %s)", units.Format(int64(m.Sys)), units.Format(limit))
+	}
+	return tr("Memory: %s", units.Format(int64(m.Sys)))
+}
@@ -0,0 +1,41 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// startMirrors copies the finished and failed notices to the Discord and
+// Slack incoming webhooks, for ops channels that live outside Telegram.
+func startMirrors() {
+	events, _ := subscribeEvents(rootContext())
+	go func() {
+		for e := range events {
+			if e.Type != eventDone && e.Type != eventFailed {
+				continue
+			}
+			c := cfg()
+			if len(c.DiscordWebhooks) == 0 && len(c.SlackWebhooks) == 0 {
+				continue
+			}
+			text := fmt.Sprintf("[%s] %s\nFrom %s in chat %d", c.InstanceName, e.Job.Result,
+				e.Job.Sender, e.Job.ChatID)
+			mirror(c.DiscordWebhooks, map[string]string{"content": text})
+			mirror(c.SlackWebhooks, map[string]string{"text": text})
+		}
+	}()
+}
+
+func mirror(urls []string, payload map[string]string) {
+	if len(urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		errorf("Mirror: %s", err.Error())
+		return
+	}
+	for _, url := range urls {
+		go postWebhook(url, body)
+	}
+}
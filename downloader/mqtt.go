@@ -0,0 +1,52 @@
+package downloader
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// startMQTT publishes every job event as JSON to <TELEGRAM_MQTT_TOPIC>/<event>,
+// e.g. telegram-files-downloader/done.
+func startMQTT() {
+	c := cfg()
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.MQTTBroker).
+		SetClientID(serviceName + "-" + c.InstanceName).
+		SetUsername(c.MQTTUser).
+		SetPassword(c.MQTTPassword).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10 * time.Second).
+		SetOnConnectHandler(func(mqtt.Client) { log.Println("MQTT connected to:", c.MQTTBroker) }).
+		SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			errorf("MQTT connection lost: %s", err.Error())
+		})
+	client := mqtt.NewClient(opts)
+	client.Connect()
+
+	events, _ := subscribeEvents(rootContext())
+	go func() {
+		for e := range events {
+			payload, err := json.Marshal(e)
+			if err != nil {
+				errorf("MQTT: %s", err.Error())
+				continue
+			}
+			// Progress is frequent and stale right away, so it's fire and
+			// forget; the rest is delivered at least once.
+			qos := byte(1)
+			if e.Type == eventProgress {
+				qos = 0
+			}
+			t := client.Publish(cfg().MQTTTopic+"/"+string(e.Type), qos, false, payload)
+			go func() {
+				if t.WaitTimeout(30*time.Second) && t.Error() != nil {
+					errorf("MQTT publish failed: %s", t.Error().Error())
+				}
+			}()
+		}
+	}()
+}
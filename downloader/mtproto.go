@@ -0,0 +1,299 @@
+package downloader
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"github.com/gotd/td/session"
+	"github.com/gotd/td/telegram"
+	"github.com/gotd/td/telegram/auth"
+	"github.com/gotd/td/telegram/downloader"
+	"github.com/gotd/td/telegram/query"
+	"github.com/gotd/td/tg"
+	"github.com/gotd/td/tgerr"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The Bot API can't see messages sent before the bot joined a chat, so
+// /backfill reads the history with a user account over MTProto instead.
+// The account is logged in once with "telegram-files-downloader mtproto-login".
+
+var backfill struct {
+	sync.Mutex
+	cancel context.CancelFunc
+}
+
+func mtprotoClient() *telegram.Client {
+	return telegram.NewClient(cfg().MTProtoAppID, cfg().MTProtoAppHash, telegram.Options{
+		SessionStorage: &session.FileStorage{Path: cfg().MTProtoSession},
+		NoUpdates:      true,
+	})
+}
+
+// mtprotoPrompt asks for the login details on the terminal.
+type mtprotoPrompt struct {
+	in *bufio.Reader
+}
+
+func (p mtprotoPrompt) ask(q string) (string, error) {
+	fmt.Print(q)
+	s, err := p.in.ReadString('\n')
+	return strings.TrimSpace(s), err
+}
+
+func (p mtprotoPrompt) Phone(context.Context) (string, error) {
+	return p.ask("Phone number (international format): ")
+}
+
+func (p mtprotoPrompt) Password(context.Context) (string, error) {
+	return p.ask("Two-step verification password: ")
+}
+
+func (p mtprotoPrompt) Code(context.Context, *tg.AuthSentCode) (string, error) {
+	return p.ask("Login code: ")
+}
+
+func (p mtprotoPrompt) AcceptTermsOfService(context.Context, tg.HelpTermsOfService) error {
+	return errors.New("the account must be registered with an official app first")
+}
+
+func (p mtprotoPrompt) SignUp(context.Context) (auth.UserInfo, error) {
+	return auth.UserInfo{}, errors.New("the account must be registered with an official app first")
+}
+
+// mtprotoLogin logs the user account in interactively and saves the session.
+func mtprotoLogin() {
+	if cfg().MTProtoAppID == 0 || cfg().MTProtoAppHash == "" {
+		log.Fatal("TELEGRAM_MTPROTO_APP_ID and TELEGRAM_MTPROTO_APP_HASH are required")
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	client := mtprotoClient()
+	err := client.Run(ctx, func(ctx context.Context) error {
+		flow := auth.NewFlow(mtprotoPrompt{bufio.NewReader(os.Stdin)}, auth.SendCodeOptions{})
+		if err := client.Auth().IfNecessary(ctx, flow); err != nil {
+			return err
+		}
+		self, err := client.Self(ctx)
+		if err != nil {
+			return err
+		}
+		log.Printf("MTProto session for %s %s (%d) saved to %s", self.FirstName, self.LastName, self.ID,
+			cfg().MTProtoSession)
+		return nil
+	})
+	if err != nil {
+		log.Fatalf("MTProto login failed: err=%s", err.Error())
+	}
+}
+
+// botAPIChatID converts an MTProto peer to the chat ID the Bot API uses.
+func botAPIChatID(p tg.InputPeerClass) int64 {
+	switch p := p.(type) {
+	case *tg.InputPeerChannel:
+		return -1000000000000 - p.ChannelID
+	case *tg.InputPeerChat:
+		return -p.ChatID
+	case *tg.InputPeerUser:
+		return p.UserID
+	}
+	return 0
+}
+
+// resolvePeer finds a chat by @username or Bot API chat ID; chats without a
+// username must be among the dialogs of the user account.
+func resolvePeer(ctx context.Context, api *tg.Client, target string) (tg.InputPeerClass, error) {
+	id, err := strconv.ParseInt(target, 10, 64)
+	if err != nil {
+		r, err := api.ContactsResolveUsername(ctx, &tg.ContactsResolveUsernameRequest{
+			Username: strings.TrimPrefix(target, "@")})
+		if err != nil {
+			return nil, err
+		}
+		switch p := r.Peer.(type) {
+		case *tg.PeerChannel:
+			for _, c := range r.Chats {
+				if ch, ok := c.(*tg.Channel); ok && ch.ID == p.ChannelID {
+					return ch.AsInputPeer(), nil
+				}
+			}
+		case *tg.PeerChat:
+			return &tg.InputPeerChat{ChatID: p.ChatID}, nil
+		case *tg.PeerUser:
+			for _, u := range r.Users {
+				if u, ok := u.(*tg.User); ok && u.ID == p.UserID {
+					return u.AsInputPeer(), nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("%s not found", target)
+	}
+
+	iter := query.GetDialogs(api).BatchSize(100).Iter()
+	for iter.Next(ctx) {
+		if p := iter.Value().Peer; botAPIChatID(p) == id {
+			return p, nil
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("chat %d is not among the dialogs of the MTProto account", id)
+}
+
+type backfillCounts struct {
+	ok, skipped, failed int
+	bytes               int64
+}
+
+// runBackfill downloads every document in the history of target into dir,
+// newest first. Messages downloaded before and files already in the archive
+// with the same name and size are skipped.
+func runBackfill(ctx context.Context, target, dir string) (backfillCounts, error) {
+	var n backfillCounts
+	client := mtprotoClient()
+	err := client.Run(ctx, func(ctx context.Context) error {
+		if status, err := client.Auth().Status(ctx); err != nil {
+			return err
+		} else if !status.Authorized {
+			return errors.New("MTProto session is not logged in, run mtproto-login first")
+		}
+		api := client.API()
+		peer, err := resolvePeer(ctx, api, target)
+		if err != nil {
+			return err
+		}
+		chatID := botAPIChatID(peer)
+
+		iter := query.Messages(api).GetHistory(peer).BatchSize(100).Iter()
+		for iter.Next(ctx) {
+			msg, ok := iter.Value().Msg.(*tg.Message)
+			if !ok {
+				continue
+			}
+			media, ok := msg.Media.(*tg.MessageMediaDocument)
+			if !ok {
+				continue
+			}
+			doc, ok := media.Document.(*tg.Document)
+			if !ok {
+				continue
+			}
+			if err := waitWhilePaused(ctx); err != nil {
+				return err
+			}
+			saved, err := backfillDocument(ctx, api, chatID, msg.ID, doc, dir)
+			switch {
+			case err != nil:
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				errorf("Backfill of message %d in %d failed: %s", msg.ID, chatID, err.Error())
+				n.failed++
+			case saved:
+				n.ok++
+				n.bytes += doc.Size
+			default:
+				n.skipped++
+			}
+		}
+		return iter.Err()
+	})
+	return n, err
+}
+
+func backfillDocument(ctx context.Context, api *tg.Client, chatID int64, msgID int, doc *tg.Document,
+	dir string) (bool, error) {
+	var fname string
+	for _, a := range doc.Attributes {
+		if a, ok := a.(*tg.DocumentAttributeFilename); ok {
+			fname = filepath.Base(a.FileName)
+		}
+	}
+	if fname == "" || fname == "." || fname == "/" {
+		fname = strconv.FormatInt(doc.ID, 10)
+	}
+	if maxSizeMessage(doc.Size) != "" {
+		log.Printf("Backfill: too large, skipped: %s", fname)
+		return false, nil
+	}
+
+	loc := &tg.InputDocumentFileLocation{ID: doc.ID, AccessHash: doc.AccessHash,
+		FileReference: doc.FileReference}
+	return archiveMessage(chatID, msgID, fname, doc.Size, dir, func(tmp string) error {
+		for {
+			_, err := downloader.NewDownloader().Download(api, loc).ToPath(ctx, tmp)
+			wait, ok := tgerr.AsFloodWait(err)
+			if !ok {
+				return err
+			}
+			log.Printf("Backfill: flood wait %s", wait)
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+}
+
+func handleBackfill(c tele.Context) error {
+	if cfg().MTProtoAppID == 0 {
+		return c.Reply(tr("Backfill needs TELEGRAM_MTPROTO_APP_ID and TELEGRAM_MTPROTO_APP_HASH"))
+	}
+	target := strconv.FormatInt(c.Chat().ID, 10)
+	if args := c.Args(); len(args) == 1 {
+		target = args[0]
+	} else if len(args) > 1 {
+		return c.Reply(tr("Usage: /backfill [@chat|chat id|stop]"))
+	}
+
+	backfill.Lock()
+	defer backfill.Unlock()
+	if target == "stop" {
+		if backfill.cancel == nil {
+			return c.Reply(tr("No backfill is running"))
+		}
+		backfill.cancel()
+		return nil
+	}
+	if backfill.cancel != nil {
+		return c.Reply(tr("A backfill is already running, stop it with /backfill stop"))
+	}
+	ctx, cancel := context.WithCancel(rootContext())
+	backfill.cancel = cancel
+	dir := botCfgFor(c).Dest
+
+	logEverywhere(c, "Backfilling %s into %s", target, dir)
+	go func() {
+		defer reportPanic(c, map[string]string{"backfill": target})
+		n, err := runBackfill(ctx, target, dir)
+		backfill.Lock()
+		backfill.cancel = nil
+		backfill.Unlock()
+		cancel()
+		switch {
+		case errors.Is(err, context.Canceled):
+			notifyChat(c, kindSummary, "Backfill of %s stopped: %d downloaded (%s), %d skipped, %d failed",
+				target, n.ok, units.Format(n.bytes), n.skipped, n.failed)
+		case err != nil:
+			reportError(c, err, map[string]string{"stage": "backfill"})
+			notifyChat(c, kindError, "Backfill of %s failed: %s", target, err.Error())
+		default:
+			notifyChat(c, kindSummary, "Backfill of %s finished: %d downloaded (%s), %d skipped, %d failed",
+				target, n.ok, units.Format(n.bytes), n.skipped, n.failed)
+		}
+	}()
+	return nil
+}
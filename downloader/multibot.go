@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// botCfg is the per-bot part of the configuration. The primary bot uses the
+// top-level TELEGRAM_TOKEN/DEST/CHATID settings; additional bots listed in
+// TELEGRAM_BOTS use TELEGRAM_BOT_<NAME>_TOKEN, _DEST and _CHATID.
+type botCfg struct {
+	Name    string
+	Token   string
+	Dest    string
+	ChatIDs []int64
+}
+
+func (c *Cfg) bots() []botCfg {
+	primary := botCfg{
+		Token:   c.TelegramToken,
+		Dest:    c.InitialWorkingDir,
+		ChatIDs: c.WhitelistedChatIDs,
+	}
+	return append([]botCfg{primary}, c.ExtraBots...)
+}
+
+// botCfgFor returns the configuration of the bot that received the update.
+func botCfgFor(c tele.Context) botCfg {
+	b, _ := c.Bot().(*tele.Bot)
+	return botCfgOf(b)
+}
+
+func botCfgOf(b *tele.Bot) botCfg {
+	bots := cfg().bots()
+	if b != nil {
+		for _, bc := range bots {
+			if bc.Token == b.Token {
+				return bc
+			}
+		}
+	}
+	return bots[0]
+}
+
+func parseChatIDs(name, s string) ([]int64, error) {
+	var ids []int64
+	var problems []error
+	if s == "" {
+		return nil, nil
+	}
+	for _, chatId := range strings.Split(s, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(chatId), 10, 64)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%s is not a valid number: err=%s",
+				name, err.Error()))
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids, errors.Join(problems...)
+}
+
+func parseExtraBots() ([]botCfg, []error) {
+	var bots []botCfg
+	var problems []error
+	for _, name := range strings.Split(getenv("TELEGRAM_BOTS"), ",") {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "TELEGRAM_BOT_" + name + "_"
+		bc := botCfg{Name: strings.ToLower(name), Dest: getenv(prefix + "DEST")}
+
+		var err error
+		bc.Token, err = secretEnv(prefix + "TOKEN")
+		if err != nil {
+			problems = append(problems, err)
+		} else if bc.Token == "" {
+			problems = append(problems, errors.New(prefix+"TOKEN is not set"))
+		}
+		if bc.Dest == "" {
+			problems = append(problems, errors.New(prefix+"DEST is not set"))
+		} else if err := probeWritable(bc.Dest); err != nil {
+			problems = append(problems, fmt.Errorf("%sDEST is not usable: err=%s", prefix, err.Error()))
+		}
+		bc.ChatIDs, err = parseChatIDs(prefix+"CHATID", getenv(prefix+"CHATID"))
+		if err != nil {
+			problems = append(problems, err)
+		}
+		bots = append(bots, bc)
+	}
+	return bots, problems
+}
+
+func describeBots(bots []botCfg) string {
+	items := make([]string, 0, len(bots))
+	for _, b := range bots {
+		items = append(items, fmt.Sprintf("%s(dest=%s chats=%v)", b.Name, b.Dest, b.ChatIDs))
+	}
+	return "[" + strings.Join(items, " ") + "]"
+}
@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+const defaultNextcloudChunkSize = 10 << 20
+
+// Chunks of a slow link can take a while, so requests are bound by the job
+// context instead of a client timeout.
+var nextcloudClient = &http.Client{}
+
+// nextcloudUpload copies a downloaded file to Nextcloud using the chunked
+// upload API (v2) and, if enabled, returns a public share link for it.
+func nextcloudUpload(ctx context.Context, local, name string) (string, error) {
+	c := cfg()
+	f, err := os.Open(local)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	remote := path.Join("/", c.NextcloudDir, name)
+	if err := nextcloudMkdirs(ctx, path.Dir(remote)); err != nil {
+		return "", err
+	}
+
+	id := make([]byte, 16)
+	rand.Read(id)
+	uploads := nextcloudDAV("uploads", "web-file-upload-"+hex.EncodeToString(id))
+	dest := nextcloudDAV("files", remote)
+	total := strconv.FormatInt(fi.Size(), 10)
+	headers := map[string]string{"Destination": dest, "OC-Total-Length": total}
+
+	if err := nextcloudDo(ctx, "MKCOL", uploads, nil, -1, headers); err != nil {
+		return "", fmt.Errorf("creating upload: %w", err)
+	}
+	for n, off := 1, int64(0); off < fi.Size() || n == 1; n++ {
+		size := c.NextcloudChunkSize
+		if rest := fi.Size() - off; rest < size {
+			size = rest
+		}
+		chunk := io.NewSectionReader(f, off, size)
+		if err := nextcloudDo(ctx, "PUT", fmt.Sprintf("%s/%05d", uploads, n), chunk, size, headers); err != nil {
+			nextcloudDo(context.Background(), "DELETE", uploads, nil, -1, nil)
+			return "", fmt.Errorf("uploading chunk %d: %w", n, err)
+		}
+		off += size
+	}
+	headers["Overwrite"] = "T"
+	if err := nextcloudDo(ctx, "MOVE", uploads+"/.file", nil, -1, headers); err != nil {
+		nextcloudDo(context.Background(), "DELETE", uploads, nil, -1, nil)
+		return "", fmt.Errorf("assembling chunks: %w", err)
+	}
+
+	if !c.NextcloudShare {
+		return "", nil
+	}
+	return nextcloudShare(ctx, remote)
+}
+
+// nextcloudMkdirs creates every folder of dir that doesn't exist yet.
+func nextcloudMkdirs(ctx context.Context, dir string) error {
+	cur := "/"
+	for _, part := range strings.Split(strings.Trim(dir, "/"), "/") {
+		if part == "" {
+			continue
+		}
+		cur = path.Join(cur, part)
+		err := nextcloudDo(ctx, "MKCOL", nextcloudDAV("files", cur), nil, -1, nil)
+		if err != nil && !strings.HasPrefix(err.Error(), "405 ") {
+			return fmt.Errorf("creating folder %s: %w", cur, err)
+		}
+	}
+	return nil
+}
+
+// nextcloudShare creates a public link share and returns its URL.
+func nextcloudShare(ctx context.Context, remote string) (string, error) {
+	form := url.Values{"path": {remote}, "shareType": {"3"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimRight(cfg().NextcloudURL, "/")+"/ocs/v2.php/apps/files_sharing/api/v1/shares",
+		strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("OCS-APIRequest", "true")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(cfg().NextcloudUser, cfg().NextcloudPassword)
+	resp, err := nextcloudClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var body struct {
+		OCS struct {
+			Meta struct {
+				Message string `json:"message"`
+			} `json:"meta"`
+			Data struct {
+				URL string `json:"url"`
+			} `json:"data"`
+		} `json:"ocs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("creating share: %s", resp.Status)
+	}
+	if resp.StatusCode/100 != 2 || body.OCS.Data.URL == "" {
+		return "", fmt.Errorf("creating share: %s %s", resp.Status, body.OCS.Meta.Message)
+	}
+	return body.OCS.Data.URL, nil
+}
+
+func nextcloudDAV(kind, p string) string {
+	return strings.TrimRight(cfg().NextcloudURL, "/") + "/remote.php/dav/" + kind + "/" +
+		url.PathEscape(cfg().NextcloudUser) + (&url.URL{Path: path.Join("/", p)}).EscapedPath()
+}
+
+func nextcloudDo(ctx context.Context, method, u string, body io.Reader, size int64,
+	headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	req.SetBasicAuth(cfg().NextcloudUser, cfg().NextcloudPassword)
+	resp, err := nextcloudClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// notifyLevel controls how much the bot says in chat about downloads.
+// Command replies are always sent.
+type notifyLevel uint8
+
+const (
+	notifySilent  notifyLevel = iota // nothing, the log only
+	notifyErrors                     // failed downloads
+	notifySummary                    // failures and batch summaries
+	notifyVerbose                    // a live status message per file
+)
+
+var notifyLevelNames = []string{"silent", "errors", "summary", "verbose"}
+
+func (l notifyLevel) String() string {
+	return notifyLevelNames[l]
+}
+
+func parseNotifyLevel(s string) (notifyLevel, error) {
+	for i, name := range notifyLevelNames {
+		if strings.EqualFold(s, name) {
+			return notifyLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown level %q, expected one of %s", s,
+		strings.Join(notifyLevelNames, ", "))
+}
+
+// messageKind classifies download messages for TELEGRAM_SILENT.
+type messageKind string
+
+const (
+	kindStatus  messageKind = "status"  // per-file status messages
+	kindError   messageKind = "errors"  // failed downloads
+	kindSummary messageKind = "summary" // "All downloads finished" and friends
+)
+
+var messageKinds = []messageKind{kindStatus, kindError, kindSummary}
+
+// silentCfg lists the message kinds sent with disable_notification, limited
+// to chats when any are given.
+type silentCfg struct {
+	kinds []messageKind
+	chats []int64
+}
+
+func parseSilentKinds(s string) ([]messageKind, error) {
+	var kinds []messageKind
+	for _, k := range strings.Split(s, ",") {
+		k = strings.ToLower(strings.TrimSpace(k))
+		switch {
+		case k == "":
+		case k == "all":
+			kinds = append(kinds, messageKinds...)
+		case slices.Contains(messageKinds, messageKind(k)):
+			kinds = append(kinds, messageKind(k))
+		default:
+			return nil, fmt.Errorf("unknown message kind %q, expected all, status, errors or summary", k)
+		}
+	}
+	return kinds, nil
+}
+
+func (s silentCfg) String() string {
+	if len(s.kinds) == 0 {
+		return "none"
+	}
+	str := fmt.Sprint(s.kinds)
+	if len(s.chats) > 0 {
+		str += fmt.Sprintf(" in chats %v", s.chats)
+	}
+	return str
+}
+
+func (s silentCfg) silent(chatID int64, kind messageKind) bool {
+	if !slices.Contains(s.kinds, kind) {
+		return false
+	}
+	return len(s.chats) == 0 || slices.Contains(s.chats, chatID)
+}
+
+// sendOptions returns the options for replying with a message of the given kind.
+func sendOptions(c tele.Context, kind messageKind) *tele.SendOptions {
+	return &tele.SendOptions{
+		ReplyTo:             c.Message(),
+		DisableNotification: cfg().Silent.silent(c.Chat().ID, kind),
+	}
+}
+
+// Counts that only matter in their last state: held by the debounce, a later
+// one replaces the earlier one.
+var replacingFormats = []string{"Done. Pending downloads: %d"}
+
+// notifyChat logs and replies with a message of the given kind. With
+// TELEGRAM_NOTIFY_DEBOUNCE the messages to a chat are held that long and sent
+// as one, once each, with the last of the replacingFormats.
+func notifyChat(c tele.Context, kind messageKind, format string, args ...interface{}) {
+	log.Printf(format, args...)
+	if isChannelPost(c) {
+		return
+	}
+	text := tr(format, args...)
+	window := cfg().NotifyDebounce
+	if window <= 0 {
+		sendNotice(c, text, sendOptions(c, kind))
+		return
+	}
+
+	notices.Lock()
+	defer notices.Unlock()
+	id := c.Chat().ID
+	n := notices.m[id]
+	if n == nil {
+		n = &pendingNotices{c: c, silent: true}
+		notices.m[id] = n
+		time.AfterFunc(window, func() { flushNotices(id) })
+	}
+	if i := slices.Index(n.formats, format); i >= 0 && slices.Contains(replacingFormats, format) {
+		n.lines[i] = text
+	} else if !slices.Contains(n.lines, text) {
+		n.formats = append(n.formats, format)
+		n.lines = append(n.lines, text)
+	}
+	n.silent = n.silent && cfg().Silent.silent(id, kind)
+}
+
+type pendingNotices struct {
+	c       tele.Context // of the first message
+	formats []string
+	lines   []string
+	silent  bool // all of them are silent
+}
+
+var notices = struct {
+	sync.Mutex
+	m map[int64]*pendingNotices
+}{m: make(map[int64]*pendingNotices)}
+
+// flushNotices sends the held messages of a chat, a single one as a reply
+// like without the debounce.
+func flushNotices(chatID int64) {
+	notices.Lock()
+	n := notices.m[chatID]
+	delete(notices.m, chatID)
+	notices.Unlock()
+	if n == nil {
+		return
+	}
+	opts := &tele.SendOptions{DisableNotification: n.silent}
+	if len(n.lines) == 1 {
+		opts.ReplyTo = n.c.Message()
+	}
+	sendNotice(n.c, strings.Join(n.lines, "\n"), opts)
+}
+
+func sendNotice(c tele.Context, text string, opts *tele.SendOptions) {
+	if _, err := apiOf(c).Send(c.Chat(), text, opts); err != nil {
+		errorf("Notification: %s", err.Error())
+	}
+}
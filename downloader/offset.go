@@ -0,0 +1,97 @@
+package downloader
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The ID of the last update each bot received is kept in the state file, so
+// after a restart polling continues where it stopped and the messages sent
+// while the bot was down are processed. Those older than
+// TELEGRAM_CATCHUP_WINDOW are skipped. The offsets are written at most every
+// offsetSaveDelay and once more at shutdown, not with every update: after a
+// crash, the updates of up to that last second come again.
+
+const offsetsBucket = "offsets"
+
+const offsetSaveDelay = time.Second
+
+// offsets are the update IDs not saved yet, by offsetKey.
+var offsets = struct {
+	sync.Mutex
+	pending map[string]int
+}{pending: make(map[string]int)}
+
+// noteOffset holds the ID of the last update of a bot until saveOffsets.
+func noteOffset(key string, id int) {
+	offsets.Lock()
+	defer offsets.Unlock()
+	if len(offsets.pending) == 0 {
+		time.AfterFunc(offsetSaveDelay, saveOffsets)
+	}
+	offsets.pending[key] = id
+}
+
+func saveOffsets() {
+	offsets.Lock()
+	pending := offsets.pending
+	offsets.pending = make(map[string]int)
+	offsets.Unlock()
+	for key, id := range pending {
+		if err := storage.Put(offsetsBucket, key, id); err != nil {
+			errorf("Update offset: %s", err.Error())
+		}
+	}
+}
+
+// offsetKey identifies a bot by the numeric part of its token.
+func offsetKey(token string) string {
+	id, _, _ := strings.Cut(token, ":")
+	return id
+}
+
+func newPoller(bc botCfg) tele.Poller {
+	lp := &tele.LongPoller{
+		Timeout:        cfg().PollTimeout,
+		AllowedUpdates: cfg().AllowedUpdates,
+	}
+	key := offsetKey(bc.Token)
+	if !cfg().DropPending {
+		if _, err := storage.Get(offsetsBucket, key, &lp.LastUpdateID); err != nil {
+			errorf("Update offset: %s", err.Error())
+		} else if lp.LastUpdateID != 0 {
+			log.Printf("Catching up from update %d", lp.LastUpdateID+1)
+		}
+	}
+	seen := newSeenSet()
+	return tele.NewMiddlewarePoller(lp, func(u *tele.Update) bool {
+		noteOffset(key, u.ID)
+		if seen.redelivered(u) {
+			return false
+		}
+		if window := cfg().CatchUpWindow; window > 0 {
+			if sent := updateTime(u); !sent.IsZero() && time.Since(sent) > window {
+				log.Printf("Skipped update %d from %s, older than %s", u.ID, sent.Format(time.DateTime), window)
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// updateTime returns when the message of an update was sent, zero for
+// updates without one.
+func updateTime(u *tele.Update) time.Time {
+	switch {
+	case u.Message != nil:
+		return u.Message.Time()
+	case u.ChannelPost != nil:
+		return u.ChannelPost.Time()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,133 @@
+package downloader
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	"github.com/fsnotify/fsnotify"
+	tele "gopkg.in/telebot.v4"
+)
+
+// With TELEGRAM_OUTBOX_DIR the bot works the other way round too: new files
+// in that folder are sent to TELEGRAM_OUTBOX_CHATID. A file is sent once it
+// hasn't changed for outboxSettle, so files still being written or copied
+// aren't sent half done, and one at a time. What was sent is kept in the
+// state file by path, size and modification time; files that arrived while
+// the bot was down are sent at the next start, and a file that changes is
+// sent again. Hidden and .tmp files are ignored, as are subfolders.
+const (
+	outboxBucket = "outbox"
+	outboxSettle = 5 * time.Second
+)
+
+type outboxEntry struct {
+	Size    int64
+	ModTime time.Time
+	Sent    time.Time
+}
+
+func startOutbox(b *tele.Bot) {
+	dir, chat := cfg().OutboxDir, tele.ChatID(cfg().OutboxChatID)
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = w.Add(dir)
+	}
+	if err != nil {
+		errorf("Outbox: watching %s: %s", dir, err.Error())
+		return
+	}
+	log.Printf("Outbox: sending new files in %s to chat %d", dir, cfg().OutboxChatID)
+
+	send := make(chan string, 100)
+	var mu sync.Mutex
+	settling := map[string]*time.Timer{}
+	settle := func(path string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if t, ok := settling[path]; ok {
+			t.Reset(outboxSettle)
+			return
+		}
+		settling[path] = time.AfterFunc(outboxSettle, func() {
+			mu.Lock()
+			delete(settling, path)
+			mu.Unlock()
+			select {
+			case send <- path:
+			case <-rootContext().Done():
+			}
+		})
+	}
+
+	go func() {
+		defer w.Close()
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			errorf("Outbox: %s", err.Error())
+		}
+		for _, e := range entries {
+			settle(filepath.Join(dir, e.Name()))
+		}
+		for {
+			select {
+			case <-rootContext().Done():
+				return
+			case e := <-w.Events:
+				if e.Has(fsnotify.Create) || e.Has(fsnotify.Write) {
+					settle(e.Name)
+				}
+			case err := <-w.Errors:
+				errorf("Outbox: %s", err.Error())
+			}
+		}
+	}()
+	go func() {
+		for {
+			select {
+			case <-rootContext().Done():
+				return
+			case path := <-send:
+				sendOutboxFile(b, chat, path)
+			}
+		}
+	}()
+}
+
+// sendOutboxFile sends the file at path unless it was sent as it is already.
+func sendOutboxFile(b *tele.Bot, chat tele.Recipient, path string) {
+	name := filepath.Base(path)
+	if strings.HasPrefix(name, ".") || filepath.Ext(name) == ".tmp" {
+		return
+	}
+	fi, err := os.Stat(path)
+	if err != nil || !fi.Mode().IsRegular() {
+		return
+	}
+	var sent outboxEntry
+	if found, err := storage.Get(outboxBucket, path, &sent); err != nil {
+		errorf("Outbox: %s", err.Error())
+		return
+	} else if found && sent.Size == fi.Size() && sent.ModTime.Equal(fi.ModTime()) {
+		return
+	}
+	if fi.Size() > uploadMaxSize {
+		log.Printf("Outbox: %s is too large to send (%s, at most %s)", name, units.Format(fi.Size()),
+			units.Format(uploadMaxSize))
+		return
+	}
+
+	if err := sendDocument(rootContext(), b, chat, path, name); err != nil {
+		errorf("Outbox: sending %s failed: %s", name, err.Error())
+		return
+	}
+	log.Printf("Outbox: sent %s (%s)", name, units.Format(fi.Size()))
+	if err := storage.Put(outboxBucket, path, outboxEntry{fi.Size(), fi.ModTime(), time.Now()}); err != nil {
+		errorf("Outbox: %s", err.Error())
+	}
+}
@@ -0,0 +1,197 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// File names come from the senders, so they are made valid for the file
+// system first: whitespace is tidied, the name normalized to one Unicode form
+// (see normalizeName), path separators and control characters are replaced
+// and long names are cut, keeping the extension. On Windows the characters it
+// reserves, trailing dots and spaces and device names such as CON or COM1
+// are avoided too (see paths_windows.go).
+
+// Most file systems, NTFS included, limit a name to 255 bytes or characters;
+// TELEGRAM_MAX_NAME_BYTES can lower it for the others. Names are cut short
+// enough for the ".tmp" of the partial download to fit too.
+const (
+	defaultMaxNameBytes = 255
+	minNameBytes        = 32
+)
+
+// maxNameBytes is the longest name a file of the destination may have.
+func maxNameBytes() int {
+	if n := cfg().MaxNameBytes; n >= minNameBytes {
+		return n
+	}
+	return defaultMaxNameBytes
+}
+
+var reservedNames = []string{"CON", "PRN", "AUX", "NUL",
+	"COM1", "COM2", "COM3", "COM4", "COM5", "COM6", "COM7", "COM8", "COM9",
+	"LPT1", "LPT2", "LPT3", "LPT4", "LPT5", "LPT6", "LPT7", "LPT8", "LPT9"}
+
+// safeFilename returns name as a valid single path element.
+func safeFilename(name string) string {
+	name = normalizeName(name)
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '/' || strings.ContainsRune(reservedChars, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	if windowsNames {
+		name = strings.TrimRight(name, ". ")
+		base, _, _ := strings.Cut(name, ".")
+		if slices.Contains(reservedNames, strings.ToUpper(strings.TrimSpace(base))) {
+			name = "_" + name
+		}
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "_"
+	}
+	return truncateName(name, maxNameBytes()-len(".tmp"))
+}
+
+// unicodeForms are the values of TELEGRAM_UNICODE_FORM. Phones send names in
+// either form, so "é" might be one code point or "e" and a combining accent:
+// names that look the same but are different files. NFC is what Linux and
+// Windows programs expect, NFD what macOS uses.
+var unicodeForms = []string{"nfc", "nfd", "none"}
+
+// Letters that don't decompose into an ASCII letter and accents.
+var asciiLetters = strings.NewReplacer("ß", "ss", "æ", "ae", "Æ", "AE", "œ", "oe", "Œ", "OE", "ø", "o", "Ø", "O",
+	"ł", "l", "Ł", "L", "đ", "d", "Đ", "D", "þ", "th", "Þ", "Th", "ð", "d", "Ð", "D", "ı", "i")
+
+// normalizeName turns every kind of space into a plain one, collapses runs of
+// them, drops invisible characters such as zero-width spaces and direction
+// marks, and applies TELEGRAM_UNICODE_FORM or, with TELEGRAM_ASCII_NAMES,
+// transliterates the name to ASCII, other characters becoming "_".
+func normalizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '\u200b' || r == '\u2060' || r == '\ufeff' || r == '\u200e' || r == '\u200f' ||
+			r >= '\u202a' && r <= '\u202e' || r >= '\u2066' && r <= '\u2069':
+			return -1
+		case unicode.IsSpace(r):
+			return ' '
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+
+	switch {
+	case cfg().ASCIINames:
+		name = strings.Map(func(r rune) rune {
+			switch {
+			case unicode.Is(unicode.Mn, r):
+				return -1
+			case r >= utf8.RuneSelf:
+				return '_'
+			}
+			return r
+		}, norm.NFD.String(asciiLetters.Replace(name)))
+	case cfg().UnicodeForm == "nfd":
+		name = norm.NFD.String(name)
+	case cfg().UnicodeForm != "none":
+		name = norm.NFC.String(name)
+	}
+	return name
+}
+
+// safePath applies safeFilename to every element of a relative path, such
+// as the names from the filename hooks.
+func safePath(name string) string {
+	var parts []string
+	for _, p := range strings.Split(filepath.ToSlash(name), "/") {
+		if p != "" {
+			parts = append(parts, safeFilename(p))
+		}
+	}
+	if len(parts) == 0 {
+		return safeFilename(name)
+	}
+	return filepath.Join(parts...)
+}
+
+// truncateName cuts name to max bytes, keeping the extension. A hash of the
+// whole name goes before the extension, so long names that only differ at
+// the end stay apart.
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	suffix := "~" + hex.EncodeToString(sum[:4])
+	ext := filepath.Ext(name)
+	if len(ext) > max/4 {
+		ext = ""
+	}
+	base := name[:max-len(suffix)-len(ext)]
+	for !utf8.ValidString(base) {
+		base = base[:len(base)-1]
+	}
+	return base + suffix + ext
+}
+
+// stagingPath is where a download to fpath is written until it's complete,
+// under a name made unique by key, such as the job ID, so two downloads of
+// files with the same name don't write to the same partial file: next to it,
+// or in TELEGRAM_STAGING_DIR.
+func stagingPath(fpath, key string) string {
+	if dir := cfg().StagingDir; dir != "" {
+		return filepath.Join(dir, truncateName(key+"_"+filepath.Base(fpath), maxNameBytes()-len(".tmp"))+".tmp")
+	}
+	return partialPath(fpath, key)
+}
+
+// partialPath is fpath with key and .tmp added, "file.jpg.7f3a1c09e45b82d6.tmp",
+// the name cut to fit if need be.
+func partialPath(fpath, key string) string {
+	suffix := "." + key + ".tmp"
+	return filepath.Join(filepath.Dir(fpath), truncateName(filepath.Base(fpath), maxNameBytes()-len(suffix))+suffix)
+}
+
+// copyPath is where moveFile copies from to next to to.
+func copyPath(from, to string) string {
+	sum := sha256.Sum256([]byte(from))
+	return partialPath(to, hex.EncodeToString(sum[:3]))
+}
+
+// moveFile puts a complete download in place. From a staging directory on
+// another file system it's copied next to the destination first, so the file
+// still appears at once.
+func moveFile(from, to string) error {
+	err := renameFile(from, to)
+	if err == nil {
+		forgetPartial(from)
+	}
+	if err == nil || !crossDevice(err) {
+		return err
+	}
+	tmp := copyPath(from, to)
+	trackPartial(tmp)
+	if err := copyFile(from, tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := renameFile(tmp, to); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	forgetPartial(tmp)
+	if err := os.Remove(from); err != nil {
+		return err
+	}
+	forgetPartial(from)
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !windows
+
+package downloader
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+const (
+	reservedChars = ""
+	windowsNames  = false
+)
+
+// renameFile moves a finished download in place, replacing an existing file
+// atomically.
+func renameFile(from, to string) error {
+	return os.Rename(from, to)
+}
+
+func crossDevice(err error) bool {
+	return errors.Is(err, syscall.EXDEV)
+}
@@ -0,0 +1,114 @@
+package downloader
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// The names from the senders stay inside the destination.
+func TestSafePath(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "plain", in: "photo.jpg", want: "photo.jpg"},
+		{name: "folder", in: "album/photo.jpg", want: filepath.Join("album", "photo.jpg")},
+		{name: "parent", in: "..", want: "_"},
+		{name: "current", in: ".", want: "_"},
+		{name: "escape", in: "../../etc/passwd", want: filepath.Join("_", "_", "etc", "passwd")},
+		{name: "inner parent", in: "a/../../b", want: filepath.Join("a", "_", "_", "b")},
+		{name: "absolute", in: "/etc/passwd", want: filepath.Join("etc", "passwd")},
+		{name: "doubled slashes", in: "a//b/", want: filepath.Join("a", "b")},
+		{name: "NUL byte", in: "a\x00b.txt", want: "a_b.txt"},
+		{name: "control characters", in: "a\nb\x7f.txt", want: "a b_.txt"},
+		{name: "empty", in: "", want: "_"},
+		{name: "only slashes", in: "///", want: "___"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := safePath(tt.in)
+			if got != tt.want {
+				t.Errorf("safePath(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+			if !filepath.IsLocal(got) {
+				t.Errorf("safePath(%q) = %q is not inside the destination", tt.in, got)
+			}
+		})
+	}
+}
+
+// Long names are cut at the byte limit on a character boundary, keeping the
+// extension and telling apart names that only differ at the end.
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		max     int
+		wantExt string
+	}{
+		{name: "short", in: "photo.jpg", max: 64, wantExt: ".jpg"},
+		{name: "at the limit", in: strings.Repeat("a", 60) + ".jpg", max: 64, wantExt: ".jpg"},
+		{name: "long", in: strings.Repeat("a", 300) + ".jpg", max: 64, wantExt: ".jpg"},
+		{name: "two-byte characters", in: strings.Repeat("é", 100) + ".pdf", max: 50, wantExt: ".pdf"},
+		{name: "four-byte characters", in: strings.Repeat("😀", 100) + ".pdf", max: 50, wantExt: ".pdf"},
+		{name: "long extension", in: strings.Repeat("a", 100) + "." + strings.Repeat("b", 40), max: 64},
+		{name: "no extension", in: strings.Repeat("日本", 100), max: 64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := truncateName(tt.in, tt.max)
+			if len(tt.in) <= tt.max && got != tt.in {
+				t.Errorf("truncateName(%q) = %q, want it unchanged", tt.in, got)
+			}
+			if len(got) > tt.max {
+				t.Errorf("%q is %d bytes, more than %d", got, len(got), tt.max)
+			}
+			if !utf8.ValidString(got) {
+				t.Errorf("%q is not valid UTF-8", got)
+			}
+			if filepath.Ext(got) != tt.wantExt {
+				t.Errorf("%q has extension %q, want %q", got, filepath.Ext(got), tt.wantExt)
+			}
+		})
+	}
+
+	a := truncateName(strings.Repeat("a", 300)+"1.jpg", 64)
+	b := truncateName(strings.Repeat("a", 300)+"2.jpg", 64)
+	if a == b {
+		t.Errorf("names differing at the end both cut to %q", a)
+	}
+}
+
+// Names are tidied and brought to one Unicode form.
+func TestNormalizeName(t *testing.T) {
+	tests := []struct {
+		name  string
+		in    string
+		want  string
+		form  string
+		ascii bool
+	}{
+		{name: "spaces", in: "  my \t  file.txt ", want: "my file.txt"},
+		{name: "invisible characters", in: "a\u200bb\u200e\u202ec\ufeff.txt", want: "abc.txt"},
+		{name: "NFC", in: "cafe\u0301.txt", want: "caf\u00e9.txt"},
+		{name: "NFD", in: "caf\u00e9.txt", want: "cafe\u0301.txt", form: "nfd"},
+		{name: "none", in: "cafe\u0301.txt", want: "cafe\u0301.txt", form: "none"},
+		{name: "ASCII", in: "Straße Ærø café 日本.txt", want: "Strasse AEro cafe __.txt", ascii: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) {
+				c.UnicodeForm, c.ASCIINames = "nfc", tt.ascii
+				if tt.form != "" {
+					c.UnicodeForm = tt.form
+				}
+			})
+			if got := normalizeName(tt.in); got != tt.want {
+				t.Errorf("normalizeName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
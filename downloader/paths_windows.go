@@ -0,0 +1,33 @@
+package downloader
+
+import (
+	"errors"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+const (
+	reservedChars = `<>:"\|?*`
+	windowsNames  = true
+)
+
+// renameFile moves a finished download in place. Windows refuses to replace
+// a file that another program, e.g. a virus scanner or the search indexer,
+// has open, so the rename is retried for a few seconds.
+func renameFile(from, to string) error {
+	var err error
+	for range 30 {
+		err = os.Rename(from, to)
+		if !errors.Is(err, windows.ERROR_SHARING_VIOLATION) && !errors.Is(err, windows.ERROR_ACCESS_DENIED) {
+			return err
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
+
+func crossDevice(err error) bool {
+	return errors.Is(err, windows.ERROR_NOT_SAME_DEVICE)
+}
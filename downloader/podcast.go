@@ -0,0 +1,178 @@
+package downloader
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+)
+
+// With TELEGRAM_PODCAST_DIR the audio files in that folder are published as a
+// podcast: a feed.xml next to them lists every one as an episode, newest
+// first, with its caption as title and description and an enclosure under
+// TELEGRAM_PODCAST_URL, where the folder is served by any web server. The
+// feed is written at start and after every download into the folder.
+const podcastFeed = "feed.xml"
+
+// The enclosure types of the audio files, which the system's MIME table
+// may not know.
+var podcastTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".m4a":  "audio/mp4",
+	".aac":  "audio/aac",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+}
+
+var podcastMu sync.Mutex
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title       string    `xml:"title"`
+	Link        string    `xml:"link"`
+	Description string    `xml:"description"`
+	Items       []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string       `xml:"title"`
+	Description string       `xml:"description,omitempty"`
+	PubDate     string       `xml:"pubDate"`
+	GUID        rssGUID      `xml:"guid"`
+	Enclosure   rssEnclosure `xml:"enclosure"`
+}
+
+type rssGUID struct {
+	PermaLink bool   `xml:"isPermaLink,attr"`
+	Value     string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func init() {
+	listenEvents(func(e jobEvent) {
+		if e.Type == eventDone && podcastDir() != "" && filepath.Dir(e.job.path) == podcastDir() &&
+			isPodcastAudio(e.job.path) {
+			// The history, with the caption, is recorded by then.
+			go writePodcastFeed()
+		}
+	})
+}
+
+func isPodcastAudio(name string) bool {
+	_, ok := podcastTypes[strings.ToLower(filepath.Ext(name))]
+	return ok
+}
+
+// podcastDir is TELEGRAM_PODCAST_DIR, in the destination if it's relative.
+func podcastDir() string {
+	dir := cfg().PodcastDir
+	if dir == "" {
+		return ""
+	}
+	if !filepath.IsAbs(dir) {
+		return filepath.Join(cfg().InitialWorkingDir, dir)
+	}
+	return filepath.Clean(dir)
+}
+
+func startPodcast() {
+	if podcastDir() != "" {
+		writePodcastFeed()
+	}
+}
+
+// writePodcastFeed writes the feed of the audio files in the podcast folder.
+func writePodcastFeed() {
+	podcastMu.Lock()
+	defer podcastMu.Unlock()
+	dir, base := podcastDir(), cfg().PodcastURL
+	if dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		errorf("Podcast: %s", err.Error())
+		return
+	}
+	captions := map[string]string{}
+	err = storage.ForEach(historyBucket, func(_ string, data []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if filepath.Dir(e.Path) == dir {
+			captions[filepath.Base(e.Path)] = e.Caption
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("Podcast: %s", err.Error())
+	}
+
+	type episode struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var episodes []episode
+	for _, e := range entries {
+		if !e.Type().IsRegular() || strings.HasPrefix(e.Name(), ".") || !isPodcastAudio(e.Name()) {
+			continue
+		}
+		if fi, err := e.Info(); err == nil {
+			episodes = append(episodes, episode{e.Name(), fi.Size(), fi.ModTime()})
+		}
+	}
+	sort.Slice(episodes, func(i, j int) bool { return episodes[i].modTime.After(episodes[j].modTime) })
+
+	base = strings.TrimSuffix(base, "/") + "/"
+	feed := rssFeed{Version: "2.0", Channel: rssChannel{Title: filepath.Base(dir), Link: base,
+		Description: tr("Audio files downloaded by the Telegram bot")}}
+	for _, ep := range episodes {
+		link := base + url.PathEscape(ep.name)
+		title, desc := strings.TrimSuffix(ep.name, filepath.Ext(ep.name)), captions[ep.name]
+		if first, _, _ := strings.Cut(strings.TrimSpace(desc), "\n"); first != "" {
+			title = first
+		}
+		typ := podcastTypes[strings.ToLower(filepath.Ext(ep.name))]
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{Title: title, Description: desc,
+			PubDate: ep.modTime.Format(time.RFC1123Z), GUID: rssGUID{Value: link},
+			Enclosure: rssEnclosure{URL: link, Length: ep.size, Type: typ}})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(feed); err != nil {
+		errorf("Podcast: %s", err.Error())
+		return
+	}
+	if err := writeAtomic(filepath.Join(dir, podcastFeed), buf.Bytes()); err != nil {
+		errorf("Podcast: %s", err.Error())
+		return
+	}
+	log.Printf("Podcast: wrote %s with %d episodes", filepath.Join(dir, podcastFeed), len(episodes))
+}
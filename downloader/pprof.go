@@ -0,0 +1,23 @@
+package downloader
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// startPprof serves net/http/pprof on localhost only, so profiles can be
+// collected with e.g. `go tool pprof http://127.0.0.1:<port>/debug/pprof/heap`.
+func startPprof(port string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	addr := net.JoinHostPort("127.0.0.1", port)
+	log.Println("pprof listening on:", addr)
+	return serveHTTP("pprof", addr, mux)
+}
@@ -0,0 +1,19 @@
+package downloader
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// preallocate reserves size bytes for f without changing its size, so a
+// short download leaves no padding. File systems without fallocate get the
+// free space check.
+func preallocate(f *os.File, size int64) error {
+	err := unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+	if errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.ENOSYS) {
+		return checkFreeSpace(f.Name(), size)
+	}
+	return err
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package downloader
+
+import "os"
+
+// preallocate only checks the free space where fallocate isn't available.
+func preallocate(f *os.File, size int64) error {
+	return checkFreeSpace(f.Name(), size)
+}
@@ -0,0 +1,137 @@
+package downloader
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+// progressWriter counts bytes flowing through the download path and keeps a
+// running speed estimate for the active downloads listing in /stats.
+type progressWriter struct {
+	name    string
+	size    int64
+	started time.Time
+
+	written int64 // accessed atomically
+	speed   int64 // bytes/s, accessed atomically
+
+	// Sampling window, only touched by the writing goroutine.
+	windowStart time.Time
+	windowBytes int64
+}
+
+var activeDownloads = struct {
+	sync.Mutex
+	m map[*progressWriter]struct{}
+}{m: make(map[*progressWriter]struct{})}
+
+func newProgressWriter(name string, size int64) *progressWriter {
+	now := time.Now()
+	p := &progressWriter{name: name, size: size, started: now, windowStart: now}
+	activeDownloads.Lock()
+	activeDownloads.m[p] = struct{}{}
+	activeDownloads.Unlock()
+	return p
+}
+
+// bytesTransferred counts the bytes of all downloads, for the throughput chart.
+var bytesTransferred int64
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	atomic.AddInt64(&bytesTransferred, int64(len(b)))
+	written := atomic.AddInt64(&p.written, int64(len(b)))
+	if elapsed := time.Since(p.windowStart); elapsed >= time.Second {
+		atomic.StoreInt64(&p.speed,
+			int64(float64(written-p.windowBytes)/elapsed.Seconds()))
+		p.windowStart = time.Now()
+		p.windowBytes = written
+	}
+	return len(b), nil
+}
+
+// resumeAt counts n bytes written before, by an earlier attempt: they are in
+// Written but not in bytesTransferred or the speed.
+func (p *progressWriter) resumeAt(n int64) {
+	atomic.AddInt64(&p.written, n)
+	p.windowBytes += n
+}
+
+func (p *progressWriter) Written() int64 {
+	return atomic.LoadInt64(&p.written)
+}
+
+func (p *progressWriter) Close() {
+	activeDownloads.Lock()
+	delete(activeDownloads.m, p)
+	activeDownloads.Unlock()
+}
+
+func (p *progressWriter) String() string {
+	written := atomic.LoadInt64(&p.written)
+	speed := atomic.LoadInt64(&p.speed)
+	if speed == 0 {
+		if elapsed := time.Since(p.started).Seconds(); elapsed > 0 {
+			speed = int64(float64(written) / elapsed)
+		}
+	}
+	if p.size > 0 {
+		return fmt.Sprintf("%s: %s/%s (%d%%) %s/s", p.name,
+			units.Format(written), units.Format(p.size),
+			written*100/p.size, units.Format(speed))
+	}
+	return fmt.Sprintf("%s: %s %s/s", p.name,
+		units.Format(written), units.Format(speed))
+}
+
+const progressBarWidth = 10
+
+// Bar renders the progress for the status message, e.g.
+// "▓▓▓▓░░░░░░ 45%\n9 MB/20 MB, 1 MB/s, 6s".
+func (p *progressWriter) Bar() string {
+	written := atomic.LoadInt64(&p.written)
+	elapsed := time.Since(p.started)
+	speed := atomic.LoadInt64(&p.speed)
+	if speed == 0 && elapsed > 0 {
+		speed = int64(float64(written) / elapsed.Seconds())
+	}
+	details := fmt.Sprintf("%s/s, %s", units.Format(speed), elapsed.Round(time.Second))
+	if p.size <= 0 {
+		return fmt.Sprintf("%s, %s", units.Format(written), details)
+	}
+	percent := written * 100 / p.size
+	if percent > 100 {
+		percent = 100
+	}
+	return fmt.Sprintf("%s\n%s/%s, %s", bar(percent), units.Format(written), units.Format(p.size), details)
+}
+
+// bar renders a percentage, e.g. "▓▓▓▓░░░░░░ 45%". Above 100% the bar stays
+// full.
+func bar(percent int64) string {
+	filled := int(min(max(percent, 0), 100)) * progressBarWidth / 100
+	return fmt.Sprintf("%s%s %d%%", strings.Repeat("▓", filled), strings.Repeat("░", progressBarWidth-filled), percent)
+}
+
+func activeDownloadsReport() string {
+	activeDownloads.Lock()
+	list := make([]*progressWriter, 0, len(activeDownloads.m))
+	for p := range activeDownloads.m {
+		list = append(list, p)
+	}
+	activeDownloads.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].started.Before(list[j].started)
+	})
+	s := ""
+	for _, p := range list {
+		s += "\n" + p.String()
+	}
+	return s
+}
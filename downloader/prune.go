@@ -0,0 +1,194 @@
+package downloader
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Every temporary file is recorded in the state file before it's created, so
+// the partial downloads left by a crash, a failure or a kill can be found
+// again: /prune and every start remove them, along with the temporary files
+// of this program in TELEGRAM_STAGING_DIR and the leftovers of /speedtest.
+// The files of jobs still running and of URLs still to download are kept,
+// and /prune also keeps those written to in the last pruneMinAge, e.g. by a
+// backfill.
+const (
+	partialsBucket = "partials"
+	pruneMinAge    = 10 * time.Minute
+)
+
+// tmpName matches the names of the temporary files of this program, so that
+// files of users that end in .tmp are left alone: those of partialPath, with
+// a job ID, the key of a URL, the hash of copyPath or the chat and message of
+// a backfill before .tmp, those of stagingPath, with the key first, and those
+// of /backup and /speedtest.
+var tmpName = regexp.MustCompile(`^(\.(backup|speedtest)-.+|.+\.` + tmpKey + `|` + tmpKey + `_.+)\.tmp$`)
+
+const tmpKey = `([0-9a-f]{6,}|url[0-9a-f]{12}|-?[0-9]+_[0-9]+)`
+
+// trackPartial records the temporary file path.
+func trackPartial(path string) {
+	if err := storage.Put(partialsBucket, path, time.Now()); err != nil {
+		errorf("Partial downloads: %s", err.Error())
+	}
+}
+
+// forgetPartial drops the record of a temporary file that was moved in place.
+func forgetPartial(path string) {
+	if err := storage.Delete(partialsBucket, path); err != nil {
+		errorf("Partial downloads: %s", err.Error())
+	}
+}
+
+type pruned struct {
+	files int
+	bytes int64
+}
+
+// prune removes the partial downloads. With all it also looks for temporary
+// files anywhere in the destinations of the bots, and with dryRun it only
+// counts. The files found by name rather than in the state file are kept for
+// pruneMinAge at least, another process may be writing them.
+func prune(minAge time.Duration, all, dryRun bool) (pruned, error) {
+	keep := map[string]bool{}
+	jobs.Lock()
+	for _, j := range jobs.m {
+		j.mu.Lock()
+		if !j.state.final() {
+			keep[j.tmpPath()] = true
+			keep[copyPath(j.tmpPath(), j.path)] = true
+		}
+		j.mu.Unlock()
+	}
+	jobs.Unlock()
+	for path := range resumablePartials(downloadsToDo()) {
+		keep[path] = true
+	}
+
+	var p pruned
+	seen := map[string]bool{}
+	remove := func(path string, fi fs.FileInfo, minAge time.Duration) {
+		if seen[path] || keep[path] || time.Since(fi.ModTime()) < minAge {
+			return
+		}
+		seen[path] = true
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				errorf("Partial downloads: %s", err.Error())
+				return
+			}
+			log.Printf("Removed partial download %s (%s)", path, units.Format(fi.Size()))
+		}
+		p.files++
+		p.bytes += fi.Size()
+	}
+
+	var recorded []string
+	err := storage.ForEach(partialsBucket, func(key string, _ []byte) error {
+		recorded = append(recorded, key)
+		return nil
+	})
+	if err != nil {
+		return p, err
+	}
+	for _, path := range recorded {
+		fi, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			if !dryRun {
+				forgetPartial(path)
+			}
+			continue
+		}
+		if err == nil {
+			remove(path, fi, minAge)
+			if !dryRun && seen[path] {
+				forgetPartial(path)
+			}
+		}
+	}
+
+	if dir := cfg().StagingDir; dir != "" {
+		walkTmp(dir, false, func(path string, fi fs.FileInfo) { remove(path, fi, max(minAge, pruneMinAge)) })
+	}
+	for _, bc := range cfg().bots() {
+		walkTmp(bc.Dest, !all, func(path string, fi fs.FileInfo) {
+			if all || strings.HasPrefix(filepath.Base(path), ".speedtest-") {
+				remove(path, fi, max(minAge, pruneMinAge))
+			}
+		})
+	}
+	return p, nil
+}
+
+// walkTmp calls fn for the temporary files of this program under dir, or
+// only those directly in it with top.
+func walkTmp(dir string, top bool, fn func(path string, fi fs.FileInfo)) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if top && path != dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !tmpName.MatchString(d.Name()) {
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			fn(path, fi)
+		}
+		return nil
+	})
+}
+
+// pruneAtStart removes the partial downloads of the previous process, but
+// those of the URLs still to download (see recovery.go). Nothing is running
+// yet, so those recorded in the state file go whatever their age.
+func pruneAtStart() pruned {
+	p, err := prune(0, false, false)
+	if err != nil {
+		errorf("Partial downloads: %s", err.Error())
+	}
+	if p.files > 0 {
+		log.Printf("Removed %d partial downloads, reclaimed %s", p.files, units.Format(p.bytes))
+	}
+	return p
+}
+
+func handlePrune(c tele.Context) error {
+	args := c.Args()
+	all := len(args) == 1 && args[0] == "all"
+	if len(args) > 1 || len(args) == 1 && !all {
+		return c.Reply(tr("Usage: /prune [all]"))
+	}
+	if all {
+		p, err := prune(pruneMinAge, true, true)
+		if err != nil {
+			return err
+		}
+		if p.files == 0 {
+			return c.Reply(tr("No partial downloads"))
+		}
+		if !askConfirmation(c, tr("Remove %d .tmp files (%s) from the destinations?", p.files, units.Format(p.bytes))) {
+			return nil
+		}
+	}
+	log.Printf("Prune by %s", senderName(c.Sender()))
+	p, err := prune(pruneMinAge, all, false)
+	if err != nil {
+		return err
+	}
+	return c.Reply(tr("Removed %d partial downloads, reclaimed %s", p.files, units.Format(p.bytes)))
+}
@@ -0,0 +1,162 @@
+package downloader
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	"github.com/klauspost/compress/zstd"
+	tele "gopkg.in/telebot.v4"
+)
+
+// /prune all removes the temporary files of the bot, not files of users that
+// happen to end in .tmp.
+func TestPruneAll(t *testing.T) {
+	staging := t.TempDir()
+	withCfg(t, func(c *Cfg) { c.StagingDir = staging })
+	dest := cfg().InitialWorkingDir
+	files := map[string]bool{
+		filepath.Join(dest, "photo.jpg.0a1b2c.tmp"):          true,
+		filepath.Join(dest, "video.mp4.url0123456789ab.tmp"): true,
+		filepath.Join(dest, "post.txt.-1001_42.tmp"):         true,
+		filepath.Join(dest, ".speedtest-123.tmp"):            true,
+		filepath.Join(staging, "0a1b2c_photo.jpg.tmp"):       true,
+		filepath.Join(staging, ".backup-123.tmp"):            true,
+		filepath.Join(dest, "notes.tmp"):                     false,
+		filepath.Join(dest, "report.draft.tmp"):              false,
+		filepath.Join(staging, "mine.tmp"):                   false,
+		filepath.Join(dest, "photo.jpg"):                     false,
+	}
+	old := time.Now().Add(-time.Hour)
+	for path := range files {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Remove(path) })
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := prune(pruneMinAge, true, false); err != nil {
+		t.Fatal(err)
+	}
+	for path, removed := range files {
+		if _, err := os.Stat(path); (err != nil) != removed {
+			t.Errorf("%s: removed %v, want %v", filepath.Base(path), err != nil, removed)
+		}
+	}
+}
+
+// sentFiles keeps what the documents sent through it had, read before
+// /backup removes their files.
+type sentFiles struct {
+	*fakebot.Bot
+	mu    sync.Mutex
+	files map[string][]byte
+}
+
+func (b *sentFiles) Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	if doc, ok := what.(*tele.Document); ok {
+		data, err := os.ReadFile(doc.File.FileLocal)
+		if err != nil {
+			return nil, err
+		}
+		b.mu.Lock()
+		b.files[doc.FileName] = data
+		b.mu.Unlock()
+	}
+	return b.Bot.Send(to, what, opts...)
+}
+
+// A /backup unpacks to the files of the folder, without the partial
+// downloads, and matches the checksum of its manifest.
+func TestBackupRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string // by path in the folder, "" for a folder
+		want  []string          // archived, the others are left out
+	}{
+		{name: "files", files: map[string]string{"a.txt": "first", "sub/": "", "sub/b.bin": "second"},
+			want: []string{"a.txt", "sub/", "sub/b.bin"}},
+		{name: "partial downloads", files: map[string]string{"c.txt": "kept", "c.txt.0a1b2c.tmp": "partial"},
+			want: []string{"c.txt"}},
+		{name: "empty folder", files: map[string]string{"empty/": ""}, want: []string{"empty/"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) { c.StagingDir = t.TempDir() })
+			dir := t.TempDir()
+			for name, data := range tt.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if strings.HasSuffix(name, "/") {
+					if err := os.MkdirAll(path, 0o755); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			b := &sentFiles{Bot: fakebot.New(), files: map[string][]byte{}}
+
+			m, err := runBackup(t.Context(), b, tele.ChatID(testChat), dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(m.parts) != 1 {
+				t.Fatalf("%d parts, want 1", len(m.parts))
+			}
+			archive := b.files[m.parts[0].name]
+			if sum := sha256.Sum256(archive); hex.EncodeToString(sum[:]) != m.sum {
+				t.Errorf("archive SHA-256 %x, manifest %s", sum, m.sum)
+			}
+			manifest := string(b.files[strings.TrimSuffix(m.name, ".tar.zst")+".manifest.txt"])
+			if !strings.Contains(manifest, m.parts[0].sum+"  "+m.parts[0].name) {
+				t.Errorf("manifest %q without the checksum of %s", manifest, m.parts[0].name)
+			}
+
+			zr, err := zstd.NewReader(bytes.NewReader(archive))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer zr.Close()
+			r := tar.NewReader(zr)
+			var got []string
+			for {
+				hdr, err := r.Next()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, hdr.Name)
+				data, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(data) != tt.files[hdr.Name] {
+					t.Errorf("%s has %q, want %q", hdr.Name, data, tt.files[hdr.Name])
+				}
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("archived %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
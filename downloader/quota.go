@@ -0,0 +1,134 @@
+package downloader
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// The usage of a user is keyed by the user ID, that of a chat by "chat:" and
+// the chat ID, as a private chat has the ID of the user.
+const quotaBucket = "quota"
+
+type quotaUsage struct {
+	Bytes int64
+	Files int
+}
+
+func userUsage(userID int64) quotaUsage {
+	var u quotaUsage
+	if _, err := storage.Get(quotaBucket, strconv.FormatInt(userID, 10), &u); err != nil {
+		errorf("Quota: %s", err.Error())
+	}
+	return u
+}
+
+func chatUsage(chatID int64) quotaUsage {
+	var u quotaUsage
+	if _, err := storage.Get(quotaBucket, chatQuotaKey(chatID), &u); err != nil {
+		errorf("Quota: %s", err.Error())
+	}
+	return u
+}
+
+func chatQuotaKey(chatID int64) string {
+	return "chat:" + strconv.FormatInt(chatID, 10)
+}
+
+// addUsage counts a downloaded file for the user who sent it and the chat it
+// was sent in.
+func addUsage(userID, chatID int64, size int64) {
+	addQuotaUsage(strconv.FormatInt(userID, 10), size)
+	addQuotaUsage(chatQuotaKey(chatID), size)
+}
+
+func addQuotaUsage(key string, size int64) {
+	var u quotaUsage
+	err := storage.Modify(quotaBucket, key, &u, func() error {
+		u.Bytes += size
+		u.Files++
+		return nil
+	})
+	if err != nil {
+		errorf("Quota: %s", err.Error())
+	}
+}
+
+// reserved is the size of the files that passed reserveQuota and aren't
+// downloaded yet, by quota key, so that the files sent at once can't all fit
+// in what's left of a quota.
+var reserved = struct {
+	sync.Mutex
+	m map[string]int64
+}{m: map[string]int64{}}
+
+// reserveQuota returns a user-facing message if the file would push the user
+// or the chat over the configured byte cap, and otherwise reserves its size
+// until releaseQuota.
+func reserveQuota(userID, chatID int64, size int64) string {
+	userKey, chatKey := strconv.FormatInt(userID, 10), chatQuotaKey(chatID)
+	reserved.Lock()
+	defer reserved.Unlock()
+	if q := cfg().UserQuota; q != 0 {
+		if used := userUsage(userID).Bytes + reserved.m[userKey]; used+size > q {
+			return tr("Quota exceeded: %s of %s used, this file needs %s.",
+				units.Format(used), units.Format(q), units.Format(size))
+		}
+	}
+	if q := cfg().ChatQuota; q != 0 {
+		if used := chatUsage(chatID).Bytes + reserved.m[chatKey]; used+size > q {
+			return tr("Chat quota exceeded: %s of %s used, this file needs %s.",
+				units.Format(used), units.Format(q), units.Format(size))
+		}
+	}
+	reserved.m[userKey] += size
+	reserved.m[chatKey] += size
+	return ""
+}
+
+// releaseQuota gives back the reservation of reserveQuota once the download
+// is over, after addUsage if it succeeded.
+func releaseQuota(userID, chatID int64, size int64) {
+	reserved.Lock()
+	defer reserved.Unlock()
+	for _, key := range []string{strconv.FormatInt(userID, 10), chatQuotaKey(chatID)} {
+		if reserved.m[key] -= size; reserved.m[key] <= 0 {
+			delete(reserved.m, key)
+		}
+	}
+}
+
+// handleQuota shows the usage of the sender and of the chat, with a bar for
+// each configured quota and rate limit.
+func handleQuota(c tele.Context) error {
+	u := userUsage(c.Sender().ID)
+	msg := tr("Your usage: %s in %d files", units.Format(u.Bytes), u.Files)
+	if q := cfg().UserQuota; q != 0 {
+		msg += "\n" + quotaBar(u.Bytes, q)
+	}
+	for _, l := range cfg().RateLimits {
+		files, bytes := recentUsage(c.Sender().ID, l.Window)
+		msg += "\n" + tr("Last %s: %s in %d files", l.Window, units.Format(bytes), files)
+		if l.Files > 0 {
+			msg += "\n" + bar(int64(files)*100/int64(l.Files)) + " " + tr("of %d files", l.Files)
+		}
+		if l.Bytes > 0 {
+			msg += "\n" + quotaBar(bytes, l.Bytes)
+		}
+	}
+	if !c.Chat().Private || cfg().ChatQuota != 0 {
+		u := chatUsage(c.Chat().ID)
+		msg += "\n\n" + tr("This chat: %s in %d files", units.Format(u.Bytes), u.Files)
+		if q := cfg().ChatQuota; q != 0 {
+			msg += "\n" + quotaBar(u.Bytes, q)
+		}
+	}
+	return c.Reply(msg)
+}
+
+func quotaBar(used, quota int64) string {
+	return bar(used*100/quota) + " " + tr("of %s", units.Format(quota))
+}
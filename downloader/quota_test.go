@@ -0,0 +1,86 @@
+package downloader
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Files sent at once reserve their size when they're enqueued, so together
+// they can't go over the quota.
+func TestQuotaConcurrentEnqueue(t *testing.T) {
+	withCfg(t, func(c *Cfg) { c.UserQuota = 10 })
+	user := &tele.User{ID: 8, Username: "quota"}
+	b := fakebot.New()
+	events, stop := subscribeEvents(t.Context())
+	defer stop()
+	var wg sync.WaitGroup
+	for i := range 5 {
+		f := b.AddFile(fmt.Appendf(nil, "%04d", i)) // not duplicates of each other
+		msg := newMessage()
+		msg.Sender = user
+		msg.Document = &tele.Document{File: *f, FileName: fmt.Sprintf("quota-%d.txt", i)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	refused := 0
+	for _, e := range b.Events() {
+		if e.Action == "reply" && strings.Contains(e.Text, "Quota exceeded") {
+			refused++
+		}
+	}
+	if refused != 3 {
+		t.Errorf("%d files refused, want 3 of 5 with 4 bytes each in a quota of 10: %+v", refused, b.Events())
+	}
+	// The other tests count the downloads.
+	timeout := time.After(10 * time.Second)
+	for accepted := 5 - refused; accepted > 0; {
+		select {
+		case e := <-events:
+			if e.Type.finished() && strings.HasPrefix(e.Job.Name, "quota-") {
+				accepted--
+			}
+		case <-timeout:
+			t.Fatalf("%d downloads didn't finish", accepted)
+		}
+	}
+}
+
+// A file counts for the bytes it took, also when Telegram didn't tell its size.
+func TestQuotaUsage(t *testing.T) {
+	user := &tele.User{ID: 9, Username: "usage"}
+	b := fakebot.New()
+	f := b.AddFile([]byte("unknown size"))
+	f.FileSize = 0
+	msg := newMessage()
+	msg.Sender = user
+	msg.Document = &tele.Document{File: *f, FileName: "usage.txt"}
+	wait := finished(t, "usage.txt")
+	if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+		t.Fatal(err)
+	}
+	if e := wait(); e.Job.Outcome != jobDone {
+		t.Fatalf("outcome %q: %s", e.Job.Outcome, e.Job.Result)
+	}
+
+	var u quotaUsage
+	if _, err := storage.Get(quotaBucket, "9", &u); err != nil {
+		t.Fatal(err)
+	}
+	if want := int64(len("unknown size")); u.Bytes != want || u.Files != 1 {
+		t.Errorf("usage of %d bytes in %d files, want %d in 1", u.Bytes, u.Files, want)
+	}
+}
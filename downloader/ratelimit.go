@@ -0,0 +1,94 @@
+package downloader
+
+import (
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+type rateLimit struct {
+	Files  int   // 0 = unlimited
+	Bytes  int64 // 0 = unlimited
+	Window time.Duration
+}
+
+type rateEntry struct {
+	at   time.Time
+	size int64
+}
+
+var userRates = struct {
+	sync.Mutex
+	m map[int64][]rateEntry
+}{m: make(map[int64][]rateEntry)}
+
+// allowEnqueue records a file of the given size for the user and returns a
+// user-facing explanation when one of the configured limits would be
+// exceeded. Rejected files, and any file in dry-run mode, are not recorded.
+func allowEnqueue(userID int64, size int64) string {
+	if len(cfg().RateLimits) == 0 {
+		return ""
+	}
+	now := time.Now()
+
+	userRates.Lock()
+	defer userRates.Unlock()
+
+	var longest time.Duration
+	for _, l := range cfg().RateLimits {
+		if l.Window > longest {
+			longest = l.Window
+		}
+	}
+	entries := userRates.m[userID]
+	for len(entries) > 0 && now.Sub(entries[0].at) > longest {
+		entries = entries[1:]
+	}
+
+	for _, l := range cfg().RateLimits {
+		files, bytes := 1, size
+		oldest := now
+		for _, e := range entries {
+			if now.Sub(e.at) <= l.Window {
+				files++
+				bytes += e.size
+				if e.at.Before(oldest) {
+					oldest = e.at
+				}
+			}
+		}
+		retry := (l.Window - now.Sub(oldest)).Round(time.Minute)
+		if l.Files > 0 && files > l.Files {
+			userRates.m[userID] = entries
+			return tr("Slow down: at most %d files per %s. Try again in %s.",
+				l.Files, l.Window, retry)
+		}
+		if l.Bytes > 0 && bytes > l.Bytes {
+			userRates.m[userID] = entries
+			return tr("Slow down: at most %s per %s. Try again in %s.",
+				units.Format(l.Bytes), l.Window, retry)
+		}
+	}
+	if cfg().DryRun {
+		userRates.m[userID] = entries
+		return ""
+	}
+	userRates.m[userID] = append(entries, rateEntry{at: now, size: size})
+	return ""
+}
+
+// recentUsage is what the user enqueued within the last window, as counted
+// by the rate limits.
+func recentUsage(userID int64, window time.Duration) (files int, bytes int64) {
+	now := time.Now()
+	userRates.Lock()
+	defer userRates.Unlock()
+	for _, e := range userRates.m[userID] {
+		if now.Sub(e.at) <= window {
+			files++
+			bytes += e.size
+		}
+	}
+	return files, bytes
+}
@@ -0,0 +1,43 @@
+package downloader
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Files beyond a limit are turned down and not counted.
+func TestAllowEnqueue(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits []rateLimit
+		dryRun bool
+		sizes  []int64
+		want   []bool
+	}{
+		{name: "no limits", sizes: []int64{1, 1, 1}, want: []bool{true, true, true}},
+		{name: "files", limits: []rateLimit{{Files: 2, Window: time.Hour}},
+			sizes: []int64{1, 1, 1}, want: []bool{true, true, false}},
+		{name: "bytes", limits: []rateLimit{{Bytes: 10, Window: time.Hour}},
+			sizes: []int64{6, 6, 4, 1}, want: []bool{true, false, true, false}},
+		{name: "every limit", limits: []rateLimit{{Files: 10, Window: time.Minute}, {Bytes: 5, Window: time.Hour}},
+			sizes: []int64{5, 1}, want: []bool{true, false}},
+		{name: "dry run", limits: []rateLimit{{Files: 1, Window: time.Hour}}, dryRun: true,
+			sizes: []int64{1, 1}, want: []bool{true, true}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withCfg(t, func(c *Cfg) { c.RateLimits, c.DryRun = tt.limits, tt.dryRun })
+			userID := int64(9000 + i)
+			for j, size := range tt.sizes {
+				refusal := allowEnqueue(userID, size)
+				if (refusal == "") != tt.want[j] {
+					t.Errorf("file %d of %d bytes: %q, want allowed %v", j, size, refusal, tt.want[j])
+				}
+				if refusal != "" && !strings.HasPrefix(refusal, "Slow down") {
+					t.Errorf("refusal %q", refusal)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package downloader
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Cameras that shoot RAW+JPEG write both files with the same base name, e.g.
+// IMG_0042.CR3 and IMG_0042.JPG. When one of them arrives in a chat that had
+// the other one in the last pairWindow, queued, running or in the history, it
+// goes into the same folder, whatever its caption says, and the completion
+// message names the pair once both are there.
+const pairWindow = 24 * time.Hour
+
+var (
+	rawExts  = []string{".cr2", ".cr3", ".nef", ".arw", ".dng", ".raf", ".orf", ".rw2"}
+	jpegExts = []string{".jpg", ".jpeg"}
+)
+
+// pairKey is the lower-case base name of a RAW or JPEG file and whether it's
+// the RAW one.
+func pairKey(name string) (key string, raw, ok bool) {
+	name = filepath.Base(name)
+	ext := strings.ToLower(filepath.Ext(name))
+	raw = slices.Contains(rawExts, ext)
+	if !raw && !slices.Contains(jpegExts, ext) {
+		return "", false, false
+	}
+	return strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name))), raw, true
+}
+
+// isPartner tells whether path is the other half of the pair of key.
+func isPartner(path, key string, raw bool) bool {
+	k, r, ok := pairKey(path)
+	return ok && k == key && r != raw
+}
+
+// pairedDir is the folder the other half of the pair of fname went to from
+// the chat of c, if any.
+func pairedDir(c tele.Context, fname string) (string, bool) {
+	key, raw, ok := pairKey(fname)
+	if !ok {
+		return "", false
+	}
+	jobs.Lock()
+	for _, j := range jobs.m {
+		if j.c.Chat().ID == c.Chat().ID && isPartner(j.path, key, raw) {
+			jobs.Unlock()
+			return filepath.Dir(j.path), true
+		}
+	}
+	jobs.Unlock()
+
+	var dir string
+	since := time.Now().Add(-pairWindow)
+	err := storage.Last(historyBucket, 200, func(_ string, data []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if dir == "" && e.ChatID == c.Chat().ID && e.Time.After(since) && isPartner(e.Path, key, raw) {
+			dir = filepath.Dir(e.Path)
+		}
+		return nil
+	})
+	if err != nil {
+		errorf("Pairing: %s", err.Error())
+	}
+	return dir, dir != ""
+}
+
+// pairedFile is the other half of the pair of fpath in its folder, "" if
+// it's not there.
+func pairedFile(fpath string) string {
+	key, raw, ok := pairKey(fpath)
+	if !ok {
+		return ""
+	}
+	entries, err := os.ReadDir(filepath.Dir(fpath))
+	if err != nil {
+		return ""
+	}
+	for _, e := range entries {
+		if e.Type().IsRegular() && isPartner(e.Name(), key, raw) {
+			return e.Name()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,82 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// At every start the partial downloads are reconciled with the downloads
+// still to do, those handed over or left by a crash and the failed ones: the
+// partial download of a URL that's still to do is kept, as the download goes
+// on from it, and the others are removed, since a Telegram download always
+// starts over. The downloads then start again and the admin chat gets a
+// summary of what was recovered.
+
+// downloadsToDo are the downloads still to do, by chat and message.
+func downloadsToDo() map[string]savedDownload {
+	m := map[string]savedDownload{}
+	for _, bucket := range []string{handoverBucket, failedBucket} {
+		err := storage.ForEach(bucket, func(_ string, data []byte) error {
+			var s savedDownload
+			if err := json.Unmarshal(data, &s); err != nil {
+				return err
+			}
+			m[fmt.Sprintf("%d:%d", s.ChatID, s.MessageID)] = s
+			return nil
+		})
+		if err != nil {
+			errorf("Recovery: %s", err.Error())
+		}
+	}
+	return m
+}
+
+// resumablePartials are the partial downloads the pending downloads go on
+// from: where the job of each URL writes to, as in downloadFileInternal.
+func resumablePartials(pending map[string]savedDownload) map[string]bool {
+	paths := map[string]bool{}
+	for _, s := range pending {
+		b := s.bot()
+		if s.URL == "" || b == nil {
+			continue
+		}
+		c, _ := s.restore(b)
+		paths[stagingPath(filepath.Join(destinationFor(c, s.Name), s.Name), urlKey(s.URL))] = true
+	}
+	return paths
+}
+
+// recoverAtStart removes the partial downloads nothing goes on from, starts
+// the downloads handed over and reports to the admin chat.
+func recoverAtStart(b *tele.Bot) {
+	pending := downloadsToDo()
+	resumed := 0
+	for path := range resumablePartials(pending) {
+		if fi, err := os.Stat(path); err == nil && fi.Size() > 0 {
+			resumed++
+		}
+	}
+	discarded := pruneAtStart()
+	restarted := resumeHandover()
+	if len(pending) == 0 && discarded.files == 0 {
+		return
+	}
+	msg := tr("Recovered after the restart: resumed %d, discarded %d (%s), re-queued %d", resumed,
+		discarded.files, units.Format(discarded.bytes), len(pending)-resumed)
+	if retries := len(pending) - restarted; retries > 0 {
+		msg += "\n" + tr("%d of them are failed downloads, retried now", retries)
+	}
+	log.Println(msg)
+	if chat := cfg().AdminChatID; chat != 0 {
+		if _, err := b.Send(tele.ChatID(chat), msg); err != nil {
+			errorf("Recovery: %s", err.Error())
+		}
+	}
+}
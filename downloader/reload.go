@@ -0,0 +1,40 @@
+package downloader
+
+import (
+	"log"
+	"os"
+	"os/signal"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// handleSIGHUP reloads the configuration on SIGHUP. The bot connection and
+// in-flight downloads are not affected.
+func handleSIGHUP() {
+	if reloadSignal == nil {
+		return
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, reloadSignal)
+	go func() {
+		for range ch {
+			log.Println("SIGHUP received, reloading configuration")
+			if err := reloadCfg(); err != nil {
+				errorf("Reload failed, keeping the old configuration: %s", err.Error())
+			}
+		}
+	}()
+}
+
+func handleReload(c tele.Context) error {
+	if err := reloadCfg(); err != nil {
+		logEverywhere(c, "Reload failed, keeping the old configuration: %s", err.Error())
+		return nil
+	}
+	logEverywhere(c, "Configuration reloaded")
+	return nil
+}
+
+func handleConfig(c tele.Context) error {
+	return replyPre(c, tr("Effective configuration:"), describeCfg(cfg()))
+}
@@ -0,0 +1,183 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// Failed downloads are kept in the state file with their Telegram file IDs
+// and retried at startup and every TELEGRAM_RETRY_INTERVAL, up to
+// TELEGRAM_RETRY_ATTEMPTS times. Downloads that can't succeed are reported
+// to the admin chat and dropped.
+
+const failedBucket = "failed"
+
+type failedDownload struct {
+	savedDownload
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error"`
+	Failed   time.Time `json:"failed"`
+}
+
+// Downloads being retried right now, so the next round doesn't start them
+// again.
+var retrying = struct {
+	sync.Mutex
+	m map[string]bool
+}{m: make(map[string]bool)}
+
+func failedKey(c tele.Context) string {
+	return fmt.Sprintf("%d:%d", c.Chat().ID, c.Message().ID)
+}
+
+// permanentFailure reports whether retrying err is pointless: the file ID
+// is no longer valid or the file is too big for the Bot API.
+func permanentFailure(err error) bool {
+	return errors.Is(err, tele.ErrWrongFileID) || errors.Is(err, tele.ErrWrongFileIDCharacter) ||
+		errors.Is(err, tele.ErrWrongFileIDLength) || errors.Is(err, tele.ErrWrongFileIDPadding) ||
+		errors.Is(err, tele.ErrWrongFileIDSymbol) || strings.Contains(err.Error(), "file is too big")
+}
+
+// recordFailure stores a failed download for the automatic retries, or
+// gives up on it.
+func recordFailure(c tele.Context, j *job, err error) {
+	if cfg().RetryAttempts <= 0 || c.Message() == nil {
+		return
+	}
+	key := failedKey(c)
+	var fd failedDownload
+	err2 := storage.Modify(failedBucket, key, &fd, func() error {
+		if fd.FileID == "" {
+			fd.savedDownload = saveDownload(j)
+		}
+		fd.JobID = j.id
+		// A flood wait says nothing about the file.
+		if !isFlood(err) {
+			fd.Attempts++
+		}
+		fd.Error = err.Error()
+		fd.Failed = time.Now()
+		return nil
+	})
+	if err2 != nil {
+		errorf("Failed downloads: %s", err2.Error())
+		return
+	}
+	if permanentFailure(err) || fd.Attempts > cfg().RetryAttempts {
+		giveUp(key, fd)
+	}
+}
+
+func init() {
+	listenEvents(func(e jobEvent) {
+		if e.Type.finished() && e.Type != eventFailed {
+			forgetFailure(e.job.c)
+		}
+	})
+}
+
+// forgetFailure drops the record once the download was done, skipped or
+// cancelled.
+func forgetFailure(c tele.Context) {
+	if c.Message() == nil {
+		return
+	}
+	if err := storage.Delete(failedBucket, failedKey(c)); err != nil {
+		errorf("Failed downloads: %s", err.Error())
+	}
+}
+
+func giveUp(key string, fd failedDownload) {
+	if err := storage.Delete(failedBucket, key); err != nil {
+		errorf("Failed downloads: %s", err.Error())
+	}
+	msg := tr("Giving up on %s from %s in chat %d after %d attempts: %s", fd.Name, senderName(&fd.Sender),
+		fd.ChatID, fd.Attempts, fd.Error)
+	log.Println(msg)
+	chat := cfg().AdminChatID
+	if chat == 0 {
+		return
+	}
+	if b := fd.bot(); b != nil {
+		if _, err := b.Send(tele.ChatID(chat), msg); err != nil {
+			errorf("Failed downloads: %s", err.Error())
+		}
+	}
+}
+
+// startRetries retries the stored failures now and then on every
+// TELEGRAM_RETRY_INTERVAL, which can change on reload.
+func startRetries() {
+	go func() {
+		ctx := rootContext()
+		retryFailures()
+		for {
+			interval := cfg().RetryInterval
+			if interval <= 0 {
+				interval = time.Minute
+			}
+			if !sleepContext(ctx, interval) {
+				return
+			}
+			if cfg().RetryInterval > 0 {
+				retryFailures()
+			}
+		}
+	}()
+}
+
+func retryFailures() {
+	if cfg().RetryAttempts <= 0 {
+		return
+	}
+	type failed struct {
+		key string
+		fd  failedDownload
+	}
+	var list []failed
+	err := storage.ForEach(failedBucket, func(key string, data []byte) error {
+		var fd failedDownload
+		if err := json.Unmarshal(data, &fd); err != nil {
+			return err
+		}
+		list = append(list, failed{key, fd})
+		return nil
+	})
+	if err != nil {
+		errorf("Failed downloads: %s", err.Error())
+		return
+	}
+
+	for _, f := range list {
+		b := f.fd.bot()
+		if b == nil || maintenance.Load() {
+			continue
+		}
+		retrying.Lock()
+		busy := retrying.m[f.key]
+		retrying.m[f.key] = true
+		retrying.Unlock()
+		if busy {
+			continue
+		}
+
+		log.Printf("Retrying %s (attempt %d)", f.fd.Name, f.fd.Attempts+1)
+		c, file := f.fd.restore(b)
+		go func(key string) {
+			defer func() {
+				retrying.Lock()
+				delete(retrying.m, key)
+				retrying.Unlock()
+			}()
+			downloadFile(handlerContext(c), c, file, f.fd.Name, time.Now())
+		}(f.key)
+	}
+}
@@ -0,0 +1,65 @@
+package downloader
+
+import (
+	"log"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+type permission uint8
+
+const (
+	permUpload permission = 1 << iota // send files for download
+	permView                          // read-only commands
+	permAdmin                         // destructive and configuration commands
+
+	permAll = permUpload | permView | permAdmin
+)
+
+type roles struct {
+	admins    userList
+	uploaders userList
+	viewers   userList
+}
+
+func (r roles) Empty() bool {
+	return r.admins.Empty() && r.uploaders.Empty() && r.viewers.Empty()
+}
+
+// permissionsOf returns what the user may do. Without any role configured
+// every user that passed the whitelists gets full access.
+func (r roles) permissionsOf(u *tele.User) permission {
+	if r.Empty() {
+		return permAll
+	}
+	var p permission
+	if r.admins.Contains(u) {
+		p |= permAll
+	}
+	if r.uploaders.Contains(u) {
+		p |= permUpload
+	}
+	if r.viewers.Contains(u) {
+		p |= permView
+	}
+	return p
+}
+
+func requirePermission(p permission) tele.MiddlewareFunc {
+	return func(next tele.HandlerFunc) tele.HandlerFunc {
+		return func(c tele.Context) error {
+			if cfg().Roles.permissionsOf(c.Sender())&p != p {
+				c.Set("denied", true)
+				if c.Sender() != nil {
+					log.Printf("Permission denied for user %d (@%s): %s",
+						c.Sender().ID, c.Sender().Username, c.Text())
+				}
+				if c.Message() != nil && c.Message().Text != "" {
+					return c.Reply(tr("Permission denied"))
+				}
+				return nil
+			}
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// A download can be deferred with /schedule <time> in reply to the file, or
+// with "/schedule <time>" in its caption: it's enqueued and checked at once
+// but stays queued until then. The time is a local time of day, the next one
+// to come in TELEGRAM_TIMEZONE, or a delay such as 2h. The start times set with /schedule are kept
+// in the state file by message, so they survive a restart like the downloads
+// themselves.
+const scheduledBucket = "scheduled"
+
+// parseStartTime parses "02:00" or "90m" into the time to start at.
+func parseStartTime(s string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := time.ParseInLocation("15:04", s, now.Location())
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither a time like 02:00 nor a delay like 2h", s)
+	}
+	at := time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, now.Location())
+	if !at.After(now) {
+		at = at.AddDate(0, 0, 1)
+	}
+	return at, nil
+}
+
+// captionSchedule returns the time of a "/schedule <time>" directive in the
+// caption.
+func captionSchedule(caption string) (string, bool) {
+	fields := strings.Fields(caption)
+	for i, f := range fields {
+		if f == "/schedule" && i+1 < len(fields) {
+			return fields[i+1], true
+		}
+	}
+	return "", false
+}
+
+// scheduledStart is when the download of the message of c may start, zero
+// for right away.
+func scheduledStart(c tele.Context, enqueued time.Time) time.Time {
+	m := c.Message()
+	if m == nil {
+		return time.Time{}
+	}
+	var at time.Time
+	if found, err := storage.Get(scheduledBucket, failedKey(c), &at); err != nil {
+		errorf("Schedule: %s", err.Error())
+	} else if found {
+		return at
+	}
+	if s, ok := captionSchedule(m.Caption); ok {
+		if at, err := parseStartTime(s, inZone(enqueued)); err == nil {
+			return at
+		}
+	}
+	return time.Time{}
+}
+
+// waitForStart keeps the job queued until its scheduled start.
+func (j *job) waitForStart(ctx context.Context) error {
+	at := scheduledStart(j.c, j.enqueued)
+	if !at.After(time.Now()) {
+		return nil
+	}
+	j.mu.Lock()
+	j.startAt = at
+	j.mu.Unlock()
+	j.logf("Scheduled for %s", at.Format(time.DateTime))
+	if !sleepContext(ctx, time.Until(at)) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+func init() {
+	// A finished job no longer needs its start time, unless it's handed over.
+	listenEvents(func(e jobEvent) {
+		if !e.Type.finished() || e.job.c.Message() == nil {
+			return
+		}
+		e.job.mu.Lock()
+		handedOver := e.job.handedOver
+		e.job.mu.Unlock()
+		if !handedOver {
+			if err := storage.Delete(scheduledBucket, failedKey(e.job.c)); err != nil {
+				errorf("Schedule: %s", err.Error())
+			}
+		}
+	})
+}
+
+func handleSchedule(c tele.Context) error {
+	m := c.Message().ReplyTo
+	args := c.Args()
+	if m == nil || len(args) != 1 {
+		return c.Reply(tr("Reply /schedule <time> to a file, e.g. /schedule 02:00 or /schedule 2h"))
+	}
+	_, f, name := channelMedia(m)
+	if f == nil {
+		return c.Reply(tr("That message has no file"))
+	}
+	at, err := parseStartTime(args[0], localNow())
+	if err != nil {
+		return c.Reply(tr("Invalid time: %s", err.Error()))
+	}
+
+	// Like /get, the file replies to its own message and counts for the user
+	// of /schedule.
+	ic := tele.NewContext(c.Bot(), tele.Update{Message: &tele.Message{ID: m.ID, Chat: c.Chat(),
+		Sender: c.Sender(), AlbumID: m.AlbumID}})
+	if err := storage.Put(scheduledBucket, failedKey(ic), at); err != nil {
+		return err
+	}
+	log.Printf("Scheduled %s for %s by %s", name, at.Format(time.DateTime), senderName(c.Sender()))
+	if err := c.Reply(tr("Scheduled %s for %s", name, at.Format("Mon 15:04"))); err != nil {
+		return err
+	}
+	return enqueueDocument(ic, &tele.Document{File: *f, FileName: name})
+}
@@ -0,0 +1,73 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Telegram can deliver an update again, e.g. when getUpdates is retried after
+// a reconnect before the new offset reached it. Every poller remembers the
+// messages it passed on for seenTTL, by chat and message ID and, for edits,
+// the time of the edit, and drops those it sees again, so a file isn't
+// enqueued twice.
+const seenTTL = 10 * time.Minute
+
+type seenSet struct {
+	sync.Mutex
+	m      map[string]time.Time
+	purged time.Time
+}
+
+func newSeenSet() *seenSet {
+	return &seenSet{m: map[string]time.Time{}, purged: time.Now()}
+}
+
+// first records key and reports whether it's new.
+func (s *seenSet) first(key string) bool {
+	s.Lock()
+	defer s.Unlock()
+	now := time.Now()
+	if now.Sub(s.purged) > seenTTL {
+		for k, t := range s.m {
+			if now.Sub(t) > seenTTL {
+				delete(s.m, k)
+			}
+		}
+		s.purged = now
+	}
+	if t, ok := s.m[key]; ok && now.Sub(t) <= seenTTL {
+		return false
+	}
+	s.m[key] = now
+	return true
+}
+
+// seenKey identifies the message of an update, "" for updates without one.
+func seenKey(u *tele.Update) string {
+	switch {
+	case u.Message != nil:
+		return fmt.Sprintf("%d:%d", u.Message.Chat.ID, u.Message.ID)
+	case u.ChannelPost != nil:
+		return fmt.Sprintf("%d:%d", u.ChannelPost.Chat.ID, u.ChannelPost.ID)
+	case u.EditedMessage != nil:
+		return fmt.Sprintf("%d:%d:%d", u.EditedMessage.Chat.ID, u.EditedMessage.ID, u.EditedMessage.LastEdit)
+	case u.EditedChannelPost != nil:
+		return fmt.Sprintf("%d:%d:%d", u.EditedChannelPost.Chat.ID, u.EditedChannelPost.ID,
+			u.EditedChannelPost.LastEdit)
+	}
+	return ""
+}
+
+// redelivered reports whether the message of u was already passed on.
+func (s *seenSet) redelivered(u *tele.Update) bool {
+	key := seenKey(u)
+	if key == "" || s.first(key) {
+		return false
+	}
+	log.Printf("Skipped update %d, message %s was already received", u.ID, key)
+	return true
+}
@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// parseChatNames parses "family=-100123,work=-100456" into a map from name to
+// chat ID.
+func parseChatNames(s string) (map[string]int64, error) {
+	m := map[string]int64{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, id, ok := strings.Cut(item, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || name == "" {
+			return nil, fmt.Errorf("expected <name>=<chat id>, got %q", item)
+		}
+		chatID, err := strconv.ParseInt(strings.TrimSpace(id), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a chat ID", id)
+		}
+		m[name] = chatID
+	}
+	return m, nil
+}
+
+// sendTarget returns the chat of a name or ID and the bot to send with.
+func sendTarget(c tele.Context, target string) (int64, botAPI, error) {
+	cf := cfg()
+	chatID, named := cf.ChatNames[strings.ToLower(target)]
+	if !named {
+		var err error
+		if chatID, err = strconv.ParseInt(target, 10, 64); err != nil {
+			return 0, nil, fmt.Errorf("no chat named %s in TELEGRAM_CHAT_NAMES", target)
+		}
+	}
+	configured := named || chatID == cf.ApprovalChatID || chatID == cf.AdminChatID
+	if _, ok := cf.channel(chatID); ok {
+		configured = true
+	}
+	runningBots.Lock()
+	defer runningBots.Unlock()
+	for _, rb := range runningBots.bots {
+		if slices.Contains(botCfgOf(rb).ChatIDs, chatID) {
+			return chatID, rb, nil
+		}
+	}
+	if !configured {
+		return 0, nil, fmt.Errorf("chat %d is not configured", chatID)
+	}
+	return chatID, apiOf(c), nil
+}
+
+// storedFile is the path of a file in the destination of bc, or of the last
+// download of bc in the history with that name or job ID. Other bots' files
+// are left out, their admins may be someone else.
+func storedFile(bc botCfg, name string) (string, error) {
+	path := filepath.Join(bc.Dest, safePath(name))
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+		return path, nil
+	}
+	found := ""
+	err := storage.ForEach(historyBucket, func(_ string, data []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if e.Bot != bc.Name {
+			return nil
+		}
+		if rel, err := filepath.Rel(bc.Dest, e.Path); err != nil || !filepath.IsLocal(rel) {
+			return nil
+		}
+		if e.Name == name || e.JobID == strings.ToLower(name) || filepath.Base(e.Path) == name {
+			found = e.Path
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if found == "" {
+		return "", fmt.Errorf("no file %s in %s or the history", name, bc.Dest)
+	}
+	if _, err := os.Stat(found); err != nil {
+		return "", err
+	}
+	return found, nil
+}
+
+// /sendto <chat> <file> uploads a file of the destination to another chat:
+// one named in TELEGRAM_CHAT_NAMES or the ID of a configured chat (whitelist,
+// channel, approval or admin chat). The file is a path in the destination of
+// the bot or, for what was downloaded, the name or job ID of a download in the
+// history of the bot, the last one first. It's sent by the bot that has the chat in its
+// whitelist, else by the bot of the command.
+func handleSendTo(c tele.Context) error {
+	args := strings.SplitN(strings.TrimSpace(c.Message().Payload), " ", 2)
+	if len(args) != 2 || strings.TrimSpace(args[1]) == "" {
+		return c.Reply(tr("Usage: /sendto <chat> <file>"))
+	}
+	chatID, b, err := sendTarget(c, args[0])
+	if err != nil {
+		return c.Reply(tr("Can't send there: %s", err.Error()))
+	}
+	path, err := storedFile(botCfgFor(c), strings.TrimSpace(args[1]))
+	if err != nil {
+		return c.Reply(tr("Can't send that: %s", err.Error()))
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if fi.Size() > uploadMaxSize {
+		return c.Reply(tr("%s is too large to send (%s, at most %s)", filepath.Base(path), units.Format(fi.Size()),
+			units.Format(uploadMaxSize)))
+	}
+
+	log.Printf("Sending %s to chat %d for %s", path, chatID, senderName(c.Sender()))
+	if err := sendDocument(handlerContext(c), b, tele.ChatID(chatID), path, filepath.Base(path)); err != nil {
+		return c.Reply(tr("Sending %s failed: %s", filepath.Base(path), err.Error()))
+	}
+	return c.Reply(tr("Sent %s (%s) to %s", filepath.Base(path), units.Format(fi.Size()), args[0]))
+}
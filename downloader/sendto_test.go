@@ -0,0 +1,38 @@
+package downloader
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+)
+
+// /sendto only finds the files of the bot of the command.
+func TestStoredFile(t *testing.T) {
+	main := cfg().bots()[0]
+	other := botCfg{Name: "other", Dest: t.TempDir()}
+	for _, bc := range []botCfg{main, other} {
+		path := filepath.Join(bc.Dest, "sendto-"+bc.Name+".bin")
+		if err := os.WriteFile(path, []byte(bc.Name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.Remove(path) })
+		e := historyEntry{savedDownload: savedDownload{Bot: bc.Name, JobID: "sendto" + bc.Name, Name: "sendto.bin"},
+			Path: path}
+		if err := storage.Append(historyBucket, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if path, err := storedFile(main, "sendtoother"); err == nil {
+		t.Errorf("found %s of the other bot", path)
+	}
+	path, err := storedFile(main, "sendto.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(main.Dest, "sendto-.bin"); path != want {
+		t.Errorf("found %s, want %s", path, want)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build !windows
+
+package downloader
+
+func runService(args []string) bool {
+	return false
+}
@@ -0,0 +1,58 @@
+package downloader
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// runService runs the bots under the Windows service manager and reports
+// whether the process was started by it. Services have no console, so set
+// TELEGRAM_LOG_FILE.
+func runService(args []string) bool {
+	if ok, err := svc.IsWindowsService(); err != nil || !ok {
+		return false
+	}
+	if err := svc.Run("telegram-files-downloader", service{args}); err != nil {
+		log.Fatalf("Service failed: err=%s", err.Error())
+	}
+	return true
+}
+
+type service struct {
+	args []string
+}
+
+func (s service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	e, err := New(s.args)
+	if err != nil {
+		errorf("Service failed: err=%s", err.Error())
+		return false, 1
+	}
+	done := make(chan struct{})
+	go func() {
+		e.Start()
+		close(done)
+	}()
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case r := <-requests:
+			switch r.Cmd {
+			case svc.Interrogate:
+				status <- r.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				log.Println("Service stop requested, shutting down")
+				status <- svc.Status{State: svc.StopPending,
+					WaitHint: uint32((shutdownTimeout + 5*time.Second).Milliseconds())}
+				e.Stop()
+				<-done
+				return false, 0
+			}
+		case <-done:
+			return false, 0
+		}
+	}
+}
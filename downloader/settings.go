@@ -0,0 +1,89 @@
+package downloader
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/clisboa/telegram-files-downloader/internal/config"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+const runtimeSettingsKey = "runtime"
+
+// loadRuntimeSettings applies the values stored by /set on a previous run.
+func loadRuntimeSettings() {
+	values := map[string]string{}
+	if _, err := storage.Get(settingsBucket, runtimeSettingsKey, &values); err != nil {
+		errorf("Runtime settings: %s", err.Error())
+		return
+	}
+	if len(values) == 0 {
+		return
+	}
+	sources().SetRuntime(values)
+	if err := rebuildCfg(); err != nil {
+		warnf("Runtime settings are invalid, ignoring them: %s", err.Error())
+		sources().SetRuntime(map[string]string{})
+	}
+}
+
+func runtimeSetting(name string) (config.Setting, bool) {
+	for _, s := range settings {
+		if s.Runtime && s.FlagName() == strings.ReplaceAll(strings.ToLower(name), "_", "-") {
+			return s, true
+		}
+	}
+	return config.Setting{}, false
+}
+
+func runtimeSettingsHelp() string {
+	names := []string{}
+	for _, s := range settings {
+		if s.Runtime {
+			names = append(names, s.FlagName())
+		}
+	}
+	sort.Strings(names)
+	return tr("Usage: /set <name> [value] (no value resets to the configured one)\nSettings: %s",
+		strings.Join(names, ", "))
+}
+
+func handleSet(c tele.Context) error {
+	args := c.Args()
+	if len(args) == 0 {
+		return c.Reply(runtimeSettingsHelp())
+	}
+	s, ok := runtimeSetting(args[0])
+	if !ok {
+		return c.Reply(tr("Unknown setting: %s", args[0]) + "\n" + runtimeSettingsHelp())
+	}
+	name := "TELEGRAM_" + s.Name
+	value := strings.Join(args[1:], " ")
+
+	undo := sources().Set(name, value)
+	if err := rebuildCfg(); err != nil {
+		undo()
+		return c.Reply(tr("Not changed: %s", err.Error()))
+	}
+
+	if err := storage.Put(settingsBucket, runtimeSettingsKey, sources().Runtime()); err != nil {
+		logEverywhere(c, "Setting applied but not persisted: %s", err.Error())
+		return nil
+	}
+	if value == "" {
+		logEverywhere(c, "%s reset to %q", s.FlagName(), getenv(name))
+	} else {
+		logEverywhere(c, "%s = %s", s.FlagName(), value)
+	}
+	return nil
+}
+
+func maxSizeMessage(size int64) string {
+	if cfg().MaxFileSize == 0 || size <= cfg().MaxFileSize {
+		return ""
+	}
+	return tr("File too large: %s, the limit is %s.",
+		units.Format(size), units.Format(cfg().MaxFileSize))
+}
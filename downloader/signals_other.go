@@ -0,0 +1,12 @@
+//go:build !unix
+
+package downloader
+
+import "os"
+
+// Windows only delivers interrupts and console close events (as SIGTERM), so
+// reloading takes /reload and TELEGRAM_TAKEOVER is ignored.
+var (
+	reloadSignal os.Signal
+	drainSignal  os.Signal
+)
@@ -0,0 +1,13 @@
+//go:build unix
+
+package downloader
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	reloadSignal os.Signal = syscall.SIGHUP
+	drainSignal  os.Signal = syscall.SIGUSR2
+)
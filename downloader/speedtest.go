@@ -0,0 +1,142 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// /speedtest downloads the replied file, or a test file the bot uploaded
+// once, to measure the throughput from Telegram, then writes as much to the
+// destination to measure the disk. The test file's ID is kept per bot in the
+// state file; file IDs are only valid for the bot that got them.
+const (
+	speedtestBucket   = "speedtest"
+	speedtestSize     = 10 << 20 // below the 20 MB download limit of the Bot API
+	speedtestDiskSize = 64 << 20 // at least, so the disk cache doesn't decide alone
+)
+
+func handleSpeedtest(c tele.Context) error {
+	var f *tele.File
+	if m := c.Message().ReplyTo; m != nil {
+		if _, f, _ = channelMedia(m); f == nil {
+			return c.Reply(tr("That message has no file"))
+		}
+	} else {
+		var err error
+		if f, err = speedtestFile(c); err != nil {
+			return c.Reply(tr("Speed test failed: %s", err.Error()))
+		}
+	}
+	log.Printf("Speed test by %s", senderName(c.Sender()))
+
+	n, took, err := measureDownload(c, f)
+	if err != nil {
+		// A test file that's no longer downloadable is uploaded again next time.
+		if c.Message().ReplyTo == nil {
+			storage.Delete(speedtestBucket, offsetKey(botCfgFor(c).Token))
+		}
+		return c.Reply(tr("Speed test failed: %s", err.Error()))
+	}
+	msg := tr("Telegram: %s in %s, %s", units.Format(n), took.Round(time.Millisecond), speed(n, took))
+
+	dir := destinationFor(c, "speedtest.bin")
+	w, wtook, err := measureDisk(dir, max(n, speedtestDiskSize))
+	if err != nil {
+		msg += "\n" + tr("Disk %s: %s", dir, err.Error())
+	} else {
+		msg += "\n" + tr("Disk %s: %s in %s, %s", dir, units.Format(w), wtook.Round(time.Millisecond), speed(w, wtook))
+	}
+	if l := writeLimiterFor(filepath.Join(dir, "speedtest.bin")); l != nil {
+		l.mu.Lock()
+		msg += "\n" + tr("Downloads there are limited to %s/s (TELEGRAM_WRITE_LIMITS)", units.Format(l.rate))
+		l.mu.Unlock()
+	}
+	log.Println(msg)
+	return replyPre(c, tr("Speed test:"), msg)
+}
+
+// speedtestFile is the test file of the bot of c, uploaded to the chat of c
+// the first time.
+func speedtestFile(c tele.Context) (*tele.File, error) {
+	key := offsetKey(botCfgFor(c).Token)
+	var id string
+	if found, err := storage.Get(speedtestBucket, key, &id); err != nil {
+		return nil, err
+	} else if found {
+		return &tele.File{FileID: id, FileSize: speedtestSize}, nil
+	}
+
+	payload := make([]byte, speedtestSize)
+	rand.Read(payload)
+	doc := &tele.Document{File: tele.FromReader(bytes.NewReader(payload)), FileName: "speedtest.bin"}
+	m, err := apiOf(c).Send(c.Chat(), doc, &tele.SendOptions{DisableNotification: true})
+	if err != nil {
+		return nil, fmt.Errorf("uploading the test file: %w", err)
+	}
+	// The file ID outlives the message.
+	apiOf(c).Delete(m)
+	if m.Document == nil {
+		return nil, errors.New("uploading the test file: no file in the reply")
+	}
+	if err := storage.Put(speedtestBucket, key, m.Document.FileID); err != nil {
+		errorf("Speed test: %s", err.Error())
+	}
+	return &m.Document.File, nil
+}
+
+func measureDownload(c tele.Context, f *tele.File) (int64, time.Duration, error) {
+	start := time.Now()
+	r, err := apiOf(c).File(f)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	n, err := streamCopy(io.Discard, ctxReader{rootContext(), r})
+	return n, time.Since(start), err
+}
+
+// measureDisk writes size bytes to a temporary file in dir, synced so the
+// time includes getting them to the disk.
+func measureDisk(dir string, size int64) (int64, time.Duration, error) {
+	f, err := os.CreateTemp(dir, ".speedtest-*.tmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	buf := copyBuffers.Get().(*[]byte)
+	defer copyBuffers.Put(buf)
+	rand.Read(*buf)
+	start := time.Now()
+	var n int64
+	for n < size {
+		w, err := f.Write(*buf)
+		n += int64(w)
+		if err != nil {
+			return n, time.Since(start), err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		return n, time.Since(start), err
+	}
+	return n, time.Since(start), f.Close()
+}
+
+func speed(n int64, d time.Duration) string {
+	if d <= 0 {
+		return "n/a"
+	}
+	return units.Format(int64(float64(n)/d.Seconds())) + "/s"
+}
@@ -0,0 +1,54 @@
+package downloader
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/clisboa/telegram-files-downloader/internal/stats"
+)
+
+// counters are the download counts of the Engine, see internal/stats. The
+// totals, per chat and per file type, count since the last /statsreset.
+var counters *stats.Counters
+
+// statsSnapshot is a consistent copy of the counters, with the jobs waiting
+// and transferring.
+type statsSnapshot struct {
+	stats.Snapshot
+	Queued int64 `json:"queued"` // waiting for a pause to end or a transfer slot
+	Active int64 `json:"active"` // transferring
+}
+
+func snapshotStats() statsSnapshot {
+	return statsSnapshot{Snapshot: counters.Snapshot(), Queued: jobsInState(stateQueued),
+		Active: jobsInState(stateDownloading)}
+}
+
+func pendingDownloads() int64 {
+	return counters.Pending()
+}
+
+// tallyReport lists the tallies by key, e.g. per chat in /stats.
+func tallyReport[K comparable](m map[K]stats.Tally, less func(a, b K) bool) string {
+	keys := make([]K, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return less(keys[i], keys[j]) })
+	s := ""
+	for _, k := range keys {
+		s += fmt.Sprintf("\n%v: %s", k, m[k])
+	}
+	return s
+}
+
+// fileType is the kind of media of the message of j, as in
+// TELEGRAM_CHANNEL_<NAME>_TYPES.
+func (j *job) fileType() string {
+	if m := j.c.Message(); m != nil {
+		if kind, _, _ := channelMedia(m); kind != "" {
+			return kind
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/fakebot"
+	"github.com/clisboa/telegram-files-downloader/internal/stats"
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// /statsreset clears the totals once confirmed and archives them. The rolling
+// windows aren't reset.
+func TestHandleStatsReset(t *testing.T) {
+	tests := []struct {
+		name   string
+		button tele.Btn
+		want   stats.Tally
+	}{
+		{name: "confirmed", button: btnConfirm, want: stats.Tally{}},
+		{name: "cancelled", button: btnCancel, want: stats.Tally{Done: 1, Failed: 1, Bytes: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters.Reset()
+			counters.Record(testChat, "document", stats.Done, 3, time.Now())
+			counters.Record(testChat, "photo", stats.Failed, 0, time.Now())
+			lastHour := snapshotStats().LastHour
+
+			b := fakebot.New()
+			msg := newMessage()
+			msg.Text = "/statsreset"
+			done := make(chan error, 1)
+			go func() { done <- handleStatsReset(b.Context(tele.Update{Message: msg})) }()
+			handler := handleCancel
+			if tt.button == btnConfirm {
+				handler = handleConfirm
+			}
+			answer(t, b, "Reset all download counters?", tt.button, handler)
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+
+			s := snapshotStats()
+			if s.Total != tt.want {
+				t.Errorf("total %+v, want %+v", s.Total, tt.want)
+			}
+			if got := s.ByChat[testChat]; got != tt.want {
+				t.Errorf("chat tally %+v, want %+v", got, tt.want)
+			}
+			if s.LastHour != lastHour {
+				t.Errorf("last hour %+v, want %+v", s.LastHour, lastHour)
+			}
+			if tt.button == btnConfirm {
+				waitEvent(t, b, "reply", "Stats reset")
+				var archived statsWindow
+				err := storage.Last(statsHistoryBucket, 1, func(_ string, data []byte) error {
+					return json.Unmarshal(data, &archived)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := (stats.Tally{Done: 1, Failed: 1, Bytes: 3}); archived.Total != want {
+					t.Errorf("archived total %+v, want %+v", archived.Total, want)
+				}
+			}
+		})
+	}
+}
+
+// Every finished download is counted once, by its outcome.
+func TestDownloadCounted(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		fail    bool
+		unsized bool // Telegram didn't tell the size of the file
+		want    stats.Tally
+	}{
+		{name: "done", data: "counted", want: stats.Tally{Done: 1, Bytes: 7}},
+		{name: "unsized", data: "unsized", unsized: true, want: stats.Tally{Done: 1, Bytes: 7}},
+		{name: "failed", data: "counted", fail: true, want: stats.Tally{Failed: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counters.Reset()
+			b := fakebot.New()
+			f := b.AddFile([]byte(tt.data))
+			if tt.fail {
+				b.FailFile(f.FileID, errors.New("connection reset"))
+			}
+			if tt.unsized {
+				f.FileSize = 0
+			}
+			name := "counted-" + tt.name + ".bin"
+			msg := newMessage()
+			msg.Document = &tele.Document{File: *f, FileName: name}
+			wait := finished(t, name)
+			if err := handleOnDocument(b.Context(tele.Update{Message: msg})); err != nil {
+				t.Fatal(err)
+			}
+			wait()
+			if got := counters.Total(); got != tt.want {
+				t.Errorf("total %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package downloader
+
+import (
+	"sync"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// statusMessage is the single reply of a download job, edited as the job
+// progresses instead of sending a new message for every step.
+type statusMessage struct {
+	c tele.Context
+
+	mu     sync.Mutex
+	msg    *tele.Message
+	shown  bool
+	silent bool
+	hidden bool // part of a batch, which reports instead
+	last   string
+	markup *tele.ReplyMarkup
+}
+
+// newStatusMessage sends the message right away only at the verbose
+// notification level without reactions; otherwise it stays hidden until Show.
+// A hidden message is never sent.
+func newStatusMessage(c tele.Context, text string, markup *tele.ReplyMarkup, hidden bool) *statusMessage {
+	s := &statusMessage{c: c, last: text, markup: markup, hidden: hidden}
+	s.showNew()
+	return s
+}
+
+// showNew sends a new message the way newStatusMessage does, for messages
+// made without sending, e.g. while holding a lock.
+func (s *statusMessage) showNew() {
+	if cfg().Notify >= notifyVerbose && !cfg().Reactions {
+		s.Show(kindStatus)
+	}
+}
+
+// Show sends the message with its current text if it isn't visible yet. A
+// message that was sent silently is sent again when kind may notify, since
+// edits never do.
+func (s *statusMessage) Show(kind messageKind) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silent := cfg().Silent.silent(s.c.Chat().ID, kind)
+	if s.hidden || s.shown && (!s.silent || silent) {
+		return
+	}
+	if s.msg != nil {
+		apiOf(s.c).Delete(s.msg)
+	}
+	s.shown = true
+	s.silent = silent
+	s.send()
+}
+
+func (s *statusMessage) send() {
+	opts := &tele.SendOptions{
+		ReplyTo:             s.c.Message(),
+		ReplyMarkup:         s.markup,
+		ParseMode:           tele.ModeHTML,
+		DisableNotification: s.silent,
+	}
+	msg, err := apiOf(s.c).Send(s.c.Chat(), s.last, opts)
+	if err != nil {
+		errorf("Status message: %s", err.Error())
+	}
+	s.msg = msg
+}
+
+// Update edits the message; unchanged text is skipped because Telegram
+// rejects edits that don't modify the message.
+func (s *statusMessage) Update(text string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if text == s.last {
+		return
+	}
+	s.last = text
+	if !s.shown {
+		return
+	}
+	if s.msg == nil {
+		s.send()
+		return
+	}
+	if _, err := apiOf(s.c).Edit(s.msg, text, s.markup, tele.ModeHTML); err != nil {
+		errorf("Status message: %s", err.Error())
+	}
+}
+
+// Hide deletes the message if it was sent and keeps it from being sent again.
+func (s *statusMessage) Hide() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.msg != nil {
+		apiOf(s.c).Delete(s.msg)
+	}
+	s.hidden = true
+	s.shown = false
+	s.msg = nil
+}
+
+// SetButtons replaces the inline keyboard, applied with the next Update.
+func (s *statusMessage) SetButtons(markup *tele.ReplyMarkup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.markup = markup
+	s.last = ""
+}
@@ -0,0 +1,53 @@
+package downloader
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state string to systemd when running under Type=notify.
+// It is a no-op when NOTIFY_SOCKET is not set.
+func sdNotify(state string) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return
+	}
+	conn, err := net.DialUnix("unixgram", nil,
+		&net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		errorf("sd_notify: %s", err.Error())
+		return
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		errorf("sd_notify: %s", err.Error())
+	}
+}
+
+func sdNotifyStatus() {
+	sdNotify(fmt.Sprintf("STATUS=Pending downloads: %d",
+		pendingDownloads()))
+}
+
+// startWatchdog sends WATCHDOG=1 keepalives at half the interval requested
+// by systemd through WATCHDOG_USEC.
+func startWatchdog() {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return
+	}
+	interval := time.Duration(usec) * time.Microsecond / 2
+	log.Printf("systemd watchdog enabled, interval: %s", interval)
+	go func() {
+		for sleepContext(rootContext(), interval) {
+			sdNotify("WATCHDOG=1")
+		}
+	}()
+}
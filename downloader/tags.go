@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+	tele "gopkg.in/telebot.v4"
+)
+
+// taggedMax is how many downloads /tagged lists, the last ones.
+const taggedMax = 20
+
+// tags are the hashtags of a download, from the caption for the history
+// entries written before they were recorded.
+func (e historyEntry) tags() []string {
+	if e.Tags != nil {
+		return e.Tags
+	}
+	return hashtags(e.Caption)
+}
+
+func handleTagged(c tele.Context) error {
+	args := c.Args()
+	if len(args) != 1 {
+		return c.Reply(tr("Usage: /tagged <tag>"))
+	}
+	tag := strings.ToLower(strings.TrimPrefix(args[0], "#"))
+	// Only admins see the downloads of other chats.
+	allChats := cfg().Roles.permissionsOf(c.Sender())&permAdmin == permAdmin
+
+	var lines []string
+	err := storage.ForEach(historyBucket, func(key string, data []byte) error {
+		var e historyEntry
+		if err := json.Unmarshal(data, &e); err != nil {
+			return err
+		}
+		if slices.Contains(e.tags(), tag) && (allChats || e.ChatID == c.Chat().ID) {
+			id, _ := strconv.ParseUint(key, 10, 64)
+			lines = append(lines, fmt.Sprintf("%d %s %s (%s, job %s)\n", id, inZone(e.Time).Format(time.RFC3339), e.Path,
+				units.Format(e.Size), e.JobID))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return c.Reply(tr("No downloads tagged #%s", tag))
+	}
+	title := tr("Downloads tagged #%s:", tag)
+	if len(lines) > taggedMax {
+		title = tr("Last %d of %d downloads tagged #%s:", taggedMax, len(lines), tag)
+		lines = lines[len(lines)-taggedMax:]
+	}
+	return replyPre(c, title, strings.Join(lines, ""))
+}
@@ -0,0 +1,125 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+// TELEGRAM_WRITE_LIMITS caps the write throughput per folder, e.g.
+// /mnt/hdd=40MB for 40 MB/s to everything under /mnt/hdd. A file is limited
+// by the deepest folder that contains it, and all the writes under a folder
+// share its limit.
+func parseWriteLimits(s string) (map[string]int64, error) {
+	m := map[string]int64{}
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		dir, limit, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(dir) == "" {
+			return nil, fmt.Errorf("expected <folder>=<size per second>, got %q", item)
+		}
+		n, err := units.Parse(strings.TrimSuffix(strings.TrimSpace(limit), "/s"))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		if n <= 0 {
+			return nil, fmt.Errorf("%q: the limit must be positive", item)
+		}
+		abs, err := filepath.Abs(strings.TrimSpace(dir))
+		if err != nil {
+			return nil, err
+		}
+		m[abs] = n
+	}
+	return m, nil
+}
+
+// writeLimiter spaces the writes out so they don't go beyond rate bytes/s:
+// every write waits until the bytes written before it and its own would
+// have been written at rate.
+type writeLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // when the bytes reserved so far are written at rate
+}
+
+func (l *writeLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	if d > 0 && !sleepContext(ctx, d) {
+		return ctx.Err()
+	}
+	return nil
+}
+
+var writeLimiters = struct {
+	sync.Mutex
+	m map[string]*writeLimiter
+}{m: map[string]*writeLimiter{}}
+
+// writeLimiterFor is the limiter of the folder that limits path, nil if
+// none does.
+func writeLimiterFor(path string) *writeLimiter {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	dir := ""
+	for d := range cfg().WriteLimits {
+		if rel, err := filepath.Rel(d, path); err == nil && filepath.IsLocal(rel) && len(d) > len(dir) {
+			dir = d
+		}
+	}
+	if dir == "" {
+		return nil
+	}
+	rate := cfg().WriteLimits[dir]
+	writeLimiters.Lock()
+	defer writeLimiters.Unlock()
+	l := writeLimiters.m[dir]
+	if l == nil {
+		l = &writeLimiter{}
+		writeLimiters.m[dir] = l
+	}
+	l.mu.Lock()
+	l.rate = rate
+	l.mu.Unlock()
+	return l
+}
+
+type throttledWriter struct {
+	ctx context.Context
+	w   io.Writer
+	l   *writeLimiter
+}
+
+func (t throttledWriter) Write(b []byte) (int, error) {
+	if err := t.l.wait(t.ctx, len(b)); err != nil {
+		return 0, err
+	}
+	return t.w.Write(b)
+}
+
+// throttled limits the writes to w, a file at path, with the limit of its
+// folder.
+func throttled(ctx context.Context, path string, w io.Writer) io.Writer {
+	if l := writeLimiterFor(path); l != nil {
+		return throttledWriter{ctx, w, l}
+	}
+	return w
+}
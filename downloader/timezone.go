@@ -0,0 +1,23 @@
+package downloader
+
+import (
+	"time"
+	_ "time/tzdata" // for TELEGRAM_TIMEZONE where the system has no zone database
+)
+
+// Dates in folder names, the times of day of /schedule and the daily summary,
+// and the times in replies are in TELEGRAM_TIMEZONE, not in whatever zone the
+// container has. The state file and the APIs keep their own times as they are.
+
+// inZone returns t in the configured time zone.
+func inZone(t time.Time) time.Time {
+	if loc := cfg().Timezone; loc != nil {
+		return t.In(loc)
+	}
+	return t.Local()
+}
+
+// localNow is the current time in the configured time zone.
+func localNow() time.Time {
+	return inZone(time.Now())
+}
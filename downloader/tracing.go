@@ -0,0 +1,56 @@
+package downloader
+
+import (
+	"context"
+	"log"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const serviceName = "telegram-files-downloader"
+
+var tracer = otel.Tracer(serviceName)
+
+// initTracing installs an OTLP/HTTP span exporter when an OTLP endpoint is
+// configured through the standard OTEL_EXPORTER_OTLP_* env vars, which the
+// exporter reads, like OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES for the
+// resource. Without one the global no-op tracer stays in place.
+func initTracing() func(context.Context) error {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		return func(context.Context) error { return nil }
+	}
+
+	ctx := context.Background()
+	exp, err := otlptracehttp.New(ctx)
+	if err != nil {
+		errorf("Tracing disabled: %s", err.Error())
+		return func(context.Context) error { return nil }
+	}
+	// The environment overrides the default service name.
+	res, err := resource.New(ctx, resource.WithTelemetrySDK(),
+		resource.WithAttributes(attribute.String("service.name", serviceName)), resource.WithFromEnv())
+	if err != nil {
+		errorf("Tracing resource: %s", err.Error())
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp), sdktrace.WithResource(res))
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer(serviceName)
+	log.Println("Tracing enabled, exporting to:", endpoint)
+	return tp.Shutdown
+}
+
+func spanError(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
@@ -0,0 +1,200 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/clisboa/telegram-files-downloader/internal/storage"
+	tele "gopkg.in/telebot.v4"
+)
+
+// /mirror downloads a URL like a file sent to the bot, with the same checks,
+// status message, history and retries. The file's FileURL is the URL and its
+// UniqueID "url:" and the URL, for the duplicate check. A URL keeps its
+// partial download between attempts and resumes it with a range request when
+// the server allows. The expected SHA-256, if given, is kept in the state file
+// by URL so the retries check it too. URLs go through the client of the
+// Telegram downloads, with its timeouts.
+const urlsBucket = "urls"
+
+type urlEntry struct {
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+func urlKey(u string) string {
+	sum := sha256.Sum256([]byte(u))
+	return "url" + hex.EncodeToString(sum[:6])
+}
+
+// urlChecksum is the SHA-256 the file of a URL must have, if any.
+func urlChecksum(f *tele.File) string {
+	if f.FileURL == "" {
+		return ""
+	}
+	var e urlEntry
+	if _, err := storage.Get(urlsBucket, f.FileURL, &e); err != nil {
+		errorf("Mirror: %s", err.Error())
+	}
+	return e.SHA256
+}
+
+// openURL requests u from what's already at path, if anything, and returns
+// the body and its offset in the file: 0 when the server sends it all.
+func openURL(ctx context.Context, u, path string) (io.ReadCloser, int64, error) {
+	var offset int64
+	if fi, err := os.Stat(path); err == nil {
+		offset = fi.Size()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := telegramClient().Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		if start, ok := contentRangeStart(resp.Header.Get("Content-Range")); !ok || start != offset {
+			// Appending another range would corrupt the file, so it
+			// starts over.
+			log.Printf("Mirror: %s sent the range %q for %d bytes, starting over", u,
+				resp.Header.Get("Content-Range"), offset)
+			resp.Body.Close()
+			if err := os.Remove(path); err != nil {
+				return nil, 0, err
+			}
+			return openURL(ctx, u, path)
+		}
+		log.Printf("Mirror: resuming %s at %d bytes", u, offset)
+		return resp.Body, offset, nil
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial download doesn't match the file anymore.
+		resp.Body.Close()
+		if err := os.Remove(path); err != nil {
+			return nil, 0, err
+		}
+		return openURL(ctx, u, path)
+	case resp.StatusCode == http.StatusOK:
+		return resp.Body, 0, nil
+	}
+	resp.Body.Close()
+	return nil, 0, fmt.Errorf("GET %s: %s", u, resp.Status)
+}
+
+// resumeTo appends r to path, after feeding the bytes already there to hash
+// so it covers the whole file. They count as written by progress but not as
+// transferred, they were before.
+func resumeTo(ctx context.Context, r io.Reader, path string, progress *progressWriter, hash io.Writer) error {
+	out, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	n, err := streamCopy(hash, ctxReader{ctx, out})
+	if err != nil {
+		return err
+	}
+	progress.resumeAt(n)
+	if _, err := streamCopy(throttled(ctx, path, out), io.TeeReader(ctxReader{ctx, r},
+		io.MultiWriter(progress, hash))); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// contentRangeStart is the first byte of a Content-Range such as
+// "bytes 100-199/200".
+func contentRangeStart(h string) (int64, bool) {
+	rest, ok := strings.CutPrefix(h, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	first, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(first, 10, 64)
+	return n, err == nil
+}
+
+// urlFile asks the server about u for the name and size of the file, both
+// best effort: the download itself finds out whether the URL works.
+func urlFile(ctx context.Context, u *url.URL) (*tele.File, string) {
+	f := &tele.File{FileURL: u.String(), UniqueID: "url:" + u.String()}
+	name := path.Base(u.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = telegramClient().Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK && resp.ContentLength > 0 {
+				f.FileSize = resp.ContentLength
+			}
+			if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil &&
+				params["filename"] != "" {
+				name = params["filename"]
+			}
+		}
+	}
+	if name == "" || name == "." || name == "/" {
+		name = u.Hostname()
+	}
+	if s, err := url.PathUnescape(name); err == nil {
+		name = s
+	}
+	return f, safeFilename(name)
+}
+
+func handleMirror(c tele.Context) error {
+	args := c.Args()
+	var sum string
+	if n := len(args); n > 1 && strings.HasPrefix(strings.ToLower(args[n-1]), "sha256:") {
+		sum = strings.ToLower(args[n-1])[len("sha256:"):]
+		args = args[:n-1]
+	}
+	if len(args) < 1 || len(args) > 2 {
+		return c.Reply(tr("Usage: /mirror <url> [folder] [sha256:<checksum>]"))
+	}
+	u, err := url.Parse(args[0])
+	if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+		err = errors.New("only http and https URLs are supported")
+	}
+	if err == nil && sum != "" && (len(sum) != 64 || strings.Trim(sum, "0123456789abcdef") != "") {
+		err = errors.New("the SHA-256 must be 64 hex digits")
+	}
+	if err != nil {
+		return c.Reply(tr("Can't mirror that: %s", err.Error()))
+	}
+
+	f, name := urlFile(handlerContext(c), u)
+	if len(args) == 2 {
+		name = filepath.Join(safePath(args[1]), name)
+	}
+	if sum == "" {
+		err = storage.Delete(urlsBucket, f.FileURL)
+	} else {
+		err = storage.Put(urlsBucket, f.FileURL, urlEntry{SHA256: sum})
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("Mirror %s by %s", u, senderName(c.Sender()))
+	return enqueueFile(c, f, name)
+}
@@ -0,0 +1,86 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// A URL resumes its partial download when the server honours the range, and
+// starts over when it doesn't. Either way the file and its hash are whole and
+// only the bytes sent count as transferred.
+func TestDownloadURLResume(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	const partial = 4000
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		wantSent int64
+	}{
+		{name: "range", wantSent: int64(len(content) - partial),
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+			}},
+		{name: "range ignored", wantSent: int64(len(content)),
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				w.Write(content)
+			}},
+		{name: "wrong range", wantSent: int64(len(content)),
+			handler: func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Range") == "" {
+					w.Write(content)
+					return
+				}
+				w.Header().Set("Content-Range", "bytes 0-99/10000")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write(content[:100])
+			}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.handler)
+			defer srv.Close()
+			path := filepath.Join(t.TempDir(), "file.bin.tmp")
+			if err := os.WriteFile(path, content[:partial], 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			progress := newProgressWriter("file.bin", int64(len(content)))
+			defer progress.Close()
+			hash := sha256.New()
+			before := atomic.LoadInt64(&bytesTransferred)
+			f := &tele.File{FileURL: srv.URL + "/file.bin", UniqueID: "url:" + srv.URL + "/file.bin"}
+			if err := downloadTo(t.Context(), nil, f, path, progress, hash); err != nil {
+				t.Fatal(err)
+			}
+			sent := atomic.LoadInt64(&bytesTransferred) - before
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, content) {
+				t.Errorf("file of %d bytes, want the %d bytes sent: %q...", len(data), len(content),
+					strings.TrimSpace(string(data[:20])))
+			}
+			if sum := sha256.Sum256(content); !bytes.Equal(hash.Sum(nil), sum[:]) {
+				t.Errorf("hash %x, want %x", hash.Sum(nil), sum)
+			}
+			if got := progress.Written(); got != int64(len(content)) {
+				t.Errorf("written %d, want %d", got, len(content))
+			}
+			if sent != tt.wantSent {
+				t.Errorf("transferred %d, want %d", sent, tt.wantSent)
+			}
+		})
+	}
+}
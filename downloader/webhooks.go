@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const webhookAttempts = 5
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+type webhookPayload struct {
+	Event    string     `json:"event"` // done or failed
+	Time     time.Time  `json:"time"`
+	Instance string     `json:"instance"`
+	JobID    string     `json:"job_id"`
+	File     string     `json:"file"`
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	ChatID   int64      `json:"chat_id"`
+	Sender   string     `json:"sender"`
+	Result   string     `json:"result"`
+	SHA256   string     `json:"sha256,omitempty"`
+	Outcome  jobOutcome `json:"outcome"`
+}
+
+// startWebhooks posts finished and failed downloads to TELEGRAM_WEBHOOKS.
+// The URLs can change on reload, so the subscription always runs.
+func startWebhooks() {
+	events, _ := subscribeEvents(rootContext())
+	go func() {
+		for e := range events {
+			if e.Type != eventDone && e.Type != eventFailed {
+				continue
+			}
+			urls := cfg().Webhooks
+			if len(urls) == 0 {
+				continue
+			}
+			body, err := json.Marshal(webhookPayload{
+				Event: string(e.Type), Time: e.Time, Instance: cfg().InstanceName,
+				JobID: e.Job.ID, File: e.Job.Name, Path: e.Job.Path, Size: e.Job.Size,
+				ChatID: e.Job.ChatID, Sender: e.Job.Sender, Result: e.Job.Result,
+				SHA256: e.Job.SHA256, Outcome: e.Job.Outcome,
+			})
+			if err != nil {
+				errorf("Webhook: %s", err.Error())
+				continue
+			}
+			for _, url := range urls {
+				go postWebhook(url, body)
+			}
+		}
+	}()
+}
+
+// postWebhook delivers body with exponential backoff. With
+// TELEGRAM_WEBHOOK_SECRET the X-Signature-256 header carries
+// "sha256=<hex HMAC of the body>".
+func postWebhook(url string, body []byte) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		err := postWebhookOnce(url, body)
+		if err == nil {
+			return
+		}
+		if attempt == webhookAttempts {
+			errorf("Webhook %s failed, giving up: %s", url, err.Error())
+			return
+		}
+		warnf("Webhook %s failed (attempt %d), retrying in %s: %s", url, attempt, delay, err.Error())
+		if !sleepContext(rootContext(), delay) {
+			return
+		}
+		delay *= 2
+	}
+}
+
+func postWebhookOnce(url string, body []byte) error {
+	req, err := http.NewRequestWithContext(rootContext(), http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := cfg().WebhookSecret; secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		req.Header.Set("X-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+// Package grpcapi is the client of the gRPC API of the downloader, the
+// telegramfilesdownloader.Downloader service that package downloader serves
+// on TELEGRAM_GRPC_ADDR: its messages, its JSON codec and a Client.
+//
+// The service is described by hand rather than in a .proto file, so neither
+// protoc nor generated code is needed. The messages have the same JSON as the
+// HTTP API and are sent with the codec named "json", which importing this
+// package registers; the Client selects it on every call.
+//
+// When the server has TELEGRAM_API_TOKEN, calls need it as metadata:
+//
+//	ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+package grpcapi
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/encoding"
+)
+
+// ServiceName is the full name of the service.
+const ServiceName = "telegramfilesdownloader.Downloader"
+
+// Codec encodes the messages as JSON.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error)      { return json.Marshal(v) }
+func (Codec) Unmarshal(data []byte, v interface{}) error { return json.Unmarshal(data, v) }
+func (Codec) Name() string                               { return "json" }
+
+func init() {
+	encoding.RegisterCodec(Codec{})
+}
+
+// EnqueueRequest downloads a file by its Telegram file ID.
+type EnqueueRequest struct {
+	Bot    string `json:"bot,omitempty"` // name from TELEGRAM_BOTS, empty for the main bot
+	ChatID int64  `json:"chat_id"`       // chat receiving the status messages
+	FileID string `json:"file_id"`
+	Name   string `json:"name"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// JobRequest names a job by its ID.
+type JobRequest struct {
+	ID string `json:"id"`
+}
+
+// ListJobsRequest asks for the running or the finished jobs.
+type ListJobsRequest struct {
+	Finished bool `json:"finished"`
+}
+
+type ListJobsResponse struct {
+	Jobs []Job `json:"jobs"`
+}
+
+type StreamEventsRequest struct{}
+
+// Job is a download, as in GET /api/jobs/{id} of the HTTP API.
+type Job struct {
+	ID       string     `json:"id"`
+	Name     string     `json:"name"`
+	Path     string     `json:"path"`
+	Size     int64      `json:"size"`
+	Sender   string     `json:"sender"`
+	ChatID   int64      `json:"chat_id"`
+	State    string     `json:"state"`             // queued, downloading, ... or the final done, failed, ...
+	Outcome  string     `json:"outcome,omitempty"` // done, failed, cancelled or skipped
+	Written  int64      `json:"written"`
+	Result   string     `json:"result,omitempty"`
+	Thumb    bool       `json:"thumbnail"`
+	SHA256   string     `json:"sha256,omitempty"`
+	Enqueued time.Time  `json:"enqueued"`
+	StartAt  *time.Time `json:"start_at,omitempty"` // of a scheduled download
+	Finished *time.Time `json:"finished,omitempty"`
+	// When the job entered each of the states it went through.
+	States map[string]time.Time `json:"states"`
+}
+
+// Event is a step of a download: queued, started, progress, done, failed,
+// cancelled or skipped.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Job  Job       `json:"job"`
+}
+
+// Client calls the service over a connection, e.g. one of grpc.NewClient.
+type Client struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewClient(cc grpc.ClientConnInterface) *Client {
+	return &Client{cc: cc}
+}
+
+func (c *Client) invoke(ctx context.Context, method string, req, resp interface{}, opts []grpc.CallOption) error {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(Codec{}.Name())}, opts...)
+	return c.cc.Invoke(ctx, "/"+ServiceName+"/"+method, req, resp, opts...)
+}
+
+// Enqueue starts a download and returns its job.
+func (c *Client) Enqueue(ctx context.Context, req *EnqueueRequest, opts ...grpc.CallOption) (*Job, error) {
+	j := new(Job)
+	if err := c.invoke(ctx, "Enqueue", req, j, opts); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Cancel cancels a running download and returns its job.
+func (c *Client) Cancel(ctx context.Context, id string, opts ...grpc.CallOption) (*Job, error) {
+	j := new(Job)
+	if err := c.invoke(ctx, "Cancel", &JobRequest{ID: id}, j, opts); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// ListJobs returns the running or the finished jobs, oldest first.
+func (c *Client) ListJobs(ctx context.Context, finished bool, opts ...grpc.CallOption) ([]Job, error) {
+	var resp ListJobsResponse
+	if err := c.invoke(ctx, "ListJobs", &ListJobsRequest{Finished: finished}, &resp, opts); err != nil {
+		return nil, err
+	}
+	return resp.Jobs, nil
+}
+
+var streamEventsDesc = grpc.StreamDesc{StreamName: "StreamEvents", ServerStreams: true}
+
+// StreamEvents streams the events of every download until ctx is done.
+func (c *Client) StreamEvents(ctx context.Context, opts ...grpc.CallOption) (*EventStream, error) {
+	opts = append([]grpc.CallOption{grpc.CallContentSubtype(Codec{}.Name())}, opts...)
+	s, err := c.cc.NewStream(ctx, &streamEventsDesc, "/"+ServiceName+"/StreamEvents", opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.SendMsg(&StreamEventsRequest{}); err != nil {
+		return nil, err
+	}
+	if err := s.CloseSend(); err != nil {
+		return nil, err
+	}
+	return &EventStream{s: s}, nil
+}
+
+// EventStream is the stream of StreamEvents.
+type EventStream struct {
+	s grpc.ClientStream
+}
+
+// Recv waits for the next event, io.EOF once the server ends the stream.
+func (s *EventStream) Recv() (*Event, error) {
+	e := new(Event)
+	if err := s.s.RecvMsg(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
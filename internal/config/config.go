@@ -0,0 +1,309 @@
+// Package config is where the values of the settings come from: command line
+// flags, the environment and a .env file, a YAML config file and the changes
+// made at runtime. Settings are named after their environment variable,
+// e.g. TELEGRAM_DEST.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"maps"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix is the start of the names of the settings.
+const Prefix = "TELEGRAM_"
+
+// Setting is a setting that can be passed as a flag or changed at runtime.
+type Setting struct {
+	Name    string // environment variable without the TELEGRAM_ prefix
+	Desc    string
+	Secret  bool   // not settable by flag, it would show up in `ps`
+	Runtime bool   // can be changed with /set
+	Alias   string // another flag name for it, e.g. workers for max-concurrent
+}
+
+func (s Setting) FlagName() string {
+	return strings.ReplaceAll(strings.ToLower(s.Name), "_", "-")
+}
+
+// Sources holds the values from every place a setting can be set, keyed by
+// name. Precedence: runtime > flags > env > file. The environment is captured
+// once because secrets are removed from it.
+type Sources struct {
+	mu      sync.RWMutex
+	runtime map[string]string
+	flags   map[string]string
+	env     map[string]string
+	file    map[string]string
+	// envPrefix replaces TELEGRAM_ in the names of environment variables and
+	// .env entries, e.g. TFD_ to read TFD_DEST instead of TELEGRAM_DEST.
+	envPrefix string
+}
+
+func New() *Sources {
+	return &Sources{runtime: map[string]string{}, flags: map[string]string{}, env: map[string]string{},
+		file: map[string]string{}, envPrefix: Prefix}
+}
+
+// Clone returns a copy of s, e.g. to load a changed config file into and use
+// only once it's valid.
+func (s *Sources) Clone() *Sources {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return &Sources{runtime: maps.Clone(s.runtime), flags: maps.Clone(s.flags), env: maps.Clone(s.env),
+		file: maps.Clone(s.file), envPrefix: s.envPrefix}
+}
+
+// ParseFlags registers a flag for every non-secret setting and parses
+// args, the program name first. Only flags that were actually passed are
+// kept. It returns flag.ErrHelp for -h.
+func (s *Sources) ParseFlags(args []string, settings []Setting) error {
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s [flags]\n\n", args[0])
+		fmt.Fprintln(fs.Output(), "Every flag can also be set with the TELEGRAM_<NAME> environment variable")
+		fmt.Fprintln(fs.Output(), "or <name> in the config file. Precedence: flags > environment > config file.")
+		fmt.Fprintln(fs.Output())
+		fs.PrintDefaults()
+	}
+	values := map[string]*string{}
+	for _, st := range settings {
+		if st.Secret {
+			continue
+		}
+		values[st.Name] = fs.String(st.FlagName(), "",
+			fmt.Sprintf("%s (TELEGRAM_%s)", st.Desc, st.Name))
+		if st.Alias != "" {
+			fs.Var(stringFlag{values[st.Name]}, st.Alias, "the same as -"+st.FlagName())
+		}
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		for _, st := range settings {
+			if st.FlagName() == f.Name || st.Alias != "" && st.Alias == f.Name {
+				s.flags[Prefix+st.Name] = *values[st.Name]
+			}
+		}
+	})
+	return nil
+}
+
+// stringFlag sets the value of another string flag, for aliases.
+type stringFlag struct{ p *string }
+
+func (f stringFlag) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return *f.p
+}
+
+func (f stringFlag) Set(v string) error {
+	*f.p = v
+	return nil
+}
+
+// LoadEnv snapshots the environment, then fills in whatever is missing from
+// the .env file (TELEGRAM_ENV_FILE, default ./.env if it exists).
+func (s *Sources) LoadEnv() error {
+	if p, ok := s.flags[Prefix+"ENV_PREFIX"]; ok {
+		s.envPrefix = p
+	} else if p := os.Getenv(Prefix + "ENV_PREFIX"); p != "" {
+		s.envPrefix = p
+	}
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok && strings.HasPrefix(k, s.envPrefix) && v != "" {
+			s.env[Prefix+strings.TrimPrefix(k, s.envPrefix)] = v
+		}
+	}
+
+	path, explicit := s.flags[Prefix+"ENV_FILE"]
+	if !explicit {
+		path, explicit = s.env[Prefix+"ENV_FILE"]
+	}
+	if !explicit {
+		path = ".env"
+	}
+	dotenv, err := readDotEnv(path)
+	if err != nil {
+		if explicit || !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("Env file can't be read: err=%s", err.Error())
+		}
+		return nil
+	}
+	for k, v := range dotenv {
+		if !strings.HasPrefix(k, s.envPrefix) || v == "" {
+			continue
+		}
+		name := Prefix + strings.TrimPrefix(k, s.envPrefix)
+		if _, ok := s.env[name]; !ok {
+			s.env[name] = v
+		}
+	}
+	log.Println("Env file:", path)
+	return nil
+}
+
+// EnvPrefix is the prefix of the environment variables, TELEGRAM_ unless
+// TELEGRAM_ENV_PREFIX changes it.
+func (s *Sources) EnvPrefix() string {
+	return s.envPrefix
+}
+
+// readDotEnv parses KEY=VALUE lines, ignoring blank lines, comments and an
+// optional "export " in front, and strips matching quotes around values.
+func readDotEnv(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		k, v, ok := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+		if !ok {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, n+1)
+		}
+		v = strings.TrimSpace(v)
+		if len(v) >= 2 && (v[0] == '"' || v[0] == '\'') && v[len(v)-1] == v[0] {
+			v = v[1 : len(v)-1]
+		}
+		values[strings.TrimSpace(k)] = v
+	}
+	return values, nil
+}
+
+// LoadFile reads a flat YAML file whose keys are the environment variable
+// names without the TELEGRAM_ prefix, in lower case, e.g. `dest: /data` or
+// `chatid: [123, -100456]`. Lists are joined with commas. The values replace
+// those of the file read before.
+func (s *Sources) LoadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Config file can't be read: err=%s", err.Error())
+	}
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("Config file %s is invalid: err=%s", path, err.Error())
+	}
+	values := map[string]string{}
+	for k, v := range raw {
+		name := Prefix + strings.ToUpper(k)
+		switch v := v.(type) {
+		case []interface{}:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				items = append(items, fmt.Sprint(item))
+			}
+			values[name] = strings.Join(items, ",")
+		case nil:
+		default:
+			values[name] = fmt.Sprint(v)
+		}
+	}
+	s.mu.Lock()
+	s.file = values
+	s.mu.Unlock()
+	log.Println("Config file:", path)
+	return nil
+}
+
+// FileNames are the settings in the config file.
+func (s *Sources) FileNames() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.file))
+	for name := range s.file {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Get returns the value of the setting from the source that takes
+// precedence.
+func (s *Sources) Get(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if v, ok := s.runtime[name]; ok {
+		return v
+	}
+	if v, ok := s.flags[name]; ok {
+		return v
+	}
+	if v, ok := s.env[name]; ok {
+		return v
+	}
+	return s.file[name]
+}
+
+// Source tells where a setting came from: /set, flag, env, file or default.
+func (s *Sources) Source(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.runtime[name]; ok {
+		return "/set"
+	}
+	if _, ok := s.flags[name]; ok {
+		return "flag"
+	}
+	if _, ok := s.env[name]; ok {
+		return "env"
+	}
+	if _, ok := s.file[name]; ok {
+		return "file"
+	}
+	return "default"
+}
+
+// Runtime returns a copy of the values changed at runtime.
+func (s *Sources) Runtime() map[string]string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	values := make(map[string]string, len(s.runtime))
+	for k, v := range s.runtime {
+		values[k] = v
+	}
+	return values
+}
+
+// SetRuntime replaces the values changed at runtime.
+func (s *Sources) SetRuntime(values map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.runtime = values
+}
+
+// Set changes a setting at runtime, or with an empty value goes back to the
+// configured one. The returned function undoes it.
+func (s *Sources) Set(name, value string) (undo func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	old, hadOld := s.runtime[name]
+	if value == "" {
+		delete(s.runtime, name)
+	} else {
+		s.runtime[name] = value
+	}
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if hadOld {
+			s.runtime[name] = old
+		} else {
+			delete(s.runtime, name)
+		}
+	}
+}
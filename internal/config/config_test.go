@@ -0,0 +1,131 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testSettings = []Setting{
+	{Name: "DEST", Desc: "destination"},
+	{Name: "TOKEN", Desc: "bot token", Secret: true},
+	{Name: "MAX_SIZE", Desc: "largest file", Runtime: true},
+	{Name: "MAX_CONCURRENT", Desc: "parallel transfers", Alias: "workers"},
+}
+
+func write(t *testing.T, name, data string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// Precedence: runtime > flags > env > file.
+func TestSources(t *testing.T) {
+	t.Setenv("TELEGRAM_ENV_FILE", os.DevNull)
+	t.Setenv("TELEGRAM_MAX_SIZE", "2GB")
+	t.Setenv("TELEGRAM_TOKEN", "1:env")
+	s := New()
+	if err := s.ParseFlags([]string{"test", "-dest", "/flag"}, testSettings); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.LoadEnv(); err != nil {
+		t.Fatal(err)
+	}
+	file := write(t, "config.yaml", "dest: /file\nmax_size: 1GB\nchatid: [1, -2]\n")
+	if err := s.LoadFile(file); err != nil {
+		t.Fatal(err)
+	}
+	undo := s.Set("TELEGRAM_MAX_SIZE", "3GB")
+
+	tests := []struct {
+		name, want, source string
+	}{
+		{name: "TELEGRAM_DEST", want: "/flag", source: "flag"},
+		{name: "TELEGRAM_MAX_SIZE", want: "3GB", source: "/set"},
+		{name: "TELEGRAM_TOKEN", want: "1:env", source: "env"},
+		{name: "TELEGRAM_CHATID", want: "1,-2", source: "file"},
+		{name: "TELEGRAM_USERS", want: "", source: "default"},
+	}
+	for _, tt := range tests {
+		if got := s.Get(tt.name); got != tt.want {
+			t.Errorf("Get(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+		if got := s.Source(tt.name); got != tt.source {
+			t.Errorf("Source(%s) = %q, want %q", tt.name, got, tt.source)
+		}
+	}
+
+	undo()
+	if got := s.Get("TELEGRAM_MAX_SIZE"); got != "2GB" {
+		t.Errorf("after undo: %q, want 2GB", got)
+	}
+	if err := s.ParseFlags([]string{"test", "-token", "1:flag"}, testSettings); err == nil {
+		t.Error("secret settings can be passed as flags")
+	}
+}
+
+// An alias sets the same setting as the flag.
+func TestFlagAlias(t *testing.T) {
+	s := New()
+	if err := s.ParseFlags([]string{"test", "-workers", "4"}, testSettings); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Get("TELEGRAM_MAX_CONCURRENT"); got != "4" {
+		t.Errorf("-workers 4 set %q, want 4", got)
+	}
+	if got := s.Source("TELEGRAM_MAX_CONCURRENT"); got != "flag" {
+		t.Errorf("source %q, want flag", got)
+	}
+}
+
+func TestLoadEnv(t *testing.T) {
+	tests := []struct {
+		name   string
+		prefix string
+		dotenv string
+		env    map[string]string
+		want   map[string]string
+	}{
+		{name: "dotenv", dotenv: "# comment\nexport TELEGRAM_DEST=\"/data\"\n\nTELEGRAM_CHATID='1'\nOTHER=x\n",
+			want: map[string]string{"TELEGRAM_DEST": "/data", "TELEGRAM_CHATID": "1", "TELEGRAM_OTHER": ""}},
+		{name: "environment first", dotenv: "TELEGRAM_DEST=/dotenv\n", env: map[string]string{"TELEGRAM_DEST": "/env"},
+			want: map[string]string{"TELEGRAM_DEST": "/env"}},
+		{name: "prefix", prefix: "TFD_", dotenv: "TFD_DEST=/tfd\nTELEGRAM_CHATID=1\n",
+			env:  map[string]string{"TFD_CHATID": "2"},
+			want: map[string]string{"TELEGRAM_DEST": "/tfd", "TELEGRAM_CHATID": "2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TELEGRAM_ENV_FILE", write(t, ".env", tt.dotenv))
+			if tt.prefix != "" {
+				t.Setenv("TELEGRAM_ENV_PREFIX", tt.prefix)
+				t.Setenv(tt.prefix+"ENV_FILE", os.Getenv("TELEGRAM_ENV_FILE"))
+			}
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			s := New()
+			if err := s.LoadEnv(); err != nil {
+				t.Fatal(err)
+			}
+			for name, want := range tt.want {
+				if got := s.Get(name); got != want {
+					t.Errorf("Get(%s) = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadEnvInvalid(t *testing.T) {
+	t.Setenv("TELEGRAM_ENV_FILE", write(t, ".env", "TELEGRAM_DEST\n"))
+	if err := New().LoadEnv(); err == nil {
+		t.Error("a line without = was accepted")
+	}
+	t.Setenv("TELEGRAM_ENV_FILE", filepath.Join(t.TempDir(), "missing"))
+	if err := New().LoadEnv(); err == nil {
+		t.Error("a missing TELEGRAM_ENV_FILE was accepted")
+	}
+}
@@ -0,0 +1,147 @@
+// Package fakebot is an in-memory stand-in for the Telegram Bot API. It
+// records the messages sent, replied, edited and deleted and the callback
+// answers, and serves files from memory, so handlers can run without Telegram through
+// tele.NewContext(bot, update). Bot API methods beyond those panic.
+package fakebot
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tele "gopkg.in/telebot.v4"
+)
+
+// Event is a message the bot sent, edited or deleted, or a callback it
+// answered.
+type Event struct {
+	Action  string // send, reply, edit, delete or respond
+	ChatID  int64
+	ID      int
+	Text    string
+	Buttons []tele.InlineButton // of the inline keyboard sent with the message
+}
+
+// Bot implements the message and file methods of tele.API.
+type Bot struct {
+	tele.API // nil, so the methods that aren't faked panic
+
+	mu     sync.Mutex
+	next   int
+	files  map[string][]byte
+	errs   map[string]error
+	events []Event
+}
+
+func New() *Bot {
+	return &Bot{files: map[string][]byte{}, errs: map[string]error{}}
+}
+
+// Context returns the handler context of an update received by b.
+func (b *Bot) Context(u tele.Update) tele.Context {
+	return tele.NewContext(b, u)
+}
+
+// Unique file IDs are the same for every bot, as in Telegram.
+var lastFile atomic.Int64
+
+// AddFile makes data downloadable and returns its file.
+func (b *Bot) AddFile(data []byte) *tele.File {
+	n := strconv.FormatInt(lastFile.Add(1), 10)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.files["file"+n] = data
+	return &tele.File{FileID: "file" + n, UniqueID: "unique" + n, FileSize: int64(len(data))}
+}
+
+// FailFile makes downloading the file with the given ID fail with err.
+func (b *Bot) FailFile(id string, err error) {
+	b.mu.Lock()
+	b.errs[id] = err
+	b.mu.Unlock()
+}
+
+// Events returns what the bot did so far, oldest first.
+func (b *Bot) Events() []Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]Event(nil), b.events...)
+}
+
+func (b *Bot) record(action string, chatID int64, id int, what interface{}, opts []interface{}) *tele.Message {
+	text, ok := what.(string)
+	if !ok && what != nil {
+		text = fmt.Sprintf("%T", what)
+	}
+	var buttons []tele.InlineButton
+	for _, opt := range opts {
+		if markup, ok := opt.(*tele.ReplyMarkup); ok && markup != nil {
+			for _, row := range markup.InlineKeyboard {
+				buttons = append(buttons, row...)
+			}
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if id == 0 {
+		b.next++
+		id = b.next
+	}
+	b.events = append(b.events, Event{Action: action, ChatID: chatID, ID: id, Text: text, Buttons: buttons})
+	return &tele.Message{ID: id, Chat: &tele.Chat{ID: chatID}, Text: text, Unixtime: time.Now().Unix()}
+}
+
+func (b *Bot) Send(to tele.Recipient, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	chatID, err := strconv.ParseInt(to.Recipient(), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("fakebot: recipient %q is not a chat ID", to.Recipient())
+	}
+	return b.record("send", chatID, 0, what, opts), nil
+}
+
+func (b *Bot) Reply(to *tele.Message, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	return b.record("reply", to.Chat.ID, 0, what, opts), nil
+}
+
+func (b *Bot) Edit(msg tele.Editable, what interface{}, opts ...interface{}) (*tele.Message, error) {
+	id, chatID := msg.MessageSig()
+	n, _ := strconv.Atoi(id)
+	return b.record("edit", chatID, n, what, opts), nil
+}
+
+func (b *Bot) Delete(msg tele.Editable) error {
+	id, chatID := msg.MessageSig()
+	n, _ := strconv.Atoi(id)
+	b.record("delete", chatID, n, nil, nil)
+	return nil
+}
+
+func (b *Bot) Respond(c *tele.Callback, resp ...*tele.CallbackResponse) error {
+	var chatID int64
+	if c.Message != nil {
+		chatID = c.Message.Chat.ID
+	}
+	var text string
+	if len(resp) > 0 {
+		text = resp[0].Text
+	}
+	b.record("respond", chatID, 0, text, nil)
+	return nil
+}
+
+func (b *Bot) File(file *tele.File) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.errs[file.FileID]; err != nil {
+		return nil, err
+	}
+	data, ok := b.files[file.FileID]
+	if !ok {
+		return nil, tele.ErrWrongFileID
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
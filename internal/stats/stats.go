@@ -0,0 +1,199 @@
+// Package stats counts the finished downloads: the totals, per chat and per
+// file type since the last reset, and rolling windows of the last hour and
+// day.
+package stats
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/clisboa/telegram-files-downloader/internal/units"
+)
+
+// Outcome is how a download ended.
+type Outcome string
+
+const (
+	Done      Outcome = "done"
+	Failed    Outcome = "failed"
+	Cancelled Outcome = "cancelled"
+	Skipped   Outcome = "skipped"
+)
+
+// Tally counts finished downloads by outcome.
+type Tally struct {
+	Done      uint64 `json:"done"`
+	Failed    uint64 `json:"failed"`
+	Cancelled uint64 `json:"cancelled"`
+	Skipped   uint64 `json:"skipped"`
+	Bytes     uint64 `json:"bytes"` // of the done ones
+}
+
+func (t *Tally) add(o Outcome, bytes int64) {
+	switch o {
+	case Done:
+		t.Done++
+		t.Bytes += uint64(max(bytes, 0))
+	case Failed:
+		t.Failed++
+	case Cancelled:
+		t.Cancelled++
+	case Skipped:
+		t.Skipped++
+	}
+}
+
+func (t *Tally) merge(o Tally) {
+	t.Done += o.Done
+	t.Failed += o.Failed
+	t.Cancelled += o.Cancelled
+	t.Skipped += o.Skipped
+	t.Bytes += o.Bytes
+}
+
+// String is done/attempted and the size, as in /stats.
+func (t Tally) String() string {
+	return fmt.Sprintf("%d/%d, %s", t.Done, t.Done+t.Failed, units.Format(int64(t.Bytes)))
+}
+
+// The last hour and day are rolling windows of one-minute buckets and aren't
+// reset.
+const minutes = 24 * 60
+
+// Counters are the counts of one process, from New.
+type Counters struct {
+	started time.Time
+	pending atomic.Int64 // enqueued or in progress
+
+	mu      sync.Mutex
+	chats   map[int64]int64 // pending by chat
+	reset   time.Time
+	total   Tally
+	byChat  map[int64]*Tally
+	byType  map[string]*Tally
+	minutes [minutes]struct {
+		minute int64 // since the epoch, to tell stale buckets
+		Tally
+	}
+	last map[Outcome]time.Time
+}
+
+// Snapshot is a consistent copy of the counters.
+type Snapshot struct {
+	Started  time.Time             `json:"started"`
+	Reset    time.Time             `json:"reset"`
+	Pending  int64                 `json:"pending"`
+	Total    Tally                 `json:"total"`
+	LastHour Tally                 `json:"last_hour"`
+	LastDay  Tally                 `json:"last_day"`
+	ByChat   map[int64]Tally       `json:"by_chat"`
+	ByType   map[string]Tally      `json:"by_type"`
+	Last     map[Outcome]time.Time `json:"last"` // the last download of each outcome
+}
+
+// New starts counting.
+func New() *Counters {
+	now := time.Now()
+	return &Counters{started: now, reset: now, chats: map[int64]int64{}, byChat: map[int64]*Tally{},
+		byType: map[string]*Tally{}, last: map[Outcome]time.Time{}}
+}
+
+// AddPending counts a download of a chat in (1) or out (-1) and returns the
+// chat's pending downloads. Only one of the downloads finishing together
+// sees the count drop to 0.
+func (s *Counters) AddPending(chatID int64, delta int64) int64 {
+	s.pending.Add(delta)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.chats[chatID] + delta
+	if n <= 0 {
+		delete(s.chats, chatID)
+	} else {
+		s.chats[chatID] = n
+	}
+	return n
+}
+
+// Pending is the number of downloads enqueued or in progress.
+func (s *Counters) Pending() int64 {
+	return s.pending.Load()
+}
+
+// Record counts a finished download of bytes with outcome o.
+func (s *Counters) Record(chatID int64, fileType string, o Outcome, bytes int64, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.total.add(o, bytes)
+	entry(s.byChat, chatID).add(o, bytes)
+	entry(s.byType, fileType).add(o, bytes)
+	minute := at.Unix() / 60
+	b := &s.minutes[minute%minutes]
+	if b.minute != minute {
+		b.minute, b.Tally = minute, Tally{}
+	}
+	b.add(o, bytes)
+	if at.After(s.last[o]) {
+		s.last[o] = at
+	}
+}
+
+func entry[K comparable](m map[K]*Tally, key K) *Tally {
+	t := m[key]
+	if t == nil {
+		t = &Tally{}
+		m[key] = t
+	}
+	return t
+}
+
+func (s *Counters) Snapshot() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot()
+}
+
+func (s *Counters) snapshot() Snapshot {
+	snap := Snapshot{Started: s.started, Reset: s.reset, Pending: s.Pending(), Total: s.total,
+		ByChat: map[int64]Tally{}, ByType: map[string]Tally{}, Last: map[Outcome]time.Time{}}
+	for id, t := range s.byChat {
+		snap.ByChat[id] = *t
+	}
+	for kind, t := range s.byType {
+		snap.ByType[kind] = *t
+	}
+	for o, at := range s.last {
+		snap.Last[o] = at
+	}
+	now := time.Now().Unix() / 60
+	for _, b := range s.minutes {
+		if age := now - b.minute; age >= 0 && age < minutes {
+			snap.LastDay.merge(b.Tally)
+			if age < 60 {
+				snap.LastHour.merge(b.Tally)
+			}
+		}
+	}
+	return snap
+}
+
+// Total is the total since the last reset, cheaper than a snapshot.
+func (s *Counters) Total() Tally {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
+
+// Reset starts counting again and returns the counters until now. Pending
+// downloads are in flight and are intentionally kept.
+func (s *Counters) Reset() Snapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.snapshot()
+	s.reset = time.Now()
+	s.total = Tally{}
+	s.byChat = map[int64]*Tally{}
+	s.byType = map[string]*Tally{}
+	return snap
+}
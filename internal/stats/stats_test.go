@@ -0,0 +1,93 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCounters(t *testing.T) {
+	tests := []struct {
+		name     string
+		outcomes []Outcome
+		bytes    int64 // of every download
+		want     Tally
+	}{
+		{name: "none", want: Tally{}},
+		{name: "done", outcomes: []Outcome{Done, Done}, bytes: 10, want: Tally{Done: 2, Bytes: 20}},
+		{name: "mixed", outcomes: []Outcome{Done, Failed, Cancelled, Skipped}, bytes: 5,
+			want: Tally{Done: 1, Failed: 1, Cancelled: 1, Skipped: 1, Bytes: 5}},
+		{name: "unknown size", outcomes: []Outcome{Done}, bytes: -1, want: Tally{Done: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			for _, o := range tt.outcomes {
+				s.Record(1, "document", o, tt.bytes, time.Now())
+			}
+			if got := s.Total(); got != tt.want {
+				t.Errorf("Total() = %+v, want %+v", got, tt.want)
+			}
+			snap := s.Snapshot()
+			if got := snap.ByChat[1]; got != tt.want {
+				t.Errorf("chat tally %+v, want %+v", got, tt.want)
+			}
+			if snap.LastHour != tt.want || snap.LastDay != tt.want {
+				t.Errorf("last hour %+v and day %+v, want %+v", snap.LastHour, snap.LastDay, tt.want)
+			}
+		})
+	}
+}
+
+// Reset clears the totals but not the rolling windows and the pending
+// downloads.
+func TestReset(t *testing.T) {
+	s := New()
+	s.AddPending(1, 1)
+	s.Record(1, "document", Done, 3, time.Now())
+	s.Record(1, "photo", Failed, 0, time.Now())
+	s.Record(1, "photo", Done, 2, time.Now().Add(-2*time.Hour))
+
+	prev := s.Reset()
+	if want := (Tally{Done: 2, Failed: 1, Bytes: 5}); prev.Total != want {
+		t.Errorf("previous total %+v, want %+v", prev.Total, want)
+	}
+	snap := s.Snapshot()
+	if snap.Total != (Tally{}) || len(snap.ByChat) != 0 || len(snap.ByType) != 0 {
+		t.Errorf("after reset: total %+v, by chat %v, by type %v", snap.Total, snap.ByChat, snap.ByType)
+	}
+	if want := (Tally{Done: 1, Failed: 1, Bytes: 3}); snap.LastHour != want {
+		t.Errorf("last hour %+v, want %+v", snap.LastHour, want)
+	}
+	if want := (Tally{Done: 2, Failed: 1, Bytes: 5}); snap.LastDay != want {
+		t.Errorf("last day %+v, want %+v", snap.LastDay, want)
+	}
+	if snap.Pending != 1 {
+		t.Errorf("pending %d, want 1", snap.Pending)
+	}
+	if !snap.Reset.After(snap.Started) {
+		t.Errorf("reset at %s, before the start at %s", snap.Reset, snap.Started)
+	}
+}
+
+func TestAddPending(t *testing.T) {
+	s := New()
+	steps := []struct {
+		chat  int64
+		delta int64
+		want  int64 // of the chat
+	}{
+		{chat: 1, delta: 1, want: 1},
+		{chat: 1, delta: 1, want: 2},
+		{chat: 2, delta: 1, want: 1},
+		{chat: 1, delta: -1, want: 1},
+		{chat: 1, delta: -1, want: 0},
+	}
+	for _, st := range steps {
+		if got := s.AddPending(st.chat, st.delta); got != st.want {
+			t.Errorf("AddPending(%d, %d) = %d, want %d", st.chat, st.delta, got, st.want)
+		}
+	}
+	if got := s.Pending(); got != 1 {
+		t.Errorf("Pending() = %d, want 1", got)
+	}
+}
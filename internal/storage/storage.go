@@ -0,0 +1,166 @@
+// Package storage is the persistent key/value store shared by the features
+// that need to survive restarts, a bbolt file with JSON values.
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var state *bolt.DB
+
+// ErrLocked is returned by OpenWait when another process keeps the state
+// file open.
+var ErrLocked = errors.New("the state file is in use by another process")
+
+// Open opens the state file at path, exiting if it is locked or unreadable.
+func Open(path string) {
+	if err := OpenWait(path, 5*time.Second); err != nil {
+		log.Fatalf("Failed to open state file %s: err=%s", path, err.Error())
+	}
+}
+
+// OpenWait opens the state file at path, waiting up to timeout for another
+// process to release it.
+func OpenWait(path string, timeout time.Duration) error {
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: timeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return ErrLocked
+	} else if err != nil {
+		return err
+	}
+	state = db
+	log.Println("State file:", path)
+	return nil
+}
+
+// Close closes the state file if it was opened.
+func Close() {
+	if state != nil {
+		state.Close()
+	}
+}
+
+// Get loads key into v and reports whether it was found.
+func Get(bucket, key string, v interface{}) (bool, error) {
+	found := false
+	err := state.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		data := b.Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(data, v)
+	})
+	return found, err
+}
+
+// Put stores v under key.
+func Put(bucket, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return state.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Modify loads key into v (leaving v untouched if absent), calls fn and
+// stores the result, all in one transaction.
+func Modify(bucket, key string, v interface{}, fn func() error) error {
+	return state.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		if data := b.Get([]byte(key)); data != nil {
+			if err := json.Unmarshal(data, v); err != nil {
+				return err
+			}
+		}
+		if err := fn(); err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), data)
+	})
+}
+
+// Delete removes key, if present.
+func Delete(bucket, key string) error {
+	return state.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+// ForEach calls fn for every entry of the bucket, in key order.
+func ForEach(bucket string, fn func(key string, data []byte) error) error {
+	return state.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+// Append stores v under the next sequence number of the bucket, which
+// keeps the bucket in insertion order.
+func Append(bucket string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return state.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(fmt.Sprintf("%020d", seq)), data)
+	})
+}
+
+// Last calls fn for up to n of the most recent entries, newest first.
+func Last(bucket string, n int, fn func(key string, data []byte) error) error {
+	return state.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil && n > 0; k, v = c.Prev() {
+			if err := fn(string(k), v); err != nil {
+				return err
+			}
+			n--
+		}
+		return nil
+	})
+}
@@ -0,0 +1,44 @@
+// Package units formats and parses file sizes.
+package units
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Format prints size in the largest unit it has, rounded down, e.g. "512 MB".
+func Format(size int64) string {
+	if size < 1024 {
+		return fmt.Sprintf("%d B", size)
+	}
+	if size < 1024*1024 {
+		return fmt.Sprintf("%d KB", size/1024)
+	}
+
+	if size < 1024*1024*1024 {
+		return fmt.Sprintf("%d MB", size/1024/1024)
+	}
+	return fmt.Sprintf("%d GB", size/1024/1024/1024)
+}
+
+// Parse is the inverse of Format, e.g. "500MB", "2 GB", "1024".
+func Parse(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}